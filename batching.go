@@ -2,82 +2,235 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
 	"time"
 )
 
+// The Timber API will not accept payloads larger than 1mb. This leaves 10kb for headers.
+const maxPayloadSize = 990000
+
+// Room left in a compressed batch for the data the compressor has buffered internally as well as the gzip footer
+const gzipPayloadMargin = 1024
+
+// Compression describes how batches are compressed before they are sent
+type Compression struct {
+	Algorithm string
+	Level     int
+}
+
+// NewCompression returns the compression for the given algorithm and level, or nil if batches should not be
+// compressed. A level of 0 selects the algorithm's default level.
+func NewCompression(algorithm string, level int) (*Compression, error) {
+	switch algorithm {
+	case "", "none":
+		return nil, nil
+	case "gzip":
+		if level < 0 || level > gzip.BestCompression {
+			return nil, fmt.Errorf("Compression level %d is not supported for gzip, expected 1 to 9", level)
+		}
+
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		return &Compression{Algorithm: algorithm, Level: level}, nil
+	default:
+		return nil, fmt.Errorf("Compression %s is not supported, expected gzip or none", algorithm)
+	}
+}
+
 func Batch(messages chan *LogMessage, batchChan chan *LogMessage, batchPeriodSeconds int64) {
+	BatchCompressed(messages, batchChan, batchPeriodSeconds, nil)
+}
+
+// BatchCompressed behaves like Batch but compresses each batch with the given compression. The maximum payload size
+// then applies to the compressed batch, so more lines fit in each one.
+func BatchCompressed(messages chan *LogMessage, batchChan chan *LogMessage, batchPeriodSeconds int64, compression *Compression) {
 	// As *LogMessage are read from the messages channel and added to our internal buffer, we also store the message's
 	// position and filename. This is so that when we flush the buffer, we can also send the source file of the buffer's
 	// contents as well as our posititon in the file. These values are written to the agent's globalState in order to
 	// resume where we left off on agent restart.
 	var position int64
+	var generation int64
 	var filename string
 
-	buf := freshBuffer()
+	buf := newBatchBuffer(compression)
+	flush := func() {
+		if buf.Len() > 0 {
+			batchChan <- &LogMessage{
+				Filename:   filename,
+				Lines:      buf.Bytes(),
+				Position:   position,
+				Encoding:   buf.Encoding(),
+				generation: generation,
+			}
+			buf = newBatchBuffer(compression)
+		}
+	}
+
 	tick := time.Tick(time.Duration(batchPeriodSeconds) * time.Second)
 	for {
 		select {
 		case message, ok := <-messages:
 			if ok {
-				line := message.Lines
 				filename = message.Filename
 
-				if len(line)+1 > buf.Cap() {
-					logger.Warn("Ignoring log line greater than the max payload size (1 MB)")
-					continue
-				}
-
-				if buf.Len()+len(line)+1 > buf.Cap() {
-					newMessage := &LogMessage{
-						Filename: filename,
-						Lines:    buf.Bytes(),
-						Position: position,
+				// Lines longer than the max event size are truncated, split or dropped, see SetOversizePolicy
+				for _, line := range applyOversizePolicy(message.Lines, message.Filename) {
+					if len(line) == 0 {
+						continue
 					}
 
-					batchChan <- newMessage
-					buf = freshBuffer()
-				}
-
-				if len(line) > 0 {
-					buf.Write(append(line, "\n"...))
+					line = encodeEventLine(line, message.Container)
+					if !buf.Write(line) {
+						flush()
+						buf.Write(line)
+					}
 
 					filename = message.Filename
 					position = message.Position
+					generation = message.generation
 				}
 
 			} else { // channel is closed
-				if buf.Len() > 0 {
-					newMessage := &LogMessage{
-						Filename: filename,
-						Lines:    buf.Bytes(),
-						Position: position,
-					}
-
-					batchChan <- newMessage
-				}
+				flush()
 				close(batchChan)
 				return
 			}
 
 		case <-tick:
-			if buf.Len() > 0 {
-				newMessage := &LogMessage{
-					Filename: filename,
-					Lines:    buf.Bytes(),
-					Position: position,
-				}
+			flush()
+		}
+	}
+}
 
-				batchChan <- newMessage
-				buf = freshBuffer()
-			}
+// batchBuffer accumulates newline terminated lines for a single batch
+type batchBuffer interface {
+	// Write adds the line to the batch, returning false if the batch would exceed the maximum payload size. A line
+	// is always accepted by an empty batch.
+	Write(line []byte) bool
+	// Len returns the number of uncompressed bytes written
+	Len() int
+	// Bytes finishes the batch and returns its payload
+	Bytes() []byte
+	// Encoding returns the content encoding of the payload, if any
+	Encoding() string
+}
+
+func newBatchBuffer(compression *Compression) batchBuffer {
+	if compression != nil && compression.Algorithm == "gzip" {
+		return newGzipBatchBuffer(compression.Level)
+	}
+
+	return &plainBatchBuffer{buf: freshBuffer()}
+}
+
+type plainBatchBuffer struct {
+	buf *bytes.Buffer
+}
+
+func (b *plainBatchBuffer) Write(line []byte) bool {
+	if b.buf.Len() > 0 && b.buf.Len()+len(line)+1 > maxPayloadSize {
+		return false
+	}
+
+	b.buf.Write(line)
+	b.buf.WriteByte('\n')
+
+	return true
+}
+
+func (b *plainBatchBuffer) Len() int {
+	return b.buf.Len()
+}
+
+func (b *plainBatchBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func (b *plainBatchBuffer) Encoding() string {
+	return ""
+}
+
+// gzipBatchBuffer compresses lines as they are written. Since the compressor buffers data internally, the compressed
+// size is only known after a flush; until then the uncompressed size of the pending data is used as an upper bound.
+type gzipBatchBuffer struct {
+	buf     *bytes.Buffer
+	gz      *gzip.Writer
+	raw     int
+	pending int
+}
+
+func newGzipBatchBuffer(level int) *gzipBatchBuffer {
+	buf := freshBuffer()
+	gz, _ := gzip.NewWriterLevel(buf, level)
+
+	return &gzipBatchBuffer{buf: buf, gz: gz}
+}
+
+func (b *gzipBatchBuffer) Write(line []byte) bool {
+	n := len(line) + 1
+
+	if b.raw > 0 && b.buf.Len()+b.pending+n+gzipPayloadMargin > maxPayloadSize {
+		b.gz.Flush()
+		b.pending = 0
+
+		if b.buf.Len()+n+gzipPayloadMargin > maxPayloadSize {
+			return false
 		}
 	}
+
+	b.gz.Write(line)
+	b.gz.Write([]byte{'\n'})
+	b.raw += n
+	b.pending += n
+
+	return true
+}
+
+func (b *gzipBatchBuffer) Len() int {
+	return b.raw
+}
+
+func (b *gzipBatchBuffer) Bytes() []byte {
+	b.gz.Close()
+	return b.buf.Bytes()
+}
+
+func (b *gzipBatchBuffer) Encoding() string {
+	return "gzip"
 }
 
 func freshBuffer() *bytes.Buffer {
 	// Preallocate 990kb. The Timber API will not accept payloads larger than 1mb.
 	// This leaves 10kb for headers.
-	buf := bytes.NewBuffer(make([]byte, 990000))
+	buf := bytes.NewBuffer(make([]byte, maxPayloadSize))
 	buf.Reset()
 	return buf
 }
+
+// eventLine is the line forwarded for an event that spans several lines or was read from a container log
+type eventLine struct {
+	Message   string            `json:"message"`
+	Container *ContainerContext `json:"container,omitempty"`
+}
+
+// encodeEventLine returns the line batched for event. Lines in a batch are separated by newlines, so an event
+// containing a line break is sent as JSON with the event as its message, which keeps it a single line. Events of
+// container logs are always sent as JSON, with the stream and time the runtime recorded them with.
+func encodeEventLine(event []byte, container *ContainerContext) []byte {
+	if container == nil && !bytes.ContainsAny(event, "\r\n") {
+		return event
+	}
+
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(&eventLine{Message: string(event), Container: container}); err != nil {
+		return event
+	}
+
+	return bytes.TrimSuffix(line.Bytes(), []byte("\n"))
+}
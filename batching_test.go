@@ -2,6 +2,10 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
 	"testing"
 )
 
@@ -42,8 +46,11 @@ func TestBufferOverflow(t *testing.T) {
 }
 
 // Batch()
-// Log lines larger than the max payload size (1 MB) should be dropped
+// Log lines larger than the max payload size (1 MB) should be dropped with the drop policy
 func TestBatchDropLogLine(t *testing.T) {
+	SetOversizePolicy("drop", 0)
+	defer SetOversizePolicy("", 0)
+
 	lines := make(chan *LogMessage)
 	bufChan := make(chan *LogMessage)
 
@@ -64,3 +71,91 @@ func TestBatchDropLogLine(t *testing.T) {
 		t.Fatalf("expected \"%+v\" to be nil", actual)
 	}
 }
+
+func TestBatchCompressedGzip(t *testing.T) {
+	lines := make(chan *LogMessage)
+	bufChan := make(chan *LogMessage)
+
+	compression, _ := NewCompression("gzip", 0)
+	go BatchCompressed(lines, bufChan, 10, compression)
+	lines <- &LogMessage{Lines: []byte("test log line")}
+	close(lines)
+
+	actual := <-bufChan
+	if actual.Encoding != "gzip" {
+		t.Fatalf("expected gzip encoding, got \"%s\"", actual.Encoding)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(actual.Lines))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressed, _ := ioutil.ReadAll(reader)
+	expected := "test log line\n"
+	if string(decompressed) != expected {
+		t.Fatalf("expected \"%+v\", got \"%+v\"", expected, string(decompressed))
+	}
+}
+
+// Compressed batches hold more lines than uncompressed ones but still stay under the max payload size
+func TestBatchCompressedOverflow(t *testing.T) {
+	lines := make(chan *LogMessage)
+	bufChan := make(chan *LogMessage)
+
+	compression, _ := NewCompression("gzip", gzip.BestSpeed)
+	go BatchCompressed(lines, bufChan, 10, compression)
+
+	// Random lines compress poorly, which forces the batch to overflow
+	random := rand.New(rand.NewSource(1))
+	go func() {
+		for written := 0; written < 2*maxPayloadSize; written += 1001 {
+			line := make([]byte, 500)
+			random.Read(line)
+			lines <- &LogMessage{Lines: []byte(hex.EncodeToString(line))}
+		}
+		close(lines)
+	}()
+
+	batches := 0
+	for batch := range bufChan {
+		batches++
+		if len(batch.Lines) > maxPayloadSize {
+			t.Fatalf("expected compressed batch to fit the max payload size, got %d bytes", len(batch.Lines))
+		}
+	}
+
+	if batches < 2 {
+		t.Fatalf("expected the compressed batch to overflow, got %d batches", batches)
+	}
+}
+
+func TestNewCompressionInvalid(t *testing.T) {
+	if _, err := NewCompression("lz4", 0); err == nil {
+		t.Error("expected an unsupported algorithm to fail")
+	}
+
+	if _, err := NewCompression("gzip", 10); err == nil {
+		t.Error("expected an unsupported gzip level to fail")
+	}
+
+	if _, err := NewCompression("gzip", gzip.HuffmanOnly); err == nil {
+		t.Error("expected a negative gzip level to fail")
+	}
+}
+
+func TestEncodeEventLine(t *testing.T) {
+	if line := encodeEventLine([]byte("single <line>"), nil); string(line) != "single <line>" {
+		t.Errorf("Expected a single line to be forwarded as is, got %q", line)
+	}
+
+	line := encodeEventLine([]byte("first\r\nsecond <line>"), nil)
+	if string(line) != `{"message":"first\r\nsecond <line>"}` {
+		t.Errorf("Expected the line breaks to be escaped, got %q", line)
+	}
+
+	line = encodeEventLine([]byte("hello"), &ContainerContext{Stream: "stdout", Time: "2018-03-01T10:00:00Z"})
+	if string(line) != `{"message":"hello","container":{"stream":"stdout","time":"2018-03-01T10:00:00Z"}}` {
+		t.Errorf("Expected a container line to be sent with its context, got %q", line)
+	}
+}
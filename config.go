@@ -6,14 +6,23 @@ import (
 	"io"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type FileConfig struct {
-	Path   string
-	ApiKey string `toml:"api_key"`
+	Path      string
+	ApiKey    string           `toml:"api_key"`
+	Multiline *MultilineConfig `toml:"multiline"`
+	Sinks     []string
+
+	// The configured path a discovered file was matched by
+	glob string
+	// Set for files discovered after the first check of their glob, which were created while the agent was running
+	discoveredLater bool
 }
 
 type Config struct {
@@ -26,22 +35,113 @@ type Config struct {
 	CollectEC2MetadataDisabled bool              `toml:"disable_ec2_metadata"`
 	KubernetesConfig           *KubernetesConfig `toml:"kubernetes"`
 	ReadNewFileFromStart       bool              `toml:"read_from_start"`
+	StartPosition              string            `toml:"start_position"`
+	Multiline                  *MultilineConfig  `toml:"multiline"`
+	Spool                      *SpoolConfig      `toml:"spool"`
+	Sinks                      []SinkConfig
+	Syslog                     []SyslogConfig
+	HTTPIngest                 *HTTPIngestConfig `toml:"http_ingest"`
+	Stdin                      *FramingConfig    `toml:"stdin"`
+	DefaultSinks               []string          `toml:"default_sinks"`
+	Compression                string
+	CompressionLevel           int    `toml:"compression_level"`
+	FingerprintBytes           int64  `toml:"fingerprint_bytes"`
+	StateTTLSeconds            int64  `toml:"state_ttl_seconds"`
+	MaxEventBytes              int    `toml:"max_event_bytes"`
+	OversizePolicy             string `toml:"oversize_policy"`
 }
 
 type KubernetesConfig struct {
 	Exclude map[string]string
+	// Only log sources matching every filter are forwarded when set, see supportedFilterKinds
+	Include map[string]string
+	// Which directory layout of the kubelet container log files are read from, see kubernetesLogLayouts
+	LogLayout string `toml:"log_layout"`
+	// Path of a kubeconfig file to reach the Kubernetes API with when the agent runs outside of the cluster
+	Kubeconfig string
+	// Name of the node the agent runs on, only pods scheduled on it are watched
+	NodeName string `toml:"node_name"`
+	// Log sources matching a route are forwarded with its API key and endpoint, the first matching route applies
+	Routes []KubernetesRoute `toml:"routes"`
+	// Node and container metadata sent with the logs of each container, see supportedMetadataFields
+	MetadataFields []string `toml:"metadata_fields"`
+	// Keys of the labels of the node sent with the logs of its containers, none are sent when empty
+	NodeLabels []string `toml:"node_labels"`
+	// Forwarding of the events of the cluster by a single elected agent
+	Events *KubernetesEventsConfig `toml:"events"`
+}
+
+// The glob matching the container log files of each supported kubelet directory layout
+var kubernetesLogLayouts = map[string]string{
+	// Symlinks named PODNAME_NAMESPACE_CONTAINERNAME-CONTAINERID.log
+	"containers": "/var/log/containers/*",
+	// NAMESPACE_PODNAME_PODUID/CONTAINERNAME/RESTARTCOUNT.log, written by newer kubelets
+	"pods": "/var/log/pods/*/*/*.log",
 }
 
 func (c *Config) Log() {
 	logger.Infof("Log collection endpoint: %s", c.Endpoint)
 	logger.Infof("Using filesystem polling: %s", c.Poll)
 	logger.Infof("Maximum time between sends: %d seconds", c.BatchPeriodSeconds)
+	if c.Compression != "" {
+		logger.Infof("Compression: %s (level %d)", c.Compression, c.CompressionLevel)
+	}
 	logger.Infof("File count: %d", len(c.Files))
 
+	for i, sink := range c.Sinks {
+		logger.Infof("Sink %d: %s (type: %s)", i+1, sink.Name, sink.Type)
+	}
+
 	for i, file := range c.Files {
-		apiKeySample := file.ApiKey[len(file.ApiKey)-4:]
-		logger.Infof("File %d: %s (api key: ...%s)", i+1, file.Path, apiKeySample)
+		if len(file.Sinks) > 0 {
+			logger.Infof("File %d: %s (sinks: %s)", i+1, file.Path, strings.Join(file.Sinks, ", "))
+		} else {
+			logger.Infof("File %d: %s (api key: ...%s)", i+1, file.Path, apiKeySample(file.ApiKey))
+		}
+
+		if file.Multiline != nil {
+			logger.Infof("File %d: merging multiline events (start pattern: %q, continuation pattern: %q)", i+1,
+				file.Multiline.StartPattern, file.Multiline.ContinuationPattern)
+		}
+	}
+
+	for i, listener := range c.Syslog {
+		if len(listener.Sinks) > 0 {
+			logger.Infof("Syslog listener %d: %s %s (sinks: %s)", i+1, listener.Protocol, listener.Address, strings.Join(listener.Sinks, ", "))
+		} else {
+			logger.Infof("Syslog listener %d: %s %s (api key: ...%s)", i+1, listener.Protocol, listener.Address, apiKeySample(listener.ApiKey))
+		}
 	}
+
+	if c.HTTPIngest != nil {
+		logger.Infof("HTTP ingest listener: %s", c.HTTPIngest.Address)
+		if len(c.HTTPIngest.ApiKeys) > 0 {
+			logger.Infof("HTTP ingest listener accepts %d API keys in the Authorization header", len(c.HTTPIngest.ApiKeys))
+		}
+	}
+
+	if c.Stdin != nil {
+		if c.Stdin.MaxRecordBytes != 0 {
+			logger.Infof("STDIN framing: %s (max record bytes: %d)", c.Stdin.framing(), c.Stdin.MaxRecordBytes)
+		} else {
+			logger.Infof("STDIN framing: %s", c.Stdin.framing())
+		}
+	}
+
+	if c.KubernetesConfig != nil {
+		for i, route := range c.KubernetesConfig.Routes {
+			endpoint := route.Endpoint
+			if endpoint == "" {
+				endpoint = c.Endpoint
+			}
+			logger.Infof("Kubernetes route %d: %s (api key: ...%s)", i+1, endpoint, apiKeySample(route.ApiKey))
+		}
+	}
+}
+
+// StateTTL returns how long the state of a file is kept after the file was last seen
+func (c *Config) StateTTL() time.Duration {
+	return time.Duration(c.StateTTLSeconds) * time.Second
 }
 
 func (c *Config) UpdateFromFile(filePath string) error {
@@ -63,11 +163,62 @@ func (c *Config) UpdateFromReader(in io.Reader) error {
 	}
 
 	// If a file does not define its own API key, the default API key
-	// is used
+	// is used. The same applies to the multiline configuration.
 	for i := range c.Files {
 		if c.Files[i].ApiKey == "" {
 			c.Files[i].ApiKey = c.DefaultApiKey
 		}
+
+		if c.Files[i].Multiline == nil {
+			c.Files[i].Multiline = c.Multiline
+		}
+
+		if len(c.Files[i].Sinks) == 0 {
+			c.Files[i].Sinks = c.DefaultSinks
+		}
+	}
+
+	// Syslog listeners fall back to the default API key and sinks in the same way
+	for i := range c.Syslog {
+		if c.Syslog[i].ApiKey == "" {
+			c.Syslog[i].ApiKey = c.DefaultApiKey
+		}
+
+		if len(c.Syslog[i].Sinks) == 0 {
+			c.Syslog[i].Sinks = c.DefaultSinks
+		}
+	}
+
+	if c.HTTPIngest != nil {
+		if c.HTTPIngest.ApiKey == "" {
+			c.HTTPIngest.ApiKey = c.DefaultApiKey
+		}
+
+		if len(c.HTTPIngest.Sinks) == 0 {
+			c.HTTPIngest.Sinks = c.DefaultSinks
+		}
+	}
+
+	// Timber sinks fall back to the top level endpoint and default API key
+	for i := range c.Sinks {
+		if c.Sinks[i].Type == "" {
+			c.Sinks[i].Type = "timber"
+		}
+
+		if c.Sinks[i].Compression == "" {
+			c.Sinks[i].Compression = c.Compression
+			c.Sinks[i].CompressionLevel = c.CompressionLevel
+		}
+
+		if c.Sinks[i].Type == "timber" {
+			if c.Sinks[i].Endpoint == "" {
+				c.Sinks[i].Endpoint = c.Endpoint
+			}
+
+			if c.Sinks[i].ApiKey == "" {
+				c.Sinks[i].ApiKey = c.DefaultApiKey
+			}
+		}
 	}
 
 	return nil
@@ -76,25 +227,189 @@ func (c *Config) UpdateFromReader(in io.Reader) error {
 func (c *Config) Validate() error {
 	if len(c.Files) > 0 {
 		for _, f := range c.Files {
-			if f.ApiKey == "" {
+			if f.ApiKey == "" && len(f.Sinks) == 0 && !c.hasKubernetesRoutes() {
 				errText := fmt.Sprintf("File %s has no API key", f.Path)
 				return errors.New(errText)
 			}
+
+			if err := c.validateSinkNames(f.Sinks); err != nil {
+				return fmt.Errorf("File %s: %s", f.Path, err)
+			}
+
+			if f.Multiline != nil {
+				if err := f.Multiline.Validate(); err != nil {
+					return fmt.Errorf("File %s has an invalid multiline configuration: %s", f.Path, err)
+				}
+			}
 		}
-	} else {
-		if c.DefaultApiKey == "" {
+	} else if len(c.Syslog) == 0 && c.HTTPIngest == nil {
+		if c.DefaultApiKey == "" && len(c.DefaultSinks) == 0 {
 			errText := "No API key. Please use --api-key, TIMBER_API_KEY, or set a default in a config file"
 			return errors.New(errText)
 		}
 	}
 
+	for _, listener := range c.Syslog {
+		if err := listener.Validate(); err != nil {
+			return err
+		}
+
+		if listener.ApiKey == "" && len(listener.Sinks) == 0 {
+			return fmt.Errorf("Syslog listener %s has no API key", listener.Address)
+		}
+
+		if err := c.validateSinkNames(listener.Sinks); err != nil {
+			return fmt.Errorf("Syslog listener %s: %s", listener.Address, err)
+		}
+	}
+
+	if c.HTTPIngest != nil {
+		if err := c.HTTPIngest.Validate(); err != nil {
+			return err
+		}
+
+		if err := c.validateSinkNames(c.HTTPIngest.Sinks); err != nil {
+			return fmt.Errorf("HTTP ingest listener: %s", err)
+		}
+	}
+
+	if c.OversizePolicy != "" && !containsString(oversizePolicies, c.OversizePolicy) {
+		return fmt.Errorf("Oversize policy %q is not supported, expected truncate, split or drop", c.OversizePolicy)
+	}
+
+	if c.MaxEventBytes != 0 && (c.MaxEventBytes < minEventBytes || c.MaxEventBytes >= maxPayloadSize) {
+		return fmt.Errorf("max_event_bytes must be between %d and %d", minEventBytes, maxPayloadSize-1)
+	}
+
+	if c.Stdin != nil {
+		if err := c.Stdin.Validate(); err != nil {
+			return fmt.Errorf("Invalid stdin configuration: %s", err)
+		}
+
+		// Records are truncated once, so that the suffix tells how many bytes were removed
+		if c.MaxEventBytes != 0 && c.Stdin.MaxRecordBytes > c.MaxEventBytes {
+			return fmt.Errorf("Invalid stdin configuration: max_record_bytes must not be larger than max_event_bytes (%d)", c.MaxEventBytes)
+		}
+	}
+
+	if c.Multiline != nil {
+		if err := c.Multiline.Validate(); err != nil {
+			return fmt.Errorf("Invalid multiline configuration: %s", err)
+		}
+	}
+
+	if c.Spool != nil {
+		if err := c.Spool.Validate(); err != nil {
+			return fmt.Errorf("Invalid spool configuration: %s", err)
+		}
+	}
+
+	if _, err := NewCompression(c.Compression, c.CompressionLevel); err != nil {
+		return err
+	}
+
+	if c.FingerprintBytes < 0 {
+		return fmt.Errorf("fingerprint_bytes must be positive, got %d", c.FingerprintBytes)
+	}
+
+	if c.StartPosition != "" && !containsString(startPositions, c.StartPosition) {
+		return fmt.Errorf("start_position must be one of %s, got %s", strings.Join(startPositions, ", "), c.StartPosition)
+	}
+
+	if c.StateTTLSeconds < 0 {
+		return fmt.Errorf("state_ttl_seconds must not be negative, got %d", c.StateTTLSeconds)
+	}
+
+	if c.KubernetesConfig != nil {
+		if _, err := c.KubernetesConfig.LogGlob(); err != nil {
+			return err
+		}
+
+		if err := c.KubernetesConfig.validateLabelSelectors(); err != nil {
+			return err
+		}
+
+		if err := c.KubernetesConfig.validateRoutes(); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, sink := range c.Sinks {
+		if sink.Name == "" {
+			return errors.New("Every sink requires a name")
+		}
+
+		if names[sink.Name] {
+			return fmt.Errorf("Sink name %s is used more than once", sink.Name)
+		}
+		names[sink.Name] = true
+
+		if _, err := NewCompression(sink.Compression, sink.CompressionLevel); err != nil {
+			return fmt.Errorf("Sink %s: %s", sink.Name, err)
+		}
+	}
+
+	if err := c.validateSinkNames(c.DefaultSinks); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// readFromStart reports whether a file without recorded state is read from its beginning rather than from its end,
+// according to the start position policy
+func (c *Config) readFromStart(fileConfig *FileConfig) bool {
+	if c.StartPosition == "discovered_from_start" && fileConfig.discoveredLater {
+		return true
+	}
+
+	return c.ReadNewFileFromStart
+}
+
+// hasKubernetesRoutes reports whether Kubernetes routes may provide the API key of files that have none
+func (c *Config) hasKubernetesRoutes() bool {
+	return c.KubernetesConfig != nil && len(c.KubernetesConfig.Routes) > 0
+}
+
+// validateSinkNames ensures every referenced sink is declared in the configuration
+func (c *Config) validateSinkNames(names []string) error {
+	for _, name := range names {
+		found := false
+		for _, sink := range c.Sinks {
+			if sink.Name == name {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("Sink %s is not declared in [[sinks]]", name)
+		}
+	}
+
+	return nil
+}
+
+// apiKeySample returns the last characters of an API key, which is enough to tell keys apart in the agent's logs
+func apiKeySample(apiKey string) string {
+	if len(apiKey) < 4 {
+		return apiKey
+	}
+
+	return apiKey[len(apiKey)-4:]
+}
+
+// Start position policies for files without recorded state. With "configured", read_from_start applies to every
+// file. With "discovered_from_start", it applies to files present at startup and files created while the agent runs
+// are read from their beginning, so that their first lines are not lost.
+var startPositions = []string{"configured", "discovered_from_start"}
+
 func NewConfig() *Config {
 	return &Config{
 		BatchPeriodSeconds: 3,
 		Endpoint:           "https://logs.timber.io/frames",
+		StateTTLSeconds:    int64(defaultStateTTL / time.Second),
 	}
 }
 
@@ -106,15 +421,105 @@ func NewKubernetesConfig() *KubernetesConfig {
 			"namespaces": "kube-system",
 			"pods":       "timber-agent",
 		},
+		LogLayout:      "containers",
+		MetadataFields: supportedMetadataFields,
+		NodeLabels: []string{
+			"topology.kubernetes.io/zone",
+			"failure-domain.beta.kubernetes.io/zone",
+			"node.kubernetes.io/instance-type",
+			"beta.kubernetes.io/instance-type",
+		},
+	}
+}
+
+// LogGlob returns the glob matching the container log files of the configured layout
+func (kc *KubernetesConfig) LogGlob() (string, error) {
+	layout := kc.LogLayout
+	if layout == "" {
+		layout = "containers"
 	}
+
+	glob, ok := kubernetesLogLayouts[layout]
+	if !ok {
+		layouts := make([]string, 0, len(kubernetesLogLayouts))
+		for layout := range kubernetesLogLayouts {
+			layouts = append(layouts, layout)
+		}
+		sort.Strings(layouts)
+
+		return "", fmt.Errorf("Kubernetes log_layout %s is not supported, expected one of %s", layout,
+			strings.Join(layouts, ", "))
+	}
+
+	return glob, nil
 }
 
-var supportedFilterKinds = []string{"namespaces", "deployments", "pods"}
+// The filter kinds, in the order filters are applied. Root owner kinds match the kind of the root owner of a pod.
+var supportedFilterKinds = []string{"namespaces", "deployments", "statefulsets", "daemonsets", "jobs", "cronjobs", "pods",
+	"containers", "labels"}
+
+// Optional node and container metadata fields of KubernetesContext. Node labels are selected with node_labels.
+var supportedMetadataFields = []string{"node_name", "pod_ip", "container_image", "container_id"}
+
+// The root owner kind matched by each root owner filter kind
+var rootOwnerFilterKinds = map[string]string{
+	"cronjobs":     "cronjob",
+	"daemonsets":   "daemonset",
+	"deployments":  "deployment",
+	"jobs":         "job",
+	"statefulsets": "statefulset",
+}
 
 //Validate Serves as a source of diagnostic information for the end user
 func (kc *KubernetesConfig) Validate() {
 	// Validate Exclude configuration
-	for kind := range kc.Exclude {
+	for _, kind := range kc.unsupportedExcludeKinds() {
+		logger.Warnf("Exclusion kind %s is not supported and will not be applied as a filter.", kind)
+	}
+
+	// Validate Include configuration
+	for _, kind := range kc.unsupportedIncludeKinds() {
+		logger.Warnf("Inclusion kind %s is not supported and will not be applied as a filter.", kind)
+	}
+
+	// Validate MetadataFields configuration
+	for _, field := range kc.unsupportedMetadataFields() {
+		logger.Warnf("Metadata field %s is not supported and will not be sent.", field)
+	}
+}
+
+// sendsMetadataField reports whether the optional metadata field is sent with logs
+func (kc *KubernetesConfig) sendsMetadataField(field string) bool {
+	return containsString(kc.MetadataFields, field)
+}
+
+// unsupportedMetadataFields returns the configured metadata fields that are not sent
+func (kc *KubernetesConfig) unsupportedMetadataFields() []string {
+	var fields []string
+
+	for _, field := range kc.MetadataFields {
+		if !containsString(supportedMetadataFields, field) {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// unsupportedExcludeKinds returns the exclusion kinds that are not applied as filters, in sorted order
+func (kc *KubernetesConfig) unsupportedExcludeKinds() []string {
+	return unsupportedFilterKinds(kc.Exclude)
+}
+
+// unsupportedIncludeKinds returns the inclusion kinds that are not applied as filters, in sorted order
+func (kc *KubernetesConfig) unsupportedIncludeKinds() []string {
+	return unsupportedFilterKinds(kc.Include)
+}
+
+func unsupportedFilterKinds(filters map[string]string) []string {
+	var kinds []string
+
+	for kind := range filters {
 		var match bool
 
 		for _, filterKind := range supportedFilterKinds {
@@ -125,64 +530,98 @@ func (kc *KubernetesConfig) Validate() {
 		}
 
 		if !match {
-			logger.Warnf("Exclusion kind %s is not supported and will not be applied as a filter.", kind)
+			kinds = append(kinds, kind)
 		}
 	}
+
+	sort.Strings(kinds)
+
+	return kinds
 }
 
-func (kc *KubernetesConfig) ApplyFilter(context *KubernetesContext) (string, bool) {
-	if len(kc.Exclude) == 0 {
-		return "", false
+// validateLabelSelectors returns an error if the labels filter of the exclude or include table cannot be parsed
+func (kc *KubernetesConfig) validateLabelSelectors() error {
+	for _, filters := range []map[string]string{kc.Exclude, kc.Include} {
+		if selector, ok := filters["labels"]; ok {
+			if _, err := ParseLabelSelector(selector); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Namespaces
-	if filterString, ok := kc.Exclude["namespaces"]; ok {
-		match, ok := compareNamespace(filterString, context.Namespace)
-		if ok {
-			match = fmt.Sprintf("%s:%s", "namespaces", match)
-			return match, ok
-		}
+	return nil
+}
+
+//ApplyFilter Returns the filter a log source described by context matches, and true if the source should not be
+// forwarded. A source is not forwarded if its pod's annotations exclude it, if it matches any exclude filter, or if
+// include filters are configured and it does not match every one of them.
+func (kc *KubernetesConfig) ApplyFilter(context *KubernetesContext) (string, bool) {
+	// Annotations of the pod
+	if annotation, ok := applyAnnotationFilter(context); ok {
+		return fmt.Sprintf("%s:%s", "annotations", annotation), ok
 	}
 
-	// Deployments
-	if filterString, ok := kc.Exclude["deployments"]; ok {
-		match, ok := compareRootOwner("deployment", filterString, context.RootOwner)
-		if ok {
-			match = fmt.Sprintf("%s:%s", "deployments", match)
-			return match, ok
+	for _, kind := range supportedFilterKinds {
+		if filterString, ok := kc.Exclude[kind]; ok {
+			match, ok := matchFilter(kind, filterString, context)
+			if ok {
+				match = fmt.Sprintf("%s:%s", kind, match)
+				return match, ok
+			}
 		}
 	}
 
-	// Pods
-	if filterString, ok := kc.Exclude["pods"]; ok {
-		match, ok := comparePod(filterString, context.PodName)
-		if ok {
-			match = fmt.Sprintf("%s:%s", "pods", match)
-			return match, ok
+	for _, kind := range supportedFilterKinds {
+		if filterString, ok := kc.Include[kind]; ok {
+			if _, ok := matchFilter(kind, filterString, context); !ok {
+				return fmt.Sprintf("%s:%s", "include", kind), true
+			}
 		}
 	}
 
 	return "", false
 }
 
-func compareNamespace(filterString, value string) (string, bool) {
-	patterns := strings.Split(filterString, ",")
-
-	for _, pattern := range patterns {
-		r, err := regexp.Compile(pattern)
-		if err != nil {
-			logger.Errorf("Unable to parse invalid regular expression: %s", pattern)
-			continue // try again with next pattern
-		}
+// matchFilter returns the pattern or selector of filterString matching context for the given filter kind
+func matchFilter(kind, filterString string, context *KubernetesContext) (string, bool) {
+	switch kind {
+	case "namespaces":
+		return compareNamespace(filterString, context.Namespace)
+	case "pods":
+		return comparePod(filterString, context.PodName)
+	case "containers":
+		return comparePatterns(filterString, kubernetesContainerName(context))
+	case "labels":
+		return compareLabels(filterString, context.Labels)
+	}
 
-		if r.MatchString(value) {
-			return pattern, true
-		}
+	if ownerKind, ok := rootOwnerFilterKinds[kind]; ok {
+		return compareRootOwner(ownerKind, filterString, context.RootOwner)
 	}
 
 	return "", false
 }
+
+func compareLabels(selector string, labels map[string]string) (string, bool) {
+	labelSelector, err := ParseLabelSelector(selector)
+	if err != nil {
+		logger.Errorf("Unable to parse invalid label selector: %s", selector)
+		return "", false
+	}
+
+	return selector, labelSelector.Matches(labels)
+}
+
+func compareNamespace(filterString, value string) (string, bool) {
+	return comparePatterns(filterString, value)
+}
+
 func comparePod(filterString, value string) (string, bool) {
+	return comparePatterns(filterString, value)
+}
+
+// comparePatterns returns the first of the comma separated regular expressions in filterString matching value
+func comparePatterns(filterString, value string) (string, bool) {
 	patterns := strings.Split(filterString, ",")
 
 	for _, pattern := range patterns {
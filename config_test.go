@@ -3,6 +3,7 @@ package main
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -557,3 +558,417 @@ func TestKubernetesConfigApplyFilterWithMatchingNamespaceRegExp(t *testing.T) {
 		t.Errorf("Expected ok to be %t, got %t", expectedOk, ok)
 	}
 }
+
+func TestConfigReadMultiline(t *testing.T) {
+	configString := `
+default_api_key = "abc:1234"
+
+[multiline]
+start_pattern = "^\\d"
+
+[[files]]
+path = "/var/log/log1.log"
+
+[[files]]
+path = "/var/log/log2.log"
+
+[files.multiline]
+continuation_pattern = "^\\s"
+max_lines = 10
+`
+
+	configFile := strings.NewReader(configString)
+	config := NewConfig()
+	err := config.UpdateFromReader(configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.Files[0].Multiline != config.Multiline {
+		t.Errorf("Expected file without multiline configuration to use the default")
+	}
+
+	multiline := config.Files[1].Multiline
+	if multiline.ContinuationPattern != `^\s` || multiline.MaxLines != 10 {
+		t.Errorf("Expected file multiline configuration to be read, got %+v", multiline)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected multiline configuration to be valid, got %s", err)
+	}
+}
+
+func TestConfigValidateInvalidMultiline(t *testing.T) {
+	config := NewConfig()
+	config.Files = []FileConfig{
+		{Path: "/var/log/log.log", ApiKey: "abc:1234", Multiline: &MultilineConfig{StartPattern: "("}},
+	}
+
+	if err := config.Validate(); err == nil {
+		t.Error("Expected invalid multiline pattern to fail validation")
+	}
+}
+
+func TestConfigReadSinks(t *testing.T) {
+	configString := `
+default_api_key = "abc:1234"
+
+[[sinks]]
+name = "timber"
+
+[[sinks]]
+name = "archive"
+type = "file"
+path = "/var/log/archive.log"
+
+[[files]]
+path = "/var/log/log.log"
+sinks = ["timber", "archive"]
+`
+
+	configFile := strings.NewReader(configString)
+	config := NewConfig()
+	err := config.UpdateFromReader(configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	timberSink := config.Sinks[0]
+	if timberSink.Type != "timber" || timberSink.ApiKey != "abc:1234" || timberSink.Endpoint != config.Endpoint {
+		t.Errorf("Expected timber sink to use the defaults, got %+v", timberSink)
+	}
+
+	if !cmp.Equal(config.Files[0].Sinks, []string{"timber", "archive"}) {
+		t.Errorf("Expected file sinks to be read, got %v", config.Files[0].Sinks)
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected sink configuration to be valid, got %s", err)
+	}
+}
+
+func TestConfigValidateUndeclaredSink(t *testing.T) {
+	config := NewConfig()
+	config.Files = []FileConfig{
+		{Path: "/var/log/log.log", Sinks: []string{"missing"}},
+	}
+
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a reference to an undeclared sink to fail validation")
+	}
+}
+
+func TestConfigValidateDuplicateSinkName(t *testing.T) {
+	config := NewConfig()
+	config.DefaultApiKey = "abc:1234"
+	config.Sinks = []SinkConfig{
+		{Name: "timber", Type: "timber"},
+		{Name: "timber", Type: "file"},
+	}
+
+	if err := config.Validate(); err == nil {
+		t.Error("Expected duplicate sink names to fail validation")
+	}
+}
+
+func TestConfigReadCompression(t *testing.T) {
+	configString := `
+default_api_key = "abc:1234"
+compression = "gzip"
+compression_level = 6
+
+[[sinks]]
+name = "timber"
+
+[[sinks]]
+name = "archive"
+type = "file"
+path = "/var/log/archive.log"
+compression = "none"
+`
+
+	configFile := strings.NewReader(configString)
+	config := NewConfig()
+	err := config.UpdateFromReader(configFile)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.Sinks[0].Compression != "gzip" || config.Sinks[0].CompressionLevel != 6 {
+		t.Errorf("Expected timber sink to inherit compression, got %+v", config.Sinks[0])
+	}
+
+	if config.Sinks[1].Compression != "none" {
+		t.Errorf("Expected archive sink to keep its own compression, got %+v", config.Sinks[1])
+	}
+
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected compression configuration to be valid, got %s", err)
+	}
+}
+
+func TestConfigValidateInvalidCompression(t *testing.T) {
+	config := NewConfig()
+	config.DefaultApiKey = "abc:1234"
+	config.Files = []FileConfig{{Path: "/var/log/log.log", ApiKey: "abc:1234"}}
+	config.Compression = "brotli"
+
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an unsupported compression to fail validation")
+	}
+}
+
+func TestConfigValidateNegativeFingerprintBytes(t *testing.T) {
+	config := NewConfig()
+	config.DefaultApiKey = "abc:1234"
+	config.Files = []FileConfig{{Path: "/var/log/log.log", ApiKey: "abc:1234"}}
+	config.FingerprintBytes = -1
+
+	if err := config.Validate(); err == nil {
+		t.Error("Expected a negative fingerprint_bytes to fail validation")
+	}
+}
+
+func TestConfigReadStateTTL(t *testing.T) {
+	config := NewConfig()
+	if config.StateTTL() != defaultStateTTL {
+		t.Fatalf("Expected the default state TTL to be %s, got %s", defaultStateTTL, config.StateTTL())
+	}
+
+	if err := config.UpdateFromReader(strings.NewReader("state_ttl_seconds = 600\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.StateTTL() != 10*time.Minute {
+		t.Fatalf("Expected a state TTL of 10m, got %s", config.StateTTL())
+	}
+}
+
+func TestKubernetesConfigLogGlob(t *testing.T) {
+	config := NewConfig()
+	config.KubernetesConfig = NewKubernetesConfig()
+
+	if err := config.UpdateFromReader(strings.NewReader("[kubernetes]\nlog_layout = \"pods\"\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	glob, err := config.KubernetesConfig.LogGlob()
+	if err != nil || glob != "/var/log/pods/*/*/*.log" {
+		t.Fatalf("Expected the pods layout glob, got %s (%v)", glob, err)
+	}
+
+	if _, ok := config.KubernetesConfig.Exclude["namespaces"]; !ok {
+		t.Fatal("Expected default exclusions to be kept")
+	}
+
+	config.KubernetesConfig.LogLayout = "docker"
+	config.DefaultApiKey = "abc:1234"
+	if err := config.Validate(); err == nil {
+		t.Fatal("Expected an unsupported log layout to fail validation")
+	}
+}
+
+func TestKubernetesConfigApplyFilterWithRootOwnerKinds(t *testing.T) {
+	kubernetesConfig := &KubernetesConfig{
+		Exclude: map[string]string{
+			"statefulsets": "^db$",
+			"daemonsets":   "^node-exporter$",
+			"jobs":         "^migrate",
+			"cronjobs":     "^backup",
+		},
+	}
+
+	cases := []struct {
+		kind     string
+		name     string
+		expected string
+	}{
+		{"StatefulSet", "db", "statefulsets:^db$"},
+		{"DaemonSet", "node-exporter", "daemonsets:^node-exporter$"},
+		{"Job", "migrate-1", "jobs:^migrate"},
+		{"CronJob", "backup-nightly", "cronjobs:^backup"},
+		{"Deployment", "db", ""},
+		{"CronJob", "migrate", ""},
+	}
+
+	for _, c := range cases {
+		kubernetesContext := &KubernetesContext{RootOwner: map[string]string{"kind": c.kind, "name": c.name}}
+		filter, ok := kubernetesConfig.ApplyFilter(kubernetesContext)
+
+		if filter != c.expected || ok != (c.expected != "") {
+			t.Errorf("Expected %s %s to match %q, got %q", c.kind, c.name, c.expected, filter)
+		}
+	}
+}
+
+func TestKubernetesConfigApplyFilterWithLabelsAndContainers(t *testing.T) {
+	kubernetesConfig := &KubernetesConfig{
+		Exclude: map[string]string{
+			"labels":     "tier=cache",
+			"containers": "^istio-proxy$",
+		},
+	}
+
+	cases := []struct {
+		container string
+		labels    map[string]string
+		expected  string
+	}{
+		{"app", map[string]string{"tier": "cache"}, "labels:tier=cache"},
+		{"istio-proxy-" + strings.Repeat("0123456789abcdef", 4), nil, "containers:^istio-proxy$"},
+		{"app", map[string]string{"tier": "web"}, ""},
+	}
+
+	for _, c := range cases {
+		kubernetesContext := &KubernetesContext{ContainerName: c.container, Labels: c.labels}
+		filter, ok := kubernetesConfig.ApplyFilter(kubernetesContext)
+
+		if filter != c.expected || ok != (c.expected != "") {
+			t.Errorf("Expected container %s with labels %v to match %q, got %q", c.container, c.labels, c.expected, filter)
+		}
+	}
+}
+
+func TestKubernetesConfigApplyFilterWithInclude(t *testing.T) {
+	kubernetesConfig := &KubernetesConfig{
+		Exclude: map[string]string{
+			"pods": "^canary-",
+		},
+		Include: map[string]string{
+			"namespaces": "^prod-",
+			"labels":     "app in (web,api)",
+		},
+	}
+
+	cases := []struct {
+		namespace string
+		pod       string
+		app       string
+		expected  string
+	}{
+		{"prod-eu", "web-1", "web", ""},
+		{"prod-eu", "api-1", "api", ""},
+		{"prod-eu", "canary-1", "web", "pods:^canary-"},
+		{"staging", "web-1", "web", "include:namespaces"},
+		{"prod-eu", "worker-1", "worker", "include:labels"},
+	}
+
+	for _, c := range cases {
+		kubernetesContext := &KubernetesContext{Namespace: c.namespace, PodName: c.pod, Labels: map[string]string{"app": c.app}}
+		filter, ok := kubernetesConfig.ApplyFilter(kubernetesContext)
+
+		if filter != c.expected || ok != (c.expected != "") {
+			t.Errorf("Expected pod %s in namespace %s to match %q, got %q", c.pod, c.namespace, c.expected, filter)
+		}
+	}
+}
+
+func TestConfigValidateInvalidLabelSelector(t *testing.T) {
+	config := NewConfig()
+	config.DefaultApiKey = "abc:1234"
+	config.KubernetesConfig = NewKubernetesConfig()
+	config.KubernetesConfig.Include = map[string]string{"labels": "app in web"}
+
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an invalid label selector to be rejected")
+	}
+}
+
+func TestConfigReadFromStart(t *testing.T) {
+	cases := []struct {
+		readFromStart   bool
+		startPosition   string
+		discoveredLater bool
+		expected        bool
+	}{
+		{false, "", false, false},
+		{false, "", true, false},
+		{true, "configured", true, true},
+		{false, "discovered_from_start", false, false},
+		{false, "discovered_from_start", true, true},
+		{true, "discovered_from_start", false, true},
+	}
+
+	for _, c := range cases {
+		config := NewConfig()
+		config.ReadNewFileFromStart = c.readFromStart
+		config.StartPosition = c.startPosition
+		fileConfig := &FileConfig{Path: "/var/log/log.log", discoveredLater: c.discoveredLater}
+
+		if readFromStart := config.readFromStart(fileConfig); readFromStart != c.expected {
+			t.Errorf("Expected read_from_start %t with start_position %q for a file discovered later %t to read from start %t",
+				c.readFromStart, c.startPosition, c.discoveredLater, c.expected)
+		}
+	}
+}
+
+func TestConfigValidateInvalidStartPosition(t *testing.T) {
+	config := NewConfig()
+	config.DefaultApiKey = "abc:1234"
+	config.StartPosition = "beginning"
+
+	if err := config.Validate(); err == nil {
+		t.Error("Expected an unknown start_position to fail validation")
+	}
+}
+
+func TestConfigReadSyslog(t *testing.T) {
+	configString := `
+default_api_key = "abc:1234"
+
+[[syslog]]
+address = ":514"
+protocol = "udp"
+
+[[syslog]]
+address = ":601"
+protocol = "tcp"
+api_key = "network:5678"
+`
+
+	config := NewConfig()
+	if err := config.UpdateFromReader(strings.NewReader(configString)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Syslog) != 2 || config.Syslog[0].ApiKey != "abc:1234" || config.Syslog[1].ApiKey != "network:5678" {
+		t.Fatalf("Expected the syslog listeners to be read with their API keys, got %+v", config.Syslog)
+	}
+
+	// Listeners do not require any [[files]]
+	if err := config.Validate(); err != nil {
+		t.Errorf("Expected syslog configuration to be valid, got %s", err)
+	}
+}
+
+func TestConfigValidateInvalidSyslog(t *testing.T) {
+	cases := []SyslogConfig{
+		{Address: ":514", Protocol: "udp"},
+		{Address: ":514", Protocol: "sctp", ApiKey: "abc:1234"},
+		{Address: ":6514", Protocol: "tls", ApiKey: "abc:1234"},
+	}
+
+	for _, listener := range cases {
+		config := NewConfig()
+		config.Syslog = []SyslogConfig{listener}
+
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected syslog listener %+v to fail validation", listener)
+		}
+	}
+}
+
+func TestConfigValidateOversize(t *testing.T) {
+	cases := []*Config{
+		{DefaultApiKey: "abc:1234", OversizePolicy: "compress"},
+		{DefaultApiKey: "abc:1234", MaxEventBytes: 10},
+		{DefaultApiKey: "abc:1234", MaxEventBytes: maxPayloadSize},
+		{DefaultApiKey: "abc:1234", MaxEventBytes: 1000, Stdin: &FramingConfig{MaxRecordBytes: 2000}},
+	}
+
+	for _, config := range cases {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected oversize policy %q with max event size %d to fail validation", config.OversizePolicy, config.MaxEventBytes)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+)
+
+// A line written by a CRI runtime such as containerd or CRI-O: "<time> <stream> <tag> <message>". The tag is P for a
+// partial line that continues on the next line of the same stream, F for the final part of a line.
+var criLogLine = regexp.MustCompile(`^(\S+) (stdout|stderr) ([PF])(?: (.*))?$`)
+
+// dockerLogLine is a line written by the Docker json-file logging driver. The log field keeps the trailing newline
+// of the line, lines longer than 16KB are split into several entries without one.
+type dockerLogLine struct {
+	Log    *string `json:"log"`
+	Stream string  `json:"stream"`
+	Time   string  `json:"time"`
+}
+
+// decodeContainerLogLine unwraps a line written by the Docker json-file driver or a CRI runtime. Returns the message,
+// the stream and time recorded by the runtime, and whether the line is partial. ok is false if the line is in
+// neither format.
+func decodeContainerLogLine(line []byte) (message []byte, context *ContainerContext, partial bool, ok bool) {
+	if len(line) > 0 && line[0] == '{' {
+		var docker dockerLogLine
+		if err := json.Unmarshal(line, &docker); err == nil && docker.Log != nil {
+			message := []byte(*docker.Log)
+			partial := !bytes.HasSuffix(message, []byte("\n"))
+			if !partial {
+				message = bytes.TrimSuffix(message[:len(message)-1], []byte("\r"))
+			}
+
+			return message, &ContainerContext{Stream: docker.Stream, Time: docker.Time}, partial, true
+		}
+	}
+
+	if match := criLogLine.FindSubmatch(line); match != nil {
+		return match[4], &ContainerContext{Stream: string(match[2]), Time: string(match[1])}, string(match[3]) == "P", true
+	}
+
+	return nil, nil, false, false
+}
+
+// ContainerLogTailer Wraps another Tailer reading a container log file and unwraps the lines written by the Docker
+// json-file driver or a CRI runtime, detected line by line. Partial lines are joined, the joined message carries the
+// position of its last part and the time of its first. Lines in neither format are passed through unchanged.
+//
+// Lines of one stream may be complete while a partial line of the other stream is pending. Their position is kept at
+// the start of the pending line, so that it is read again if the agent restarts before it is complete.
+type ContainerLogTailer struct {
+	lines chan *LogMessage
+}
+
+// NewContainerLogTailer Returns a *ContainerLogTailer unwrapping the lines of inner, which started reading the file at
+// offset start
+func NewContainerLogTailer(inner Tailer, start int64) *ContainerLogTailer {
+	ch := make(chan *LogMessage)
+
+	go func() {
+		// Partial lines of each stream, which are interleaved in the file, and the positions they start at
+		pending := make(map[string]*LogMessage)
+		starts := make(map[string]int64)
+		lastPosition := start
+
+		// Sends message with a position no further than the start of any pending line
+		send := func(message *LogMessage) {
+			for _, start := range starts {
+				if start < message.Position {
+					message.Position = start
+				}
+			}
+			ch <- message
+		}
+
+		for message := range inner.Lines() {
+			// A truncated or replaced file is read again from its beginning, see NewFileTailer
+			if message.Position < lastPosition {
+				lastPosition = 0
+			}
+
+			start := lastPosition
+			lastPosition = message.Position
+
+			line, context, partial, ok := decodeContainerLogLine(message.Lines)
+			if !ok {
+				send(message)
+				continue
+			}
+
+			decoded := pending[context.Stream]
+			if decoded == nil {
+				decoded = &LogMessage{
+					Filename:   message.Filename,
+					Lines:      append([]byte(nil), line...),
+					Container:  context,
+					generation: message.generation,
+				}
+				starts[context.Stream] = start
+			} else {
+				decoded.Lines = append(decoded.Lines, line...)
+				decoded.generation = message.generation
+			}
+			decoded.Position = message.Position
+
+			// A line that never ends is sent in pieces rather than buffered without bound
+			if partial && len(decoded.Lines) < maxPayloadSize {
+				pending[context.Stream] = decoded
+				continue
+			}
+
+			delete(pending, context.Stream)
+			delete(starts, context.Stream)
+			send(decoded)
+		}
+
+		for _, decoded := range pending {
+			ch <- decoded
+		}
+		close(ch)
+	}()
+
+	return &ContainerLogTailer{lines: ch}
+}
+
+func (c *ContainerLogTailer) Lines() chan *LogMessage {
+	return c.lines
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDecodeContainerLogLine(test *testing.T) {
+	cases := []struct {
+		line    string
+		message string
+		stream  string
+		time    string
+		partial bool
+	}{
+		{`{"log":"hello world\n","stream":"stdout","time":"2018-03-01T10:00:00.123456789Z"}`, "hello world", "stdout", "2018-03-01T10:00:00.123456789Z", false},
+		{`{"log":"part of a long li","stream":"stderr","time":"2018-03-01T10:00:00Z"}`, "part of a long li", "stderr", "2018-03-01T10:00:00Z", true},
+		{`{"log":"windows\r\n","stream":"stdout","time":"2018-03-01T10:00:00Z"}`, "windows", "stdout", "2018-03-01T10:00:00Z", false},
+		{`2018-03-01T10:00:00.123456789Z stdout F hello world`, "hello world", "stdout", "2018-03-01T10:00:00.123456789Z", false},
+		{`2018-03-01T10:00:00.123456789+01:00 stderr P part of`, "part of", "stderr", "2018-03-01T10:00:00.123456789+01:00", true},
+		{`2018-03-01T10:00:00Z stdout F `, "", "stdout", "2018-03-01T10:00:00Z", false},
+		{`2018-03-01T10:00:00Z stdout F`, "", "stdout", "2018-03-01T10:00:00Z", false},
+	}
+
+	for _, c := range cases {
+		message, context, partial, ok := decodeContainerLogLine([]byte(c.line))
+		if !ok {
+			test.Fatalf("expected %q to be decoded", c.line)
+		}
+
+		if string(message) != c.message || context.Stream != c.stream || context.Time != c.time || partial != c.partial {
+			test.Fatalf("decoding %q: got message %q, stream %s, time %s, partial %t", c.line, message, context.Stream,
+				context.Time, partial)
+		}
+	}
+}
+
+func TestDecodeContainerLogLineIgnoresOtherFormats(test *testing.T) {
+	lines := []string{
+		`plain text`,
+		`{"message":"json without a log field"}`,
+		`2018-03-01T10:00:00Z stdin F not a stream`,
+		`{"log":`,
+	}
+
+	for _, line := range lines {
+		if _, _, _, ok := decodeContainerLogLine([]byte(line)); ok {
+			test.Fatalf("expected %q not to be decoded", line)
+		}
+	}
+}
+
+func TestContainerLogTailerJoinsPartialLines(test *testing.T) {
+	inner := &staticTailer{lines: make(chan *LogMessage)}
+	tailer := NewContainerLogTailer(inner, 0)
+
+	go func() {
+		inner.lines <- &LogMessage{Lines: []byte(`2018-03-01T09:59:59Z stdout F hello`), Position: 5}
+		inner.lines <- &LogMessage{Lines: []byte(`2018-03-01T10:00:00Z stdout P first `), Position: 10}
+		inner.lines <- &LogMessage{Lines: []byte(`2018-03-01T10:00:01Z stderr F an error`), Position: 20}
+		inner.lines <- &LogMessage{Lines: []byte(`2018-03-01T10:00:02Z stdout P second `), Position: 30}
+		inner.lines <- &LogMessage{Lines: []byte(`2018-03-01T10:00:03Z stdout F third`), Position: 40}
+		inner.lines <- &LogMessage{Lines: []byte(`not a container line`), Position: 50}
+		close(inner.lines)
+	}()
+
+	expectMessage(test, tailer, "hello", 5)
+
+	// The stderr line is complete before the stdout line that started first, whose start it must not be recorded past
+	expectMessage(test, tailer, "an error", 5)
+
+	message := <-tailer.Lines()
+	if string(message.Lines) != "first second third" || message.Position != 40 {
+		test.Fatalf("expected the partial lines to be joined, got %q at %d", message.Lines, message.Position)
+	}
+
+	if message.Container.Stream != "stdout" || message.Container.Time != "2018-03-01T10:00:00Z" {
+		test.Fatalf("expected the stream and time of the first part of the joined line, got %+v", message.Container)
+	}
+
+	expectMessage(test, tailer, "not a container line", 50)
+
+	if _, ok := <-tailer.Lines(); ok {
+		test.Fatal("expected container log tailer to close after inner tailer")
+	}
+}
+
+func TestContainerLogTailerStartsAtInnerOffset(test *testing.T) {
+	inner := &staticTailer{lines: make(chan *LogMessage)}
+	tailer := NewContainerLogTailer(inner, 100)
+
+	go func() {
+		inner.lines <- &LogMessage{Lines: []byte(`2018-03-01T10:00:00Z stdout P first `), Position: 130}
+		inner.lines <- &LogMessage{Lines: []byte(`2018-03-01T10:00:01Z stderr F an error`), Position: 160}
+		inner.lines <- &LogMessage{Lines: []byte(`2018-03-01T10:00:02Z stdout F second`), Position: 190}
+		close(inner.lines)
+	}()
+
+	// The pending line started where the inner tailer resumed reading, not at the beginning of the file
+	expectMessage(test, tailer, "an error", 100)
+	expectMessage(test, tailer, "first second", 190)
+}
+
+func TestBatchSendsContainerContextWithEachLine(test *testing.T) {
+	inputs := map[string][]string{
+		"docker": {
+			`{"log":"out 1\n","stream":"stdout","time":"2018-03-01T10:00:00Z"}`,
+			`{"log":"err 1\n","stream":"stderr","time":"2018-03-01T10:00:01Z"}`,
+			`{"log":"out 2\n","stream":"stdout","time":"2018-03-01T10:00:02Z"}`,
+		},
+		"cri": {
+			`2018-03-01T10:00:00Z stdout F out 1`,
+			`2018-03-01T10:00:01Z stderr F err 1`,
+			`2018-03-01T10:00:02Z stdout F out 2`,
+		},
+	}
+
+	// Lines of both streams share a batch, each with the time the runtime received it
+	expected := `{"message":"out 1","container":{"stream":"stdout","time":"2018-03-01T10:00:00Z"}}` + "\n" +
+		`{"message":"err 1","container":{"stream":"stderr","time":"2018-03-01T10:00:01Z"}}` + "\n" +
+		`{"message":"out 2","container":{"stream":"stdout","time":"2018-03-01T10:00:02Z"}}` + "\n"
+
+	for format, lines := range inputs {
+		inner := &staticTailer{lines: make(chan *LogMessage)}
+		batches := make(chan *LogMessage)
+		go Batch(NewContainerLogTailer(inner, 0).Lines(), batches, 60)
+
+		go func(lines []string) {
+			for i, line := range lines {
+				inner.lines <- &LogMessage{Lines: []byte(line), Position: int64(i + 1)}
+			}
+			close(inner.lines)
+		}(lines)
+
+		batch := <-batches
+		if string(batch.Lines) != expected {
+			test.Fatalf("expected %s lines to be sent with their context, got %q", format, batch.Lines)
+		}
+	}
+}
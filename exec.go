@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Signals relayed to the command run by capture-exec, which decides itself whether to stop
+var execForwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// How long the streams of the command are read after it exited. Processes it started in the background may keep them
+// open.
+const execStreamsDrainTimeout = 5 * time.Second
+
+// Exit code of capture-exec when the command cannot be started, as used by shells for commands that are not found
+const execStartFailedExitCode = 127
+
+// ExecCommand Runs a command whose stdout and stderr are forwarded as separate streams
+type ExecCommand struct {
+	cmd     *exec.Cmd
+	command string
+	started time.Time
+
+	// Read ends of the pipes the command writes its stdout and stderr to
+	stdout *os.File
+	stderr *os.File
+}
+
+// execExitLine is the JSON log line reporting how the command exited
+type execExitLine struct {
+	Message string `json:"message"`
+	// Exit status of the command, or 128 plus the signal that terminated it
+	ExitCode   int    `json:"exit_code"`
+	Signal     string `json:"signal,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// StartExecCommand Starts the command described by args, the name of the program followed by its arguments. The
+// command reads the agent's stdin and inherits its environment.
+func StartExecCommand(args []string) (*ExecCommand, error) {
+	c := &ExecCommand{
+		cmd:     exec.Command(args[0], args[1:]...),
+		command: strings.Join(args, " "),
+	}
+	c.cmd.Stdin = os.Stdin
+
+	// The pipes are created here rather than by exec so that waiting for the command does not close them before
+	// everything it wrote has been read
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, stderrWriter, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutWriter.Close()
+		return nil, err
+	}
+
+	c.cmd.Stdout, c.cmd.Stderr = stdoutWriter, stderrWriter
+	c.stdout, c.stderr = stdout, stderr
+
+	c.started = time.Now()
+	err = c.cmd.Start()
+
+	// The command holds its own copies of the write ends, the read ends reach EOF once it and any process it started
+	// close them
+	stdoutWriter.Close()
+	stderrWriter.Close()
+
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, fmt.Errorf("Unable to start %s: %s", c.command, err)
+	}
+
+	return c, nil
+}
+
+// context returns the exec context of lines written to stream, the empty stream for the exit line
+func (c *ExecCommand) context(stream string) *ExecContext {
+	return &ExecContext{Command: c.command, PID: c.cmd.Process.Pid, Stream: stream}
+}
+
+// Wait relays signals received by the agent to the command until it exits. Returns the line reporting how it exited
+// and the exit code the agent should exit with.
+func (c *ExecCommand) Wait() (*execExitLine, int) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, execForwardedSignals...)
+	defer signal.Stop(signals)
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				logger.Infof("got %s, forwarding to %s", sig, c.command)
+				if err := c.cmd.Process.Signal(sig); err != nil {
+					logger.Warnf("Failed to forward %s to %s: %s", sig, c.command, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := c.cmd.Wait()
+	close(done)
+
+	line := &execExitLine{DurationMS: int64(time.Since(c.started) / time.Millisecond)}
+
+	if err != nil && c.cmd.ProcessState == nil {
+		logger.Errorf("Failed to wait for %s: %s", c.command, err)
+		line.ExitCode = 1
+		line.Message = fmt.Sprintf("%s failed: %s", c.command, err)
+		return line, 1
+	}
+
+	status, ok := c.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		line.ExitCode = 128 + int(status.Signal())
+		line.Signal = status.Signal().String()
+		line.Message = fmt.Sprintf("%s was terminated by signal %s", c.command, line.Signal)
+		return line, line.ExitCode
+	}
+
+	if ok {
+		line.ExitCode = status.ExitStatus()
+	} else if !c.cmd.ProcessState.Success() {
+		line.ExitCode = 1
+	}
+	line.Message = fmt.Sprintf("%s exited with status %d", c.command, line.ExitCode)
+
+	return line, line.ExitCode
+}
+
+// spoolSource returns the name the spool queues of source, one of the streams of the command or its exit line, are
+// opened under
+func (c *ExecCommand) spoolSource(source string) string {
+	return fmt.Sprintf("%s %s", source, c.command)
+}
+
+// ForwardExec forwards what the command writes to stdout and stderr until it exits and both streams end, then
+// forwards a line reporting how the command exited. Returns the exit code the agent should exit with once every line
+// has been delivered.
+func ForwardExec(command *ExecCommand, sinks []Sink, batchPeriodSeconds int64, multiline *MultilineConfig, spool *Spool, metadata *LogEvent) (int, error) {
+	logger.Infof("Starting forward for %s", command.command)
+
+	var wg sync.WaitGroup
+	for stream, r := range map[string]*os.File{"stdout": command.stdout, "stderr": command.stderr} {
+		source := "exec-" + stream
+
+		encodedMetadata, queues, err := prepareExecForward(command, stream, source, sinks, spool, metadata)
+		if err != nil {
+			// Nothing would read what the command writes
+			command.cmd.Process.Kill()
+			return 1, err
+		}
+
+		// The streams are read to their end, even when the agent is asked to stop, so that the command is not
+		// blocked writing to them
+		var tailer Tailer = NewReaderTailer(r, source, nil, nil)
+		if multiline != nil {
+			tailer = NewMultilineTailer(tailer, multiline)
+		}
+
+		wg.Add(1)
+		go func(lines chan *LogMessage, queues []*SpoolQueue, encodedMetadata []byte) {
+			defer wg.Done()
+			forwardToSinks(lines, sinks, nil, queues, batchPeriodSeconds, newSharedMetadata(encodedMetadata))
+		}(tailer.Lines(), queues, encodedMetadata)
+	}
+
+	exitLine, exitCode := command.Wait()
+
+	drained := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(execStreamsDrainTimeout):
+		logger.Warnf("The output of %s is still open after it exited, it will no longer be read", command.command)
+		command.stdout.Close()
+		command.stderr.Close()
+		<-drained
+	}
+
+	logger.Info(exitLine.Message)
+
+	encodedLine, err := json.Marshal(exitLine)
+	if err != nil {
+		return exitCode, err
+	}
+
+	encodedMetadata, queues, err := prepareExecForward(command, "", "exec", sinks, spool, metadata)
+	if err != nil {
+		return exitCode, err
+	}
+
+	lines := make(chan *LogMessage, 1)
+	lines <- &LogMessage{Filename: "exec", Lines: encodedLine}
+	close(lines)
+
+	// Forward will block until the line has been delivered
+	forwardToSinks(lines, sinks, nil, queues, batchPeriodSeconds, newSharedMetadata(encodedMetadata))
+
+	return exitCode, nil
+}
+
+// prepareExecForward returns the metadata and spool queues of the lines of a stream of the command
+func prepareExecForward(command *ExecCommand, stream string, source string, sinks []Sink, spool *Spool, metadata *LogEvent) ([]byte, []*SpoolQueue, error) {
+	streamMetadata := metadata.DeepCopy()
+	if streamMetadata == nil {
+		return nil, nil, fmt.Errorf("Failed to copy metadata while preparing to forward %s", source)
+	}
+	streamMetadata.AddExecContext(command.context(stream))
+
+	encodedMetadata, err := streamMetadata.EncodeJSON()
+	if err != nil {
+		logger.Errorf("Failed to encode additional metadata as JSON while preparing to forward %s", source)
+		return nil, nil, err
+	}
+
+	// Lines written by the command cannot be read again, so spooled batches are replayed. The queues are named after
+	// the command, so that batches spooled for another command are not sent with the metadata of this one.
+	queues, err := openSpoolQueues(spool, command.spoolSource(source), sinks, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encodedMetadata, queues, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestForwardExec(test *testing.T) {
+	if runtime.GOOS == "windows" {
+		test.Skip("Requires a POSIX shell")
+	}
+
+	command, err := StartExecCommand([]string{"sh", "-c", "echo out; echo err >&2; echo more out; exit 3"})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	sink := &recordingSink{name: "default"}
+	exitCode, err := ForwardExec(command, []Sink{sink}, 1, nil, nil, NewLogEvent())
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	if exitCode != 3 {
+		test.Fatalf("Expected the exit code of the command, got %d", exitCode)
+	}
+
+	batches := strings.Join(sink.batches, "")
+	if !strings.Contains(batches, "out\nmore out\n") || !strings.Contains(batches, "err\n") {
+		test.Fatalf("Expected the stdout and stderr lines to be forwarded, got %q", sink.batches)
+	}
+
+	var exitLine execExitLine
+	if err := json.Unmarshal([]byte(sink.batches[len(sink.batches)-1]), &exitLine); err != nil {
+		test.Fatalf("Expected the exit line to be forwarded last, got %q", sink.batches)
+	}
+
+	if exitLine.ExitCode != 3 || exitLine.Message != "sh -c echo out; echo err >&2; echo more out; exit 3 exited with status 3" {
+		test.Fatalf("Unexpected exit line %+v", exitLine)
+	}
+}
+
+func TestForwardExecReplaysBatchesOfTheSameCommand(test *testing.T) {
+	if runtime.GOOS == "windows" {
+		test.Skip("Requires a POSIX shell")
+	}
+
+	spool := newTestSpool(test, &SpoolConfig{})
+	defer os.RemoveAll(spool.config.Path)
+
+	args := []string{"sh", "-c", "echo out"}
+	for _, spooled := range []struct {
+		command string
+		lines   string
+	}{
+		{"sh -c echo out", "same command\n"},
+		{"sh -c echo other", "other command\n"},
+	} {
+		spooledCommand := &ExecCommand{command: spooled.command}
+		queue, _ := spool.Queue(spooledCommand.spoolSource("exec-stdout")+"#default", true)
+		queue.write(&LogMessage{Filename: "exec-stdout", Lines: []byte(spooled.lines)})
+	}
+
+	// Reopening the spool simulates an agent restart
+	spool, err := OpenSpool(spool.config)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	command, err := StartExecCommand(args)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	sink := &recordingSink{name: "default"}
+	if _, err := ForwardExec(command, []Sink{sink}, 1, nil, spool, NewLogEvent()); err != nil {
+		test.Fatal(err)
+	}
+
+	batches := sink.received()
+	if !strings.Contains(batches, "same command\n") || strings.Contains(batches, "other command\n") {
+		test.Fatalf("Expected only the batches spooled for the same command to be replayed, got %q", batches)
+	}
+}
+
+func TestExecCommandTerminatedBySignal(test *testing.T) {
+	if runtime.GOOS == "windows" {
+		test.Skip("Requires a POSIX shell")
+	}
+
+	command, err := StartExecCommand([]string{"sh", "-c", "kill -TERM $$"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	command.stdout.Close()
+	command.stderr.Close()
+
+	exitLine, exitCode := command.Wait()
+	if exitCode != 143 || exitLine.ExitCode != 143 || exitLine.Signal != "terminated" {
+		test.Fatalf("Expected the command to be reported as terminated by SIGTERM, got %d %+v", exitCode, exitLine)
+	}
+}
+
+func TestStartExecCommandNotFound(test *testing.T) {
+	if _, err := StartExecCommand([]string{"timber-agent-missing-command"}); err == nil {
+		test.Fatal("Expected a missing command to fail to start")
+	}
+}
@@ -0,0 +1,22 @@
+// Implements fileIdentity() for platforms that report device and inode
+// numbers through syscall.Stat_t.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the device and inode of the file described by info
+func fileIdentity(info os.FileInfo) (FileIdentity, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileIdentity{}, false
+	}
+
+	return FileIdentity{Device: uint64(stat.Dev), Inode: uint64(stat.Ino)}, true
+}
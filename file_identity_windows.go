@@ -0,0 +1,11 @@
+// Implements fileIdentity() for Windows, where os.FileInfo does not expose a
+// file index. Files are identified by their fingerprint alone.
+
+package main
+
+import "os"
+
+// fileIdentity is not available on Windows
+func fileIdentity(info os.FileInfo) (FileIdentity, bool) {
+	return FileIdentity{}, false
+}
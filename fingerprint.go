@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// The default maximum number of bytes at the start of a file that are used to fingerprint it
+const defaultFingerprintBytes = 1024
+
+// Maximum number of bytes the fingerprint of a file grows to, set from the configuration. Accessed atomically since
+// it may change when the configuration is reloaded.
+var fingerprintMaxBytes int64 = defaultFingerprintBytes
+
+// SetFingerprintMaxBytes sets the maximum fingerprint length used for files discovered from now on. Zero selects the
+// default.
+func SetFingerprintMaxBytes(n int64) {
+	if n <= 0 {
+		n = defaultFingerprintBytes
+	}
+
+	atomic.StoreInt64(&fingerprintMaxBytes, n)
+}
+
+// FileIdentity identifies a file independently of its path, so that a file keeps its state when it is renamed
+type FileIdentity struct {
+	Device uint64
+	Inode  uint64
+}
+
+func (id FileIdentity) key() string {
+	return fmt.Sprintf("%d:%d", id.Device, id.Inode)
+}
+
+// fingerprintFile returns the CRC32 of the first length bytes of the file. An error is returned if the file is
+// shorter than length.
+func fingerprintFile(filename string, length int64) (uint32, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	hash := crc32.NewIEEE()
+	if _, err := io.CopyN(hash, f, length); err != nil {
+		return 0, err
+	}
+
+	return hash.Sum32(), nil
+}
+
+// fingerprintLength returns how many bytes of a file of the given size are fingerprinted
+func fingerprintLength(size int64) int64 {
+	max := atomic.LoadInt64(&fingerprintMaxBytes)
+	if size < max {
+		return size
+	}
+
+	return max
+}
+
+// identify records the identity of the file described by info in the state, along with a fingerprint of as many
+// bytes as the file currently allows
+func (s *State) identify(filename string, info os.FileInfo) error {
+	identity, _ := fileIdentity(info)
+	s.Device = identity.Device
+	s.Inode = identity.Inode
+
+	length := fingerprintLength(info.Size())
+	checksum, err := fingerprintFile(filename, length)
+	if err != nil {
+		return err
+	}
+
+	s.Checksum = checksum
+	s.FingerprintLength = length
+
+	return nil
+}
+
+// identifies reports whether the state was recorded for the file described by info. Where available, the device and
+// inode must match. The fingerprint must match as well, since inodes are reused once a file is deleted.
+func (s *State) identifies(filename string, info os.FileInfo) bool {
+	if identity, ok := fileIdentity(info); ok && s.Inode != 0 {
+		if identity.Device != s.Device || identity.Inode != s.Inode {
+			return false
+		}
+	}
+
+	if s.FingerprintLength == 0 {
+		if s.Checksum == 0 {
+			// The file was empty when it was fingerprinted
+			return true
+		}
+
+		// States recorded by earlier versions checksum the first 256 bytes, padded with zeros
+		checksum, err := calculateChecksum(filename)
+		return err == nil && checksum == s.Checksum
+	}
+
+	checksum, err := fingerprintFile(filename, s.FingerprintLength)
+	return err == nil && checksum == s.Checksum
+}
+
+func (s *State) identity() FileIdentity {
+	return FileIdentity{Device: s.Device, Inode: s.Inode}
+}
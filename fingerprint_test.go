@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(test *testing.T, path string, content string) os.FileInfo {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		test.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	return info
+}
+
+func TestStateIdentifiesFilesWithSameHeader(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-agent-test")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header := strings.Repeat("# generated by the application\n", 20)
+	first := filepath.Join(dir, "first.log")
+	second := filepath.Join(dir, "second.log")
+	firstInfo := writeTestFile(test, first, header)
+	secondInfo := writeTestFile(test, second, header)
+
+	if _, ok := fileIdentity(firstInfo); !ok {
+		test.Skip("file identities are not available on this platform")
+	}
+
+	state := &State{}
+	if err := state.identify(first, firstInfo); err != nil {
+		test.Fatal(err)
+	}
+
+	if !state.identifies(first, firstInfo) {
+		test.Fatalf("expected state to identify %s", first)
+	}
+
+	if state.identifies(second, secondInfo) {
+		test.Fatalf("expected state not to identify %s, it has a different inode", second)
+	}
+}
+
+func TestStateIdentifiesGrowingFile(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-agent-test")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	info := writeTestFile(test, path, "short\n")
+
+	state := &State{}
+	if err := state.identify(path, info); err != nil {
+		test.Fatal(err)
+	}
+
+	if state.FingerprintLength != 6 {
+		test.Fatalf("expected fingerprint of 6 bytes, got %d", state.FingerprintLength)
+	}
+
+	// The file grows past the legacy 256 byte checksum and the fingerprint maximum
+	info = writeTestFile(test, path, "short\n"+strings.Repeat("x", 2*defaultFingerprintBytes))
+	if !state.identifies(path, info) {
+		test.Fatalf("expected state to identify the file after it grew")
+	}
+
+	info = writeTestFile(test, path, "other\n"+strings.Repeat("x", 2*defaultFingerprintBytes))
+	if state.identifies(path, info) {
+		test.Fatalf("expected state not to identify the file after its start changed")
+	}
+}
+
+func TestFindMovedState(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-agent-test")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gs := NewGlobalState()
+
+	path := filepath.Join(dir, "app.log")
+	rotated := filepath.Join(dir, "app.log.1")
+	info := writeTestFile(test, path, "line one\nline two\n")
+	if _, ok := fileIdentity(info); !ok {
+		test.Skip("file identities are not available on this platform")
+	}
+
+	state := &State{Offset: 9}
+	if err := state.identify(path, info); err != nil {
+		test.Fatal(err)
+	}
+	gs.saveState(path, state)
+
+	if err := os.Rename(path, rotated); err != nil {
+		test.Fatal(err)
+	}
+	info, _ = os.Stat(rotated)
+
+	moved, from := gs.findMovedState(rotated, info)
+	if moved == nil {
+		test.Fatalf("expected the state of %s to be carried over", path)
+	}
+
+	if from != path || moved.Offset != 9 {
+		test.Fatalf("expected offset 9 from %s, got %d from %s", path, moved.Offset, from)
+	}
+
+	if gs.getState(path) != nil {
+		test.Fatalf("expected the state of %s to be removed, the file was renamed", path)
+	}
+}
+
+func TestFindMovedStateFromDetached(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-agent-test")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gs := NewGlobalState()
+
+	path := filepath.Join(dir, "app.log")
+	rotated := filepath.Join(dir, "app.log.1")
+	info := writeTestFile(test, path, "line one\nline two\n")
+	if _, ok := fileIdentity(info); !ok {
+		test.Skip("file identities are not available on this platform")
+	}
+
+	state := &State{Offset: 9}
+	if err := state.identify(path, info); err != nil {
+		test.Fatal(err)
+	}
+	gs.saveState(path, state)
+
+	// A new file takes over the path before the rotated file is discovered
+	if err := os.Rename(path, rotated); err != nil {
+		test.Fatal(err)
+	}
+	writeTestFile(test, path, "new file\n")
+	gs.resetState(path)
+
+	if len(gs.Data.Detached) != 1 {
+		test.Fatalf("expected the replaced state to be detached, got %d detached states", len(gs.Data.Detached))
+	}
+
+	info, _ = os.Stat(rotated)
+	moved, _ := gs.findMovedState(rotated, info)
+	if moved == nil || moved.Offset != 9 {
+		test.Fatalf("expected the detached state with offset 9 to be carried over, got %v", moved)
+	}
+
+	if len(gs.Data.Detached) != 0 {
+		test.Fatalf("expected the detached state to be removed once carried over")
+	}
+}
+
+func TestUpdateSinkOffsetIgnoresReplacedFile(test *testing.T) {
+	gs := NewGlobalState()
+	gs.saveState("app.log", &State{Offset: 100})
+
+	stale := gs.generation("app.log")
+	gs.nextGeneration("app.log")
+	gs.saveState("app.log", &State{})
+
+	if err := gs.updateSinkOffset("app.log", "timber", 200, stale); err != nil {
+		test.Fatal(err)
+	}
+
+	if offset := gs.getState("app.log").Offset; offset != 0 {
+		test.Fatalf("expected offset of the replaced file to be ignored, got %d", offset)
+	}
+
+	if err := gs.updateSinkOffset("app.log", "timber", 20, gs.generation("app.log")); err != nil {
+		test.Fatal(err)
+	}
+
+	if offset := gs.getState("app.log").Offset; offset != 20 {
+		test.Fatalf("expected offset 20, got %d", offset)
+	}
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/base64"
-	"errors"
 	"fmt"
-	"io/ioutil"
+	"log"
 	"math"
+	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -21,64 +21,81 @@ func init() {
 	defaultHTTPClient.HTTPClient.Timeout = 10 * time.Second
 	// Retry "forever"
 	defaultHTTPClient.RetryMax = math.MaxInt32
+
+	defaultHTTPClient.RequestLogHook = func(_ *log.Logger, req *http.Request, attempt int) {
+		if attempt > 0 {
+			httpRetriesMetric.Inc(req.URL.Host)
+		}
+	}
+	defaultHTTPClient.ResponseLogHook = func(_ *log.Logger, resp *http.Response) {
+		httpResponsesMetric.Inc(resp.Request.URL.Host, strconv.Itoa(resp.StatusCode))
+	}
 }
 
+// Forward delivers every batch from messageChan to the Timber endpoint with the given API key
 func Forward(messageChan chan *LogMessage, httpClient *retryablehttp.Client, endpoint, apiKey string, metadata []byte) error {
-	// Set the logger when the function is called to ensure we pickup any logger changes.
-	httpClient.Logger = standardLoggerAlternative
-	token := base64.StdEncoding.EncodeToString([]byte(apiKey))
-	authorization := fmt.Sprintf("Basic %s", token)
+	return ForwardToSink(messageChan, NewTimberSink(defaultSinkName, httpClient, endpoint, apiKey, nil), metadata)
+}
 
-	for message := range messageChan {
-		req, err := retryablehttp.NewRequest("POST", endpoint, bytes.NewReader(message.Lines))
-		if err != nil {
-			logger.Fatal(err)
-		}
+// sharedMetadata holds the encoded metadata sent with every batch of a source. It is replaced while the source is
+// forwarded when its metadata changes, such as the labels of a Kubernetes pod.
+type sharedMetadata struct {
+	sync.RWMutex
+	encoded []byte
+}
 
-		req.Header.Add("Content-Type", "text/plain")
-		req.Header.Add("Authorization", authorization)
-		req.Header.Add("User-Agent", UserAgent)
+func newSharedMetadata(encoded []byte) *sharedMetadata {
+	return &sharedMetadata{encoded: encoded}
+}
 
-		if len(metadata) > 0 {
-			encodedMetadata := base64.StdEncoding.EncodeToString(metadata)
-			req.Header.Add("Timber-Metadata-Override", encodedMetadata)
-		}
+func (m *sharedMetadata) get() []byte {
+	if m == nil {
+		return nil
+	}
 
-		// We do not need to handle this error since we retry "forever"
-		resp, _ := httpClient.Do(req)
+	m.RLock()
+	defer m.RUnlock()
+	return m.encoded
+}
 
-		// We should not reach this if, but require it for testing
-		if resp == nil {
-			return errors.New("httpClient did not return a response")
-		}
+func (m *sharedMetadata) set(encoded []byte) {
+	m.Lock()
+	defer m.Unlock()
+	m.encoded = encoded
+}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			logger.Warn("unable to read response body")
-		}
-		resp.Body.Close()
+// ForwardToSink delivers every batch from messageChan to the sink until the channel is closed. The delivery offset
+// for the sink is recorded in the global state for each delivered batch.
+func ForwardToSink(messageChan chan *LogMessage, sink Sink, metadata []byte) error {
+	return forwardToSink(messageChan, sink, newSharedMetadata(metadata))
+}
 
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-			logger.Infof("flushed buffer (status code %d)", resp.StatusCode)
+func forwardToSink(messageChan chan *LogMessage, sink Sink, sharedMetadata *sharedMetadata) error {
+	for message := range messageChan {
+		err := sink.Deliver(message, sharedMetadata.get())
+		if err != nil {
+			// We log the error here instead of returning it in order to keep
+			// draining the channel, other sinks fed by the same tailer would
+			// otherwise block. Spooled batches stay in the spool to be retried.
+			logger.Errorf("Failed to deliver batch to sink %s: %s", sink.Name(), err)
+			batchErrorsMetric.Inc(sink.Name())
+		} else {
+			batchesSentMetric.Inc(sink.Name())
+			bytesSentMetric.Add(float64(len(message.Lines)), sink.Name())
 
-			// Store state in global state upon success
 			if message.Position != 0 {
 				// If position != 0, we have a LogMessage that supports recording state
-				UpdateStateOffset(message.Filename, message.Position)
+				UpdateMessageSinkOffset(message, sink.Name())
 			}
-		} else {
-			// We log the error here instead of returning it in
-			// order to continue retrying on any http error. We had
-			// previously returned on any client error, but some
-			// should resolve themselves.
-			logger.Errorf(fmt.Sprintf("unexpected response (status code %d): %s", resp.StatusCode, string(body)))
 		}
+
+		message.acknowledge(err == nil)
 	}
 
 	return nil
 }
 
-func ForwardStdin(endpoint string, apiKey string, batchPeriodSeconds int64, metadata *LogEvent, quit chan bool) error {
+func ForwardStdin(sinks []Sink, batchPeriodSeconds int64, multiline *MultilineConfig, framing *FramingConfig, spool *Spool, metadata *LogEvent, quit chan bool) error {
 	logger.Info("Starting forward for STDIN")
 
 	encodedMetadata, err := metadata.EncodeJSON()
@@ -89,22 +106,95 @@ func ForwardStdin(endpoint string, apiKey string, batchPeriodSeconds int64, meta
 		return err
 	}
 
-	messageChan := make(chan *LogMessage)
-	tailer := NewReaderTailer(os.Stdin, quit)
+	// Spooled STDIN batches cannot be read again, so they are replayed from a previous run
+	queues, err := openSpoolQueues(spool, "stdin", sinks, true)
+	if err != nil {
+		return err
+	}
+
+	var tailer Tailer = NewReaderTailer(os.Stdin, "stdin", framing, quit)
+	if multiline != nil {
+		tailer = NewMultilineTailer(tailer, multiline)
+	}
 
-	// Here we run our batcher in the background and return from Forward
 	// Forward will block until the tailer is closed
-	go Batch(tailer.Lines(), messageChan, batchPeriodSeconds)
-	return Forward(messageChan, defaultHTTPClient, endpoint, apiKey, encodedMetadata)
+	forwardToSinks(tailer.Lines(), sinks, nil, queues, batchPeriodSeconds, newSharedMetadata(encodedMetadata))
+
+	return nil
 }
 
-func ForwardFile(filePath string, readNewFileFromStart bool, endpoint string, apiKey string, poll bool, batchPeriodSeconds int64, metadata *LogEvent, quit chan bool, stop chan bool) error {
+// ForwardFile tails the file at filePath and forwards its lines to the sinks until quit or stop is closed. When
+// containerLogs is set, lines written by the Docker json-file driver or a CRI runtime are unwrapped. Metadata
+// received on metadataUpdates, which may be nil, replaces metadata for the batches that follow.
+func ForwardFile(filePath string, readNewFileFromStart bool, poll bool, batchPeriodSeconds int64, containerLogs bool, multiline *MultilineConfig, spool *Spool, sinks []Sink, metadata *LogEvent, metadataUpdates chan *LogEvent, quit chan bool, stop chan bool) error {
 	logger.Infof("Starting forward for file %s", filePath)
 
 	// Takes the base of the file's path so that "/var/log/apache2/access.log"
 	// becomes "access.log"
 	fileName := path.Base(filePath)
 
+	encodedMetadata, err := encodeFileMetadata(metadata, fileName)
+	if err != nil {
+		// If there was an error encoding to JSON, we do not add it to the sources
+		// list and therefore do not tail it
+		logger.Errorf("Failed to encode additional metadata as JSON while preparing to tail %s", filePath)
+		return err
+	}
+
+	sharedMetadata := newSharedMetadata(encodedMetadata)
+	done := make(chan bool)
+	defer close(done)
+
+	if metadataUpdates != nil {
+		go func() {
+			for {
+				select {
+				case update := <-metadataUpdates:
+					encoded, err := encodeFileMetadata(update, fileName)
+					if err != nil {
+						logger.Errorf("Failed to encode updated metadata as JSON for %s, keeping the previous metadata", filePath)
+						continue
+					}
+					sharedMetadata.set(encoded)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	queues, err := openSpoolQueues(spool, filePath, sinks, false)
+	if err != nil {
+		return err
+	}
+
+	fileTailer := NewFileTailer(filePath, readNewFileFromStart, poll, quit, stop)
+
+	var tailer Tailer = fileTailer
+	if containerLogs {
+		tailer = NewContainerLogTailer(tailer, fileTailer.StartOffset())
+	}
+	if multiline != nil {
+		tailer = NewMultilineTailer(tailer, multiline)
+	}
+
+	// The tailer resumes from the offset of the sink that is furthest behind. Each sink then skips what it has
+	// already delivered, so a sink that is ahead does not receive lines twice. The generation is read first, so
+	// that offsets read after the file was truncated or replaced are not applied to the earlier file.
+	delivered := &deliveredOffsets{generation: globalState.generation(filePath)}
+	delivered.offsets = InitSinkOffsets(filePath, sinkNames(sinks))
+
+	// Forward will block until the tailer is closed
+	forwardToSinks(tailer.Lines(), sinks, delivered, queues, batchPeriodSeconds, sharedMetadata)
+
+	// Files are counted by path, which is not read again once the file was rotated away
+	linesReadMetric.Delete(filePath)
+
+	return nil
+}
+
+// encodeFileMetadata encodes metadata with the source file name set
+func encodeFileMetadata(metadata *LogEvent, fileName string) ([]byte, error) {
 	// Makes a copy of the metadata; we only want set the filename on the
 	// local copy of the metadata
 	localMetadata := *metadata // localMetadata is of type LogEvent
@@ -112,19 +202,129 @@ func ForwardFile(filePath string, readNewFileFromStart bool, endpoint string, ap
 	md.ensureSourceContext()
 	md.Context.Source.FileName = fileName
 
-	encodedMetadata, err := md.EncodeJSON()
-	if err != nil {
-		// If there was an error encoding to JSON, we do not add it to the sources
-		// list and therefore do not tail it
-		logger.Errorf("Failed to encode additional metadata as JSON while preparing to tail %s", filePath)
-		return err
+	return md.EncodeJSON()
+}
+
+// Number of lines a sink can be behind the other sinks fed by the same source, see fanOut
+const sinkBufferSize = 1000
+
+// deliveredOffsets are the offsets each sink had delivered a file up to when it started being forwarded, for the
+// generation of the file they belong to
+type deliveredOffsets struct {
+	offsets    []int64
+	generation int64
+}
+
+// forwardToSinks runs a batcher and forwarder per sink, each fed with every line from lines. Lines the sink had
+// delivered, if delivered is not nil, are not sent to that sink. Blocks until lines is closed and every sink has been
+// drained.
+func forwardToSinks(lines chan *LogMessage, sinks []Sink, delivered *deliveredOffsets, queues []*SpoolQueue, batchPeriodSeconds int64, metadata *sharedMetadata) {
+	var wg sync.WaitGroup
+
+	for i, sinkLines := range fanOut(lines, len(sinks)) {
+		if delivered != nil {
+			sinkLines = skipDelivered(sinkLines, delivered.offsets[i], delivered.generation)
+		}
+
+		messageChan := make(chan *LogMessage)
+
+		// Here we run our batcher in the background for each sink
+		go BatchCompressed(sinkLines, messageChan, batchPeriodSeconds, sinks[i].Compression())
+
+		wg.Add(1)
+		go func(sink Sink, messageChan chan *LogMessage) {
+			defer wg.Done()
+			forwardToSink(messageChan, sink, metadata)
+		}(sinks[i], spoolMessages(queues[i], messageChan))
 	}
 
-	messageChan := make(chan *LogMessage)
-	tailer := NewFileTailer(filePath, readNewFileFromStart, poll, quit, stop)
+	wg.Wait()
+}
 
-	// Here we run our batcher in the background and return from Forward
-	// Forward will block until the tailer is closed
-	go Batch(tailer.Lines(), messageChan, batchPeriodSeconds)
-	return Forward(messageChan, defaultHTTPClient, endpoint, apiKey, encodedMetadata)
+// fanOut copies every message received on in to n channels. Each channel is closed once in is closed.
+//
+// Each channel buffers sinkBufferSize messages, so a sink that is slow or retrying does not hold up the other sinks
+// until it falls that far behind. From then on, in is only read as fast as that sink takes messages. Batches of sinks
+// with a spool queue wait in the spool instead, so these sinks only fall behind once the spool blocks.
+func fanOut(in chan *LogMessage, n int) []chan *LogMessage {
+	if n == 1 {
+		return []chan *LogMessage{in}
+	}
+
+	outs := make([]chan *LogMessage, n)
+	for i := range outs {
+		outs[i] = make(chan *LogMessage, sinkBufferSize)
+	}
+
+	go func() {
+		for message := range in {
+			for _, out := range outs {
+				out <- message
+			}
+		}
+
+		for _, out := range outs {
+			close(out)
+		}
+	}()
+
+	return outs
+}
+
+// skipDelivered drops messages positioned at or before offset, which were delivered before the agent restarted.
+// Messages are only dropped until one past offset is seen, or one read after the file was truncated or replaced at
+// its path, that is of a generation other than the given one.
+func skipDelivered(in chan *LogMessage, offset int64, generation int64) chan *LogMessage {
+	if offset == 0 {
+		return in
+	}
+
+	out := make(chan *LogMessage)
+
+	go func() {
+		skipping := true
+		for message := range in {
+			if skipping && (message.Position > offset || message.generation != generation) {
+				skipping = false
+			}
+
+			if !skipping {
+				out <- message
+			}
+		}
+		close(out)
+	}()
+
+	return out
+}
+
+// openSpoolQueues opens a queue per sink for the given source. Without a spool, the returned queues are nil.
+func openSpoolQueues(spool *Spool, source string, sinks []Sink, replay bool) ([]*SpoolQueue, error) {
+	queues := make([]*SpoolQueue, len(sinks))
+	if spool == nil {
+		return queues, nil
+	}
+
+	for i, sink := range sinks {
+		queue, err := spool.Queue(fmt.Sprintf("%s#%s", source, sink.Name()), replay)
+		if err != nil {
+			return nil, err
+		}
+		queues[i] = queue
+	}
+
+	return queues, nil
+}
+
+// spoolMessages places the given queue between the batcher and the forwarder. Without a queue, batches are handed
+// to the forwarder directly.
+func spoolMessages(queue *SpoolQueue, messageChan chan *LogMessage) chan *LogMessage {
+	if queue == nil {
+		return messageChan
+	}
+
+	spooledChan := make(chan *LogMessage)
+	go queue.Run(messageChan, spooledChan)
+
+	return spooledChan
 }
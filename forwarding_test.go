@@ -3,9 +3,12 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -136,3 +139,156 @@ func TestForwardForwardingTimeoutDoesNotFatal(test *testing.T) {
 		test.Fatalf("expected to exhaust all retries and make requests %d, made %d", 10, requests)
 	}
 }
+
+func TestForwardAcknowledgesMessages(test *testing.T) {
+	acknowledged := false
+	bufChan := make(chan *LogMessage, 1)
+	bufChan <- &LogMessage{
+		Lines: []byte("test log line\n"),
+		ack:   func(delivered bool) { acknowledged = delivered },
+	}
+	close(bufChan)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer ts.Close()
+
+	Forward(bufChan, retryablehttp.NewClient(), ts.URL, "api key", []byte{})
+
+	if !acknowledged {
+		test.Fatal("expected message to be acknowledged after forwarding")
+	}
+}
+
+func TestForwardDoesNotAcknowledgeUndeliveredMessages(test *testing.T) {
+	acknowledged := true
+	bufChan := make(chan *LogMessage, 1)
+	bufChan <- &LogMessage{
+		Lines: []byte("test log line\n"),
+		ack:   func(delivered bool) { acknowledged = delivered },
+	}
+	close(bufChan)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+	}))
+	defer ts.Close()
+
+	Forward(bufChan, retryablehttp.NewClient(), ts.URL, "api key", []byte{})
+
+	if acknowledged {
+		test.Fatal("expected message not to be acknowledged as delivered after a client error")
+	}
+}
+
+func TestFanOutDoesNotWaitForSlowSinks(test *testing.T) {
+	in := make(chan *LogMessage)
+	outs := fanOut(in, 2)
+
+	// Nothing reads the first channel, as if its sink were retrying
+	go func() {
+		for i := 0; i < 10; i++ {
+			in <- &LogMessage{Lines: []byte("line")}
+		}
+		close(in)
+	}()
+
+	received := 0
+	timeout := time.After(5 * time.Second)
+	for received < 10 {
+		select {
+		case <-outs[1]:
+			received++
+		case <-timeout:
+			test.Fatalf("expected the second sink to receive every line, got %d", received)
+		}
+	}
+}
+
+func TestForwardFileSendsLinesOfTruncatedFile(test *testing.T) {
+	file, err := ioutil.TempFile("", "timber-agent-test")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	globalStateFile, err := ioutil.TempFile("", "timber-agent-test-statefile.json")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(globalStateFile.Name())
+	globalState = NewGlobalState()
+	globalState.Filename = globalStateFile.Name()
+
+	fmt.Fprintln(file, "header")
+	sendLines(file, generateLogLines("before", 10))
+
+	forward := func(sink Sink, quit chan bool) chan bool {
+		done := make(chan bool)
+		go func() {
+			ForwardFile(file.Name(), true, true, 1, false, nil, nil, []Sink{sink}, NewLogEvent(), nil, quit, nil)
+			close(done)
+		}()
+		return done
+	}
+
+	// The sink delivers the whole file before the agent restarts
+	first := &recordingSink{name: "timber"}
+	quit := make(chan bool)
+	done := forward(first, quit)
+	first.waitForLines(test, "before 9\n")
+	close(quit)
+	<-done
+
+	second := &recordingSink{name: "timber"}
+	quit = make(chan bool)
+	defer close(quit)
+	forward(second, quit)
+	time.Sleep(100 * time.Millisecond)
+
+	// copytruncate: the new lines are positioned before the offset the sink had delivered up to
+	file.Truncate(0)
+	file.Seek(0, io.SeekStart)
+	fmt.Fprintln(file, "header")
+	fmt.Fprintln(file, "after")
+
+	second.waitForLines(test, "header\nafter\n")
+}
+
+func TestForwardFileRemovesItsLinesReadSeries(test *testing.T) {
+	file, err := ioutil.TempFile("", "timber-agent-test")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	globalStateFile, err := ioutil.TempFile("", "timber-agent-test-statefile.json")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(globalStateFile.Name())
+	globalState = NewGlobalState()
+	globalState.Filename = globalStateFile.Name()
+
+	fmt.Fprintln(file, "line")
+
+	sink := &recordingSink{name: "timber"}
+	quit := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		ForwardFile(file.Name(), true, true, 1, false, nil, nil, []Sink{sink}, NewLogEvent(), nil, quit, nil)
+		close(done)
+	}()
+	sink.waitForLines(test, "line\n")
+
+	close(quit)
+	<-done
+
+	// Rotated files are no longer read, their series would otherwise accumulate
+	var buf bytes.Buffer
+	linesReadMetric.write(&buf)
+	if strings.Contains(buf.String(), file.Name()) {
+		test.Fatalf("expected the series of %s to be removed once it is no longer forwarded, got:\n%s", file.Name(), buf.String())
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// How records can be delimited in a stream
+var supportedFramings = []string{
+	// Records end with "\n", a preceding "\r" is removed
+	"newline",
+	// Records end with a NUL byte
+	"nul",
+	// Each record follows its length as a 4 byte big endian integer
+	"length_prefixed",
+	// Each record follows its length in ASCII digits and a space, as in RFC 6587
+	"octet_counting",
+}
+
+// FramingConfig Configures how records are read from stdin
+type FramingConfig struct {
+	// One of supportedFramings, newline when empty
+	Framing string
+	// Records longer than this many bytes are truncated, the max event size when 0
+	MaxRecordBytes int `toml:"max_record_bytes"`
+}
+
+// Validate returns an error if records cannot be read with the configuration
+func (fc *FramingConfig) Validate() error {
+	if fc.Framing != "" && !containsString(supportedFramings, fc.Framing) {
+		return fmt.Errorf("Framing %q is not supported, expected one of newline, nul, length_prefixed or octet_counting", fc.Framing)
+	}
+
+	if fc.MaxRecordBytes != 0 && (fc.MaxRecordBytes < minEventBytes || fc.MaxRecordBytes >= maxPayloadSize) {
+		return fmt.Errorf("max_record_bytes must be between %d and %d", minEventBytes, maxPayloadSize-1)
+	}
+
+	return nil
+}
+
+func (fc *FramingConfig) framing() string {
+	if fc == nil || fc.Framing == "" {
+		return "newline"
+	}
+
+	return fc.Framing
+}
+
+func (fc *FramingConfig) maxRecordBytes() int {
+	if fc == nil || fc.MaxRecordBytes == 0 {
+		return oversize.Load().(oversizeSettings).maxBytes
+	}
+
+	return fc.MaxRecordBytes
+}
+
+// Returned when a length prefix cannot be read, after which the records of the stream cannot be told apart
+var errInvalidRecordLength = errors.New("Invalid record length")
+
+// recordReader reads the records of a stream. Records longer than the max record size are truncated like lines longer
+// than the max event size, and the rest of them is skipped.
+type recordReader struct {
+	r        *bufio.Reader
+	framing  string
+	maxBytes int
+}
+
+// newRecordReader returns a recordReader for r, framed as configured by config, which may be nil for newline framing
+func newRecordReader(r io.Reader, config *FramingConfig) *recordReader {
+	return &recordReader{
+		r:        bufio.NewReader(r),
+		framing:  config.framing(),
+		maxBytes: config.maxRecordBytes(),
+	}
+}
+
+// ReadRecord returns the next record and whether it was truncated. The last record of the stream does not need to be
+// delimited. Returns io.EOF once the stream ended.
+func (rr *recordReader) ReadRecord() ([]byte, bool, error) {
+	switch rr.framing {
+	case "nul":
+		return rr.readDelimited(0)
+	case "length_prefixed":
+		var length uint32
+		if err := binary.Read(rr.r, binary.BigEndian, &length); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, false, errInvalidRecordLength
+			}
+			return nil, false, err
+		}
+		return rr.readCounted(int64(length))
+	case "octet_counting":
+		length, err := rr.readOctetCount()
+		if err != nil {
+			return nil, false, err
+		}
+		return rr.readCounted(length)
+	default:
+		record, truncated, err := rr.readDelimited('\n')
+		if !truncated && len(record) > 0 && record[len(record)-1] == '\r' {
+			record = record[:len(record)-1]
+		}
+		return record, truncated, err
+	}
+}
+
+// readDelimited reads a record ending with delimiter, which is not returned
+func (rr *recordReader) readDelimited(delimiter byte) ([]byte, bool, error) {
+	var record []byte
+	var length int64
+
+	for {
+		chunk, err := rr.r.ReadSlice(delimiter)
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+
+		// Past the max record size, only the length of the record is kept
+		if len(record) <= rr.maxBytes {
+			record = append(record, chunk...)
+		}
+		length += int64(len(chunk))
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		truncated := length > int64(rr.maxBytes)
+		if truncated {
+			record = truncateLineOfLength(record, length, rr.maxBytes)
+		}
+
+		if err == io.EOF && length > 0 {
+			return record, truncated, nil
+		}
+
+		return record, truncated, err
+	}
+}
+
+// readCounted reads a record of the given length
+func (rr *recordReader) readCounted(length int64) ([]byte, bool, error) {
+	kept := length
+	if kept > int64(rr.maxBytes) {
+		kept = int64(rr.maxBytes)
+	}
+
+	record := make([]byte, kept)
+	if _, err := io.ReadFull(rr.r, record); err != nil {
+		return nil, false, unexpectedEOF(err)
+	}
+
+	if kept == length {
+		return record, false, nil
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, rr.r, length-kept); err != nil {
+		return nil, false, unexpectedEOF(err)
+	}
+
+	return truncateLineOfLength(record, length, rr.maxBytes), true, nil
+}
+
+// readOctetCount reads the length of an octet counted record and the space that follows it
+func (rr *recordReader) readOctetCount() (int64, error) {
+	var length int64
+	for digits := 0; ; digits++ {
+		c, err := rr.r.ReadByte()
+		if err == io.EOF && digits == 0 {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, errInvalidRecordLength
+		}
+		if c == ' ' && digits > 0 {
+			return length, nil
+		}
+		if c < '0' || c > '9' || digits == 10 {
+			return 0, errInvalidRecordLength
+		}
+		length = length*10 + int64(c-'0')
+	}
+}
+
+// unexpectedEOF reports a stream ending within a record as an error
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
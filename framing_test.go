@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAllRecords(test *testing.T, r io.Reader, config *FramingConfig) ([]string, error) {
+	records := newRecordReader(r, config)
+
+	var read []string
+	for {
+		record, _, err := records.ReadRecord()
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+		read = append(read, string(record))
+	}
+}
+
+func TestRecordReaderFramings(test *testing.T) {
+	lengthPrefixed := &bytes.Buffer{}
+	for _, record := range []string{"first", "with\nnewline", ""} {
+		binary.Write(lengthPrefixed, binary.BigEndian, uint32(len(record)))
+		lengthPrefixed.WriteString(record)
+	}
+
+	cases := []struct {
+		framing  string
+		stream   io.Reader
+		expected []string
+	}{
+		{"", strings.NewReader("first\r\nsecond\n\nunterminated"), []string{"first", "second", "", "unterminated"}},
+		{"nul", strings.NewReader("first\x00with\nnewline\x00"), []string{"first", "with\nnewline"}},
+		{"length_prefixed", lengthPrefixed, []string{"first", "with\nnewline", ""}},
+		{"octet_counting", strings.NewReader("5 first12 with\nnewline"), []string{"first", "with\nnewline"}},
+	}
+
+	for _, c := range cases {
+		records, err := readAllRecords(test, c.stream, &FramingConfig{Framing: c.framing})
+		if err != nil {
+			test.Fatalf("Unexpected error reading %s records: %s", c.framing, err)
+		}
+
+		if strings.Join(records, "|") != strings.Join(c.expected, "|") {
+			test.Fatalf("Expected %s records %q, got %q", c.framing, c.expected, records)
+		}
+	}
+}
+
+func TestRecordReaderTruncatesLongRecords(test *testing.T) {
+	long := strings.Repeat("a", 70000)
+	expected := strings.Repeat("a", 74) + "…[truncated 69926 bytes]"
+
+	cases := []struct {
+		framing string
+		stream  string
+	}{
+		{"newline", long + "\nnext\n"},
+		{"octet_counting", "70000 " + long + "4 next"},
+	}
+
+	for _, c := range cases {
+		records := newRecordReader(strings.NewReader(c.stream), &FramingConfig{Framing: c.framing, MaxRecordBytes: 100})
+
+		record, truncated, err := records.ReadRecord()
+		if err != nil || !truncated || string(record) != expected {
+			test.Fatalf("Expected the long %s record to be truncated, got %.120q %t %v", c.framing, record, truncated, err)
+		}
+
+		// Reading continues with the next record
+		record, truncated, err = records.ReadRecord()
+		if err != nil || truncated || string(record) != "next" {
+			test.Fatalf("Expected the %s record after the long record, got %q %t %v", c.framing, record, truncated, err)
+		}
+	}
+}
+
+func TestRecordReaderInvalidLength(test *testing.T) {
+	_, err := readAllRecords(test, strings.NewReader("5 first oops"), &FramingConfig{Framing: "octet_counting"})
+	if err != errInvalidRecordLength {
+		test.Fatalf("Expected an invalid length to end the stream, got %v", err)
+	}
+
+	_, err = readAllRecords(test, strings.NewReader("10 short"), &FramingConfig{Framing: "octet_counting"})
+	if err != io.ErrUnexpectedEOF {
+		test.Fatalf("Expected a stream ending within a record to be reported, got %v", err)
+	}
+}
+
+func TestFramingConfigValidate(test *testing.T) {
+	cases := []FramingConfig{
+		{Framing: "csv"},
+		{MaxRecordBytes: minEventBytes - 1},
+		{MaxRecordBytes: maxPayloadSize},
+	}
+
+	for _, config := range cases {
+		if err := config.Validate(); err == nil {
+			test.Fatalf("Expected %+v to fail validation", config)
+		}
+	}
+}
+
+func TestReaderTailerSendsRecordsWithNewlinesAsOneLine(test *testing.T) {
+	lengthPrefixed := &bytes.Buffer{}
+	for _, record := range []string{"first\nsecond", "third"} {
+		binary.Write(lengthPrefixed, binary.BigEndian, uint32(len(record)))
+		lengthPrefixed.WriteString(record)
+	}
+
+	inputs := map[string]io.Reader{
+		"nul":             strings.NewReader("first\nsecond\x00third\x00"),
+		"length_prefixed": lengthPrefixed,
+	}
+
+	for framing, input := range inputs {
+		quit := make(chan bool)
+		tailer := NewReaderTailer(input, "stdin", &FramingConfig{Framing: framing}, quit)
+
+		sink := &recordingSink{name: "timber"}
+		done := make(chan bool)
+		go func() {
+			forwardToSinks(tailer.Lines(), []Sink{sink}, nil, make([]*SpoolQueue, 1), 1, nil)
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			test.Fatalf("timed out forwarding %s framed records", framing)
+		}
+		close(quit)
+
+		// The receiver splits batches on newlines, which must leave every record in one piece
+		expected := `{"message":"first\nsecond"}` + "\nthird\n"
+		if sink.received() != expected {
+			test.Errorf("expected %s framed records to be sent as %q, got %q", framing, expected, sink.received())
+		}
+	}
+}
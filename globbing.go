@@ -7,11 +7,12 @@ import (
 
 const globCheckInterval = 10 * time.Second
 
-// Continually globs the given path checking for new files.
-func GlobContinually(path string, apiKey string, fileConfigChan chan *FileConfig) error {
-	logger.Infof("Discovering files for %s", path)
+// Continually globs the given path checking for new files until stop is closed. Discovered files
+// inherit the settings of the given FileConfig. A nil stop channel globs forever.
+func GlobContinually(fileConfig FileConfig, fileConfigChan chan *FileConfig, stop chan bool) error {
+	logger.Infof("Discovering files for %s", fileConfig.Path)
 
-	globState := newGlobState(path, apiKey, fileConfigChan)
+	globState := newGlobState(fileConfig, fileConfigChan)
 
 	// Perform an inital check, time.Ticket waits before it's first execution.
 	err := globState.Check()
@@ -20,26 +21,32 @@ func GlobContinually(path string, apiKey string, fileConfigChan chan *FileConfig
 	}
 
 	// Kick off the continual checking
-	tick := time.Tick(globCheckInterval)
-	return GlobWithTick(globState, tick)
+	ticker := time.NewTicker(globCheckInterval)
+	defer ticker.Stop()
+
+	return GlobWithTick(globState, ticker.C, stop)
 }
 
 // For testing purposes only.
-func GlobWithTick(globState *globState, tick <-chan time.Time) error {
-	for range tick {
-		err := globState.Check()
-		if err != nil {
-			return err
+func GlobWithTick(globState *globState, tick <-chan time.Time, stop chan bool) error {
+	for {
+		select {
+		case <-tick:
+			err := globState.Check()
+			if err != nil {
+				return err
+			}
+
+		case <-stop:
+			return nil
 		}
 	}
-
-	return nil
 }
 
-func newGlobState(path string, apiKey string, fileConfigChan chan *FileConfig) *globState {
+func newGlobState(fileConfig FileConfig, fileConfigChan chan *FileConfig) *globState {
 	return &globState{
-		path:           path,
-		apiKey:         apiKey,
+		path:           fileConfig.Path,
+		fileConfig:     fileConfig,
 		currentPaths:   map[string]bool{},
 		fileConfigChan: fileConfigChan,
 		checkCount:     int64(0),
@@ -48,7 +55,7 @@ func newGlobState(path string, apiKey string, fileConfigChan chan *FileConfig) *
 
 type globState struct {
 	path           string
-	apiKey         string
+	fileConfig     FileConfig
 	currentPaths   map[string]bool
 	fileConfigChan chan *FileConfig
 	checkCount     int64
@@ -75,11 +82,12 @@ func (g *globState) Check() error {
 			logger.Infof("Discovered new file from %s -> %s", g.path, path)
 
 			g.currentPaths[path] = true
-			newFileConfig := &FileConfig{
-				Path:   path,
-				ApiKey: g.apiKey,
-			}
-			g.fileConfigChan <- newFileConfig
+			// Discovered files share the settings of the configured glob
+			newFileConfig := g.fileConfig
+			newFileConfig.Path = path
+			newFileConfig.glob = g.path
+			newFileConfig.discoveredLater = g.checkCount > 0
+			g.fileConfigChan <- &newFileConfig
 		}
 	}
 
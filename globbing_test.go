@@ -17,12 +17,12 @@ func TestGlobbingDiscoversNewFiles(test *testing.T) {
 	globFilePath := fmt.Sprintf("%s/*.log", testFilesDirPath)
 	apiKey := "apikey"
 	fileConfigsChan := make(chan *FileConfig)
-	globState := newGlobState(globFilePath, apiKey, fileConfigsChan)
+	globState := newGlobState(FileConfig{Path: globFilePath, ApiKey: apiKey}, fileConfigsChan)
 	tick := make(chan time.Time)
 
 
 	go func() {
-		err := GlobWithTick(globState, tick)
+		err := GlobWithTick(globState, tick, nil)
 		if err != nil {
 			test.Fatal(err)
 		}
@@ -41,6 +41,9 @@ func TestGlobbingDiscoversNewFiles(test *testing.T) {
 	if firstFileConfig.Path != firstFilePath {
 		test.Fatalf("Expected to receive file %s but got %s", firstFilePath, firstFileConfig.Path)
 	}
+	if firstFileConfig.discoveredLater {
+		test.Fatalf("Expected file %s to be present at the first check", firstFilePath)
+	}
 
 	// Add the second file
 	secondFilePath := fmt.Sprintf("%s/second.log", testFilesDirPath)
@@ -55,6 +58,9 @@ func TestGlobbingDiscoversNewFiles(test *testing.T) {
 	if secondFileConfig.Path != secondFilePath {
 		test.Fatalf("Expected to receive file %s but got %s", secondFilePath, secondFileConfig.Path)
 	}
+	if !secondFileConfig.discoveredLater {
+		test.Fatalf("Expected file %s to be discovered after the first check", secondFilePath)
+	}
 
 	// Cleanup
 	os.RemoveAll(testFilesDirPath)
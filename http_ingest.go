@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The largest request body accepted, larger requests are rejected with 413
+const maxHTTPIngestBodySize = 10 * 1024 * 1024
+
+// Number of lines each API key can have waiting to be batched. Requests that do not fit are rejected with 429 so that
+// clients retry once the sinks catch up.
+const httpIngestQueueSize = 10000
+
+// How long in-flight requests are given to complete when the agent stops
+const httpIngestShutdownTimeout = 10 * time.Second
+
+// How long clients are given to send the headers of a request, so that slow clients cannot hold connections open
+const httpIngestReadHeaderTimeout = 10 * time.Second
+
+// Number of API keys whose lines can be forwarded at once. Requests with other API keys are rejected with 429 until
+// the pipeline of an API key is closed for being idle.
+const maxHTTPIngestPipelines = 100
+
+// The pipeline of an API key is closed once it has not received lines for this long, after its batches are flushed
+var httpIngestPipelineIdleTimeout = 5 * time.Minute
+
+// Returned when an API key needs a pipeline while maxHTTPIngestPipelines are open
+var errTooManyHTTPIngestPipelines = errors.New("Too many API keys are sending lines, retry later")
+
+// HTTPIngestConfig Configures a listener accepting lines POSTed by applications
+type HTTPIngestConfig struct {
+	// Address to listen on, such as "127.0.0.1:8080"
+	Address string
+	// API key of requests without an Authorization header, the default API key when empty
+	ApiKey string `toml:"api_key"`
+	// API keys accepted in the Authorization header, any API key when empty
+	ApiKeys []string `toml:"api_keys"`
+	// Sinks of requests without an Authorization header, the default sinks when empty
+	Sinks []string
+	// Certificate and private key to serve HTTPS with
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// Validate returns an error if the listener cannot be started
+func (hc *HTTPIngestConfig) Validate() error {
+	if hc.Address == "" {
+		return errors.New("The HTTP ingest listener requires an address")
+	}
+
+	if (hc.CertFile == "") != (hc.KeyFile == "") {
+		return errors.New("The HTTP ingest listener requires both cert_file and key_file")
+	}
+
+	return nil
+}
+
+// acceptsApiKey returns whether requests with the API key are accepted, the empty key for requests without one. The
+// digests of the API keys are compared in constant time, so that response times do not tell how much of an API key
+// was guessed right.
+func (hc *HTTPIngestConfig) acceptsApiKey(apiKey string) bool {
+	if apiKey == "" || len(hc.ApiKeys) == 0 {
+		return true
+	}
+
+	digest := sha256.Sum256([]byte(apiKey))
+	accepted := 0
+	for _, key := range hc.ApiKeys {
+		keyDigest := sha256.Sum256([]byte(key))
+		accepted |= subtle.ConstantTimeCompare(digest[:], keyDigest[:])
+	}
+
+	return accepted == 1
+}
+
+// HTTPIngestServer Accepts newline delimited text or NDJSON POSTed to any path and forwards each line. The API key of
+// a request is read from its Authorization header, in the "Basic BASE64(API KEY)" form the Timber endpoint accepts,
+// and the lines of each API key are batched separately.
+type HTTPIngestServer struct {
+	config   HTTPIngestConfig
+	listener net.Listener
+
+	// Returns the sinks the lines of an API key are forwarded to, the empty key for requests without one
+	sinks              func(apiKey string) []Sink
+	spool              *Spool
+	batchPeriodSeconds int64
+	metadata           *sharedMetadata
+
+	lock      sync.Mutex
+	pipelines map[string]*httpIngestPipeline
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// httpIngestPipeline feeds the lines of an API key to its batchers
+type httpIngestPipeline struct {
+	sync.Mutex
+
+	source string
+	lines  chan *LogMessage
+	closed bool
+	// Set when the pipeline was closed for being idle, until its batches are flushed
+	idle bool
+	// When lines were last queued
+	used time.Time
+}
+
+// NewHTTPIngestServer Returns a *HTTPIngestServer listening on the address of config, which accepts requests once
+// ForwardHTTPIngest is called
+func NewHTTPIngestServer(config HTTPIngestConfig) (*HTTPIngestServer, error) {
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for HTTP requests on %s: %s", config.Address, err)
+	}
+
+	if config.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("Unable to load the certificate of the HTTP ingest listener: %s", err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{certificate}})
+	}
+
+	return &HTTPIngestServer{
+		config:    config,
+		listener:  listener,
+		pipelines: make(map[string]*httpIngestPipeline),
+	}, nil
+}
+
+// Addr returns the address the server accepts requests on
+func (s *HTTPIngestServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// ServeHTTP accepts the lines of a POST request, or rejects all of them
+func (s *HTTPIngestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	code, err := s.accept(r)
+	httpIngestRequestsMetric.Inc(fmt.Sprint(code))
+
+	if code == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.WriteHeader(code)
+}
+
+// accept returns the status code to respond to the request with, and an error describing why it was rejected
+func (s *HTTPIngestServer) accept(r *http.Request) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, errors.New("Lines must be sent with POST")
+	}
+
+	apiKey, err := httpIngestApiKey(r)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+
+	if !s.config.acceptsApiKey(apiKey) {
+		return http.StatusUnauthorized, errors.New("Unknown API key")
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxHTTPIngestBodySize))
+	if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("Request bodies are limited to %d bytes", maxHTTPIngestBodySize)
+	}
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Failed to read the request body: %s", err)
+	}
+
+	lines := splitHTTPIngestLines(body)
+	if len(lines) == 0 {
+		return http.StatusAccepted, nil
+	}
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-ndjson" || mediaType == "application/ndjson" {
+		for i, line := range lines {
+			var value json.RawMessage
+			if err := json.Unmarshal(line, &value); err != nil {
+				return http.StatusBadRequest, fmt.Errorf("Line %d is not valid JSON", i+1)
+			}
+		}
+	}
+
+	if len(lines) > httpIngestQueueSize {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("Requests are limited to %d lines", httpIngestQueueSize)
+	}
+
+	pipeline, err := s.pipeline(apiKey)
+	if err == errTooManyHTTPIngestPipelines {
+		return http.StatusTooManyRequests, err
+	}
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+
+	// Only senders holding the lock add lines, so those that fit are queued without blocking
+	pipeline.Lock()
+	defer pipeline.Unlock()
+
+	if pipeline.idle {
+		return http.StatusTooManyRequests, errors.New("Lines of this API key are being flushed, retry later")
+	}
+
+	if pipeline.closed {
+		return http.StatusServiceUnavailable, errors.New("The agent is stopping")
+	}
+
+	if len(pipeline.lines)+len(lines) > cap(pipeline.lines) {
+		return http.StatusTooManyRequests, errors.New("Too many lines are waiting to be forwarded, retry later")
+	}
+
+	for _, line := range lines {
+		linesReadMetric.Inc(pipeline.source)
+		pipeline.lines <- &LogMessage{Filename: pipeline.source, Lines: line}
+	}
+	pipeline.used = time.Now()
+
+	return http.StatusAccepted, nil
+}
+
+// httpIngestApiKey returns the API key of the Authorization header of the request, or the empty string without one
+func httpIngestApiKey(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "", nil
+	}
+
+	if !strings.HasPrefix(authorization, "Basic ") {
+		return "", errors.New("The Authorization header must hold the base64 encoded API key, as in \"Basic BASE64(API KEY)\"")
+	}
+
+	apiKey, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "Basic "))
+	if err != nil || len(apiKey) == 0 {
+		return "", errors.New("The Authorization header must hold the base64 encoded API key, as in \"Basic BASE64(API KEY)\"")
+	}
+
+	return string(apiKey), nil
+}
+
+// splitHTTPIngestLines returns the non-empty lines of body, without their line endings
+func splitHTTPIngestLines(body []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines
+}
+
+// pipeline returns the pipeline of an API key, starting it on first use. Once the server is stopping, or while the
+// pipeline of the API key is flushed after being idle, the returned pipeline is closed.
+func (s *HTTPIngestServer) pipeline(apiKey string) (*httpIngestPipeline, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return &httpIngestPipeline{closed: true}, nil
+	}
+
+	if pipeline, ok := s.pipelines[apiKey]; ok {
+		return pipeline, nil
+	}
+
+	sinks := s.sinks(apiKey)
+	if len(sinks) == 0 {
+		return nil, errors.New("No API key. Please send one in the Authorization header")
+	}
+
+	if len(s.pipelines) >= maxHTTPIngestPipelines {
+		return nil, errTooManyHTTPIngestPipelines
+	}
+
+	// API keys are hashed so that they are not written to disk in the names of spool queues
+	source := "http"
+	if apiKey != "" {
+		source = fmt.Sprintf("http-%x", sha256.Sum256([]byte(apiKey)))[:13]
+	}
+
+	// Accepted lines cannot be sent again, so spooled batches are replayed
+	queues, err := openSpoolQueues(s.spool, source, sinks, true)
+	if err != nil {
+		logger.Errorf("Failed to open the spool queues of %s: %s", source, err)
+		queues = make([]*SpoolQueue, len(sinks))
+	}
+
+	pipeline := &httpIngestPipeline{source: source, lines: make(chan *LogMessage, httpIngestQueueSize), used: time.Now()}
+	s.pipelines[apiKey] = pipeline
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		forwardToSinks(pipeline.lines, sinks, nil, queues, s.batchPeriodSeconds, s.metadata)
+		linesReadMetric.Delete(source)
+
+		// The API key gets a new pipeline only once this one is flushed, since both would use the same spool queues
+		s.lock.Lock()
+		if s.pipelines[apiKey] == pipeline {
+			delete(s.pipelines, apiKey)
+		}
+		s.lock.Unlock()
+	}()
+
+	return pipeline, nil
+}
+
+// closeIdlePipelines closes the pipelines that have not received lines since idleSince
+func (s *HTTPIngestServer) closeIdlePipelines(idleSince time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, pipeline := range s.pipelines {
+		pipeline.Lock()
+		if !pipeline.closed && !pipeline.used.After(idleSince) {
+			logger.Infof("Closing %s, which received no lines since %s", pipeline.source, idleSince.Format(time.RFC3339))
+			pipeline.closed = true
+			pipeline.idle = true
+			close(pipeline.lines)
+		}
+		pipeline.Unlock()
+	}
+}
+
+// ForwardHTTPIngest forwards the lines accepted by the server until quit is closed. sinks returns the sinks the lines
+// of an API key are forwarded to, or none if the key is empty and there is no default.
+func ForwardHTTPIngest(server *HTTPIngestServer, sinks func(apiKey string) []Sink, batchPeriodSeconds int64, spool *Spool, metadata *LogEvent, quit chan bool) error {
+	logger.Infof("Starting forward for HTTP requests on %s", server.Addr())
+
+	encodedMetadata, err := metadata.EncodeJSON()
+	if err != nil {
+		logger.Error("Failed to encode additional metadata as JSON while preparing to accept HTTP requests")
+		return err
+	}
+
+	server.sinks = sinks
+	server.spool = spool
+	server.batchPeriodSeconds = batchPeriodSeconds
+	server.metadata = newSharedMetadata(encodedMetadata)
+
+	idleTimeout := httpIngestPipelineIdleTimeout
+	go func() {
+		ticker := time.NewTicker(idleTimeout / 10)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				server.closeIdlePipelines(now.Add(-idleTimeout))
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	httpServer := &http.Server{Handler: server, ReadHeaderTimeout: httpIngestReadHeaderTimeout}
+	go func() {
+		<-quit
+
+		ctx, cancel := context.WithTimeout(context.Background(), httpIngestShutdownTimeout)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+	}()
+
+	if err := httpServer.Serve(server.listener); err != http.ErrServerClosed {
+		logger.Errorf("HTTP ingest listener on %s failed: %s", server.Addr(), err)
+	}
+
+	// What accepted requests queued is flushed before returning
+	server.lock.Lock()
+	server.closed = true
+	for _, pipeline := range server.pipelines {
+		pipeline.Lock()
+		if !pipeline.closed {
+			pipeline.closed = true
+			close(pipeline.lines)
+		}
+		pipeline.Unlock()
+	}
+	server.lock.Unlock()
+
+	server.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestHTTPIngestForwardsLinesByApiKey(test *testing.T) {
+	server, err := NewHTTPIngestServer(HTTPIngestConfig{Address: "127.0.0.1:0"})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	sinks := map[string]*recordingSink{
+		"":       {name: "default"},
+		"team-a": {name: "team-a"},
+	}
+	sinksByApiKey := func(apiKey string) []Sink {
+		if sink, ok := sinks[apiKey]; ok {
+			return []Sink{sink}
+		}
+		return nil
+	}
+
+	quit := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		ForwardHTTPIngest(server, sinksByApiKey, 1, nil, NewLogEvent(), quit)
+		close(done)
+	}()
+
+	url := "http://" + server.Addr().String() + "/"
+	requests := []struct {
+		apiKey      string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"", "text/plain", "first line\r\nsecond line\n\n", http.StatusAccepted},
+		{"team-a", "application/x-ndjson", `{"message": "from team a"}` + "\n", http.StatusAccepted},
+		{"team-a", "application/x-ndjson", "not json\n", http.StatusBadRequest},
+		{"team-b", "text/plain", "no sinks for team b\n", http.StatusUnauthorized},
+	}
+
+	for _, r := range requests {
+		req, _ := http.NewRequest("POST", url, strings.NewReader(r.body))
+		req.Header.Set("Content-Type", r.contentType)
+		if r.apiKey != "" {
+			req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(r.apiKey)))
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			test.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != r.code {
+			test.Fatalf("Expected %q to be answered with %d, got %d", r.body, r.code, resp.StatusCode)
+		}
+	}
+
+	// Accepted lines are flushed when the server stops
+	close(quit)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected the server to stop")
+	}
+
+	if expected := []string{"first line\nsecond line\n"}; !reflect.DeepEqual(sinks[""].batches, expected) {
+		test.Fatalf("Expected %q to be forwarded with the default API key, got %q", expected, sinks[""].batches)
+	}
+
+	if expected := []string{`{"message": "from team a"}` + "\n"}; !reflect.DeepEqual(sinks["team-a"].batches, expected) {
+		test.Fatalf("Expected %q to be forwarded with the team-a API key, got %q", expected, sinks["team-a"].batches)
+	}
+}
+
+func TestHTTPIngestRejectsRequests(test *testing.T) {
+	server := &HTTPIngestServer{pipelines: make(map[string]*httpIngestPipeline)}
+
+	// A pipeline whose batchers do not keep up
+	saturated := &httpIngestPipeline{source: "http", lines: make(chan *LogMessage, 2)}
+	saturated.lines <- &LogMessage{Lines: []byte("waiting")}
+	server.pipelines[""] = saturated
+
+	cases := []struct {
+		method        string
+		authorization string
+		body          string
+		code          int
+	}{
+		{"GET", "", "", http.StatusMethodNotAllowed},
+		{"POST", "Bearer abc", "line\n", http.StatusUnauthorized},
+		{"POST", "", "line\n", http.StatusAccepted},
+		{"POST", "", "line\n", http.StatusTooManyRequests},
+		{"POST", "", strings.Repeat("a", maxHTTPIngestBodySize+1), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/", strings.NewReader(c.body))
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+
+		if recorder.Code != c.code {
+			test.Fatalf("Expected %s %.20q to be answered with %d, got %d", c.method, c.body, c.code, recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("POST", "/", strings.NewReader("line\n")))
+	if recorder.Header().Get("Retry-After") == "" {
+		test.Fatal("Expected a Retry-After header when the pipeline is saturated")
+	}
+
+	// A body that cannot be read is not too large
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("POST", "/", iotest.ErrReader(errors.New("connection reset"))))
+	if recorder.Code != http.StatusBadRequest {
+		test.Fatalf("Expected a body that cannot be read to be answered with 400, got %d", recorder.Code)
+	}
+}
+
+func TestHTTPIngestLimitsApiKeys(test *testing.T) {
+	server := &HTTPIngestServer{
+		config:    HTTPIngestConfig{ApiKeys: []string{"team-a"}},
+		pipelines: make(map[string]*httpIngestPipeline),
+		sinks: func(apiKey string) []Sink {
+			return []Sink{&recordingSink{name: apiKey}}
+		},
+	}
+
+	// Other API keys already have a pipeline each
+	for i := 0; i < maxHTTPIngestPipelines; i++ {
+		server.pipelines[fmt.Sprint(i)] = &httpIngestPipeline{source: "http", lines: make(chan *LogMessage, 1)}
+	}
+
+	cases := []struct {
+		apiKey string
+		code   int
+	}{
+		{"team-b", http.StatusUnauthorized},
+		{"team-a", http.StatusTooManyRequests},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("line\n"))
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.apiKey)))
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+
+		if recorder.Code != c.code {
+			test.Fatalf("Expected a request with API key %s to be answered with %d, got %d", c.apiKey, c.code, recorder.Code)
+		}
+	}
+}
+
+func TestHTTPIngestClosesIdlePipelines(test *testing.T) {
+	defaultIdleTimeout := httpIngestPipelineIdleTimeout
+	httpIngestPipelineIdleTimeout = 50 * time.Millisecond
+	defer func() { httpIngestPipelineIdleTimeout = defaultIdleTimeout }()
+
+	server, err := NewHTTPIngestServer(HTTPIngestConfig{Address: "127.0.0.1:0"})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	sink := &recordingSink{name: "team-a"}
+	quit := make(chan bool)
+	defer close(quit)
+	go ForwardHTTPIngest(server, func(string) []Sink { return []Sink{sink} }, 60, nil, NewLogEvent(), quit)
+
+	send := func(body string) {
+		req, _ := http.NewRequest("POST", "http://"+server.Addr().String()+"/", strings.NewReader(body))
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("team-a")))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			test.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted {
+			test.Fatalf("Expected %q to be accepted, got %d", body, resp.StatusCode)
+		}
+	}
+
+	// The batch is flushed when the pipeline is closed, well before the batch period ends
+	for _, body := range []string{"first\n", "second\n"} {
+		send(body)
+
+		timeout := time.After(5 * time.Second)
+		for {
+			server.lock.Lock()
+			pipelines := len(server.pipelines)
+			server.lock.Unlock()
+			if pipelines == 0 {
+				break
+			}
+
+			select {
+			case <-timeout:
+				test.Fatal("Expected the idle pipeline to be closed")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	sink.Lock()
+	defer sink.Unlock()
+	if expected := []string{"first\n", "second\n"}; !reflect.DeepEqual(sink.batches, expected) {
+		test.Fatalf("Expected %q to be forwarded, got %q", expected, sink.batches)
+	}
+}
+
+func TestHTTPIngestConfigValidate(test *testing.T) {
+	cases := []HTTPIngestConfig{
+		{},
+		{Address: ":8443", CertFile: "/etc/timber/ingest.crt"},
+	}
+
+	for _, config := range cases {
+		if err := config.Validate(); err == nil {
+			test.Fatalf("Expected %+v to fail validation", config)
+		}
+	}
+}
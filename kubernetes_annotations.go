@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Annotations on a pod that override the agent configuration for the log files of the pod's containers
+const (
+	// "true" excludes every container of the pod
+	kubernetesExcludeAnnotation = "timber.io/exclude"
+	// NAME or NAME/KEY of a secret in the pod's namespace holding the API key the pod's logs are sent with
+	kubernetesAPIKeySecretAnnotation = "timber.io/api-key-secret"
+	// Lines matching the pattern begin a new event, see MultilineConfig.StartPattern
+	kubernetesMultilinePatternAnnotation = "timber.io/multiline-pattern"
+	// Comma separated names of the containers whose logs are forwarded, the logs of other containers are not
+	kubernetesContainersAnnotation = "timber.io/containers"
+)
+
+// The key read from the secret named by the api-key-secret annotation when the annotation does not name one, which
+// is the key of the secret created when installing the agent
+const defaultKubernetesAPIKeySecretKey = "timber-api-key"
+
+// The ID the kubelet appends to container names in the /var/log/containers layout
+var kubernetesContainerID = regexp.MustCompile(`-[0-9a-f]{64}$`)
+
+// kubernetesContainerName returns the name of the container as declared in the pod
+func kubernetesContainerName(context *KubernetesContext) string {
+	return kubernetesContainerID.ReplaceAllString(context.ContainerName, "")
+}
+
+// applyAnnotationFilter returns the annotation excluding the file of the container described by context, if any
+func applyAnnotationFilter(context *KubernetesContext) (string, bool) {
+	if value, ok := context.Annotations[kubernetesExcludeAnnotation]; ok {
+		exclude, err := strconv.ParseBool(value)
+		if err != nil {
+			logger.Warnf("Ignoring annotation %s of Kubernetes Pod %s in namespace %s, %q is not a boolean",
+				kubernetesExcludeAnnotation, context.PodName, context.Namespace, value)
+		} else if exclude {
+			return kubernetesExcludeAnnotation, true
+		}
+	}
+
+	if value, ok := context.Annotations[kubernetesContainersAnnotation]; ok {
+		name := kubernetesContainerName(context)
+		for _, container := range strings.Split(value, ",") {
+			if strings.TrimSpace(container) == name {
+				return "", false
+			}
+		}
+
+		return kubernetesContainersAnnotation, true
+	}
+
+	return "", false
+}
+
+// kubernetesForwardingAnnotationsChanged reports whether annotations that change how a file is forwarded differ
+// between two contexts of the same file. The file must be forwarded again for them to apply.
+func kubernetesForwardingAnnotationsChanged(previous *KubernetesContext, current *KubernetesContext) bool {
+	for _, annotation := range []string{kubernetesAPIKeySecretAnnotation, kubernetesMultilinePatternAnnotation} {
+		if previous.Annotations[annotation] != current.Annotations[annotation] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// kubernetesAnnotationOverrides returns the API key and multiline configuration the file of the container described
+// by context is forwarded with, apiKey and multiline unless annotations on the pod override them. Annotations that
+// cannot be applied are reported and the agent configuration is used instead.
+func kubernetesAnnotationOverrides(client *KubernetesClient, context *KubernetesContext, apiKey string, multiline *MultilineConfig) (string, *MultilineConfig) {
+	if context == nil {
+		return apiKey, multiline
+	}
+
+	if secret, ok := context.Annotations[kubernetesAPIKeySecretAnnotation]; ok {
+		key, err := getKubernetesAPIKeySecret(client, context.Namespace, secret)
+		if err != nil {
+			logger.Errorf("Failed to read the API key of Kubernetes Pod %s in namespace %s from secret %s, "+
+				"using the agent's API key: %s", context.PodName, context.Namespace, secret, err)
+		} else {
+			apiKey = key
+		}
+	}
+
+	if pattern, ok := context.Annotations[kubernetesMultilinePatternAnnotation]; ok {
+		podMultiline := &MultilineConfig{StartPattern: pattern}
+		if err := podMultiline.Validate(); err != nil {
+			logger.Errorf("Ignoring annotation %s of Kubernetes Pod %s in namespace %s: %s",
+				kubernetesMultilinePatternAnnotation, context.PodName, context.Namespace, err)
+		} else {
+			multiline = podMultiline
+		}
+	}
+
+	return apiKey, multiline
+}
+
+// getKubernetesAPIKeySecret reads the API key from the secret named by the api-key-secret annotation
+func getKubernetesAPIKeySecret(client *KubernetesClient, namespace string, secret string) (string, error) {
+	if client == nil {
+		return "", fmt.Errorf("KubernetesClient is nil")
+	}
+
+	name, key := secret, defaultKubernetesAPIKeySecretKey
+	if i := strings.Index(secret, "/"); i >= 0 {
+		name, key = secret[:i], secret[i+1:]
+	}
+
+	value, err := client.GetSecretValue(namespace, name, key)
+	if err != nil {
+		return "", err
+	}
+
+	apiKey := strings.TrimSpace(value)
+	if apiKey == "" {
+		return "", fmt.Errorf("Key %s of secret %s is empty", key, name)
+	}
+
+	return apiKey, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyFilterAnnotations(test *testing.T) {
+	config := NewKubernetesConfig()
+	containerID := strings.Repeat("0123456789abcdef", 4)
+
+	cases := []struct {
+		annotations map[string]string
+		container   string
+		filter      string
+		excluded    bool
+	}{
+		{nil, "nginx", "", false},
+		{map[string]string{kubernetesExcludeAnnotation: "true"}, "nginx", "annotations:timber.io/exclude", true},
+		{map[string]string{kubernetesExcludeAnnotation: "false"}, "nginx", "", false},
+		{map[string]string{kubernetesExcludeAnnotation: "sometimes"}, "nginx", "", false},
+		{map[string]string{kubernetesContainersAnnotation: "app, nginx"}, "nginx", "", false},
+		{map[string]string{kubernetesContainersAnnotation: "app, nginx"}, "nginx-" + containerID, "", false},
+		{map[string]string{kubernetesContainersAnnotation: "app"}, "nginx-" + containerID, "annotations:timber.io/containers", true},
+	}
+
+	for _, c := range cases {
+		context := &KubernetesContext{PodName: "web-1", Namespace: "default", ContainerName: c.container, Annotations: c.annotations}
+		filter, excluded := config.ApplyFilter(context)
+
+		if filter != c.filter || excluded != c.excluded {
+			test.Fatalf("Expected container %s of pod with annotations %v to be excluded %t by %q, got %t by %q",
+				c.container, c.annotations, c.excluded, c.filter, excluded, filter)
+		}
+	}
+}
+
+func TestKubernetesAnnotationOverrides(test *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/team-a/secrets/timber":
+			// base64 of "team-a-key\n"
+			w.Write([]byte(`{"data": {"timber-api-key": "dGVhbS1hLWtleQo=", "other": "b3RoZXIta2V5"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	host, port := getHostAndPortFromURL(ts.URL)
+	client, _ := getKubernetesClientWithEnvironment(host, port)
+	defaultMultiline := &MultilineConfig{ContinuationPattern: `^\s`}
+
+	cases := []struct {
+		annotations  map[string]string
+		apiKey       string
+		startPattern string
+	}{
+		{nil, "agent-key", ""},
+		{map[string]string{kubernetesAPIKeySecretAnnotation: "timber"}, "team-a-key", ""},
+		{map[string]string{kubernetesAPIKeySecretAnnotation: "timber/other"}, "other-key", ""},
+		{map[string]string{kubernetesAPIKeySecretAnnotation: "missing"}, "agent-key", ""},
+		{map[string]string{kubernetesAPIKeySecretAnnotation: "timber/missing"}, "agent-key", ""},
+		{map[string]string{kubernetesMultilinePatternAnnotation: `^\d{4}-`}, "agent-key", `^\d{4}-`},
+		{map[string]string{kubernetesMultilinePatternAnnotation: `^(`}, "agent-key", ""},
+	}
+
+	for _, c := range cases {
+		context := &KubernetesContext{PodName: "web-1", Namespace: "team-a", Annotations: c.annotations}
+		apiKey, multiline := kubernetesAnnotationOverrides(client, context, "agent-key", defaultMultiline)
+
+		if apiKey != c.apiKey {
+			test.Fatalf("Expected API key %s for annotations %v, got %s", c.apiKey, c.annotations, apiKey)
+		}
+
+		if c.startPattern == "" && multiline != defaultMultiline {
+			test.Fatalf("Expected the agent's multiline configuration for annotations %v, got %+v", c.annotations, multiline)
+		}
+
+		if c.startPattern != "" && (multiline.StartPattern != c.startPattern || !multiline.startsEvent([]byte("2018-03-01 error"))) {
+			test.Fatalf("Expected multiline start pattern %s for annotations %v, got %+v", c.startPattern, c.annotations, multiline)
+		}
+	}
+}
+
+func TestFollowKubernetesPodStopsWhenForwardingAnnotationsChange(test *testing.T) {
+	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
+	config := NewKubernetesConfig()
+
+	cache.setPod(decodeTestPod(test, testPod("web-1", "1", `{"app": "web"}`, "")))
+	pod, _, release := cache.getPod("default", "web-1")
+	release()
+
+	fileContext := KubernetesContext{PodName: "web-1", Namespace: "default", ContainerName: "nginx"}
+	current := cache.podContext(pod, fileContext, config)
+	stop := make(chan bool)
+	updates := make(chan *LogEvent, 1)
+	quit := make(chan bool)
+	defer close(quit)
+	go followKubernetesPod(cache, config, "web-1.log", NewLogEvent(), fileContext, current, stop, updates, quit, nil)
+
+	annotated := decodeTestPod(test, testPod("web-1", "2", `{"app": "web"}`, ""))
+	annotated.Metadata.Annotations = map[string]string{kubernetesMultilinePatternAnnotation: `^\S`}
+	cache.setPod(annotated)
+
+	select {
+	case <-stop:
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected stop to be closed once the multiline pattern annotation changes")
+	}
+}
+
+func TestWaitForFilePodChange(test *testing.T) {
+	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
+	filePath := "/var/log/containers/web-1_default_nginx.log"
+
+	cache.setPod(decodeTestPod(test, testPod("web-1", "1", `{"app": "web"}`, "")))
+
+	changed := make(chan bool)
+	go func() {
+		changed <- cache.waitForFilePodChange(filePath, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// A change of the pod's status does not change its labels or annotations
+	cache.setPod(decodeTestPod(test, testPod("web-1", "2", `{"app": "web"}`, "")))
+
+	annotated := decodeTestPod(test, testPod("web-1", "3", `{"app": "web"}`, ""))
+	annotated.Metadata.Annotations = map[string]string{kubernetesExcludeAnnotation: "false"}
+	cache.setPod(annotated)
+
+	select {
+	case ok := <-changed:
+		if !ok {
+			test.Fatal("Expected the annotation change to be reported")
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected the annotation change to be reported")
+	}
+
+	go func() {
+		changed <- cache.waitForFilePodChange(filePath, nil)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cache.deletePod("default", "web-1")
+
+	select {
+	case ok := <-changed:
+		if ok {
+			test.Fatal("Expected the deletion of the pod to end waiting")
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected the deletion of the pod to end waiting")
+	}
+}
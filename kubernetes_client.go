@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where Kubernetes mounts the credentials of the service account a pod runs as
+var kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Timeout for each request made to the Kubernetes API
+const kubernetesRequestTimeout = 1 * time.Second
+
+// Service account tokens are rotated by the kubelet, so token files are read again after this long
+const kubernetesTokenRefreshInterval = 1 * time.Minute
+
+// kubernetesCredentials authenticate requests to the Kubernetes API. At most one kind of credential is used, in the
+// order of the fields.
+type kubernetesCredentials struct {
+	token     string
+	tokenFile string
+	username  string
+	password  string
+}
+
+// kubernetesTransport adds credentials to every request made to the Kubernetes API
+type kubernetesTransport struct {
+	sync.Mutex
+
+	base        http.RoundTripper
+	credentials kubernetesCredentials
+
+	// The token last read from credentials.tokenFile
+	fileToken   string
+	fileTokenAt time.Time
+}
+
+func (t *kubernetesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it was given
+	authenticated := new(http.Request)
+	*authenticated = *req
+	authenticated.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		authenticated.Header[key] = values
+	}
+
+	switch {
+	case t.credentials.token != "":
+		authenticated.Header.Set("Authorization", "Bearer "+t.credentials.token)
+
+	case t.credentials.tokenFile != "":
+		token, err := t.readTokenFile()
+		if err != nil {
+			return nil, err
+		}
+		authenticated.Header.Set("Authorization", "Bearer "+token)
+
+	case t.credentials.username != "":
+		authenticated.SetBasicAuth(t.credentials.username, t.credentials.password)
+	}
+
+	return t.base.RoundTrip(authenticated)
+}
+
+func (t *kubernetesTransport) readTokenFile() (string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.fileToken != "" && time.Since(t.fileTokenAt) < kubernetesTokenRefreshInterval {
+		return t.fileToken, nil
+	}
+
+	token, err := ioutil.ReadFile(t.credentials.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read Kubernetes token from %s: %s", t.credentials.tokenFile, err)
+	}
+
+	t.fileToken = strings.TrimSpace(string(token))
+	t.fileTokenAt = time.Now()
+
+	return t.fileToken, nil
+}
+
+// newKubernetesHTTPClient returns an HTTP client for the Kubernetes API that verifies the server with the PEM encoded
+// caData, unless it is empty, and authenticates with the given client certificate and credentials
+func newKubernetesHTTPClient(caData []byte, clientCertificate *tls.Certificate, insecure bool, credentials kubernetesCredentials) (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+
+	if len(caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.New("No valid certificates found in the Kubernetes certificate authority")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if clientCertificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*clientCertificate}
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   kubernetesRequestTimeout,
+		Transport: &kubernetesTransport{base: transport, credentials: credentials},
+	}, nil
+}
+
+// getInClusterKubernetesClient returns a client for the API server of the cluster the agent runs in, authenticated as
+// the service account of its pod
+func getInClusterKubernetesClient() (*KubernetesClient, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Could not read KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT from environment")
+	}
+
+	tokenFile := filepath.Join(kubernetesServiceAccountDir, "token")
+	if _, err := os.Stat(tokenFile); err != nil {
+		return nil, fmt.Errorf("Unable to read service account token: %s", err)
+	}
+
+	caData, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read service account certificate authority: %s", err)
+	}
+
+	httpClient, err := newKubernetesHTTPClient(caData, nil, false, kubernetesCredentials{tokenFile: tokenFile})
+	if err != nil {
+		return nil, err
+	}
+
+	return &KubernetesClient{
+		BaseEndpoint: "https://" + net.JoinHostPort(host, port),
+		HTTPClient:   httpClient,
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string            `json:"name"`
+		Cluster kubeconfigCluster `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string         `json:"name"`
+		User kubeconfigUser `json:"user"`
+	} `json:"users"`
+}
+
+type kubeconfigCluster struct {
+	Server                   string `json:"server"`
+	CertificateAuthority     string `json:"certificate-authority"`
+	CertificateAuthorityData []byte `json:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+}
+
+type kubeconfigUser struct {
+	ClientCertificate     string `json:"client-certificate"`
+	ClientCertificateData []byte `json:"client-certificate-data"`
+	ClientKey             string `json:"client-key"`
+	ClientKeyData         []byte `json:"client-key-data"`
+	Token                 string `json:"token"`
+	TokenFile             string `json:"tokenFile"`
+	Username              string `json:"username"`
+	Password              string `json:"password"`
+}
+
+// GetKubernetesClientFromKubeconfig Return a *KubernetesClient for the current context of the kubeconfig file at path,
+// for running the agent outside of the cluster. Only kubeconfig files in JSON format are supported, which
+// `kubectl config view --raw --flatten -o json` converts to.
+func GetKubernetesClientFromKubeconfig(path string) (*KubernetesClient, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read kubeconfig: %s", err)
+	}
+
+	// kubectl writes YAML, which is told apart from JSON by not being an object
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] != '{' {
+		return nil, fmt.Errorf("Kubeconfig %s is not in JSON format, convert it with "+
+			"kubectl config view --raw --flatten -o json > kubeconfig.json", path)
+	}
+
+	var config kubeconfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Unable to parse kubeconfig %s: %s", path, err)
+	}
+
+	var clusterName, userName string
+	found := false
+	for _, context := range config.Contexts {
+		if context.Name == config.CurrentContext {
+			clusterName, userName = context.Context.Cluster, context.Context.User
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("Context %q of kubeconfig %s does not exist", config.CurrentContext, path)
+	}
+
+	var cluster *kubeconfigCluster
+	for i := range config.Clusters {
+		if config.Clusters[i].Name == clusterName {
+			cluster = &config.Clusters[i].Cluster
+		}
+	}
+	if cluster == nil || cluster.Server == "" {
+		return nil, fmt.Errorf("Cluster %q of kubeconfig %s does not exist or has no server", clusterName, path)
+	}
+
+	user := kubeconfigUser{}
+	for _, u := range config.Users {
+		if u.Name == userName {
+			user = u.User
+		}
+	}
+
+	// Files referenced by a kubeconfig are relative to the kubeconfig
+	resolve := func(file string) string {
+		if file == "" || filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(filepath.Dir(path), file)
+	}
+
+	caData := cluster.CertificateAuthorityData
+	if len(caData) == 0 && cluster.CertificateAuthority != "" {
+		if caData, err = ioutil.ReadFile(resolve(cluster.CertificateAuthority)); err != nil {
+			return nil, fmt.Errorf("Unable to read certificate authority of kubeconfig %s: %s", path, err)
+		}
+	}
+
+	var clientCertificate *tls.Certificate
+	certData, keyData := user.ClientCertificateData, user.ClientKeyData
+	if len(certData) == 0 && user.ClientCertificate != "" {
+		if certData, err = ioutil.ReadFile(resolve(user.ClientCertificate)); err != nil {
+			return nil, fmt.Errorf("Unable to read client certificate of kubeconfig %s: %s", path, err)
+		}
+	}
+	if len(keyData) == 0 && user.ClientKey != "" {
+		if keyData, err = ioutil.ReadFile(resolve(user.ClientKey)); err != nil {
+			return nil, fmt.Errorf("Unable to read client key of kubeconfig %s: %s", path, err)
+		}
+	}
+	if len(certData) > 0 {
+		certificate, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client certificate in kubeconfig %s: %s", path, err)
+		}
+		clientCertificate = &certificate
+	}
+
+	credentials := kubernetesCredentials{
+		token:     user.Token,
+		tokenFile: resolve(user.TokenFile),
+		username:  user.Username,
+		password:  user.Password,
+	}
+
+	httpClient, err := newKubernetesHTTPClient(caData, clientCertificate, cluster.InsecureSkipTLSVerify, credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KubernetesClient{
+		BaseEndpoint: strings.TrimSuffix(cluster.Server, "/"),
+		HTTPClient:   httpClient,
+	}, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newKubernetesTLSServer returns an API server that only answers requests carrying the given authorization header,
+// along with its PEM encoded certificate
+func newKubernetesTLSServer(authorization string) (*httptest.Server, []byte) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != authorization {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+
+	return ts, caData
+}
+
+func TestGetKubernetesClientInCluster(test *testing.T) {
+	ts, caData := newKubernetesTLSServer("Bearer service-account-token")
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "timber-agent-serviceaccount")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "token"), []byte("service-account-token\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "ca.crt"), caData, 0600)
+
+	defaultDir := kubernetesServiceAccountDir
+	kubernetesServiceAccountDir = dir
+	defer func() { kubernetesServiceAccountDir = defaultDir }()
+
+	host, port := getHostAndPortFromURL(ts.URL)
+	os.Setenv("KUBERNETES_SERVICE_HOST", host)
+	os.Setenv("KUBERNETES_SERVICE_PORT", port)
+	defer os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	defer os.Unsetenv("KUBERNETES_SERVICE_PORT")
+
+	kubernetesClient, err := GetKubernetesClient()
+	if err != nil {
+		test.Fatalf("Expecting kubernetesClient creation to succeed, got %s", err)
+	}
+
+	if !strings.HasPrefix(kubernetesClient.BaseEndpoint, "https://") {
+		test.Fatalf("Expecting the API server to be reached over https, got %s", kubernetesClient.BaseEndpoint)
+	}
+
+	if !kubernetesClient.Available() {
+		test.Fatal("Expecting the API server to accept the service account token and certificate authority")
+	}
+}
+
+func TestGetKubernetesClientFallsBackToProxy(test *testing.T) {
+	defaultDir := kubernetesServiceAccountDir
+	kubernetesServiceAccountDir = "/does/not/exist"
+	defer func() { kubernetesServiceAccountDir = defaultDir }()
+
+	os.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+	os.Setenv("KUBERNETES_SERVICE_PORT", "443")
+	defer os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	defer os.Unsetenv("KUBERNETES_SERVICE_PORT")
+
+	kubernetesClient, err := getKubernetesClientWithEnvironment("localhost", "8001")
+	if err != nil {
+		test.Fatalf("Expecting kubernetesClient creation to succeed, got %s", err)
+	}
+
+	if kubernetesClient.BaseEndpoint != "http://localhost:8001" {
+		test.Fatalf("Expecting the proxy to be used, got %s", kubernetesClient.BaseEndpoint)
+	}
+}
+
+func TestGetKubernetesClientFromKubeconfig(test *testing.T) {
+	ts, caData := newKubernetesTLSServer("Bearer user-token")
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "timber-agent-kubeconfig")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The certificate authority is referenced relative to the kubeconfig
+	ioutil.WriteFile(filepath.Join(dir, "ca.crt"), caData, 0600)
+
+	config := map[string]interface{}{
+		"current-context": "test",
+		"contexts": []interface{}{
+			map[string]interface{}{"name": "other", "context": map[string]string{"cluster": "other", "user": "other"}},
+			map[string]interface{}{"name": "test", "context": map[string]string{"cluster": "test", "user": "test"}},
+		},
+		"clusters": []interface{}{
+			map[string]interface{}{"name": "test", "cluster": map[string]string{"server": ts.URL, "certificate-authority": "ca.crt"}},
+		},
+		"users": []interface{}{
+			map[string]interface{}{"name": "test", "user": map[string]string{"token": "user-token"}},
+		},
+	}
+	data, _ := json.Marshal(config)
+	path := filepath.Join(dir, "kubeconfig")
+	ioutil.WriteFile(path, data, 0600)
+
+	kubernetesClient, err := GetKubernetesClientFromKubeconfig(path)
+	if err != nil {
+		test.Fatalf("Expecting kubernetesClient creation to succeed, got %s", err)
+	}
+
+	if kubernetesClient.BaseEndpoint != ts.URL {
+		test.Fatalf("Expecting the server of the current context, got %s", kubernetesClient.BaseEndpoint)
+	}
+
+	if !kubernetesClient.Available() {
+		test.Fatal("Expecting the API server to accept the user token and certificate authority")
+	}
+}
+
+func TestGetKubernetesClientFromKubeconfigRequiresJSON(test *testing.T) {
+	file, err := ioutil.TempFile("", "timber-agent-kubeconfig")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("apiVersion: v1\nkind: Config\ncurrent-context: test\n")
+
+	_, err = GetKubernetesClientFromKubeconfig(file.Name())
+	if err == nil || !strings.Contains(err.Error(), "JSON") {
+		test.Fatalf("Expecting an error explaining that kubeconfig must be JSON, got %v", err)
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The file name events are forwarded under, in metadata, metrics and spool queues
+const kubernetesEventsSource = "kubernetes-events"
+
+// Annotation of the Lease recording the resource version of the last event read, so that the next agent elected
+// resumes from it
+const kubernetesEventsResourceVersionAnnotation = "timber.io/events-resource-version"
+
+// The time format of the acquire and renew times of a Lease
+const kubernetesMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// How long an agent holds the Lease without renewing it, and how long the agent forwarding events keeps forwarding
+// them while it fails to renew it. The deadline is shorter than the duration so that the agent stops before another
+// one can be elected.
+var (
+	kubernetesLeaseDuration      = 15 * time.Second
+	kubernetesLeaseRenewDeadline = 10 * time.Second
+	kubernetesLeaseRetryPeriod   = 2 * time.Second
+)
+
+// Returned when the Lease was changed by another agent since it was read
+var errKubernetesLeaseConflict = errors.New("Kubernetes Lease was changed by another agent")
+
+// KubernetesEventsConfig Configures forwarding the events of the cluster. Every agent with events enabled competes for
+// the same Lease and only the agent holding it forwards events.
+type KubernetesEventsConfig struct {
+	Enabled bool
+	// API key events are sent with, the agent's API key when empty
+	ApiKey string `toml:"api_key"`
+	// Namespace of the Lease, the namespace of the agent's service account when empty
+	LeaseNamespace string `toml:"lease_namespace"`
+	// Name of the Lease, timber-agent-events when empty
+	LeaseName string `toml:"lease_name"`
+}
+
+// leaseNamespace returns the namespace of the Lease, defaulting to the namespace the agent runs in
+func (ec *KubernetesEventsConfig) leaseNamespace() string {
+	if ec.LeaseNamespace != "" {
+		return ec.LeaseNamespace
+	}
+
+	if namespace, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "namespace")); err == nil {
+		return strings.TrimSpace(string(namespace))
+	}
+
+	return "default"
+}
+
+func (ec *KubernetesEventsConfig) leaseName() string {
+	if ec.LeaseName != "" {
+		return ec.LeaseName
+	}
+
+	return "timber-agent-events"
+}
+
+type kubernetesLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+		Annotations     map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// expired reports whether the holder of the lease failed to renew it in time
+func (l *kubernetesLease) expired(now time.Time) bool {
+	renewTime, err := time.Parse(kubernetesMicroTime, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+
+	return now.After(renewTime.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// KubernetesEvent is an event of the Kubernetes Events API
+type KubernetesEvent struct {
+	Metadata       *KubernetesMetadata `json:"metadata"`
+	InvolvedObject struct {
+		Kind      string `json:"kind"`
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+		UID       string `json:"uid"`
+		FieldPath string `json:"fieldPath"`
+	} `json:"involvedObject"`
+	Type           string `json:"type"`
+	Reason         string `json:"reason"`
+	Message        string `json:"message"`
+	Count          int    `json:"count"`
+	FirstTimestamp string `json:"firstTimestamp"`
+	LastTimestamp  string `json:"lastTimestamp"`
+	Source         struct {
+		Component string `json:"component"`
+		Host      string `json:"host"`
+	} `json:"source"`
+}
+
+// kubernetesEventLine is the JSON log line an event is forwarded as
+type kubernetesEventLine struct {
+	Type           string                    `json:"type"`
+	Reason         string                    `json:"reason"`
+	Message        string                    `json:"message"`
+	Count          int                       `json:"count,omitempty"`
+	FirstTimestamp string                    `json:"first_timestamp,omitempty"`
+	LastTimestamp  string                    `json:"last_timestamp,omitempty"`
+	Source         map[string]string         `json:"source,omitempty"`
+	InvolvedObject kubernetesEventLineObject `json:"involved_object"`
+}
+
+type kubernetesEventLineObject struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	UID       string `json:"uid,omitempty"`
+	FieldPath string `json:"field_path,omitempty"`
+}
+
+// encodeLine returns the event as a JSON log line
+func (e *KubernetesEvent) encodeLine() ([]byte, error) {
+	line := kubernetesEventLine{
+		Type:           e.Type,
+		Reason:         e.Reason,
+		Message:        e.Message,
+		Count:          e.Count,
+		FirstTimestamp: e.FirstTimestamp,
+		LastTimestamp:  e.LastTimestamp,
+		InvolvedObject: kubernetesEventLineObject{
+			Kind:      e.InvolvedObject.Kind,
+			Namespace: e.InvolvedObject.Namespace,
+			Name:      e.InvolvedObject.Name,
+			UID:       e.InvolvedObject.UID,
+			FieldPath: e.InvolvedObject.FieldPath,
+		},
+	}
+
+	if e.Source.Component != "" || e.Source.Host != "" {
+		line.Source = map[string]string{"component": e.Source.Component, "host": e.Source.Host}
+	}
+
+	return json.Marshal(line)
+}
+
+// KubernetesEventsForwarder Reads the events of the cluster while it holds the Lease electing the agent that forwards
+// them. The resource version of the last event read is recorded on the Lease when it is renewed. Events are read
+// before they are batched and delivered, so when the agent stops abruptly the events it did not deliver are lost,
+// unless their batch was written to the spool.
+type KubernetesEventsForwarder struct {
+	sync.Mutex
+
+	client    *KubernetesClient
+	identity  string
+	namespace string
+	name      string
+
+	// Resource version of the last event read, recorded on the Lease. The event may not be delivered yet.
+	resourceVersion string
+}
+
+// NewKubernetesEventsForwarder Returns a *KubernetesEventsForwarder competing for the Lease of config as identity
+func NewKubernetesEventsForwarder(client *KubernetesClient, config *KubernetesEventsConfig, identity string) *KubernetesEventsForwarder {
+	return &KubernetesEventsForwarder{
+		client:    client,
+		identity:  identity,
+		namespace: config.leaseNamespace(),
+		name:      config.leaseName(),
+	}
+}
+
+func (f *KubernetesEventsForwarder) getResourceVersion() string {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.resourceVersion
+}
+
+func (f *KubernetesEventsForwarder) setResourceVersion(resourceVersion string) {
+	f.Lock()
+	f.resourceVersion = resourceVersion
+	f.Unlock()
+}
+
+// Run Forwards events to lines while the agent holds the Lease, until quit is closed. lines is closed on return.
+func (f *KubernetesEventsForwarder) Run(lines chan *LogMessage, quit chan bool) {
+	var stop chan bool
+	var done chan struct{}
+	var renewed time.Time
+
+	for {
+		leader, err := f.tryAcquireOrRenew(time.Now(), stop != nil)
+		if err != nil {
+			logger.Warnf("Failed to acquire or renew Kubernetes Lease %s in namespace %s: %s", f.name, f.namespace, err)
+			// The agent keeps forwarding events until the renew deadline, the Lease may still be renewed in time
+			leader = stop != nil && time.Since(renewed) < kubernetesLeaseRenewDeadline
+		} else if leader {
+			renewed = time.Now()
+		}
+
+		if leader && stop == nil {
+			logger.Infof("Acquired Kubernetes Lease %s in namespace %s, forwarding Kubernetes events", f.name, f.namespace)
+			stop, done = make(chan bool), make(chan struct{})
+			go func(stop chan bool, done chan struct{}) {
+				f.watchEvents(lines, stop)
+				close(done)
+			}(stop, done)
+		}
+
+		if !leader && stop != nil {
+			logger.Infof("Lost Kubernetes Lease %s in namespace %s, no longer forwarding Kubernetes events", f.name, f.namespace)
+			close(stop)
+			<-done
+			stop = nil
+		}
+
+		select {
+		case <-quit:
+			if stop != nil {
+				close(stop)
+				<-done
+				f.release()
+			}
+			close(lines)
+			return
+		case <-time.After(kubernetesLeaseRetryPeriod):
+		}
+	}
+}
+
+// tryAcquireOrRenew creates the Lease, renews it when held by this agent or takes it over once its holder failed to
+// renew it. leading tells whether the agent is forwarding events already. Returns whether the agent holds the Lease.
+func (f *KubernetesEventsForwarder) tryAcquireOrRenew(now time.Time, leading bool) (bool, error) {
+	lease, err := f.client.getLease(f.namespace, f.name)
+	if err != nil {
+		return false, err
+	}
+
+	if lease == nil {
+		lease = &kubernetesLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name = f.name
+		lease.Metadata.Namespace = f.namespace
+		lease.Spec.HolderIdentity = f.identity
+		lease.Spec.LeaseDurationSeconds = int(kubernetesLeaseDuration / time.Second)
+		lease.Spec.AcquireTime = now.Format(kubernetesMicroTime)
+		lease.Spec.RenewTime = lease.Spec.AcquireTime
+
+		err := f.client.createLease(lease)
+		if err == errKubernetesLeaseConflict {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	if lease.Spec.HolderIdentity != f.identity {
+		if lease.Spec.HolderIdentity != "" && !lease.expired(now) {
+			return false, nil
+		}
+
+		// Resume from the last event read by the previous holder
+		f.setResourceVersion(lease.Metadata.Annotations[kubernetesEventsResourceVersionAnnotation])
+		lease.Spec.HolderIdentity = f.identity
+		lease.Spec.AcquireTime = now.Format(kubernetesMicroTime)
+		lease.Spec.LeaseTransitions++
+	} else if !leading && f.getResourceVersion() == "" {
+		// The agent held the Lease before it restarted, resume from the last event it read
+		f.setResourceVersion(lease.Metadata.Annotations[kubernetesEventsResourceVersionAnnotation])
+	}
+
+	lease.Spec.LeaseDurationSeconds = int(kubernetesLeaseDuration / time.Second)
+	lease.Spec.RenewTime = now.Format(kubernetesMicroTime)
+	f.recordResourceVersion(lease)
+
+	err = f.client.updateLease(lease)
+	if err == errKubernetesLeaseConflict {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// release records the resource version of the last event read and gives up the Lease, so that another agent does not
+// wait for it to expire
+func (f *KubernetesEventsForwarder) release() {
+	lease, err := f.client.getLease(f.namespace, f.name)
+	if err != nil || lease == nil || lease.Spec.HolderIdentity != f.identity {
+		return
+	}
+
+	lease.Spec.HolderIdentity = ""
+	f.recordResourceVersion(lease)
+
+	if err := f.client.updateLease(lease); err != nil {
+		logger.Warnf("Failed to release Kubernetes Lease %s in namespace %s: %s", f.name, f.namespace, err)
+	}
+}
+
+func (f *KubernetesEventsForwarder) recordResourceVersion(lease *kubernetesLease) {
+	resourceVersion := f.getResourceVersion()
+	if resourceVersion == "" {
+		return
+	}
+
+	if lease.Metadata.Annotations == nil {
+		lease.Metadata.Annotations = make(map[string]string)
+	}
+	lease.Metadata.Annotations[kubernetesEventsResourceVersionAnnotation] = resourceVersion
+}
+
+// watchEvents sends the events of the cluster to lines until stop is closed. Without a resource version to resume
+// from, or when it is too old, the events that already happened are not forwarded.
+func (f *KubernetesEventsForwarder) watchEvents(lines chan *LogMessage, stop chan bool) {
+	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	attempts := 0
+
+	for {
+		resourceVersion := f.getResourceVersion()
+
+		var err error
+		if resourceVersion == "" {
+			resourceVersion, err = f.client.getEventsResourceVersion()
+			if err == nil {
+				f.setResourceVersion(resourceVersion)
+			}
+		}
+
+		for err == nil {
+			attempts = 0
+			resourceVersion, err = f.watch(resourceVersion, lines, stop)
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+
+		if err == errKubernetesWatchExpired {
+			logger.Warn("Kubernetes events watch expired, events since the last event read may not be forwarded")
+			f.setResourceVersion("")
+			continue
+		}
+
+		attempts++
+		sleepDuration := kubernetesBackoff(attempts, rand)
+		logger.Warnf("Failed to watch Kubernetes events: %s. Retrying in %.f seconds.", err, sleepDuration.Seconds())
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(sleepDuration):
+		}
+	}
+}
+
+// watch sends events from resourceVersion on to lines until the API server ends the watch or stop is closed. Returns
+// the resource version to resume from.
+func (f *KubernetesEventsForwarder) watch(resourceVersion string, lines chan *LogMessage, stop chan bool) (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", fmt.Sprint(kubernetesWatchTimeoutSeconds))
+
+	req, err := http.NewRequest("GET", f.client.BaseEndpoint+"/api/v1/events?"+query.Encode(), nil)
+	if err != nil {
+		return resourceVersion, err
+	}
+
+	// The watch is a long running response, only the time to connect is limited
+	client := &http.Client{Transport: f.client.HTTPClient.Transport}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return resourceVersion, errKubernetesWatchExpired
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resourceVersion, fmt.Errorf("Watching events returned status code %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var watchEvent kubernetesWatchEvent
+		if err := decoder.Decode(&watchEvent); err != nil {
+			if ctx.Err() != nil || err == io.EOF {
+				// Ended by stop or by the API server
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+
+		if watchEvent.Type == "ERROR" {
+			var status kubernetesStatus
+			json.Unmarshal(watchEvent.Object, &status)
+			if status.Code == http.StatusGone {
+				return resourceVersion, errKubernetesWatchExpired
+			}
+			return resourceVersion, fmt.Errorf("Watching events failed: %s", status.Message)
+		}
+
+		var event KubernetesEvent
+		if err := json.Unmarshal(watchEvent.Object, &event); err != nil || event.Metadata == nil {
+			logger.Warnf("Ignoring Kubernetes event %s that could not be decoded", watchEvent.Type)
+			continue
+		}
+		resourceVersion = event.Metadata.ResourceVersion
+
+		// Events are modified when they happen again, deleted events expired
+		if watchEvent.Type == "ADDED" || watchEvent.Type == "MODIFIED" {
+			line, err := event.encodeLine()
+			if err != nil {
+				logger.Warnf("Failed to encode Kubernetes event %s: %s", event.Metadata.Name, err)
+				continue
+			}
+
+			linesReadMetric.Inc(kubernetesEventsSource)
+			// The resource version is recorded once the event is handed to the batchers, not once it is delivered
+			select {
+			case lines <- &LogMessage{Filename: kubernetesEventsSource, Lines: line}:
+			case <-stop:
+				return resourceVersion, nil
+			}
+		}
+
+		f.setResourceVersion(resourceVersion)
+	}
+}
+
+// ForwardKubernetesEvents forwards the events of the cluster to the sinks while this agent is elected to, until quit
+// is closed
+func ForwardKubernetesEvents(forwarder *KubernetesEventsForwarder, sinks []Sink, batchPeriodSeconds int64, spool *Spool, metadata *LogEvent, quit chan bool) error {
+	logger.Info("Starting forward for Kubernetes events")
+
+	encodedMetadata, err := encodeFileMetadata(metadata, kubernetesEventsSource)
+	if err != nil {
+		logger.Error("Failed to encode additional metadata as JSON while preparing to forward Kubernetes events")
+		return err
+	}
+
+	// Events cannot be read again once the resource version moved past them, so spooled batches are replayed
+	queues, err := openSpoolQueues(spool, kubernetesEventsSource, sinks, true)
+	if err != nil {
+		return err
+	}
+
+	lines := make(chan *LogMessage)
+	go forwarder.Run(lines, quit)
+
+	// Forward will block until lines is closed
+	forwardToSinks(lines, sinks, nil, queues, batchPeriodSeconds, newSharedMetadata(encodedMetadata))
+
+	return nil
+}
+
+// getEventsResourceVersion returns the current resource version of the events of the cluster, without listing them
+func (client *KubernetesClient) getEventsResourceVersion() (string, error) {
+	resp, err := client.HTTPClient.Get(client.BaseEndpoint + "/api/v1/events?limit=1")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("Listing events returned status code %d", resp.StatusCode)
+	}
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+func (client *KubernetesClient) leaseURL(namespace, name string) string {
+	return fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", client.BaseEndpoint, namespace, name)
+}
+
+// getLease returns the Lease, or nil if it does not exist
+func (client *KubernetesClient) getLease(namespace, name string) (*kubernetesLease, error) {
+	resp, err := client.HTTPClient.Get(client.leaseURL(namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Did not receive a valid response from Kubernetes API (status code %d)", resp.StatusCode)
+	}
+
+	var lease kubernetesLease
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, err
+	}
+
+	return &lease, nil
+}
+
+// createLease creates the Lease, returning errKubernetesLeaseConflict if it already exists
+func (client *KubernetesClient) createLease(lease *kubernetesLease) error {
+	url := fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", client.BaseEndpoint, lease.Metadata.Namespace)
+	return client.sendLease("POST", url, lease)
+}
+
+// updateLease replaces the Lease, returning errKubernetesLeaseConflict if it changed since it was read
+func (client *KubernetesClient) updateLease(lease *kubernetesLease) error {
+	return client.sendLease("PUT", client.leaseURL(lease.Metadata.Namespace, lease.Metadata.Name), lease)
+}
+
+func (client *KubernetesClient) sendLease(method, url string, lease *kubernetesLease) error {
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return errKubernetesLeaseConflict
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Did not receive a valid response from Kubernetes API (status code %d)", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseServer stores a single Lease the way the API server does, rejecting updates of outdated versions
+type fakeLeaseServer struct {
+	sync.Mutex
+	lease   *kubernetesLease
+	version int
+}
+
+func (s *fakeLeaseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+
+	switch r.Method {
+	case "GET":
+		if s.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(s.lease)
+
+	case "POST", "PUT":
+		var lease kubernetesLease
+		json.NewDecoder(r.Body).Decode(&lease)
+
+		if (r.Method == "POST" && s.lease != nil) ||
+			(r.Method == "PUT" && (s.lease == nil || lease.Metadata.ResourceVersion != s.lease.Metadata.ResourceVersion)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		s.version++
+		lease.Metadata.ResourceVersion = fmt.Sprint(s.version)
+		s.lease = &lease
+		json.NewEncoder(w).Encode(s.lease)
+	}
+}
+
+func (s *fakeLeaseServer) get() kubernetesLease {
+	s.Lock()
+	defer s.Unlock()
+
+	return *s.lease
+}
+
+func TestKubernetesEventsForwarderLeaderElection(test *testing.T) {
+	leases := &fakeLeaseServer{}
+	ts := httptest.NewServer(leases)
+	defer ts.Close()
+
+	host, port := getHostAndPortFromURL(ts.URL)
+	client, _ := getKubernetesClientWithEnvironment(host, port)
+	config := &KubernetesEventsConfig{LeaseNamespace: "timber"}
+	agentA := NewKubernetesEventsForwarder(client, config, "agent-a")
+	agentB := NewKubernetesEventsForwarder(client, config, "agent-b")
+	now := time.Now()
+
+	if leader, err := agentA.tryAcquireOrRenew(now, false); !leader || err != nil {
+		test.Fatalf("Expected the first agent to create the Lease, got %t %v", leader, err)
+	}
+
+	agentA.setResourceVersion("42")
+	if leader, err := agentA.tryAcquireOrRenew(now.Add(time.Second), true); !leader || err != nil {
+		test.Fatalf("Expected the holder to renew the Lease, got %t %v", leader, err)
+	}
+
+	if leader, err := agentB.tryAcquireOrRenew(now.Add(2*time.Second), false); leader || err != nil {
+		test.Fatalf("Expected the Lease to be held by the first agent, got %t %v", leader, err)
+	}
+
+	// The first agent stops renewing the Lease
+	if leader, err := agentB.tryAcquireOrRenew(now.Add(time.Minute), false); !leader || err != nil {
+		test.Fatalf("Expected the expired Lease to be taken over, got %t %v", leader, err)
+	}
+
+	lease := leases.get()
+	if lease.Spec.HolderIdentity != "agent-b" || lease.Spec.LeaseTransitions != 1 {
+		test.Fatalf("Expected the Lease to be held by agent-b after one transition, got %+v", lease.Spec)
+	}
+
+	if resourceVersion := agentB.getResourceVersion(); resourceVersion != "42" {
+		test.Fatalf("Expected the new holder to resume from resource version 42, got %s", resourceVersion)
+	}
+
+	if leader, err := agentA.tryAcquireOrRenew(now.Add(time.Minute+time.Second), true); leader || err != nil {
+		test.Fatalf("Expected the previous holder to lose the Lease, got %t %v", leader, err)
+	}
+}
+
+func TestKubernetesEventsForwarderResumesAfterRestart(test *testing.T) {
+	leases := &fakeLeaseServer{}
+	ts := httptest.NewServer(leases)
+	defer ts.Close()
+
+	host, port := getHostAndPortFromURL(ts.URL)
+	client, _ := getKubernetesClientWithEnvironment(host, port)
+	config := &KubernetesEventsConfig{LeaseNamespace: "timber"}
+	now := time.Now()
+
+	agent := NewKubernetesEventsForwarder(client, config, "agent-a")
+	if leader, err := agent.tryAcquireOrRenew(now, false); !leader || err != nil {
+		test.Fatalf("Expected the agent to create the Lease, got %t %v", leader, err)
+	}
+
+	agent.setResourceVersion("42")
+	if leader, err := agent.tryAcquireOrRenew(now.Add(time.Second), true); !leader || err != nil {
+		test.Fatalf("Expected the holder to renew the Lease, got %t %v", leader, err)
+	}
+
+	// The agent restarts with the same identity before the Lease expires
+	restarted := NewKubernetesEventsForwarder(client, config, "agent-a")
+	if leader, err := restarted.tryAcquireOrRenew(now.Add(2*time.Second), false); !leader || err != nil {
+		test.Fatalf("Expected the restarted agent to renew the Lease, got %t %v", leader, err)
+	}
+
+	if resourceVersion := restarted.getResourceVersion(); resourceVersion != "42" {
+		test.Fatalf("Expected the restarted agent to resume from resource version 42, got %s", resourceVersion)
+	}
+}
+
+func TestKubernetesEventsForwarderForwardsEvents(test *testing.T) {
+	defaultRetryPeriod := kubernetesLeaseRetryPeriod
+	kubernetesLeaseRetryPeriod = 10 * time.Millisecond
+	defer func() { kubernetesLeaseRetryPeriod = defaultRetryPeriod }()
+
+	leases := &fakeLeaseServer{}
+	events := []string{
+		`{"type": "ADDED", "object": {"metadata": {"name": "web-1.1", "resourceVersion": "11"}, "type": "Warning", ` +
+			`"reason": "OOMKilling", "message": "Memory cgroup out of memory", "count": 1, ` +
+			`"involvedObject": {"kind": "Pod", "namespace": "default", "name": "web-1"}, "source": {"component": "kubelet", "host": "node-1"}}}`,
+		`{"type": "DELETED", "object": {"metadata": {"name": "web-0.1", "resourceVersion": "12"}, "reason": "Pulled"}}`,
+		`{"type": "MODIFIED", "object": {"metadata": {"name": "web-1.1", "resourceVersion": "13"}, "type": "Warning", ` +
+			`"reason": "OOMKilling", "count": 2, "involvedObject": {"kind": "Pod", "namespace": "default", "name": "web-1"}}}`,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/apis/coordination.k8s.io/") {
+			leases.ServeHTTP(w, r)
+			return
+		}
+
+		if r.URL.Query().Get("watch") == "" {
+			w.Write([]byte(`{"metadata": {"resourceVersion": "10"}, "items": []}`))
+			return
+		}
+
+		if r.URL.Query().Get("resourceVersion") != "10" {
+			<-r.Context().Done()
+			return
+		}
+
+		for _, event := range events {
+			w.Write([]byte(event + "\n"))
+		}
+	}))
+	defer ts.Close()
+
+	host, port := getHostAndPortFromURL(ts.URL)
+	client, _ := getKubernetesClientWithEnvironment(host, port)
+	forwarder := NewKubernetesEventsForwarder(client, &KubernetesEventsConfig{LeaseNamespace: "timber"}, "agent-a")
+
+	lines := make(chan *LogMessage)
+	quit := make(chan bool)
+	go forwarder.Run(lines, quit)
+
+	var received []kubernetesEventLine
+	for len(received) < 2 {
+		select {
+		case message := <-lines:
+			var line kubernetesEventLine
+			if err := json.Unmarshal(message.Lines, &line); err != nil {
+				test.Fatal(err)
+			}
+			received = append(received, line)
+		case <-time.After(5 * time.Second):
+			test.Fatalf("Expected 2 events to be forwarded, got %d", len(received))
+		}
+	}
+
+	if received[0].Reason != "OOMKilling" || received[0].InvolvedObject.Name != "web-1" || received[0].Source["host"] != "node-1" {
+		test.Fatalf("Unexpected event line %+v", received[0])
+	}
+
+	if received[1].Count != 2 {
+		test.Fatalf("Expected the modified event to be forwarded with its count, got %+v", received[1])
+	}
+
+	// The forwarder releases the Lease and records the last event read when it stops
+	close(quit)
+	for range lines {
+	}
+
+	lease := leases.get()
+	if lease.Spec.HolderIdentity != "" || lease.Metadata.Annotations[kubernetesEventsResourceVersionAnnotation] != "13" {
+		test.Fatalf("Expected the released Lease to record resource version 13, got %+v", lease)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -33,32 +35,30 @@ func (e *KubernetesLogFileParseError) Error() string {
 	return e.message
 }
 
-type KubernetesClientUnavailableError struct {
-	message string
-}
-
-func NewKubernetesClientUnavailableError(message string) *KubernetesClientUnavailableError {
-	return &KubernetesClientUnavailableError{
-		message: message,
-	}
-}
-
-func (e *KubernetesClientUnavailableError) Error() string {
-	return e.message
-}
-
 //CollectAndProcessKubernetesMetadata Abstracts all logic involved in collected and acting upon Kubernetes metadata,
-// with the goal of simplifying our main function and only exposing the necessary details.
-func CollectAndProcessKubernetesMetadata(client *KubernetesClient, config *KubernetesConfig, filepath string, metadata *LogEvent) (bool, chan bool, *LogEvent) {
-	// A *KubernetesContext is always returned
-	context, err := GetKubernetesMetadata(client, filepath)
+// with the goal of simplifying our main function and only exposing the necessary details. Pod metadata is read from
+// the cache, which is nil if no Kubernetes client could be initialized. When it is not, the pod keeps being followed:
+// the returned stop channel is closed if the pod comes to match an exclusion filter, and updated metadata is sent on
+// the returned updates channel when the pod changes, for example when its labels are updated. The pod is followed
+// until quit or done is closed, done once the file is no longer forwarded.
+func CollectAndProcessKubernetesMetadata(cache *KubernetesPodCache, config *KubernetesConfig, filepath string, metadata *LogEvent, quit chan bool, done chan bool) (bool, chan bool, *LogEvent, chan *LogEvent) {
+	fileContext := &KubernetesContext{}
+	err := GetKubernetesMetadataFromFile(filepath, fileContext)
 
 	// If we have received a KubernetesLogFileParseError, we were and will be unable to retrieve any new metadata and
 	// should ship the logs with our existing metadata
 	_, ok := err.(*KubernetesLogFileParseError)
 	if ok {
 		logger.Warnf("Failed to parse log file %s. Logs will be sent without Kubernetes fields.", filepath)
-		return true, nil, metadata
+		return true, nil, metadata, nil
+	}
+
+	// Wait briefly for the pod, the cache may still be listing pods or may not have seen a new pod yet
+	context := fileContext
+	if cache != nil {
+		if pod := cache.waitForPod(fileContext.Namespace, fileContext.PodName, kubernetesPodWaitTimeout); pod != nil {
+			context = cache.podContext(pod, *fileContext, config)
+		}
 	}
 
 	// Attempt to filter based on metadata we have collected so far
@@ -66,7 +66,7 @@ func CollectAndProcessKubernetesMetadata(client *KubernetesClient, config *Kuber
 		logger.Infof("File logs will not be forwarded due to matching an exclusion filter: %s %s",
 			filepath, filter)
 
-		return false, nil, nil
+		return false, nil, nil, nil
 	}
 
 	// By default, in Kubernetes each container has its own log file and as such, each file has its
@@ -79,76 +79,104 @@ func CollectAndProcessKubernetesMetadata(client *KubernetesClient, config *Kuber
 	metadataCopy := metadata.DeepCopy()
 	if metadataCopy == nil {
 		logger.Warnf("Failed to add Kubernetes metadata. Logs will be sent without Kubernetes fields.", filepath)
-		return true, nil, metadata
+		return true, nil, metadata, nil
 	}
 
-	// Add Kubernetes metadata we have collected to our overall metadata context. Saving a reference to this pointer
-	// will allows us to add additional Kubernetes metadata if retries are required.
+	// Add Kubernetes metadata we have collected to our overall metadata context
 	metadataCopy.AddKubernetesContext(context)
 
-	// If the client was unavailable at the time of our request, we need to retry
-	_, ok = err.(*KubernetesClientUnavailableError)
-	if ok {
-		// Create a channel to be passed to listers. The only channel event will be a close, that will indicate the
-		// log source has matched an exclusion filter, and should no longer be forwarded.
-		stop := make(chan bool)
+	// Without a client there is nothing more to learn about the pod
+	if cache == nil {
+		return true, nil, metadataCopy, nil
+	}
+
+	// Create a channel to be passed to listers. The only channel event will be a close, that will indicate the
+	// log source has matched an exclusion filter, and should no longer be forwarded.
+	stop := make(chan bool)
+	updates := make(chan *LogEvent, 1)
 
-		// Start a backgroud task to continually query the Kubernetes API with exponential backoff
-		go func() {
-			// We are using exponential backoff with jitter to avoid a stampede
-			// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
-			rand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	go followKubernetesPod(cache, config, filepath, metadata, *fileContext, context, stop, updates, quit, done)
+
+	// Return references to be used by listeners
+	return true, stop, metadataCopy, updates
+}
+
+// followKubernetesPod applies changes of the pod of a container log file until the pod is deleted, matches an
+// exclusion filter, or matches a different route or changes annotations that configure how the file is forwarded. stop is closed in the latter two
+// cases. Only the latest metadata is kept on updates, earlier metadata that was not received yet is outdated. Returns
+// once quit or done is closed as well.
+func followKubernetesPod(cache *KubernetesPodCache, config *KubernetesConfig, filepath string, metadata *LogEvent, fileContext KubernetesContext, current *KubernetesContext, stop chan bool, updates chan *LogEvent, quit chan bool, done chan bool) {
+	seen := false
+
+	for {
+		pod, changed, release := cache.getPod(fileContext.Namespace, fileContext.PodName)
+		if pod == nil && seen {
+			// The pod was deleted, its metadata will not change anymore
+			release()
+			return
+		}
 
-			// Blocks until error or success
-			client.GetMetadataFromAPIWithBackoff(context, rand)
+		if pod != nil {
+			seen = true
+			context := cache.podContext(pod, fileContext, config)
 
-			// We attempt to filter again as we may have retrieved new Kubernetes metadata that matches a configured
-			// exclusion filter
+			// We attempt to filter again as the pod may now match a configured exclusion filter
 			if filter, ok := config.ApplyFilter(context); ok {
 				logger.Infof("File logs will not be forwarded due to matching an exclusion filter: %s %s",
 					filepath, filter)
 
 				// Inform listeners that this file should no longer be forwarded
+				release()
 				close(stop)
+				return
 			}
-		}()
 
-		// Return references to be used by listeners
-		return true, stop, metadataCopy
-	}
+			if kubernetesForwardingAnnotationsChanged(current, context) || config.Route(current) != config.Route(context) {
+				logger.Infof("Kubernetes Pod %s in namespace %s now matches a different route or annotations, "+
+					"%s will be forwarded again", context.PodName, context.Namespace, filepath)
 
-	// If we have reached this point, we have either encountered no errors or an error that we do not have specific
-	// logic for handing. In either case we return what we have.
-	return true, nil, metadataCopy
-}
-
-//GetKubernetesMetadata Retrieves as much Kubernetes metadata as possible from both the filepath and the API. Always
-// returns a *KubernetesContext which may or may not be empty.
-func GetKubernetesMetadata(client *KubernetesClient, filepath string) (*KubernetesContext, error) {
-	context := &KubernetesContext{}
-
-	err := GetKubernetesMetadataFromFile(filepath, context)
-	if err != nil {
-		return context, err
-	}
+				// Listeners forward the file again once stopped, with the new route and annotations applied
+				release()
+				close(stop)
+				return
+			}
 
-	// If the *KubernetesClient fails to be allocated, the returned value is nil. We check here since our client is
-	// initialized in the global scope, and we can collect some metadata without it.
-	if client == nil {
-		return context, errors.New("KubernetesClient is nil")
-	}
+			if !reflect.DeepEqual(context, current) {
+				if update := metadata.DeepCopy(); update != nil {
+					logger.Infof("Updated Kubernetes metadata for %s", filepath)
+					update.AddKubernetesContext(context)
+					current = context
+
+					select {
+					case <-updates:
+					default:
+					}
+					updates <- update
+				}
+			}
+		}
 
-	err = client.GetMetadataFromAPI(context)
-	if err != nil {
-		return context, err
+		select {
+		case <-changed:
+			release()
+		case <-quit:
+			release()
+			return
+		case <-done:
+			release()
+			return
+		}
 	}
-
-	return context, nil
 }
 
 //GetKubernetesMetadataFromFile Given a filePath, the given *KubernetesContext will be updated with discovered metadata.
-// The expected format of the file is /path/to/file/PODNAME_NAMESPACE_CONTAINERNAME.ext
+// The expected format of the file is either /path/to/file/PODNAME_NAMESPACE_CONTAINERNAME.ext or, as written by newer
+// kubelets, /path/to/NAMESPACE_PODNAME_PODUID/CONTAINERNAME/RESTARTCOUNT.log
 func GetKubernetesMetadataFromFile(filePath string, context *KubernetesContext) error {
+	if getKubernetesMetadataFromPodsPath(filePath, context) {
+		return nil
+	}
+
 	fileName := strings.TrimSuffix(path.Base(filePath), path.Ext(filePath))
 	parts := strings.Split(fileName, "_")
 
@@ -165,8 +193,49 @@ func GetKubernetesMetadataFromFile(filePath string, context *KubernetesContext)
 	return nil
 }
 
-//GetKubernetesClient Return a *KubernetesClient, or nil if an error is encountered
+// getKubernetesMetadataFromPodsPath updates context from a path in the /var/log/pods layout, returning false if the
+// path is in another layout
+func getKubernetesMetadataFromPodsPath(filePath string, context *KubernetesContext) bool {
+	if path.Ext(filePath) != ".log" {
+		return false
+	}
+
+	restartCount, err := strconv.Atoi(strings.TrimSuffix(path.Base(filePath), ".log"))
+	if err != nil || restartCount < 0 {
+		return false
+	}
+
+	containerDir := path.Dir(filePath)
+	parts := strings.Split(path.Base(path.Dir(containerDir)), "_")
+	if len(parts) != 3 {
+		return false
+	}
+
+	context.Namespace = parts[0]
+	context.PodName = parts[1]
+	context.PodUID = parts[2]
+	context.ContainerName = path.Base(containerDir)
+	context.RestartCount = restartCount
+
+	return true
+}
+
+//GetKubernetesClient Return a *KubernetesClient, or nil if an error is encountered. When running in a pod, the client
+// talks to the API server directly using the pod's service account. Otherwise a kubectl proxy reachable through
+// TIMBER_AGENT_PROXY_SERVICE_HOST and TIMBER_AGENT_PROXY_SERVICE_PORT is used.
 func GetKubernetesClient() (*KubernetesClient, error) {
+	kubernetesClient, err := getInClusterKubernetesClient()
+	if err == nil {
+		logger.Infof("Using in-cluster Kubernetes API at %s", kubernetesClient.BaseEndpoint)
+		return kubernetesClient, nil
+	}
+	logger.Debugf("Not using in-cluster Kubernetes credentials: %s", err)
+
+	return getProxyKubernetesClient()
+}
+
+// getProxyKubernetesClient returns a client for a kubectl proxy, which authenticates requests on behalf of the agent
+func getProxyKubernetesClient() (*KubernetesClient, error) {
 	host := os.Getenv("TIMBER_AGENT_PROXY_SERVICE_HOST")
 	if host == "" {
 		return nil, errors.New("Could not read TIMBER_AGENT_PROXY_SERVICE_HOST from environment")
@@ -189,35 +258,6 @@ func GetKubernetesClient() (*KubernetesClient, error) {
 	return kubernetesClient, nil
 }
 
-//GetMetadataFromAPI The given *KubernetesContext will be updated with metadata discovered from the API.
-func (client *KubernetesClient) GetMetadataFromAPI(context *KubernetesContext) error {
-	if !client.Available() {
-		return NewKubernetesClientUnavailableError("Kubernetes API is unavailable")
-	}
-
-	// Query api to collect addtional metadata
-	labels, err := client.getPodLabels(context.Namespace, context.PodName)
-	if err != nil {
-		logger.Warnf("Failed to retrieve labels for Kubernetes Pod %s in namespace %s", context.PodName,
-			context.Namespace)
-	} else {
-		logger.Infof("Retrieved labels for Kubernetes Pod %s in namespace %s", context.PodName, context.Namespace)
-		context.Labels = labels
-	}
-
-	owner, err := client.getPodRootOwner(context.Namespace, context.PodName)
-	if err != nil {
-		logger.Warnf("Failed to retrieve root owner for Kubernetes Pod %s in namespace %s", context.PodName,
-			context.Namespace)
-	} else {
-		logger.Infof("Retrieved root owner for Kubernetes Pod %s in namespace %s", context.PodName,
-			context.Namespace)
-		context.RootOwner = owner
-	}
-
-	return nil
-}
-
 //Available Returns true if the configured Kubernetes API base URL returns a success, false otherwise
 func (client *KubernetesClient) Available() bool {
 	resp, err := client.HTTPClient.Get(client.BaseEndpoint + "/healthz")
@@ -233,49 +273,82 @@ func (client *KubernetesClient) Available() bool {
 	return true
 }
 
-//GetMetadataFromAPIWithBackoff Queries the Kubernetes API for metadata and if available updates the *KubernetesContext.
-// If the API is unavailable, retries are performed with exponential backoff.
-func (client *KubernetesClient) GetMetadataFromAPIWithBackoff(context *KubernetesContext, rand *rand.Rand) {
-	// sleepLimit tracks the maximum amount of time to sleep in seconds
-	sleepLimit := 0.0
+// kubernetesBackoff returns how long to wait before retrying a request to the Kubernetes API that failed attempts
+// times in a row. rand is used to provide jitter in order to avoid an API stampede.
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+func kubernetesBackoff(attempts int, rand *rand.Rand) time.Duration {
+	// We want to cap request retries at ~10 minutes. Since we are
+	// exponentially backing off with steps of 2^x, our values around
+	// 10 minutes are 512 seconds and 1024 seconds. In this case we
+	// opt to use the lesser value of 512 as our limit, since 1024
+	// seconds (~17 minutes) is well past our desired maximum. This
+	// also means that at most, retries will be between ~4 and ~8
+	// minutes.
+	// 2^8 seconds == 512 seconds == 8.53 minutes
+	// 2^9 seconds == 1024 seconds == 17.07 minutes
+	sleepLimit := math.Min(math.Pow(2, float64(attempts)), 512)
+
+	// Calculate time to sleep with jitter
+	sleepDuration := sleepLimit/2 + (rand.Float64()*sleepLimit)/2
+
+	return time.Duration(sleepDuration * float64(time.Second))
+}
 
-	// Initialize number of attempts we have made against the API
-	attempts := 0
+type KubernetesSecret struct {
+	Data map[string][]byte `json:"data"`
+}
 
-	for {
-		err := client.GetMetadataFromAPI(context)
-		switch err.(type) {
-		case *KubernetesClientUnavailableError:
-			// If client is still unavailable, backoff and try again
-			// rand is used to provide jitter in order to avoid an API stampede.
-			// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
-			attempts++
-
-			// We want to cap request retries at ~10 minutes. Since we are
-			// exponentially backing off with steps of 2^x, our values around
-			// 10 minutes are 512 seconds and 1024 seconds. In this case we
-			// opt to use the lesser value of 512 as our limit, since 1024
-			// seconds (~17 minutes) is well past our desired maximum. This
-			// also means that at most, retries will be between ~4 and ~8
-			// minutes.
-			// 2^8 seconds == 512 seconds == 8.53 minutes
-			// 2^9 seconds == 1024 seconds == 17.07 minutes
-			if sleepLimit < 512 {
-				sleepLimit = math.Pow(2, float64(attempts))
-			}
+//GetSecretValue Returns the value of key in the given secret
+func (client *KubernetesClient) GetSecretValue(namespace, name, key string) (string, error) {
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/secrets/%s", client.BaseEndpoint, namespace, name)
+
+	resp, err := client.HTTPClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
 
-			// Calculate time to sleep with jitter
-			sleepDuration := sleepLimit/2 + (rand.Float64()*sleepLimit)/2
-			logger.Warnf("Failed to get metadata for container %s in pod %s in namespace %s. Retrying in %.f seconds.",
-				context.ContainerName, context.PodName, context.Namespace, sleepDuration)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("Did not receive a valid response from Kubernetes API (status code %d)", resp.StatusCode)
+	}
 
-			// time.Duration defaults to nanoseconds, so we multiply by seconds factor
-			time.Sleep(time.Duration(sleepDuration) * time.Second)
-		default:
-			// We have succeeded or received a different error and no longer retry
-			return
-		}
+	var secret KubernetesSecret
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("Secret %s has no key %s", name, key)
 	}
+
+	return string(value), nil
+}
+
+//GetNodeLabels Returns the labels of the given node
+func (client *KubernetesClient) GetNodeLabels(name string) (map[string]string, error) {
+	url := fmt.Sprintf("%s/api/v1/nodes/%s", client.BaseEndpoint, name)
+
+	resp, err := client.HTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Did not receive a valid response from Kubernetes API (status code %d)", resp.StatusCode)
+	}
+
+	var kr KubernetesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&kr); err != nil {
+		return nil, err
+	}
+
+	if kr.Metadata == nil {
+		return nil, nil
+	}
+
+	return kr.Metadata.Labels, nil
 }
 
 type KubernetesResponse struct {
@@ -291,6 +364,11 @@ type KubernetesOwnerReference struct {
 type KubernetesMetadata struct {
 	Labels          map[string]string           `json:"labels"`
 	OwnerReferences []*KubernetesOwnerReference `json:"ownerReferences,omitempty"`
+	Annotations     map[string]string           `json:"annotations,omitempty"`
+	Name            string                      `json:"name,omitempty"`
+	Namespace       string                      `json:"namespace,omitempty"`
+	UID             string                      `json:"uid,omitempty"`
+	ResourceVersion string                      `json:"resourceVersion,omitempty"`
 }
 
 //GetPodMetadata Returns *KubernetesResponse for given pod
@@ -339,21 +417,8 @@ func (client *KubernetesClient) GetMetadataWithAPIVersion(namespace, kind, name,
 	return &kr, nil
 }
 
-func (client *KubernetesClient) getPodLabels(namespace, name string) (map[string]string, error) {
-	kr, err := client.GetPodMetadata(namespace, name)
-	if err != nil {
-		return nil, err
-	}
-
-	return kr.Metadata.Labels, nil
-}
-
-// getPodRootOwner attempts to retrieve the top level or root owner from all directly reachable owners of the given pod
-// by following ownerReferences found in metadata returned by the Kubernetes API.
-func (client *KubernetesClient) getPodRootOwner(namespace, name string) (map[string]string, error) {
-	var apiVersion = "v1"
-	var kind = "pod"
-
+// getRootOwner follows ownerReferences from the given resource until a resource without owners is found
+func (client *KubernetesClient) getRootOwner(namespace, kind, name, apiVersion string) (map[string]string, error) {
 	for {
 		kr, err := client.GetMetadataWithAPIVersion(namespace, kind, name, apiVersion)
 		if err != nil {
@@ -184,73 +184,6 @@ func TestKubernetesClientAvailableFalse(test *testing.T) {
 	}
 }
 
-// AddKubernetesMetadata()
-// When file path is not in the expected form, no metadata should be added.
-func TestAddKubernetesMetadataBadFilePath(test *testing.T) {
-	// filePath is bad because it does not match expected format of /path/PODNAME_NAMESPACE_CONTAINERNAME.ext
-	filePath := "/known/to/be/bad-file-path.log"
-
-	kubernetesClient, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
-	kubernetesContext, err := GetKubernetesMetadata(kubernetesClient, filePath)
-
-	if _, ok := err.(*KubernetesLogFileParseError); !ok {
-		test.Fatal("Expected err not to be nil and of type *KubernetesLogFileParseError")
-	}
-
-	if !cmp.Equal(kubernetesContext, &KubernetesContext{}) {
-		test.Fatal("Expected *KubernetesContext to be empty")
-	}
-}
-
-// AddKubernetesMetadata()
-// When file path is in the expected form, some metadata should be collected.
-func TestAddKubernetesMetadataGoodFilePathClientAvailable(test *testing.T) {
-	filePath := "/known/to/be/good_file_path.log"
-
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-	}))
-
-	host, port := getHostAndPortFromURL(ts.URL)
-	kubernetesClient, _ := getKubernetesClientWithEnvironment(host, port)
-	kubernetesContext, err := GetKubernetesMetadata(kubernetesClient, filePath)
-
-	expected := &KubernetesContext{
-		ContainerName: "path",
-		Namespace:     "file",
-		PodName:       "good",
-	}
-
-	if err != nil {
-		test.Fatal("Expected err to be nil")
-	}
-
-	if !cmp.Equal(kubernetesContext, expected) {
-		test.Fatalf("Expected %s, got %s", expected, kubernetesContext)
-	}
-}
-
-func TestAddKubernetesMetadataGoodFilePathClientUnavailable(test *testing.T) {
-	filePath := "/known/to/be/good_file_path.log"
-
-	kubernetesClient, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
-	kubernetesContext, err := GetKubernetesMetadata(kubernetesClient, filePath)
-
-	expected := &KubernetesContext{
-		ContainerName: "path",
-		Namespace:     "file",
-		PodName:       "good",
-	}
-
-	if _, ok := err.(*KubernetesClientUnavailableError); !ok {
-		test.Fatal("Expected err not to be nil and of type *KubernetesLogFileParseError")
-	}
-
-	if !cmp.Equal(kubernetesContext, expected) {
-		test.Fatalf("Expected %s, got %s", expected, kubernetesContext)
-	}
-}
-
 // JSON fixtures for testing KubernetesClient.GetMetadata and AddKubernetesMetadata
 var DaemonSetMetadataJSON = `{
 	"name": "daemonset-name",
@@ -435,8 +368,8 @@ func TestKubernetesClientGetMetadatWithAPIVersionaUnknown(test *testing.T) {
 	}
 }
 
-// AddKubernetesMetadata()
-// When a Pod has a single ownerReference in its metadata, that owner should be added to the KubernetesContext
+// getRootOwner()
+// When a Pod has a single ownerReference in its metadata, that owner should be its root owner
 func TestAddKubernetesMetadataPodWithOwner(test *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		podURL := "/api/v1/namespaces/namespace/pods/pod-name"
@@ -454,32 +387,25 @@ func TestAddKubernetesMetadataPodWithOwner(test *testing.T) {
 		}
 	}))
 
-	filePath := "/var/log/containers/pod-name_namespace_container-name.log"
 	host, port := getHostAndPortFromURL(ts.URL)
 	kubernetesClient, _ := getKubernetesClientWithEnvironment(host, port)
-	kubernetesContext, _ := GetKubernetesMetadata(kubernetesClient, filePath)
+	rootOwner, err := kubernetesClient.getRootOwner("namespace", "pod", "pod-name", "v1")
+	if err != nil {
+		test.Fatal(err)
+	}
 
-	expected := &KubernetesContext{
-		ContainerName: "container-name",
-		Namespace:     "namespace",
-		PodName:       "pod-name",
-		RootOwner: map[string]string{
-			"kind": "ReplicaSet",
-			"name": "replicaset-name",
-		},
-		Labels: map[string]string{
-			"name": "pod-name",
-		},
+	expected := map[string]string{
+		"kind": "ReplicaSet",
+		"name": "replicaset-name",
 	}
 
-	if !cmp.Equal(expected, kubernetesContext) {
-		test.Fatalf("Expected logEvent.Context.Platform.KubernetesContext to be %s, got %s",
-			expected, kubernetesContext)
+	if !cmp.Equal(expected, rootOwner) {
+		test.Fatalf("Expected root owner to be %v, got %v", expected, rootOwner)
 	}
 }
 
-// AddKubernetesMetadta()
-// When a Pod has a multiple ownerReferences in its metadata, only the root owner should be added to the KubernetesContext
+// getRootOwner()
+// When a Pod has a chain of ownerReferences in its metadata, the last owner should be its root owner
 func TestAddKubernetesMetadataPodWithOwners(test *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		podURL := "/api/v1/namespaces/namespace/pods/pod-name"
@@ -501,45 +427,41 @@ func TestAddKubernetesMetadataPodWithOwners(test *testing.T) {
 		}
 	}))
 
-	filePath := "/var/log/containers/pod-name_namespace_container-name.log"
 	host, port := getHostAndPortFromURL(ts.URL)
 	kubernetesClient, _ := getKubernetesClientWithEnvironment(host, port)
-	kubernetesContext, _ := GetKubernetesMetadata(kubernetesClient, filePath)
+	rootOwner, err := kubernetesClient.getRootOwner("namespace", "pod", "pod-name", "v1")
+	if err != nil {
+		test.Fatal(err)
+	}
 
-	expected := &KubernetesContext{
-		ContainerName: "container-name",
-		Namespace:     "namespace",
-		PodName:       "pod-name",
-		RootOwner: map[string]string{
-			"kind": "Deployment",
-			"name": "deployment-name",
-		},
-		Labels: map[string]string{
-			"name": "pod-name",
-		},
+	expected := map[string]string{
+		"kind": "Deployment",
+		"name": "deployment-name",
 	}
 
-	if !cmp.Equal(expected, kubernetesContext) {
-		test.Fatalf("Expected logEvent.Context.Platform.KubernetesContext to be %s, got %s",
-			expected, kubernetesContext)
+	if !cmp.Equal(expected, rootOwner) {
+		test.Fatalf("Expected root owner to be %v, got %v", expected, rootOwner)
 	}
 }
 
 func TestCollectAndProcessKubernetesMetadataBadFilePath(test *testing.T) {
 	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
 	config := NewKubernetesConfig()
 	filePath := "/known/to/be/bad-file-path.log"
 
 	metadata := NewLogEvent()
 
-	forwardFile, stop, currentMetadata := CollectAndProcessKubernetesMetadata(client, config, filePath, metadata)
+	quit := make(chan bool)
+	defer close(quit)
+	forwardFile, stop, currentMetadata, updates := CollectAndProcessKubernetesMetadata(cache, config, filePath, metadata, quit, nil)
 
 	if !forwardFile {
 		test.Fatal("Expected forwardFile to be true")
 	}
 
-	if stop != nil {
-		test.Fatal("Expected stop channel to be an initialized channel")
+	if stop != nil || updates != nil {
+		test.Fatal("Expected stop and updates channels to be nil")
 	}
 
 	if metadata != currentMetadata {
@@ -548,7 +470,10 @@ func TestCollectAndProcessKubernetesMetadataBadFilePath(test *testing.T) {
 }
 
 func TestCollectAndProcessKubernetesMetadataMatchingFilter(test *testing.T) {
+	defer setKubernetesPodWaitTimeout(10 * time.Millisecond)()
+
 	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
 	filePath := "/known/to/be/good_file_path.log"
 
 	config := NewKubernetesConfig()
@@ -558,14 +483,16 @@ func TestCollectAndProcessKubernetesMetadataMatchingFilter(test *testing.T) {
 
 	metadata := NewLogEvent()
 
-	forwardFile, stop, currentMetadata := CollectAndProcessKubernetesMetadata(client, config, filePath, metadata)
+	quit := make(chan bool)
+	defer close(quit)
+	forwardFile, stop, currentMetadata, updates := CollectAndProcessKubernetesMetadata(cache, config, filePath, metadata, quit, nil)
 
 	if forwardFile {
 		test.Fatal("Expected forwardFile to be false")
 	}
 
-	if stop != nil {
-		test.Fatal("Expected stop channel to be nil")
+	if stop != nil || updates != nil {
+		test.Fatal("Expected stop and updates channels to be nil")
 	}
 
 	if currentMetadata != nil {
@@ -574,22 +501,28 @@ func TestCollectAndProcessKubernetesMetadataMatchingFilter(test *testing.T) {
 }
 
 func TestCollectAndProcessKubernetesMetadataClientUnavailable(test *testing.T) {
+	defer setKubernetesPodWaitTimeout(10 * time.Millisecond)()
+
 	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
 	config := NewKubernetesConfig()
 	filePath := "/known/to/be/good_file_path.log"
 
-	context, _ := GetKubernetesMetadata(client, filePath)
+	context := &KubernetesContext{}
+	GetKubernetesMetadataFromFile(filePath, context)
 	metadata := NewLogEvent()
 	metadata.AddKubernetesContext(context)
 
-	forwardFile, stop, currentMetadata := CollectAndProcessKubernetesMetadata(client, config, filePath, metadata)
+	quit := make(chan bool)
+	defer close(quit)
+	forwardFile, stop, currentMetadata, updates := CollectAndProcessKubernetesMetadata(cache, config, filePath, metadata, quit, nil)
 
 	if !forwardFile {
 		test.Fatal("Expected forwardFile to be true")
 	}
 
-	if stop == nil {
-		test.Fatal("Expected stop channel to be an initialized channel")
+	if stop == nil || updates == nil {
+		test.Fatal("Expected stop and updates channels to be initialized channels")
 	}
 
 	if metadata == currentMetadata {
@@ -597,29 +530,32 @@ func TestCollectAndProcessKubernetesMetadataClientUnavailable(test *testing.T) {
 	}
 
 	if !cmp.Equal(metadata, currentMetadata) {
-		test.Fatalf("Execpted metadata to equal %s, got %s", metadata, currentMetadata)
+		test.Fatalf("Execpted metadata to equal %v, got %v", metadata, currentMetadata)
 	}
 
 }
 
 func TestCollectAndProcessKubernetesMetadataClientUninitialized(test *testing.T) {
-	// kubernetesClient should be nil here
-	client, _ := GetKubernetesClient()
+	// No cache is created without a client
+	var cache *KubernetesPodCache
 	config := NewKubernetesConfig()
 	filePath := "/known/to/be/good_file_path.log"
 
-	context, _ := GetKubernetesMetadata(client, filePath)
+	context := &KubernetesContext{}
+	GetKubernetesMetadataFromFile(filePath, context)
 	metadata := NewLogEvent()
 	metadata.AddKubernetesContext(context)
 
-	forwardFile, stop, currentMetadata := CollectAndProcessKubernetesMetadata(client, config, filePath, metadata)
+	quit := make(chan bool)
+	defer close(quit)
+	forwardFile, stop, currentMetadata, updates := CollectAndProcessKubernetesMetadata(cache, config, filePath, metadata, quit, nil)
 
 	if !forwardFile {
 		test.Fatal("Expected forwardFile to be true")
 	}
 
-	if stop != nil {
-		test.Fatal("Expected stop channel to be nil")
+	if stop != nil || updates != nil {
+		test.Fatal("Expected stop and updates channels to be nil")
 	}
 
 	if metadata == currentMetadata {
@@ -627,49 +563,94 @@ func TestCollectAndProcessKubernetesMetadataClientUninitialized(test *testing.T)
 	}
 
 	if !cmp.Equal(metadata, currentMetadata) {
-		test.Fatalf("Execpted metadata to equal %s, got %s", metadata, currentMetadata)
+		test.Fatalf("Execpted metadata to equal %v, got %v", metadata, currentMetadata)
 	}
 }
 
 func TestCollectAndProcessKubernetesMetadataClientAvailable(test *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		podURL := "/api/v1/namespaces/test-namespace/pods/pod-name"
+		if r.URL.Path != "/api/v1/pods" {
+			test.Errorf("Expected only pods to be requested, got %s", r.RequestURI)
+		}
 
 		w.WriteHeader(200)
-		switch r.RequestURI {
-		case "/healthz":
-		case podURL:
-			w.Write([]byte(PodMetadataWithoutOwnerJSON))
-		default:
-			test.Fatalf("Expected request URI to match %s or %s, but got %s",
-				podURL, "/", r.RequestURI)
-		}
+		w.Write([]byte(`{"metadata": {"resourceVersion": "1"}, "items": [{"metadata": {"name": "pod-name", ` +
+			`"namespace": "test-namespace", "labels": {"name": "pod-name"}}}]}`))
 	}))
+	defer ts.Close()
 
 	host, port := getHostAndPortFromURL(ts.URL)
 	client, _ := getKubernetesClientWithEnvironment(host, port)
+	cache := NewKubernetesPodCache(client, "")
+	if _, err := cache.list(); err != nil {
+		test.Fatal(err)
+	}
+
 	config := NewKubernetesConfig()
 	filePath := "/var/log/containers/pod-name_test-namespace_container-name.log"
 
-	context, _ := GetKubernetesMetadata(client, filePath)
-	metadata := NewLogEvent()
-	metadata.AddKubernetesContext(context)
-
-	forwardFile, stop, currentMetadata := CollectAndProcessKubernetesMetadata(client, config, filePath, metadata)
+	quit := make(chan bool)
+	defer close(quit)
+	forwardFile, stop, currentMetadata, updates := CollectAndProcessKubernetesMetadata(cache, config, filePath, NewLogEvent(), quit, nil)
 
 	if !forwardFile {
 		test.Fatal("Expected forwardFile to be true")
 	}
 
-	if stop != nil {
-		test.Fatal("Expected stop channel to be nil")
+	if stop == nil || updates == nil {
+		test.Fatal("Expected stop and updates channels to be initialized channels")
 	}
 
-	if metadata == currentMetadata {
-		test.Fatal("Expected deep copy of metadata to be returned")
+	expected := &KubernetesContext{
+		ContainerName: "container-name",
+		Namespace:     "test-namespace",
+		PodName:       "pod-name",
+		Labels:        map[string]string{"name": "pod-name"},
+		RootOwner:     map[string]string{"kind": "pod", "name": "pod-name"},
 	}
 
-	if !cmp.Equal(metadata, currentMetadata) {
-		test.Fatalf("Execpted metadata to equal %s, got %s", metadata, currentMetadata)
+	kubernetesContext := currentMetadata.Context.Platform.Kubernetes
+	if !cmp.Equal(kubernetesContext, expected) {
+		test.Fatalf("Execpted Kubernetes metadata to equal %v, got %v", expected, kubernetesContext)
+	}
+}
+
+func TestGetKubernetesMetadataFromFilePodsLayout(test *testing.T) {
+	filePath := "/var/log/pods/default_web-5d8f7c9b4-x2x7k_0c8b4f5e-1d2a-4c3b-9e8f-7a6b5c4d3e2f/nginx/3.log"
+	context := &KubernetesContext{}
+
+	if err := GetKubernetesMetadataFromFile(filePath, context); err != nil {
+		test.Fatalf("Expected err to be nil, got %s", err)
+	}
+
+	expected := &KubernetesContext{
+		ContainerName: "nginx",
+		Namespace:     "default",
+		PodName:       "web-5d8f7c9b4-x2x7k",
+		PodUID:        "0c8b4f5e-1d2a-4c3b-9e8f-7a6b5c4d3e2f",
+		RestartCount:  3,
+	}
+
+	if !cmp.Equal(context, expected) {
+		test.Fatalf("Expected %v, got %v", expected, context)
+	}
+}
+
+func TestGetKubernetesMetadataFromFileContainersLayout(test *testing.T) {
+	filePath := "/var/log/containers/web-5d8f7c9b4-x2x7k_default_nginx-4f0b2a.log"
+	context := &KubernetesContext{}
+
+	if err := GetKubernetesMetadataFromFile(filePath, context); err != nil {
+		test.Fatalf("Expected err to be nil, got %s", err)
+	}
+
+	expected := &KubernetesContext{
+		ContainerName: "nginx-4f0b2a",
+		Namespace:     "default",
+		PodName:       "web-5d8f7c9b4-x2x7k",
+	}
+
+	if !cmp.Equal(context, expected) {
+		test.Fatalf("Expected %v, got %v", expected, context)
 	}
 }
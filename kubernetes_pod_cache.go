@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout for listing the pods of the node, which can take longer than a single GET
+const kubernetesListTimeout = 30 * time.Second
+
+// Watches are ended by the API server after this long and resumed from the last resource version seen
+const kubernetesWatchTimeoutSeconds = 300
+
+// Watches of pods the API server did not end in time, for example over a connection that was silently dropped, are
+// ended by the agent after this long
+var kubernetesPodWatchDeadline = (kubernetesWatchTimeoutSeconds + 30) * time.Second
+
+// How long the metadata of a new container log file waits for its pod to be known by the cache before the file is
+// forwarded with the metadata found so far. Metadata retrieved later is applied while forwarding.
+var kubernetesPodWaitTimeout = 5 * time.Second
+
+// Returned when the resource version a watch resumes from is too old, the pods have to be listed again
+var errKubernetesWatchExpired = errors.New("Kubernetes watch expired")
+
+type KubernetesPod struct {
+	Metadata *KubernetesMetadata `json:"metadata"`
+	Spec     struct {
+		NodeName       string                `json:"nodeName"`
+		Containers     []kubernetesContainer `json:"containers"`
+		InitContainers []kubernetesContainer `json:"initContainers"`
+	} `json:"spec"`
+	Status struct {
+		PodIP                 string                      `json:"podIP"`
+		ContainerStatuses     []kubernetesContainerStatus `json:"containerStatuses"`
+		InitContainerStatuses []kubernetesContainerStatus `json:"initContainerStatuses"`
+	} `json:"status"`
+}
+
+type kubernetesContainer struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+type kubernetesContainerStatus struct {
+	Name string `json:"name"`
+	// The runtime and the ID of the container, such as docker://ID
+	ContainerID string `json:"containerID"`
+}
+
+type kubernetesPodList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []*KubernetesPod `json:"items"`
+}
+
+type kubernetesWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubernetesStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// kubernetesPodEntry is a pod known to the cache, or a placeholder for a pod that is waited for. changed is closed
+// when the entry is replaced or removed. A placeholder is removed once nothing waits for it.
+type kubernetesPodEntry struct {
+	pod     *KubernetesPod
+	changed chan struct{}
+	waiters int
+}
+
+// KubernetesPodCache Keeps the pods of a node up to date by listing and then watching them, so that metadata of
+// container log files is read from memory instead of requested from the Kubernetes API for each file. Root owners are
+// memoized per direct owner of a pod, such as a ReplicaSet or a Job, since they do not change.
+type KubernetesPodCache struct {
+	sync.Mutex
+
+	client *KubernetesClient
+	// Only pods scheduled on this node are watched, every pod of the cluster is when empty
+	nodeName string
+
+	// Pods by namespace and name
+	pods map[string]*kubernetesPodEntry
+	// Root owners by namespace, kind and name of the direct owner of a pod
+	owners map[string]map[string]string
+	// Labels of nodes by name, nil for nodes whose labels could not be retrieved
+	nodes map[string]map[string]string
+}
+
+// NewKubernetesPodCache Return an empty *KubernetesPodCache, which is filled once Run is called
+func NewKubernetesPodCache(client *KubernetesClient, nodeName string) *KubernetesPodCache {
+	return &KubernetesPodCache{
+		client:   client,
+		nodeName: nodeName,
+		pods:     make(map[string]*kubernetesPodEntry),
+		owners:   make(map[string]map[string]string),
+		nodes:    make(map[string]map[string]string),
+	}
+}
+
+func kubernetesPodKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// Run Lists and watches pods until quit is closed. Pods are listed again when a watch cannot be resumed, with backoff
+// while the Kubernetes API is unavailable.
+func (c *KubernetesPodCache) Run(quit chan bool) {
+	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	attempts := 0
+
+	for {
+		resourceVersion, err := c.list()
+		for err == nil {
+			attempts = 0
+			resourceVersion, err = c.watch(resourceVersion, quit)
+
+			select {
+			case <-quit:
+				return
+			default:
+			}
+		}
+
+		if err == errKubernetesWatchExpired {
+			logger.Debug("Kubernetes pod watch expired, listing pods again")
+			continue
+		}
+
+		attempts++
+		sleepDuration := kubernetesBackoff(attempts, rand)
+		logger.Warnf("Failed to watch Kubernetes pods: %s. Retrying in %.f seconds.", err, sleepDuration.Seconds())
+
+		select {
+		case <-quit:
+			return
+		case <-time.After(sleepDuration):
+		}
+	}
+}
+
+// podsURL returns the URL of the pods of the node with the given extra query parameters
+func (c *KubernetesPodCache) podsURL(query url.Values) string {
+	if c.nodeName != "" {
+		query.Set("fieldSelector", "spec.nodeName="+c.nodeName)
+	}
+
+	return c.client.BaseEndpoint + "/api/v1/pods?" + query.Encode()
+}
+
+// list replaces the cached pods with the pods of the node and returns the resource version to watch from
+func (c *KubernetesPodCache) list() (string, error) {
+	client := &http.Client{Transport: c.client.HTTPClient.Transport, Timeout: kubernetesListTimeout}
+
+	resp, err := client.Get(c.podsURL(url.Values{}))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("Listing pods returned status code %d", resp.StatusCode)
+	}
+
+	var list kubernetesPodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+
+	c.replacePods(list.Items)
+	logger.Infof("Listed %d Kubernetes pods", len(list.Items))
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies pod changes from resourceVersion on until the API server ends the watch or quit is closed. Returns
+// the resource version to resume from.
+func (c *KubernetesPodCache) watch(resourceVersion string, quit chan bool) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesPodWatchDeadline)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("timeoutSeconds", fmt.Sprint(kubernetesWatchTimeoutSeconds))
+
+	req, err := http.NewRequest("GET", c.podsURL(query), nil)
+	if err != nil {
+		return resourceVersion, err
+	}
+
+	// The watch is a long running response, which is only limited by the deadline of ctx
+	client := &http.Client{Transport: c.client.HTTPClient.Transport}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return resourceVersion, errKubernetesWatchExpired
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resourceVersion, fmt.Errorf("Watching pods returned status code %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event kubernetesWatchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return resourceVersion, fmt.Errorf("Watching pods did not end within %s", kubernetesPodWatchDeadline)
+			}
+			if ctx.Err() != nil {
+				// Ended by quit
+				return resourceVersion, nil
+			}
+			if err == io.EOF {
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+
+		if event.Type == "ERROR" {
+			var status kubernetesStatus
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return resourceVersion, errKubernetesWatchExpired
+			}
+			return resourceVersion, fmt.Errorf("Watching pods failed: %s", status.Message)
+		}
+
+		var pod KubernetesPod
+		if err := json.Unmarshal(event.Object, &pod); err != nil || pod.Metadata == nil {
+			logger.Warnf("Ignoring Kubernetes pod %s event that could not be decoded", event.Type)
+			continue
+		}
+		resourceVersion = pod.Metadata.ResourceVersion
+
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			c.setPod(&pod)
+		case "DELETED":
+			c.deletePod(pod.Metadata.Namespace, pod.Metadata.Name)
+		}
+	}
+}
+
+// replacePods replaces every cached pod with pods. Placeholders of pods that are waited for are kept.
+func (c *KubernetesPodCache) replacePods(pods []*KubernetesPod) {
+	c.Lock()
+	defer c.Unlock()
+
+	listed := make(map[string]bool)
+	owners := make(map[string]map[string]string)
+	for _, pod := range pods {
+		if pod.Metadata == nil {
+			continue
+		}
+
+		key := kubernetesPodKey(pod.Metadata.Namespace, pod.Metadata.Name)
+		listed[key] = true
+		c.replaceEntry(key, pod)
+
+		// Only the root owners of listed pods are kept
+		if ownerKey := kubernetesOwnerKey(pod); ownerKey != "" {
+			if owner, ok := c.owners[ownerKey]; ok {
+				owners[ownerKey] = owner
+			}
+		}
+	}
+
+	for key, entry := range c.pods {
+		if !listed[key] && entry.pod != nil {
+			close(entry.changed)
+			delete(c.pods, key)
+		}
+	}
+
+	c.owners = owners
+}
+
+func (c *KubernetesPodCache) setPod(pod *KubernetesPod) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.replaceEntry(kubernetesPodKey(pod.Metadata.Namespace, pod.Metadata.Name), pod)
+}
+
+func (c *KubernetesPodCache) deletePod(namespace, name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := kubernetesPodKey(namespace, name)
+	if entry, ok := c.pods[key]; ok {
+		close(entry.changed)
+		delete(c.pods, key)
+	}
+}
+
+// replaceEntry must be called with the cache locked
+func (c *KubernetesPodCache) replaceEntry(key string, pod *KubernetesPod) {
+	if entry, ok := c.pods[key]; ok {
+		close(entry.changed)
+	}
+
+	c.pods[key] = &kubernetesPodEntry{pod: pod, changed: make(chan struct{})}
+}
+
+// getPod returns the cached pod, or nil if it is not known, along with a channel that is closed when the pod is
+// added, changed or deleted. The returned function must be called once the caller no longer waits on the channel.
+func (c *KubernetesPodCache) getPod(namespace, name string) (*KubernetesPod, chan struct{}, func()) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := kubernetesPodKey(namespace, name)
+	entry, ok := c.pods[key]
+	if !ok {
+		entry = &kubernetesPodEntry{changed: make(chan struct{})}
+		c.pods[key] = entry
+	}
+	entry.waiters++
+
+	release := func() {
+		c.Lock()
+		defer c.Unlock()
+
+		entry.waiters--
+		if entry.pod == nil && entry.waiters == 0 && c.pods[key] == entry {
+			delete(c.pods, key)
+		}
+	}
+
+	return entry.pod, entry.changed, release
+}
+
+// waitForPod returns the cached pod, waiting up to timeout for it to be added. Returns nil if the pod is not known
+// by then.
+func (c *KubernetesPodCache) waitForPod(namespace, name string, timeout time.Duration) *KubernetesPod {
+	deadline := time.After(timeout)
+
+	for {
+		pod, changed, release := c.getPod(namespace, name)
+		if pod != nil {
+			release()
+			return pod
+		}
+
+		select {
+		case <-changed:
+			release()
+		case <-deadline:
+			release()
+			return nil
+		}
+	}
+}
+
+// kubernetesOwnerKey returns the key root owners are memoized under for the pod, or "" if the pod has no owner
+func kubernetesOwnerKey(pod *KubernetesPod) string {
+	if len(pod.Metadata.OwnerReferences) == 0 {
+		return ""
+	}
+
+	owner := pod.Metadata.OwnerReferences[0]
+	return pod.Metadata.Namespace + "/" + owner.Kind + "/" + owner.Name
+}
+
+// rootOwner returns the root owner of the pod, following owner references through the Kubernetes API the first time
+// an owner is seen
+func (c *KubernetesPodCache) rootOwner(pod *KubernetesPod) (map[string]string, error) {
+	key := kubernetesOwnerKey(pod)
+	if key == "" {
+		return map[string]string{
+			"kind": "pod",
+			"name": pod.Metadata.Name,
+		}, nil
+	}
+
+	c.Lock()
+	owner, ok := c.owners[key]
+	c.Unlock()
+	if ok {
+		return owner, nil
+	}
+
+	// We are assuming ownerReferences contains only one reference, or the first reference is the one we are
+	// interested in.
+	ownerReference := pod.Metadata.OwnerReferences[0]
+	owner, err := c.client.getRootOwner(pod.Metadata.Namespace, ownerReference.Kind, ownerReference.Name,
+		ownerReference.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.owners[key] = owner
+	c.Unlock()
+
+	return owner, nil
+}
+
+// nodeLabels returns the labels of the node, requesting them from the Kubernetes API the first time the node is seen.
+// A node whose labels cannot be retrieved is reported once and has no labels.
+func (c *KubernetesPodCache) nodeLabels(name string) map[string]string {
+	c.Lock()
+	labels, ok := c.nodes[name]
+	c.Unlock()
+	if ok {
+		return labels
+	}
+
+	labels, err := c.client.GetNodeLabels(name)
+	if err != nil {
+		logger.Warnf("Failed to retrieve labels of Kubernetes node %s, they will not be sent: %s", name, err)
+	}
+
+	c.Lock()
+	c.nodes[name] = labels
+	c.Unlock()
+
+	return labels
+}
+
+// podContext returns a copy of fileContext, the metadata found in the path of a container log file, completed with
+// the metadata of its pod. The node and container metadata selected by config are added as well.
+func (c *KubernetesPodCache) podContext(pod *KubernetesPod, fileContext KubernetesContext, config *KubernetesConfig) *KubernetesContext {
+	context := fileContext
+	context.Labels = pod.Metadata.Labels
+	context.Annotations = pod.Metadata.Annotations
+	if context.PodUID == "" {
+		context.PodUID = pod.Metadata.UID
+	}
+
+	owner, err := c.rootOwner(pod)
+	if err != nil {
+		logger.Warnf("Failed to retrieve root owner for Kubernetes Pod %s in namespace %s: %s", context.PodName,
+			context.Namespace, err)
+	} else {
+		context.RootOwner = owner
+	}
+
+	if config != nil {
+		c.addNodeAndContainerContext(&context, pod, config)
+	}
+
+	return &context
+}
+
+// addNodeAndContainerContext adds the metadata fields and node labels selected by config to context
+func (c *KubernetesPodCache) addNodeAndContainerContext(context *KubernetesContext, pod *KubernetesPod, config *KubernetesConfig) {
+	name := kubernetesContainerName(context)
+
+	if config.sendsMetadataField("node_name") {
+		context.NodeName = pod.Spec.NodeName
+	}
+
+	if config.sendsMetadataField("pod_ip") {
+		context.PodIP = pod.Status.PodIP
+	}
+
+	if config.sendsMetadataField("container_image") {
+		for _, container := range append(pod.Spec.Containers, pod.Spec.InitContainers...) {
+			if container.Name == name {
+				context.ContainerImage, context.ContainerImageTag = splitContainerImage(container.Image)
+			}
+		}
+	}
+
+	if config.sendsMetadataField("container_id") {
+		// The /var/log/containers layout names the container that wrote the file, the status only knows the current
+		// container, which differs once the container was restarted
+		if id := kubernetesContainerID.FindString(context.ContainerName); id != "" {
+			context.ContainerID = id[1:]
+		} else {
+			for _, status := range append(pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses...) {
+				if status.Name == name {
+					context.ContainerID = trimContainerRuntime(status.ContainerID)
+				}
+			}
+		}
+	}
+
+	if len(config.NodeLabels) > 0 && pod.Spec.NodeName != "" {
+		nodeLabels := c.nodeLabels(pod.Spec.NodeName)
+		for _, key := range config.NodeLabels {
+			if value, ok := nodeLabels[key]; ok {
+				if context.NodeLabels == nil {
+					context.NodeLabels = make(map[string]string)
+				}
+				context.NodeLabels[key] = value
+			}
+		}
+	}
+}
+
+// splitContainerImage splits an image reference such as registry:5000/app:1.2 into its name and tag. The tag is
+// empty for images referenced without one or by digest.
+func splitContainerImage(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[:i], ""
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+
+	return image, ""
+}
+
+// trimContainerRuntime removes the runtime prefix of a container ID such as docker://ID
+func trimContainerRuntime(containerID string) string {
+	if i := strings.Index(containerID, "://"); i >= 0 {
+		return containerID[i+3:]
+	}
+
+	return containerID
+}
+
+// waitForFilePodChange blocks until the labels or annotations of the pod of the container log file change. Returns
+// false if the pod is deleted, the path is not of a container log file or quit is closed first.
+func (c *KubernetesPodCache) waitForFilePodChange(filePath string, quit chan bool) bool {
+	if c == nil {
+		return false
+	}
+
+	context := &KubernetesContext{}
+	if err := GetKubernetesMetadataFromFile(filePath, context); err != nil {
+		return false
+	}
+
+	pod, changed, release := c.getPod(context.Namespace, context.PodName)
+	for {
+		select {
+		case <-changed:
+			release()
+		case <-quit:
+			release()
+			return false
+		}
+
+		var next *KubernetesPod
+		next, changed, release = c.getPod(context.Namespace, context.PodName)
+		switch {
+		case next == nil && pod != nil:
+			release()
+			return false
+		case next == nil:
+			continue
+		case pod == nil:
+			release()
+			return true
+		}
+
+		if !reflect.DeepEqual(next.Metadata.Labels, pod.Metadata.Labels) ||
+			!reflect.DeepEqual(next.Metadata.Annotations, pod.Metadata.Annotations) {
+			release()
+			return true
+		}
+		pod = next
+	}
+}
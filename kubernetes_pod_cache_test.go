@@ -0,0 +1,391 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setKubernetesPodWaitTimeout changes kubernetesPodWaitTimeout and returns a function restoring it
+func setKubernetesPodWaitTimeout(timeout time.Duration) func() {
+	defaultTimeout := kubernetesPodWaitTimeout
+	kubernetesPodWaitTimeout = timeout
+
+	return func() { kubernetesPodWaitTimeout = defaultTimeout }
+}
+
+func testPod(name string, resourceVersion string, labels string, owner string) string {
+	ownerReferences := ""
+	if owner != "" {
+		ownerReferences = fmt.Sprintf(`, "ownerReferences": [{"kind": "ReplicaSet", "name": "%s", "apiVersion": "apps/v1"}]`, owner)
+	}
+
+	return fmt.Sprintf(`{"metadata": {"name": "%s", "namespace": "default", "uid": "uid-%s", "resourceVersion": "%s", `+
+		`"labels": %s%s}, "spec": {"nodeName": "node-1"}}`, name, name, resourceVersion, labels, ownerReferences)
+}
+
+// waitForLabel waits for the pod to have the given value for the app label
+func waitForLabel(test *testing.T, cache *KubernetesPodCache, name string, value string) {
+	timeout := time.After(5 * time.Second)
+
+	for {
+		pod, changed, release := cache.getPod("default", name)
+		if pod != nil && pod.Metadata.Labels["app"] == value {
+			release()
+			return
+		}
+
+		select {
+		case <-changed:
+			release()
+		case <-timeout:
+			release()
+			test.Fatalf("Expected pod %s to have label app=%s", name, value)
+		}
+	}
+}
+
+func TestKubernetesPodCacheListsAndWatchesPods(test *testing.T) {
+	events := make(chan string)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fieldSelector") != "spec.nodeName=node-1" {
+			test.Errorf("Expected pods to be selected by node, got %s", r.RequestURI)
+		}
+
+		if r.URL.Query().Get("watch") == "" {
+			w.Write([]byte(`{"metadata": {"resourceVersion": "10"}, "items": [` +
+				testPod("web", "9", `{"app": "web"}`, "") + `]}`))
+			return
+		}
+
+		if r.URL.Query().Get("resourceVersion") != "10" {
+			// Resumed watches are not answered until the test ends
+			<-r.Context().Done()
+			return
+		}
+
+		w.(http.Flusher).Flush()
+		for event := range events {
+			w.Write([]byte(event + "\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer ts.Close()
+
+	host, port := getHostAndPortFromURL(ts.URL)
+	client, _ := getKubernetesClientWithEnvironment(host, port)
+	cache := NewKubernetesPodCache(client, "node-1")
+
+	quit := make(chan bool)
+	defer close(quit)
+	go cache.Run(quit)
+
+	waitForLabel(test, cache, "web", "web")
+
+	events <- `{"type": "ADDED", "object": ` + testPod("worker", "11", `{"app": "worker"}`, "") + `}`
+	waitForLabel(test, cache, "worker", "worker")
+
+	events <- `{"type": "MODIFIED", "object": ` + testPod("web", "12", `{"app": "web-v2"}`, "") + `}`
+	waitForLabel(test, cache, "web", "web-v2")
+
+	_, changed, release := cache.getPod("default", "worker")
+	defer release()
+	events <- `{"type": "DELETED", "object": ` + testPod("worker", "13", `{"app": "worker"}`, "") + `}`
+	close(events)
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected the deleted pod to be removed")
+	}
+
+	pod, _, releaseDeleted := cache.getPod("default", "worker")
+	releaseDeleted()
+	if pod != nil {
+		test.Fatal("Expected the deleted pod to be removed")
+	}
+}
+
+func TestKubernetesPodCacheEndsSilentWatches(test *testing.T) {
+	defaultDeadline := kubernetesPodWatchDeadline
+	kubernetesPodWatchDeadline = 100 * time.Millisecond
+	defer func() { kubernetesPodWatchDeadline = defaultDeadline }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response starts but no event follows, as over a connection that was dropped
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	host, port := getHostAndPortFromURL(ts.URL)
+	client, _ := getKubernetesClientWithEnvironment(host, port)
+	cache := NewKubernetesPodCache(client, "node-1")
+
+	done := make(chan error)
+	go func() {
+		_, err := cache.watch("10", make(chan bool))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			test.Fatal("Expected a watch ended by its deadline to fail so that pods are listed again")
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected the watch to end at its deadline")
+	}
+}
+
+func TestKubernetesPodCacheMemoizesRootOwners(test *testing.T) {
+	var lock sync.Mutex
+	requests := make(map[string]int)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+
+		switch r.URL.Path {
+		case "/apis/apps/v1/namespaces/default/replicasets/web-1234":
+			w.Write([]byte(ReplicaSetWithOwnerMetdataJSON))
+		case "/apis/extensions/v1beta1/namespaces/default/deployments/deployment-name":
+			w.Write([]byte(DeploymentMetadataJSON))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	host, port := getHostAndPortFromURL(ts.URL)
+	client, _ := getKubernetesClientWithEnvironment(host, port)
+	cache := NewKubernetesPodCache(client, "")
+
+	for _, name := range []string{"web-1234-a", "web-1234-b"} {
+		cache.setPod(decodeTestPod(test, testPod(name, "1", `{"app": "web"}`, "web-1234")))
+		pod, _, release := cache.getPod("default", name)
+		release()
+
+		context := cache.podContext(pod, KubernetesContext{PodName: name, Namespace: "default"}, nil)
+		expected := map[string]string{"kind": "Deployment", "name": "deployment-name"}
+		if fmt.Sprint(context.RootOwner) != fmt.Sprint(expected) {
+			test.Fatalf("Expected root owner %v, got %v", expected, context.RootOwner)
+		}
+
+		if context.PodUID != "uid-"+name {
+			test.Fatalf("Expected pod UID to be taken from the pod, got %s", context.PodUID)
+		}
+	}
+
+	if requests["/apis/apps/v1/namespaces/default/replicasets/web-1234"] != 1 {
+		test.Fatalf("Expected the ReplicaSet to be requested once, got %d requests",
+			requests["/apis/apps/v1/namespaces/default/replicasets/web-1234"])
+	}
+}
+
+func TestKubernetesPodCacheAddsNodeAndContainerContext(test *testing.T) {
+	var lock sync.Mutex
+	requests := make(map[string]int)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+
+		switch r.URL.Path {
+		case "/api/v1/nodes/node-1":
+			w.Write([]byte(`{"metadata": {"name": "node-1", "labels": {"topology.kubernetes.io/zone": "us-east-1a", ` +
+				`"node.kubernetes.io/instance-type": "m5.large", "kubernetes.io/hostname": "node-1"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	host, port := getHostAndPortFromURL(ts.URL)
+	client, _ := getKubernetesClientWithEnvironment(host, port)
+	cache := NewKubernetesPodCache(client, "node-1")
+	config := NewKubernetesConfig()
+
+	pod := decodeTestPod(test, `{"metadata": {"name": "web-1", "namespace": "default"}, `+
+		`"spec": {"nodeName": "node-1", "containers": [{"name": "nginx", "image": "registry:5000/nginx:1.15"}]}, `+
+		`"status": {"podIP": "10.0.0.7", "containerStatuses": [{"name": "nginx", "containerID": "docker://abc123"}]}}`)
+
+	for i := 0; i < 2; i++ {
+		context := cache.podContext(pod, KubernetesContext{PodName: "web-1", Namespace: "default", ContainerName: "nginx"}, config)
+
+		if context.NodeName != "node-1" || context.PodIP != "10.0.0.7" || context.ContainerID != "abc123" {
+			test.Fatalf("Unexpected node and container metadata %+v", context)
+		}
+
+		if context.ContainerImage != "registry:5000/nginx" || context.ContainerImageTag != "1.15" {
+			test.Fatalf("Expected image registry:5000/nginx tag 1.15, got %s tag %s", context.ContainerImage, context.ContainerImageTag)
+		}
+
+		expected := map[string]string{"topology.kubernetes.io/zone": "us-east-1a", "node.kubernetes.io/instance-type": "m5.large"}
+		if fmt.Sprint(context.NodeLabels) != fmt.Sprint(expected) {
+			test.Fatalf("Expected node labels %v, got %v", expected, context.NodeLabels)
+		}
+	}
+
+	if requests["/api/v1/nodes/node-1"] != 1 {
+		test.Fatalf("Expected the node to be requested once, got %d requests", requests["/api/v1/nodes/node-1"])
+	}
+
+	// The file name of the /var/log/containers layout gives the ID of the container that wrote it
+	containerID := strings.Repeat("0123456789abcdef", 4)
+	config.MetadataFields = []string{"container_id"}
+	config.NodeLabels = nil
+	context := cache.podContext(pod, KubernetesContext{PodName: "web-1", Namespace: "default", ContainerName: "nginx-" + containerID}, config)
+
+	if context.ContainerID != containerID || context.NodeName != "" || context.ContainerImage != "" || context.NodeLabels != nil {
+		test.Fatalf("Expected only the container ID of the file, got %+v", context)
+	}
+}
+
+func TestSplitContainerImage(test *testing.T) {
+	cases := []struct {
+		image string
+		name  string
+		tag   string
+	}{
+		{"nginx", "nginx", ""},
+		{"nginx:1.15", "nginx", "1.15"},
+		{"registry:5000/team/app", "registry:5000/team/app", ""},
+		{"registry:5000/team/app:v2", "registry:5000/team/app", "v2"},
+		{"nginx@sha256:0123", "nginx", ""},
+	}
+
+	for _, c := range cases {
+		name, tag := splitContainerImage(c.image)
+		if name != c.name || tag != c.tag {
+			test.Fatalf("Expected %s to be split into %s and %s, got %s and %s", c.image, c.name, c.tag, name, tag)
+		}
+	}
+}
+
+func TestFollowKubernetesPodUpdatesMetadata(test *testing.T) {
+	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
+
+	config := NewKubernetesConfig()
+
+	fileContext := KubernetesContext{PodName: "web-1", Namespace: "default", ContainerName: "nginx"}
+	stop := make(chan bool)
+	updates := make(chan *LogEvent, 1)
+	quit := make(chan bool)
+	defer close(quit)
+	go followKubernetesPod(cache, config, "web-1.log", NewLogEvent(), fileContext, &fileContext, stop, updates, quit, nil)
+
+	cache.setPod(decodeTestPod(test, testPod("web-1", "1", `{"app": "web"}`, "")))
+
+	select {
+	case update := <-updates:
+		if labels := update.Context.Platform.Kubernetes.Labels; labels["app"] != "web" {
+			test.Fatalf("Expected updated labels, got %v", labels)
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected metadata to be updated once the pod is known")
+	}
+
+	cache.setPod(decodeTestPod(test, testPod("web-1", "2", `{"app": "web-v2"}`, "")))
+
+	select {
+	case update := <-updates:
+		if labels := update.Context.Platform.Kubernetes.Labels; labels["app"] != "web-v2" {
+			test.Fatalf("Expected updated labels, got %v", labels)
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected metadata to be updated when labels change")
+	}
+}
+
+func TestFollowKubernetesPodStopsExcludedPod(test *testing.T) {
+	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
+
+	config := NewKubernetesConfig()
+	config.Exclude = map[string]string{"deployments": "web"}
+
+	fileContext := KubernetesContext{PodName: "web-1", Namespace: "default", ContainerName: "nginx"}
+	stop := make(chan bool)
+	updates := make(chan *LogEvent, 1)
+	quit := make(chan bool)
+	defer close(quit)
+	go followKubernetesPod(cache, config, "web-1.log", NewLogEvent(), fileContext, &fileContext, stop, updates, quit, nil)
+
+	// The cache already knows the root owner of the pod
+	cache.Lock()
+	cache.owners["default/ReplicaSet/web-1234"] = map[string]string{"kind": "Deployment", "name": "web"}
+	cache.Unlock()
+	cache.setPod(decodeTestPod(test, testPod("web-1", "1", `{"app": "web"}`, "web-1234")))
+
+	select {
+	case <-stop:
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected stop to be closed once the pod matches an exclusion filter")
+	}
+}
+
+func TestKubernetesPodCacheRemovesUnusedPlaceholders(test *testing.T) {
+	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
+
+	if pod := cache.waitForPod("default", "web-1", 10*time.Millisecond); pod != nil {
+		test.Fatal("Expected the pod not to be known")
+	}
+
+	if len(cache.pods) != 0 {
+		test.Fatalf("Expected the placeholder of the pod to be removed, got %d entries", len(cache.pods))
+	}
+}
+
+func TestFollowKubernetesPodReturnsWhenDone(test *testing.T) {
+	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
+
+	config := NewKubernetesConfig()
+
+	fileContext := KubernetesContext{PodName: "web-1", Namespace: "default", ContainerName: "nginx"}
+	stop := make(chan bool)
+	updates := make(chan *LogEvent, 1)
+	quit := make(chan bool)
+	defer close(quit)
+	done := make(chan bool)
+
+	returned := make(chan bool)
+	go func() {
+		followKubernetesPod(cache, config, "web-1.log", NewLogEvent(), fileContext, &fileContext, stop, updates, quit, done)
+		close(returned)
+	}()
+
+	close(done)
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected the pod not to be followed once done is closed")
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+	if len(cache.pods) != 0 {
+		test.Fatalf("Expected the placeholder of the pod to be removed, got %d entries", len(cache.pods))
+	}
+}
+
+func decodeTestPod(test *testing.T, data string) *KubernetesPod {
+	var pod KubernetesPod
+	if err := json.Unmarshal([]byte(data), &pod); err != nil {
+		test.Fatal(err)
+	}
+
+	return &pod
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+)
+
+// KubernetesRoute sends the logs of the containers it matches with its own API key, to its own endpoint, or both.
+// Clusters shared by teams with separate Timber applications route the logs of each team to its application.
+type KubernetesRoute struct {
+	// Filters a log source must match every one of, see supportedFilterKinds. A route without filters matches every
+	// log source.
+	Match map[string]string
+	// API key the matching logs are sent with, the agent's API key when empty
+	ApiKey string `toml:"api_key"`
+	// Endpoint the matching logs are sent to, the agent's endpoint when empty
+	Endpoint string
+}
+
+// Matches reports whether the log source described by context matches every filter of the route
+func (r *KubernetesRoute) Matches(context *KubernetesContext) bool {
+	for _, kind := range supportedFilterKinds {
+		if filterString, ok := r.Match[kind]; ok {
+			if _, ok := matchFilter(kind, filterString, context); !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Route returns the first route matching the log source described by context, or nil if none does
+func (kc *KubernetesConfig) Route(context *KubernetesContext) *KubernetesRoute {
+	if context == nil {
+		return nil
+	}
+
+	for i := range kc.Routes {
+		if kc.Routes[i].Matches(context) {
+			return &kc.Routes[i]
+		}
+	}
+
+	return nil
+}
+
+// validateRoutes returns an error for the first route that sets neither an API key nor an endpoint, or has a filter
+// that cannot be applied. Unlike exclusions, such a route is not ignored as it would send logs with the wrong
+// credentials.
+func (kc *KubernetesConfig) validateRoutes() error {
+	for i, route := range kc.Routes {
+		if route.ApiKey == "" && route.Endpoint == "" {
+			return fmt.Errorf("Kubernetes route %d sets neither an API key nor an endpoint", i+1)
+		}
+
+		if kinds := unsupportedFilterKinds(route.Match); len(kinds) > 0 {
+			return fmt.Errorf("Kubernetes route %d matches unsupported kind %s", i+1, kinds[0])
+		}
+
+		if selector, ok := route.Match["labels"]; ok {
+			if _, err := ParseLabelSelector(selector); err != nil {
+				return fmt.Errorf("Kubernetes route %d: %s", i+1, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// kubernetesRouteDestination returns the sinks, endpoint and API key the file of the log source described by context
+// is forwarded with. A matching route replaces the configured sinks with the Timber endpoint, using the route's
+// endpoint and API key where set.
+func kubernetesRouteDestination(kc *KubernetesConfig, context *KubernetesContext, sinkNames []string, endpoint string, apiKey string) ([]string, string, string) {
+	route := kc.Route(context)
+	if route == nil {
+		return sinkNames, endpoint, apiKey
+	}
+
+	if route.Endpoint != "" {
+		endpoint = route.Endpoint
+	}
+
+	if route.ApiKey != "" {
+		apiKey = route.ApiKey
+	}
+
+	return nil, endpoint, apiKey
+}
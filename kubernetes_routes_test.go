@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKubernetesConfigReadRoutes(test *testing.T) {
+	configString := `
+[[kubernetes.routes]]
+api_key = "team-a-key"
+
+[kubernetes.routes.match]
+namespaces = "^team-a-"
+
+[[kubernetes.routes]]
+api_key = "team-b-key"
+endpoint = "https://logs.team-b.example.com/frames"
+
+[kubernetes.routes.match]
+labels = "team=b"
+deployments = "^api$"
+`
+
+	config := NewConfig()
+	config.KubernetesConfig = NewKubernetesConfig()
+	if err := config.UpdateFromReader(strings.NewReader(configString)); err != nil {
+		test.Fatal(err)
+	}
+
+	routes := config.KubernetesConfig.Routes
+	if len(routes) != 2 {
+		test.Fatalf("Expected 2 routes, got %d", len(routes))
+	}
+
+	if routes[0].ApiKey != "team-a-key" || routes[0].Match["namespaces"] != "^team-a-" {
+		test.Fatalf("Unexpected first route %+v", routes[0])
+	}
+
+	if routes[1].Endpoint != "https://logs.team-b.example.com/frames" || routes[1].Match["labels"] != "team=b" {
+		test.Fatalf("Unexpected second route %+v", routes[1])
+	}
+
+	// capture-kube forwards the container log files with the agent's API key, which routes make optional
+	config.Files = []FileConfig{{Path: "/var/log/containers/*"}}
+	if err := config.Validate(); err != nil {
+		test.Fatalf("Expected routes to provide the API key, got %s", err)
+	}
+}
+
+func TestKubernetesConfigRoute(test *testing.T) {
+	config := NewKubernetesConfig()
+	config.Routes = []KubernetesRoute{
+		{Match: map[string]string{"namespaces": "^team-a-"}, ApiKey: "team-a-key"},
+		{Match: map[string]string{"labels": "team=b", "deployments": "^api$"}, ApiKey: "team-b-key"},
+		{Match: map[string]string{"labels": "team"}, ApiKey: "teams-key"},
+	}
+
+	cases := []struct {
+		context *KubernetesContext
+		apiKey  string
+	}{
+		{&KubernetesContext{Namespace: "team-a-prod", Labels: map[string]string{"team": "b"}}, "team-a-key"},
+		{&KubernetesContext{Namespace: "default", Labels: map[string]string{"team": "b"},
+			RootOwner: map[string]string{"kind": "Deployment", "name": "api"}}, "team-b-key"},
+		{&KubernetesContext{Namespace: "default", Labels: map[string]string{"team": "b"},
+			RootOwner: map[string]string{"kind": "StatefulSet", "name": "api"}}, "teams-key"},
+		{&KubernetesContext{Namespace: "default"}, ""},
+		{nil, ""},
+	}
+
+	for _, c := range cases {
+		route := config.Route(c.context)
+
+		var apiKey string
+		if route != nil {
+			apiKey = route.ApiKey
+		}
+
+		if apiKey != c.apiKey {
+			test.Fatalf("Expected %+v to be routed with API key %q, got %q", c.context, c.apiKey, apiKey)
+		}
+	}
+}
+
+func TestKubernetesConfigValidateRoutes(test *testing.T) {
+	cases := []KubernetesRoute{
+		{Match: map[string]string{"namespaces": "team-a"}},
+		{Match: map[string]string{"services": "api"}, ApiKey: "team-a-key"},
+		{Match: map[string]string{"labels": "team in (a"}, ApiKey: "team-a-key"},
+	}
+
+	for _, route := range cases {
+		config := NewConfig()
+		config.KubernetesConfig = NewKubernetesConfig()
+		config.KubernetesConfig.Routes = []KubernetesRoute{route}
+
+		if err := config.Validate(); err == nil {
+			test.Fatalf("Expected route %+v to fail validation", route)
+		}
+	}
+}
+
+func TestKubernetesRouteDestination(test *testing.T) {
+	config := NewKubernetesConfig()
+	config.Routes = []KubernetesRoute{
+		{Match: map[string]string{"namespaces": "^team-a$"}, ApiKey: "team-a-key"},
+		{Match: map[string]string{"namespaces": "^team-b$"}, Endpoint: "https://team-b.example.com"},
+	}
+
+	cases := []struct {
+		namespace string
+		sinks     []string
+		endpoint  string
+		apiKey    string
+	}{
+		{"default", []string{"archive"}, "https://agent.example.com", "agent-key"},
+		{"team-a", nil, "https://agent.example.com", "team-a-key"},
+		{"team-b", nil, "https://team-b.example.com", "agent-key"},
+	}
+
+	for _, c := range cases {
+		context := &KubernetesContext{Namespace: c.namespace}
+		sinks, endpoint, apiKey := kubernetesRouteDestination(config, context, []string{"archive"}, "https://agent.example.com", "agent-key")
+
+		if len(sinks) != len(c.sinks) || endpoint != c.endpoint || apiKey != c.apiKey {
+			test.Fatalf("Expected namespace %s to be forwarded to %v %s with %s, got %v %s with %s",
+				c.namespace, c.sinks, c.endpoint, c.apiKey, sinks, endpoint, apiKey)
+		}
+	}
+}
+
+func TestFollowKubernetesPodStopsWhenRouteChanges(test *testing.T) {
+	client, _ := getKubernetesClientWithEnvironment(randomHost(), randomPort())
+	cache := NewKubernetesPodCache(client, "")
+	config := NewKubernetesConfig()
+	config.Routes = []KubernetesRoute{
+		{Match: map[string]string{"labels": "team=a"}, ApiKey: "team-a-key"},
+	}
+
+	cache.setPod(decodeTestPod(test, testPod("web-1", "1", `{"team": "a"}`, "")))
+	pod, _, release := cache.getPod("default", "web-1")
+	release()
+
+	fileContext := KubernetesContext{PodName: "web-1", Namespace: "default", ContainerName: "nginx"}
+	current := cache.podContext(pod, fileContext, config)
+	stop := make(chan bool)
+	updates := make(chan *LogEvent, 1)
+	quit := make(chan bool)
+	defer close(quit)
+	go followKubernetesPod(cache, config, "web-1.log", NewLogEvent(), fileContext, current, stop, updates, quit, nil)
+
+	cache.setPod(decodeTestPod(test, testPod("web-1", "2", `{"team": "b"}`, "")))
+
+	select {
+	case <-stop:
+	case <-time.After(5 * time.Second):
+		test.Fatal("Expected stop to be closed once the pod no longer matches its route")
+	}
+}
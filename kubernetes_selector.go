@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Label keys, optionally prefixed with a DNS subdomain and a slash
+var labelKey = regexp.MustCompile(`^([a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?/)?[a-zA-Z0-9]([-a-zA-Z0-9_.]*[a-zA-Z0-9])?$`)
+
+// A set based requirement such as "tier in (web, api)"
+var labelSetRequirement = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+// labelRequirement is a single requirement of a label selector. operator is one of =, !=, in, notin, exists and
+// !exists.
+type labelRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+// LabelSelector Matches labels against the requirements of a Kubernetes label selector expression, such as
+// "app in (web,api),tier!=cache". Every requirement must be met.
+type LabelSelector []labelRequirement
+
+// ParseLabelSelector parses a label selector expression using the syntax of kubectl's --selector flag. The empty
+// expression matches every set of labels.
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	var requirements LabelSelector
+
+	for _, expression := range splitLabelSelector(selector) {
+		expression = strings.TrimSpace(expression)
+		if expression == "" {
+			continue
+		}
+
+		requirement, err := parseLabelRequirement(expression)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid label selector %q: %s", selector, err)
+		}
+
+		requirements = append(requirements, requirement)
+	}
+
+	return requirements, nil
+}
+
+// splitLabelSelector splits a selector on the commas separating its requirements, which are not the commas
+// separating the values of a set
+func splitLabelSelector(selector string) []string {
+	var expressions []string
+	depth, start := 0, 0
+
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				expressions = append(expressions, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(expressions, selector[start:])
+}
+
+func parseLabelRequirement(expression string) (labelRequirement, error) {
+	var requirement labelRequirement
+
+	switch match := labelSetRequirement.FindStringSubmatch(expression); {
+	case match != nil:
+		requirement.key, requirement.operator = match[1], match[2]
+		for _, value := range strings.Split(match[3], ",") {
+			requirement.values = append(requirement.values, strings.TrimSpace(value))
+		}
+
+	case strings.HasPrefix(expression, "!"):
+		requirement.key, requirement.operator = strings.TrimSpace(expression[1:]), "!exists"
+
+	case strings.Contains(expression, "!="):
+		parts := strings.SplitN(expression, "!=", 2)
+		requirement.key, requirement.operator = strings.TrimSpace(parts[0]), "!="
+		requirement.values = []string{strings.TrimSpace(parts[1])}
+
+	case strings.Contains(expression, "="):
+		parts := strings.SplitN(expression, "=", 2)
+		requirement.key, requirement.operator = strings.TrimSpace(parts[0]), "="
+		// "==" is the same as "="
+		requirement.values = []string{strings.TrimSpace(strings.TrimPrefix(parts[1], "="))}
+
+	default:
+		requirement.key, requirement.operator = expression, "exists"
+	}
+
+	if !labelKey.MatchString(requirement.key) {
+		return requirement, fmt.Errorf("%q is not a valid label key", requirement.key)
+	}
+
+	return requirement, nil
+}
+
+// Matches reports whether labels meet every requirement of the selector. As in Kubernetes, != and notin are met by
+// labels that do not have the key at all.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range s {
+		value, ok := labels[requirement.key]
+
+		var met bool
+		switch requirement.operator {
+		case "exists":
+			met = ok
+		case "!exists":
+			met = !ok
+		case "=":
+			met = ok && value == requirement.values[0]
+		case "!=":
+			met = !ok || value != requirement.values[0]
+		case "in":
+			met = ok && containsString(requirement.values, value)
+		case "notin":
+			met = !ok || !containsString(requirement.values, value)
+		}
+
+		if !met {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLabelSelectorMatches(test *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "frontend", "example.com/team": "a"}
+
+	cases := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"app=web", true},
+		{"app==web", true},
+		{"app=api", false},
+		{"app!=api", true},
+		{"missing!=api", true},
+		{"app in (web,api)", true},
+		{"app in (api, worker)", false},
+		{"app notin (api,worker)", true},
+		{"missing notin (api)", true},
+		{"missing in (api)", false},
+		{"tier", true},
+		{"!tier", false},
+		{"!missing", true},
+		{"example.com/team=a", true},
+		{"app in (web,api),tier!=cache", true},
+		{"app in (web,api), tier=cache", false},
+	}
+
+	for _, c := range cases {
+		selector, err := ParseLabelSelector(c.selector)
+		if err != nil {
+			test.Fatalf("Expected %q to be parsed, got %s", c.selector, err)
+		}
+
+		if selector.Matches(labels) != c.matches {
+			test.Fatalf("Expected %q to match %t", c.selector, c.matches)
+		}
+	}
+}
+
+func TestParseLabelSelectorInvalid(test *testing.T) {
+	for _, selector := range []string{"app in web", "=web", "bad key=web", "app=web,!"} {
+		if _, err := ParseLabelSelector(selector); err == nil {
+			test.Fatalf("Expected %q not to be parsed", selector)
+		}
+	}
+}
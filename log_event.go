@@ -17,6 +17,7 @@ type Context struct {
 	System   *SystemContext   `json:"system,omitempty"`
 	Platform *PlatformContext `json:"platform,omitempty"`
 	Source   *SourceContext   `json:"source,omitempty"`
+	Exec     *ExecContext     `json:"exec,omitempty"`
 }
 
 type SystemContext struct {
@@ -46,6 +47,37 @@ type KubernetesContext struct {
 	Namespace     string            `json:"namespace,omitempty"`
 	RootOwner     map[string]string `json:"root_owner,omitempty"`
 	Labels        map[string]string `json:"labels,omitempty"`
+	// Only known for files in the /var/log/pods layout
+	PodUID string `json:"pod_uid,omitempty"`
+	// How often the container was restarted before it wrote the file, only known for files in the /var/log/pods
+	// layout
+	RestartCount int `json:"restart_count,omitempty"`
+	// Node and container metadata, each sent only when selected by the metadata_fields option
+	NodeName          string `json:"node_name,omitempty"`
+	PodIP             string `json:"pod_ip,omitempty"`
+	ContainerImage    string `json:"container_image,omitempty"`
+	ContainerImageTag string `json:"container_image_tag,omitempty"`
+	ContainerID       string `json:"container_id,omitempty"`
+	// Labels of the node selected by the node_labels option
+	NodeLabels map[string]string `json:"node_labels,omitempty"`
+	// Annotations of the pod, which configure how its logs are forwarded and are not sent with them
+	Annotations map[string]string `json:"-"`
+}
+
+// ContainerContext describes how the container runtime recorded a log line
+type ContainerContext struct {
+	// stdout or stderr
+	Stream string `json:"stream,omitempty"`
+	// RFC 3339 time at which the runtime received the line
+	Time string `json:"time,omitempty"`
+}
+
+// ExecContext describes the command run by capture-exec that wrote a log line
+type ExecContext struct {
+	Command string `json:"command,omitempty"`
+	PID     int    `json:"pid,omitempty"`
+	// stdout or stderr, empty for the line reporting how the command exited
+	Stream string `json:"stream,omitempty"`
 }
 
 func NewLogEvent() *LogEvent {
@@ -81,6 +113,20 @@ func (logEvent *LogEvent) AddKubernetesContext(context *KubernetesContext) {
 	logEvent.Context.Platform.Kubernetes = context
 }
 
+// kubernetesContext returns the Kubernetes context of the event, or nil if it has none
+func (logEvent *LogEvent) kubernetesContext() *KubernetesContext {
+	if logEvent.Context == nil || logEvent.Context.Platform == nil {
+		return nil
+	}
+
+	return logEvent.Context.Platform.Kubernetes
+}
+
+func (logEvent *LogEvent) AddExecContext(context *ExecContext) {
+	logEvent.ensureContext()
+	logEvent.Context.Exec = context
+}
+
 func (logEvent *LogEvent) ensureContext() {
 	if logEvent.Context == nil {
 		logEvent.Context = &Context{}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"os"
+	"sync"
 
+	"github.com/sirupsen/logrus"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -26,6 +29,11 @@ func main() {
 		Usage: "starts an instance of agent as a daemon (only available on Linux; see documentation)",
 	}
 
+	framingFlag := cli.StringFlag{
+		Name:  "framing",
+		Usage: "how records are delimited on STDIN: newline, nul, length_prefixed or octet_counting (default: newline)",
+	}
+
 	endpointFlag := cli.StringFlag{
 		Name:   "endpoint",
 		Usage:  "Configures the log collection endpoint logs are sent to",
@@ -37,11 +45,32 @@ func main() {
 		Usage: "the agent will write its own logs to `FILE` (will use STDOUT if not provided)",
 	}
 
+	metricsAddrFlag := cli.StringFlag{
+		Name:  "metrics-addr",
+		Usage: "serves Prometheus metrics about the agent at http://`ADDRESS`/metrics when set, for example :9100",
+	}
+
 	pidfileFlag := cli.StringFlag{
 		Name:  "pidfile",
 		Usage: "will store the pid in `FILE` when set",
 	}
 
+	probeFlag := cli.BoolFlag{
+		Name:  "probe",
+		Usage: "also sends an empty batch to each Timber endpoint to check that it is reachable and accepts the API key",
+	}
+
+	nodeNameFlag := cli.StringFlag{
+		Name:   "node-name",
+		Usage:  "name of the Kubernetes node the agent runs on, only pods scheduled on it are watched for metadata",
+		EnvVar: "TIMBER_AGENT_NODE_NAME",
+	}
+
+	watchConfigFlag := cli.BoolFlag{
+		Name:  "watch-config",
+		Usage: "reloads the config file when it changes, as is done on SIGHUP",
+	}
+
 	statefileFlag := cli.StringFlag{
 		Name:  "statefile",
 		Usage: "File path for storing global state, defaults to sane path based on OS",
@@ -60,7 +89,9 @@ func main() {
 				apiKeyFlag,
 				configFlag,
 				endpointFlag,
+				framingFlag,
 				logfileFlag,
+				metricsAddrFlag,
 				pidfileFlag,
 			},
 		},
@@ -73,8 +104,10 @@ func main() {
 				daemonizeFlag,
 				endpointFlag,
 				logfileFlag,
+				metricsAddrFlag,
 				pidfileFlag,
 				statefileFlag,
+				watchConfigFlag,
 			},
 		},
 		{
@@ -86,10 +119,61 @@ func main() {
 				configFlag,
 				daemonizeFlag,
 				logfileFlag,
+				metricsAddrFlag,
+				nodeNameFlag,
 				pidfileFlag,
 				statefileFlag,
 			},
 		},
+		{
+			Name:   "capture-syslog",
+			Usage:  "Receives syslog messages on the listeners declared in configuration and forwards to Timber's log collection endpoint",
+			Action: runCaptureSyslog,
+			Flags: []cli.Flag{
+				configFlag,
+				endpointFlag,
+				logfileFlag,
+				metricsAddrFlag,
+				pidfileFlag,
+			},
+		},
+		{
+			Name:      "capture-exec",
+			Usage:     "Runs a command and forwards what it writes to stdout and stderr to Timber's log collection endpoint, exiting with its exit code",
+			ArgsUsage: "-- COMMAND [ARGUMENTS...]",
+			Action:    runCaptureExec,
+			Flags: []cli.Flag{
+				apiKeyFlag,
+				configFlag,
+				endpointFlag,
+				logfileFlag,
+				metricsAddrFlag,
+				pidfileFlag,
+			},
+		},
+		{
+			Name:   "capture-http",
+			Usage:  "Accepts log lines POSTed to the HTTP listener declared in configuration and forwards to Timber's log collection endpoint",
+			Action: runCaptureHTTP,
+			Flags: []cli.Flag{
+				configFlag,
+				endpointFlag,
+				logfileFlag,
+				metricsAddrFlag,
+				pidfileFlag,
+			},
+		},
+		{
+			Name:    "validate",
+			Aliases: []string{"doctor"},
+			Usage:   "Checks the configuration and reports which files would be captured and from where, without forwarding anything",
+			Action:  runValidate,
+			Flags: []cli.Flag{
+				configFlag,
+				probeFlag,
+				statefileFlag,
+			},
+		},
 	}
 
 	err := app.Run(os.Args)
@@ -141,6 +225,15 @@ func runCaptureStdin(ctx *cli.Context) error {
 		config.DefaultApiKey = apiKey
 	}
 
+	// As does the framing flag
+	framing := ctx.String("framing")
+	if framing != "" {
+		if config.Stdin == nil {
+			config.Stdin = &FramingConfig{}
+		}
+		config.Stdin.Framing = framing
+	}
+
 	config.Log()
 
 	// Validate the configuration
@@ -151,6 +244,12 @@ func runCaptureStdin(ctx *cli.Context) error {
 		os.Exit(65)
 	}
 
+	serveMetrics(ctx.String("metrics-addr"))
+	SetOversizePolicy(config.OversizePolicy, config.MaxEventBytes)
+	spool := openSpool(config)
+	sinks := buildSinks(config)
+	compression, _ := NewCompression(config.Compression, config.CompressionLevel)
+
 	// Once the configuration has been fetched, we build the base of the metadata that
 	// will accompany every log frame sent to the collection endpoint. The metadata is
 	// of the type *LogEvent.
@@ -158,7 +257,7 @@ func runCaptureStdin(ctx *cli.Context) error {
 
 	// Start forwarding STDIN
 	quit := handleSignals()
-	err = ForwardStdin(config.Endpoint, config.DefaultApiKey, config.BatchPeriodSeconds, metadata, quit)
+	err = ForwardStdin(selectSinks(config.DefaultSinks, sinks, config.Endpoint, config.DefaultApiKey, compression), config.BatchPeriodSeconds, config.Multiline, config.Stdin, spool, metadata, quit)
 	if err != nil {
 		logger.Error(err)
 	} else {
@@ -247,77 +346,353 @@ func runCaptureFiles(ctx *cli.Context) error {
 		os.Exit(65)
 	}
 
+	serveMetrics(ctx.String("metrics-addr"))
+	SetOversizePolicy(config.OversizePolicy, config.MaxEventBytes)
+	SetFingerprintMaxBytes(config.FingerprintBytes)
+	globalState.SetStateTTL(config.StateTTL())
+	spool := openSpool(config)
+	sinks := buildSinks(config)
+
 	// Once the configuration has been fetched, we build the base of the metadata that
 	// will accompany every log frame sent to the collection endpoint. The metadata is
 	// of the type *LogEvent.
 	metadata := BuildBaseMetadata(config)
 
-	// Each file in the configuration can contain a path with a glob pattern. So
-	// we set a file path channel to receive these paths over time as they are discovered.
-	globs := make(map[string]bool)
-	fileConfigsChan := make(chan *FileConfig)
+	// Listen for new files, tail them, and forward them
+	quit := handleSignals()
 
-	for _, fileConfig := range config.Files {
-		// Check to see if we already looping on glob, if so do not duplicate
-		if _, ok := globs[fileConfig.Path]; ok {
-			logger.Warnf("Ignoring duplicate glob pattern: %s", fileConfig.Path)
-			continue
-		} else {
-			globs[fileConfig.Path] = true
+	// The configuration is read again on SIGHUP and, if requested, whenever the config file changes
+	reload := handleReloadSignal()
+	if ctx.Bool("watch-config") {
+		go watchConfigFile(configFilePath, reload, quit)
+	}
+
+	loadConfig := func() (*Config, error) {
+		config := NewConfig()
+		if endpoint != "" {
+			config.Endpoint = endpoint
 		}
 
-		go func(fileConfig FileConfig) {
-			err := GlobContinually(fileConfig.Path, fileConfig.ApiKey, fileConfigsChan)
-			if err != nil {
-				logger.Error(err)
-			} else {
-				logger.Infof("Globbing goroutine quit for %s", fileConfig.Path)
-			}
-		}(fileConfig)
-	}
+		if err := config.UpdateFromFile(configFilePath); err != nil {
+			return nil, err
+		}
 
-	// Listen for new files, tail them, and forward them
-	quit := handleSignals()
+		config.Log()
+
+		return config, config.Validate()
+	}
 
 	// Start global state flush timer
 	go globalState.Start()
 
-	// Listen for a shutdown signal and close the fileConfigsChan
-	// This allows us to move to code in the end of this function, which allows us cleanup our globalState ticker and
-	// persist state to disk once more before existing
-	go func() {
-		<-quit
-		close(fileConfigsChan)
-		return
-	}()
+	// Each file in the configuration can contain a path with a glob pattern. The supervisor
+	// globs these paths continually and forwards files as they are discovered until a
+	// shutdown signal is received.
+	newFileSupervisor(config, sinks, spool, metadata, quit).Run(reload, loadConfig)
 
-	files := make(map[string]bool)
-	for fileConfig := range fileConfigsChan {
-		logger.Infof("Received file %s, attempting to foward", fileConfig.Path)
-
-		// Check to see if we already tailing file, if so do not duplicate
-		if _, ok := files[fileConfig.Path]; ok {
-			logger.Warnf("Already tailing file: %s", fileConfig.Path)
-			continue
-		} else {
-			files[fileConfig.Path] = true
+	// Before exiting, stop global state timer and flush state to disk
+	globalState.Stop()
+	globalState.PersistState()
+
+	// Wait for graceful cleanup as handled in signals.go
+	select {}
+}
+
+// Entry point for running the agent as a syslog server
+func runCaptureSyslog(ctx *cli.Context) error {
+	// Setup the logger first so that any debug output can be made to the user.
+	logfilePath := ctx.String("output-log-file")
+	if logfilePath != "" {
+		logFile, err := setLoggerOutputFile(logfilePath)
+		if err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			os.Exit(65)
 		}
+		defer logFile.Close()
+	}
 
-		go func(fileConfig *FileConfig) {
-			err := ForwardFile(fileConfig.Path, config.ReadNewFileFromStart, config.Endpoint, fileConfig.ApiKey, config.Poll, config.BatchPeriodSeconds, metadata, quit, nil)
-			if err != nil {
+	logger.Info("Timber agent starting")
+
+	// Handle the PID file. If it exists, exit. If it does not, write it.
+	pidfilePath := ctx.String("pidfile")
+	if pidfilePath != "" {
+		if err := writePIDFile(pidfilePath); err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			os.Exit(65)
+		}
+		defer removePIDFile(pidfilePath)
+	}
+
+	// Load the config with defaults.
+	config := NewConfig()
+
+	// Update endpoint to one specified on command line if present
+	endpoint := ctx.String("endpoint")
+	if endpoint != "" {
+		config.Endpoint = endpoint
+	}
+
+	// Update the configuration from a file. This *is* required for syslog mode, which declares its listeners there.
+	configFilePath := ctx.String("config")
+	err := config.UpdateFromFile(configFilePath)
+	if err != nil {
+		logger.Errorf("Could not open config file at %s: %s", configFilePath, err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		os.Exit(65)
+	}
+
+	config.Log()
+
+	// Validate the configuration
+	err = config.Validate()
+	if err == nil && len(config.Syslog) == 0 {
+		err = errors.New("No syslog listeners. Please declare at least one [[syslog]] listener in the config file")
+	}
+	if err != nil {
+		logger.Error(err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		os.Exit(65)
+	}
+
+	// Every listener is bound before forwarding starts so that a port in use is reported immediately
+	listeners := make([]*SyslogListener, len(config.Syslog))
+	for i, listenerConfig := range config.Syslog {
+		listeners[i], err = NewSyslogListener(listenerConfig)
+		if err != nil {
+			logger.Error(err)
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			os.Exit(65)
+		}
+	}
+
+	serveMetrics(ctx.String("metrics-addr"))
+	SetOversizePolicy(config.OversizePolicy, config.MaxEventBytes)
+	spool := openSpool(config)
+	sinks := buildSinks(config)
+	compression, _ := NewCompression(config.Compression, config.CompressionLevel)
+
+	// Once the configuration has been fetched, we build the base of the metadata that
+	// will accompany every log frame sent to the collection endpoint. The metadata is
+	// of the type *LogEvent.
+	metadata := BuildBaseMetadata(config)
+
+	// Receive and forward syslog messages until a shutdown signal is received
+	quit := handleSignals()
+
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		listenerSinks := selectSinks(config.Syslog[i].Sinks, sinks, config.Endpoint, config.Syslog[i].ApiKey, compression)
+
+		wg.Add(1)
+		go func(listener *SyslogListener, listenerSinks []Sink) {
+			defer wg.Done()
+
+			if err := ForwardSyslog(listener, listenerSinks, config.BatchPeriodSeconds, spool, metadata, quit); err != nil {
 				logger.Error(err)
 			}
-			logger.Infof("Forwarding goroutine quit for %s", fileConfig.Path)
-		}(fileConfig)
+		}(listener, listenerSinks)
 	}
 
-	// Before exiting, stop global state timer and flush state to disk
-	globalState.Stop()
-	globalState.PersistState()
+	wg.Wait()
+	logger.Info("Syslog forwarding goroutines quit")
 
-	// Wait for graceful cleanup as handled in signals.go
-	select {}
+	return nil
+}
+
+// Entry point for running a command and forwarding its output. The agent exits with the command's exit code.
+func runCaptureExec(ctx *cli.Context) error {
+	os.Exit(captureExec(ctx))
+	return nil
+}
+
+// captureExec runs the command given after the flags and returns the exit code of the agent
+func captureExec(ctx *cli.Context) int {
+	// Setup the logger first so that any debug output can be made to the user.
+	logfilePath := ctx.String("output-log-file")
+	if logfilePath != "" {
+		logFile, err := setLoggerOutputFile(logfilePath)
+		if err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return 65
+		}
+		defer logFile.Close()
+	}
+
+	if len(ctx.Args()) == 0 {
+		logger.Error("No command to run. Please pass it after the options, as in capture-exec -- COMMAND")
+		// Exit with 64, EX_USAGE, to indicate a command line usage error
+		return 64
+	}
+
+	logger.Info("Timber agent starting")
+
+	// Handle the PID file. If it exists, exit. If it does not, write it.
+	pidfilePath := ctx.String("pidfile")
+	if pidfilePath != "" {
+		if err := writePIDFile(pidfilePath); err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			return 65
+		}
+		defer removePIDFile(pidfilePath)
+	}
+
+	// Load the config with defaults.
+	config := NewConfig()
+
+	// Update endpoint to one specified on command line if present
+	endpoint := ctx.String("endpoint")
+	if endpoint != "" {
+		config.Endpoint = endpoint
+	}
+
+	// Update the configuration from a file. This is not required for exec mode.
+	configFilePath := ctx.String("config")
+	err := config.UpdateFromFile(configFilePath)
+	if err != nil {
+		logger.Warnf("Could not open config file at %s: %s", configFilePath, err)
+		logger.Infof("Config file not required in exec mode")
+	}
+
+	// The API key flag take precedence if present.
+	apiKey := ctx.String("api-key")
+	if apiKey != "" {
+		config.DefaultApiKey = apiKey
+	}
+
+	config.Log()
+
+	// Validate the configuration
+	err = config.Validate()
+	if err != nil {
+		logger.Error(err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		return 65
+	}
+
+	serveMetrics(ctx.String("metrics-addr"))
+	SetOversizePolicy(config.OversizePolicy, config.MaxEventBytes)
+	spool := openSpool(config)
+	sinks := buildSinks(config)
+	compression, _ := NewCompression(config.Compression, config.CompressionLevel)
+
+	// Once the configuration has been fetched, we build the base of the metadata that
+	// will accompany every log frame sent to the collection endpoint. The metadata is
+	// of the type *LogEvent.
+	metadata := BuildBaseMetadata(config)
+
+	command, err := StartExecCommand(ctx.Args())
+	if err != nil {
+		logger.Error(err)
+		return execStartFailedExitCode
+	}
+
+	// Signals are relayed to the command, the agent stops once the command has exited and its output was delivered
+	exitCode, err := ForwardExec(command, selectSinks(config.DefaultSinks, sinks, config.Endpoint, config.DefaultApiKey, compression), config.BatchPeriodSeconds, config.Multiline, spool, metadata)
+	if err != nil {
+		logger.Error(err)
+	}
+
+	return exitCode
+}
+
+// Entry point for running the agent as an HTTP ingest server
+func runCaptureHTTP(ctx *cli.Context) error {
+	// Setup the logger first so that any debug output can be made to the user.
+	logfilePath := ctx.String("output-log-file")
+	if logfilePath != "" {
+		logFile, err := setLoggerOutputFile(logfilePath)
+		if err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			os.Exit(65)
+		}
+		defer logFile.Close()
+	}
+
+	logger.Info("Timber agent starting")
+
+	// Handle the PID file. If it exists, exit. If it does not, write it.
+	pidfilePath := ctx.String("pidfile")
+	if pidfilePath != "" {
+		if err := writePIDFile(pidfilePath); err != nil {
+			// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+			os.Exit(65)
+		}
+		defer removePIDFile(pidfilePath)
+	}
+
+	// Load the config with defaults.
+	config := NewConfig()
+
+	// Update endpoint to one specified on command line if present
+	endpoint := ctx.String("endpoint")
+	if endpoint != "" {
+		config.Endpoint = endpoint
+	}
+
+	// Update the configuration from a file. This *is* required for HTTP mode, which declares its listener there.
+	configFilePath := ctx.String("config")
+	err := config.UpdateFromFile(configFilePath)
+	if err != nil {
+		logger.Errorf("Could not open config file at %s: %s", configFilePath, err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		os.Exit(65)
+	}
+
+	config.Log()
+
+	// Validate the configuration
+	err = config.Validate()
+	if err == nil && config.HTTPIngest == nil {
+		err = errors.New("No HTTP ingest listener. Please declare an [http_ingest] listener in the config file")
+	}
+	if err != nil {
+		logger.Error(err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		os.Exit(65)
+	}
+
+	// The listener is bound before forwarding starts so that a port in use is reported immediately
+	server, err := NewHTTPIngestServer(*config.HTTPIngest)
+	if err != nil {
+		logger.Error(err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		os.Exit(65)
+	}
+
+	serveMetrics(ctx.String("metrics-addr"))
+	SetOversizePolicy(config.OversizePolicy, config.MaxEventBytes)
+	spool := openSpool(config)
+	sinks := buildSinks(config)
+	compression, _ := NewCompression(config.Compression, config.CompressionLevel)
+
+	// Requests with an API key are forwarded to the Timber endpoint with it, others to the listener's sinks
+	ingestSinks := func(apiKey string) []Sink {
+		if apiKey != "" {
+			return selectSinks(nil, sinks, config.Endpoint, apiKey, compression)
+		}
+
+		if config.HTTPIngest.ApiKey == "" && len(config.HTTPIngest.Sinks) == 0 {
+			return nil
+		}
+
+		return selectSinks(config.HTTPIngest.Sinks, sinks, config.Endpoint, config.HTTPIngest.ApiKey, compression)
+	}
+
+	// Once the configuration has been fetched, we build the base of the metadata that
+	// will accompany every log frame sent to the collection endpoint. The metadata is
+	// of the type *LogEvent.
+	metadata := BuildBaseMetadata(config)
+
+	// Accept and forward lines until a shutdown signal is received
+	quit := handleSignals()
+	err = ForwardHTTPIngest(server, ingestSinks, config.BatchPeriodSeconds, spool, metadata, quit)
+	if err != nil {
+		logger.Error(err)
+	} else {
+		logger.Info("HTTP forwarding goroutine quit")
+	}
+
+	return nil
 }
 
 // Entry point for running the agent on Kubernetes
@@ -357,9 +732,9 @@ func runCaptureKube(ctx *cli.Context) {
 		logger.Info("Config file not required in Kubernetes mode")
 	}
 
-	// The API key flag take precedence if present.
+	// The API key flag take precedence if present. Routes may provide the API key of the logs they match instead.
 	apiKey := ctx.String("api-key")
-	if apiKey == "" && config.DefaultApiKey == "" {
+	if apiKey == "" && config.DefaultApiKey == "" && len(config.DefaultSinks) == 0 && !config.hasKubernetesRoutes() {
 		logger.Error("No API key. Please use --api-key, TIMBER_API_KEY, or set a default in a config file")
 		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
 		os.Exit(65)
@@ -367,14 +742,21 @@ func runCaptureKube(ctx *cli.Context) {
 		apiKey = config.DefaultApiKey
 	}
 
+	// The node name flag takes precedence if present
+	if nodeName := ctx.String("node-name"); nodeName != "" {
+		config.KubernetesConfig.NodeName = nodeName
+	}
+
 	// Set Kubernetes default configuration options
 	// Overwrites any passed in file config
 	if len(config.Files) > 0 {
 		logger.Warn("File configurations are ignored in Kubernetes mode")
 	}
 
-	// Configure default glob path for Kubernetes application logs
-	kubeFileConfig := FileConfig{ApiKey: apiKey, Path: "/var/log/containers/*"}
+	// Configure the glob path for Kubernetes application logs. An unsupported layout is reported when the
+	// configuration is validated below.
+	kubeGlob, _ := config.KubernetesConfig.LogGlob()
+	kubeFileConfig := FileConfig{ApiKey: apiKey, Path: kubeGlob, Multiline: config.Multiline, Sinks: config.DefaultSinks}
 	config.Files = []FileConfig{kubeFileConfig}
 
 	config.Log()
@@ -405,6 +787,14 @@ func runCaptureKube(ctx *cli.Context) {
 		os.Exit(65)
 	}
 
+	serveMetrics(ctx.String("metrics-addr"))
+	SetOversizePolicy(config.OversizePolicy, config.MaxEventBytes)
+	SetFingerprintMaxBytes(config.FingerprintBytes)
+	globalState.SetStateTTL(config.StateTTL())
+	spool := openSpool(config)
+	sinks := buildSinks(config)
+	compression, _ := NewCompression(config.Compression, config.CompressionLevel)
+
 	// Once the configuration has been fetched, we build the base of the metadata that
 	// will accompany every log frame sent to the collection endpoint. The metadata is
 	// of the type *LogEvent.
@@ -415,7 +805,7 @@ func runCaptureKube(ctx *cli.Context) {
 	fileConfigsChan := make(chan *FileConfig)
 	for _, fileConfig := range config.Files {
 		go func(fileConfig FileConfig) {
-			err := GlobContinually(fileConfig.Path, fileConfig.ApiKey, fileConfigsChan)
+			err := GlobContinually(fileConfig, fileConfigsChan, nil)
 			if err != nil {
 				logger.Error(err)
 			} else {
@@ -428,12 +818,55 @@ func runCaptureKube(ctx *cli.Context) {
 	quit := handleSignals()
 
 	// Initialize KubernetesClient for gathering additional Kubernetes metadata
-	kubernetesClient, err := GetKubernetesClient()
+	var kubernetesClient *KubernetesClient
+	if config.KubernetesConfig.Kubeconfig != "" {
+		kubernetesClient, err = GetKubernetesClientFromKubeconfig(config.KubernetesConfig.Kubeconfig)
+	} else {
+		kubernetesClient, err = GetKubernetesClient()
+	}
 	if err != nil {
 		logger.Error("Unable to initialize Kubernetes client: " + err.Error())
 		logger.Warn("Metadata dependent on the Kubernetes API will not be collected.")
 	}
 
+	// Pod metadata is kept up to date by watching the pods of this node
+	var podCache *KubernetesPodCache
+	if kubernetesClient != nil {
+		nodeName := config.KubernetesConfig.NodeName
+		if nodeName == "" {
+			logger.Warn("The node name is unknown, set --node-name or TIMBER_AGENT_NODE_NAME to only watch the pods of this node")
+		}
+
+		podCache = NewKubernetesPodCache(kubernetesClient, nodeName)
+		go podCache.Run(quit)
+	}
+
+	// Events of the cluster are forwarded by the agent holding the events Lease
+	if events := config.KubernetesConfig.Events; events != nil && events.Enabled {
+		// Events sent with their own API key go to the Timber endpoint rather than the configured sinks
+		eventSinkNames, eventsApiKey := config.DefaultSinks, apiKey
+		if events.ApiKey != "" {
+			eventSinkNames, eventsApiKey = nil, events.ApiKey
+		}
+
+		identity, _ := os.Hostname()
+		switch {
+		case kubernetesClient == nil:
+			logger.Error("Kubernetes events will not be forwarded without access to the Kubernetes API")
+		case eventsApiKey == "" && len(eventSinkNames) == 0:
+			logger.Error("Kubernetes events will not be forwarded, there is no API key to forward them with")
+		default:
+			forwarder := NewKubernetesEventsForwarder(kubernetesClient, events, identity)
+			eventSinks := selectSinks(eventSinkNames, sinks, config.Endpoint, eventsApiKey, compression)
+
+			go func() {
+				if err := ForwardKubernetesEvents(forwarder, eventSinks, config.BatchPeriodSeconds, spool, metadata, quit); err != nil {
+					logger.Error(err)
+				}
+			}()
+		}
+	}
+
 	// Start global state flush timer
 	go globalState.Start()
 
@@ -450,14 +883,57 @@ func runCaptureKube(ctx *cli.Context) {
 		logger.Infof("Received file %s, attempting to forward", fileConfig.Path)
 
 		go func(fileConfig *FileConfig) {
-			forwardFile, stop, currentMetadata := CollectAndProcessKubernetesMetadata(kubernetesClient, config.KubernetesConfig, fileConfig.Path, metadata)
-			if !forwardFile {
-				return
-			}
-
-			err = ForwardFile(fileConfig.Path, config.ReadNewFileFromStart, config.Endpoint, fileConfig.ApiKey, config.Poll, config.BatchPeriodSeconds, currentMetadata, quit, stop)
-			if err != nil {
-				logger.Error(err)
+			readNewFileFromStart := config.readFromStart(fileConfig)
+
+			for {
+				// Closed once this attempt to forward the file ends, which stops following its pod
+				done := make(chan bool)
+				forwardFile, stop, currentMetadata, metadataUpdates := CollectAndProcessKubernetesMetadata(podCache, config.KubernetesConfig, fileConfig.Path, metadata, quit, done)
+				if !forwardFile {
+					close(done)
+					// Exclusions are evaluated again when the labels or annotations of the pod change. Lines written
+					// while the file was excluded are not forwarded.
+					if !podCache.waitForFilePodChange(fileConfig.Path, quit) {
+						break
+					}
+					globalState.deleteState(fileConfig.Path)
+					readNewFileFromStart = false
+					continue
+				}
+
+				// The first route matching the file's pod sets the API key and endpoint, annotations of the pod
+				// override the API key and multiline configuration. Logs sent with the API key of a route or of the
+				// pod go to the Timber endpoint rather than the configured sinks.
+				context := currentMetadata.kubernetesContext()
+				sinkNames, endpoint, routeApiKey := kubernetesRouteDestination(config.KubernetesConfig, context, fileConfig.Sinks, config.Endpoint, fileConfig.ApiKey)
+				apiKey, multiline := kubernetesAnnotationOverrides(kubernetesClient, context, routeApiKey, fileConfig.Multiline)
+				if apiKey != routeApiKey {
+					sinkNames = nil
+				}
+
+				if apiKey == "" && len(sinkNames) == 0 {
+					// Routes are evaluated again when the labels or annotations of the pod change
+					logger.Errorf("File %s matches no Kubernetes route and there is no API key to forward it with", fileConfig.Path)
+					close(done)
+					if !podCache.waitForFilePodChange(fileConfig.Path, quit) {
+						break
+					}
+					globalState.deleteState(fileConfig.Path)
+					readNewFileFromStart = false
+					continue
+				}
+
+				err := ForwardFile(fileConfig.Path, readNewFileFromStart, config.Poll, config.BatchPeriodSeconds, true, multiline, spool, selectSinks(sinkNames, sinks, endpoint, apiKey, compression), currentMetadata, metadataUpdates, quit, stop)
+				close(done)
+				if err != nil {
+					logger.Error(err)
+				}
+
+				// The file is forwarded again when it was stopped because of a change to its pod, unless the agent is
+				// shutting down
+				if stop == nil || !isClosed(stop) || isClosed(quit) {
+					break
+				}
 			}
 
 			logger.Infof("Forwarding goroutine quit for %s", fileConfig.Path)
@@ -471,3 +947,74 @@ func runCaptureKube(ctx *cli.Context) {
 	// Wait for graceful cleanup as handled in signals.go
 	select {}
 }
+
+// Entry point for validating the configuration
+func runValidate(ctx *cli.Context) error {
+	// The report is written to STDOUT, the agent's own logs are limited to warnings on STDERR
+	logger.Out = os.Stderr
+	logger.Level = logrus.WarnLevel
+
+	stateFilePath := ctx.String("statefile")
+	if stateFilePath == "" {
+		stateFilePath = DefaultGlobalStateFilename()
+	}
+
+	problems := ValidateConfigFile(ctx.String("config"), stateFilePath, ctx.Bool("probe"), os.Stdout)
+	if problems > 0 {
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		os.Exit(65)
+	}
+
+	return nil
+}
+
+// Opens the spool if one is configured, exiting if it cannot be used. Returns nil when spooling is disabled.
+func openSpool(config *Config) *Spool {
+	if config.Spool == nil {
+		return nil
+	}
+
+	spool, err := OpenSpool(config.Spool)
+	if err != nil {
+		logger.Errorf("Failed to open spool: %s", err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		os.Exit(65)
+	}
+
+	return spool
+}
+
+// Builds the sinks declared in the configuration, exiting if any of them cannot be used
+func buildSinks(config *Config) map[string]Sink {
+	sinks, err := NewSinks(config.Sinks)
+	if err != nil {
+		logger.Errorf("Failed to configure sinks: %s", err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		os.Exit(65)
+	}
+
+	return sinks
+}
+
+// Starts the metrics server if an address is given, exiting if the address cannot be listened on
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+
+	if err := ServeMetrics(addr); err != nil {
+		logger.Errorf("Failed to serve metrics on %s: %s", addr, err)
+		// Exit with 65, EX_DATAERR, to indicate input data was incorrect
+		os.Exit(65)
+	}
+}
+
+// Reports whether the channel has been closed, without blocking
+func isClosed(ch chan bool) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
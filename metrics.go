@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics about the agent itself. They are kept in memory and exposed in the Prometheus text format when the
+// --metrics-addr flag is set.
+var (
+	linesReadMetric = newMetricVec("timber_agent_lines_read_total", "counter",
+		"Number of lines read from each source.", "source")
+	bytesSentMetric = newMetricVec("timber_agent_bytes_sent_total", "counter",
+		"Number of bytes delivered to each sink, after compression.", "sink")
+	batchesSentMetric = newMetricVec("timber_agent_batches_sent_total", "counter",
+		"Number of batches delivered to each sink.", "sink")
+	batchErrorsMetric = newMetricVec("timber_agent_batch_errors_total", "counter",
+		"Number of batches that could not be delivered to each sink.", "sink")
+	httpResponsesMetric = newMetricVec("timber_agent_http_responses_total", "counter",
+		"Number of HTTP responses received, including those that were retried.", "host", "code")
+	httpRetriesMetric = newMetricVec("timber_agent_http_retries_total", "counter",
+		"Number of HTTP requests that were retried.", "host")
+	droppedLinesMetric = newMetricVec("timber_agent_dropped_lines_total", "counter",
+		"Number of lines dropped before being batched.", "reason")
+	oversizeLinesMetric = newMetricVec("timber_agent_oversize_lines_total", "counter",
+		"Number of lines longer than the max event size, by the oversize policy applied to them.", "policy")
+	httpIngestRequestsMetric = newMetricVec("timber_agent_http_ingest_requests_total", "counter",
+		"Number of requests received by the HTTP ingest listener, by response code.", "code")
+)
+
+var registeredMetrics = []*metricVec{
+	linesReadMetric,
+	bytesSentMetric,
+	batchesSentMetric,
+	batchErrorsMetric,
+	httpResponsesMetric,
+	httpRetriesMetric,
+	droppedLinesMetric,
+	oversizeLinesMetric,
+	httpIngestRequestsMetric,
+}
+
+// metricVec is a metric with one value per combination of label values
+type metricVec struct {
+	sync.Mutex
+
+	name       string
+	metricType string
+	help       string
+	labels     []string
+	values     map[string]float64
+}
+
+func newMetricVec(name, metricType, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:       name,
+		metricType: metricType,
+		help:       help,
+		labels:     labels,
+		values:     make(map[string]float64),
+	}
+}
+
+// Inc adds one to the value for the given label values
+func (m *metricVec) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Add adds delta to the value for the given label values, which must be given in the order the labels were declared
+func (m *metricVec) Add(delta float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.values[strings.Join(labelValues, "\xff")] += delta
+}
+
+// Set replaces the value for the given label values
+func (m *metricVec) Set(value float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.values[strings.Join(labelValues, "\xff")] = value
+}
+
+// Delete removes the value for the given label values, so that sources that are no longer read, such as rotated
+// files, do not accumulate
+func (m *metricVec) Delete(labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.values, strings.Join(labelValues, "\xff"))
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.metricType)
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		labelValues := strings.Split(key, "\xff")
+		pairs := make([]string, len(m.labels))
+		for i, label := range m.labels {
+			pairs[i] = fmt.Sprintf("%s=\"%s\"", label, escapeLabelValue(labelValues[i]))
+		}
+
+		fmt.Fprintf(w, "%s{%s} %g\n", m.name, strings.Join(pairs, ","), m.values[key])
+	}
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// fileLagMetric reports how many bytes of each tailed file have not been delivered yet, computed from the offset in
+// the global state and the current size of the file. Files that can no longer be read are left out.
+func fileLagMetric() *metricVec {
+	lag := newMetricVec("timber_agent_file_lag_bytes", "gauge",
+		"Number of bytes of each tailed file that have not been delivered yet.", "file")
+
+	for filename, offset := range globalState.offsets() {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+
+		behind := stat.Size() - offset
+		if behind < 0 {
+			// The file was truncated and has not been reopened yet
+			behind = 0
+		}
+
+		lag.Set(float64(behind), filename)
+	}
+
+	return lag
+}
+
+// WriteMetrics writes every metric in the Prometheus text exposition format
+func WriteMetrics(w io.Writer) {
+	for _, metric := range registeredMetrics {
+		metric.write(w)
+	}
+
+	fileLagMetric().write(w)
+}
+
+// ServeMetrics listens on addr and serves metrics at /metrics in the background. An error is returned if the address
+// cannot be listened on.
+func ServeMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Errorf("Metrics server stopped: %s", err)
+		}
+	}()
+
+	logger.Infof("Serving metrics at http://%s/metrics", listener.Addr())
+
+	return nil
+}
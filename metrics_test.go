@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetricVecWrite(test *testing.T) {
+	metric := newMetricVec("test_responses_total", "counter", "Test responses.", "host", "code")
+	metric.Inc("logs.timber.io", "200")
+	metric.Add(2, "logs.timber.io", "500")
+	metric.Inc("logs.timber.io", "200")
+
+	var buf bytes.Buffer
+	metric.write(&buf)
+
+	expected := `# HELP test_responses_total Test responses.
+# TYPE test_responses_total counter
+test_responses_total{host="logs.timber.io",code="200"} 2
+test_responses_total{host="logs.timber.io",code="500"} 2
+`
+	if buf.String() != expected {
+		test.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestMetricVecEscapesLabelValues(test *testing.T) {
+	metric := newMetricVec("test_lines_total", "counter", "Test lines.", "source")
+	metric.Inc(`C:\logs\"app".log`)
+
+	var buf bytes.Buffer
+	metric.write(&buf)
+
+	if !strings.Contains(buf.String(), `test_lines_total{source="C:\\logs\\\"app\".log"} 1`) {
+		test.Fatalf("expected label value to be escaped, got:\n%s", buf.String())
+	}
+}
+
+func TestFileLagMetric(test *testing.T) {
+	file, err := ioutil.TempFile("", "metrics-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.Write([]byte("first line\nsecond line\n"))
+	file.Close()
+
+	globalState = NewGlobalState()
+	UpdateState(file.Name(), 12345, 11)
+	UpdateState("/does/not/exist.log", 12345, 11)
+	globalState.startTailing(file.Name())
+	globalState.startTailing("/does/not/exist.log")
+
+	var buf bytes.Buffer
+	fileLagMetric().write(&buf)
+
+	if !strings.Contains(buf.String(), "timber_agent_file_lag_bytes{file=\""+file.Name()+"\"} 12\n") {
+		test.Fatalf("expected a lag of 12 bytes, got:\n%s", buf.String())
+	}
+
+	if strings.Contains(buf.String(), "/does/not/exist.log") {
+		test.Fatalf("expected missing files to be left out, got:\n%s", buf.String())
+	}
+}
+
+func TestFileLagMetricLeavesOutFilesNoLongerTailed(test *testing.T) {
+	file, err := ioutil.TempFile("", "metrics-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(file.Name())
+
+	globalState = NewGlobalState()
+	UpdateState(file.Name(), 12345, 0)
+
+	var buf bytes.Buffer
+	fileLagMetric().write(&buf)
+
+	if strings.Contains(buf.String(), file.Name()) {
+		test.Fatalf("expected files that are not tailed to be left out, got:\n%s", buf.String())
+	}
+}
+
+func TestMetricVecDelete(test *testing.T) {
+	metric := newMetricVec("test_lines_total", "counter", "Test lines.", "source")
+	metric.Inc("/var/log/app.log")
+	metric.Inc("/var/log/app.log.1")
+	metric.Delete("/var/log/app.log.1")
+
+	var buf bytes.Buffer
+	metric.write(&buf)
+
+	if strings.Contains(buf.String(), "app.log.1") || !strings.Contains(buf.String(), `source="/var/log/app.log"} 1`) {
+		test.Fatalf("expected only the deleted series to be removed, got:\n%s", buf.String())
+	}
+}
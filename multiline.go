@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"time"
+)
+
+const (
+	defaultMultilineMaxLines                 = 500
+	defaultMultilineFlushTimeoutMilliseconds = 1000
+)
+
+// MultilineConfig describes how consecutive lines are merged into a single event, for example to keep a stack trace
+// together. Exactly one of StartPattern or ContinuationPattern must be set.
+type MultilineConfig struct {
+	// Lines matching StartPattern begin a new event, all other lines are appended to the current event
+	StartPattern string `toml:"start_pattern"`
+	// Lines matching ContinuationPattern are appended to the current event, all other lines begin a new event
+	ContinuationPattern string `toml:"continuation_pattern"`
+	// The maximum number of lines in a single event before it is flushed
+	MaxLines int `toml:"max_lines"`
+	// The amount of time to wait for a continuation line before flushing the current event
+	FlushTimeoutMilliseconds int64 `toml:"flush_timeout_milliseconds"`
+
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+}
+
+// Validate Ensures the multiline configuration is usable and compiles its patterns. Must be called before the
+// configuration is handed to NewMultilineTailer.
+func (mc *MultilineConfig) Validate() error {
+	if mc.StartPattern == "" && mc.ContinuationPattern == "" {
+		return errors.New("Multiline configuration requires either start_pattern or continuation_pattern")
+	}
+
+	if mc.StartPattern != "" && mc.ContinuationPattern != "" {
+		return errors.New("Multiline configuration cannot set both start_pattern and continuation_pattern")
+	}
+
+	var err error
+	if mc.StartPattern != "" {
+		mc.start, err = regexp.Compile(mc.StartPattern)
+	} else {
+		mc.continuation, err = regexp.Compile(mc.ContinuationPattern)
+	}
+	if err != nil {
+		return err
+	}
+
+	if mc.MaxLines <= 0 {
+		mc.MaxLines = defaultMultilineMaxLines
+	}
+
+	if mc.FlushTimeoutMilliseconds <= 0 {
+		mc.FlushTimeoutMilliseconds = defaultMultilineFlushTimeoutMilliseconds
+	}
+
+	return nil
+}
+
+// startsEvent reports whether line begins a new event rather than continuing the current one
+func (mc *MultilineConfig) startsEvent(line []byte) bool {
+	if mc.start != nil {
+		return mc.start.Match(line)
+	}
+
+	return !mc.continuation.Match(line)
+}
+
+// MultilineTailer Wraps another Tailer and merges continuation lines into a single *LogMessage. The merged message
+// carries the position of its last line and the container context of its first, so that state is only ever recorded
+// at the end of a complete event. Events of several lines are batched as JSON, see encodeEventLine.
+type MultilineTailer struct {
+	lines chan *LogMessage
+}
+
+func NewMultilineTailer(inner Tailer, config *MultilineConfig) *MultilineTailer {
+	ch := make(chan *LogMessage)
+	timeout := time.Duration(config.FlushTimeoutMilliseconds) * time.Millisecond
+
+	go func() {
+		var pending *LogMessage
+		var pendingLines int
+
+		timer := time.NewTimer(timeout)
+		stopTimer := func() {
+			// Drain the channel if the timer already fired so that a stale tick does not flush the next event early
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+		stopTimer()
+
+		flush := func() {
+			if pending != nil {
+				ch <- pending
+				pending = nil
+				pendingLines = 0
+			}
+			stopTimer()
+		}
+
+		for {
+			select {
+			case message, ok := <-inner.Lines():
+				if !ok {
+					flush()
+					close(ch)
+					return
+				}
+
+				if pending != nil && config.startsEvent(message.Lines) {
+					flush()
+				}
+
+				if pending == nil {
+					pending = &LogMessage{
+						Filename:   message.Filename,
+						Lines:      append([]byte(nil), message.Lines...),
+						Position:   message.Position,
+						Container:  message.Container,
+						generation: message.generation,
+					}
+				} else {
+					var buf bytes.Buffer
+					buf.Write(pending.Lines)
+					buf.WriteByte('\n')
+					buf.Write(message.Lines)
+
+					pending.Lines = buf.Bytes()
+					pending.Position = message.Position
+					pending.generation = message.generation
+				}
+				pendingLines++
+
+				if pendingLines >= config.MaxLines {
+					flush()
+				} else {
+					stopTimer()
+					timer.Reset(timeout)
+				}
+
+			case <-timer.C:
+				flush()
+			}
+		}
+	}()
+
+	return &MultilineTailer{lines: ch}
+}
+
+func (m *MultilineTailer) Lines() chan *LogMessage {
+	return m.lines
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// staticTailer is a Tailer fed directly from a channel
+type staticTailer struct {
+	lines chan *LogMessage
+}
+
+func (s *staticTailer) Lines() chan *LogMessage {
+	return s.lines
+}
+
+func newMultilineTestTailer(config *MultilineConfig) (*staticTailer, *MultilineTailer) {
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+
+	inner := &staticTailer{lines: make(chan *LogMessage)}
+	return inner, NewMultilineTailer(inner, config)
+}
+
+func expectMessage(test *testing.T, tailer Tailer, expectedLines string, expectedPosition int64) {
+	select {
+	case message := <-tailer.Lines():
+		if string(message.Lines) != expectedLines {
+			test.Fatalf("expected \"%s\", got \"%s\"", expectedLines, message.Lines)
+		}
+
+		if message.Position != expectedPosition {
+			test.Fatalf("expected position %d, got %d", expectedPosition, message.Position)
+		}
+	case <-time.After(5 * time.Second):
+		test.Fatalf("timed out expecting \"%s\"", expectedLines)
+	}
+}
+
+func TestMultilineConfigValidateRequiresPattern(test *testing.T) {
+	config := &MultilineConfig{}
+
+	if err := config.Validate(); err == nil {
+		test.Fatal("expected validation to fail without a pattern")
+	}
+}
+
+func TestMultilineConfigValidateRejectsBothPatterns(test *testing.T) {
+	config := &MultilineConfig{StartPattern: "^a", ContinuationPattern: "^b"}
+
+	if err := config.Validate(); err == nil {
+		test.Fatal("expected validation to fail with both patterns set")
+	}
+}
+
+func TestMultilineConfigValidateSetsDefaults(test *testing.T) {
+	config := &MultilineConfig{StartPattern: "^a"}
+
+	if err := config.Validate(); err != nil {
+		test.Fatal(err)
+	}
+
+	if config.MaxLines != defaultMultilineMaxLines {
+		test.Fatalf("expected max lines to default to %d, got %d", defaultMultilineMaxLines, config.MaxLines)
+	}
+
+	if config.FlushTimeoutMilliseconds != defaultMultilineFlushTimeoutMilliseconds {
+		test.Fatalf("expected flush timeout to default to %d, got %d", defaultMultilineFlushTimeoutMilliseconds,
+			config.FlushTimeoutMilliseconds)
+	}
+}
+
+func TestMultilineTailerStartPattern(test *testing.T) {
+	inner, tailer := newMultilineTestTailer(&MultilineConfig{StartPattern: `^\d{4}-`})
+
+	go func() {
+		inner.lines <- &LogMessage{Filename: "app.log", Lines: []byte("2018-01-01 first"), Position: 17}
+		inner.lines <- &LogMessage{Filename: "app.log", Lines: []byte("2018-01-01 error"), Position: 34}
+		inner.lines <- &LogMessage{Filename: "app.log", Lines: []byte("  at Foo.bar"), Position: 47}
+		inner.lines <- &LogMessage{Filename: "app.log", Lines: []byte("  at Foo.baz"), Position: 60}
+		inner.lines <- &LogMessage{Filename: "app.log", Lines: []byte("2018-01-01 last"), Position: 76}
+		close(inner.lines)
+	}()
+
+	expectMessage(test, tailer, "2018-01-01 first", 17)
+	expectMessage(test, tailer, "2018-01-01 error\n  at Foo.bar\n  at Foo.baz", 60)
+	expectMessage(test, tailer, "2018-01-01 last", 76)
+
+	if _, ok := <-tailer.Lines(); ok {
+		test.Fatal("expected multiline tailer to close after inner tailer")
+	}
+}
+
+func TestMultilineTailerContinuationPattern(test *testing.T) {
+	inner, tailer := newMultilineTestTailer(&MultilineConfig{ContinuationPattern: `^\s`})
+
+	go func() {
+		inner.lines <- &LogMessage{Lines: []byte("Traceback"), Position: 10}
+		inner.lines <- &LogMessage{Lines: []byte("  File \"x.py\""), Position: 24}
+		inner.lines <- &LogMessage{Lines: []byte("ValueError"), Position: 35}
+		close(inner.lines)
+	}()
+
+	expectMessage(test, tailer, "Traceback\n  File \"x.py\"", 24)
+	expectMessage(test, tailer, "ValueError", 35)
+}
+
+func TestMultilineTailerMaxLines(test *testing.T) {
+	inner, tailer := newMultilineTestTailer(&MultilineConfig{ContinuationPattern: `^\s`, MaxLines: 2})
+
+	go func() {
+		inner.lines <- &LogMessage{Lines: []byte("start"), Position: 1}
+		inner.lines <- &LogMessage{Lines: []byte(" one"), Position: 2}
+		inner.lines <- &LogMessage{Lines: []byte(" two"), Position: 3}
+		close(inner.lines)
+	}()
+
+	expectMessage(test, tailer, "start\n one", 2)
+	expectMessage(test, tailer, " two", 3)
+}
+
+func TestMultilineTailerFlushTimeout(test *testing.T) {
+	inner, tailer := newMultilineTestTailer(&MultilineConfig{ContinuationPattern: `^\s`, FlushTimeoutMilliseconds: 10})
+
+	inner.lines <- &LogMessage{Lines: []byte("lonely"), Position: 7}
+
+	// The inner tailer stays open, so only the timeout can flush the pending event
+	expectMessage(test, tailer, "lonely", 7)
+}
+
+func TestMultilineTailerKeepsGeneration(test *testing.T) {
+	inner, tailer := newMultilineTestTailer(&MultilineConfig{ContinuationPattern: `^\s`})
+
+	go func() {
+		inner.lines <- &LogMessage{Filename: "app.log", Lines: []byte("error"), Position: 6, generation: 2}
+		inner.lines <- &LogMessage{Filename: "app.log", Lines: []byte("  at Foo.bar"), Position: 19, generation: 2}
+		close(inner.lines)
+	}()
+
+	message := <-tailer.Lines()
+	if message.generation != 2 {
+		test.Fatalf("expected the merged message to keep generation 2, got %d", message.generation)
+	}
+}
+
+func TestForwardFileSendsMultilineEventsAsOneLine(test *testing.T) {
+	file, err := ioutil.TempFile("", "timber-agent-test")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	globalStateFile, err := ioutil.TempFile("", "timber-agent-test-statefile.json")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(globalStateFile.Name())
+	globalState = NewGlobalState()
+	globalState.Filename = globalStateFile.Name()
+
+	fmt.Fprintln(file, "error")
+	fmt.Fprintln(file, "  at Foo.bar")
+	fmt.Fprintln(file, "done")
+
+	config := &MultilineConfig{ContinuationPattern: `^\s`, FlushTimeoutMilliseconds: 10}
+	if err := config.Validate(); err != nil {
+		test.Fatal(err)
+	}
+
+	sink := &recordingSink{name: "timber"}
+	quit := make(chan bool)
+	defer close(quit)
+	go ForwardFile(file.Name(), true, true, 1, false, config, nil, []Sink{sink}, NewLogEvent(), nil, quit, nil)
+
+	// The receiver splits batches on newlines, which must leave the event in one piece
+	sink.waitForLines(test, `{"message":"error\n  at Foo.bar"}`+"\ndone\n")
+}
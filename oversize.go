@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// The smallest max event size accepted, leaving room for the suffix of truncated lines
+const minEventBytes = 64
+
+// How lines longer than the max event size are handled
+var oversizePolicies = []string{
+	// Lines are cut at the max event size and end with a suffix telling how many bytes were removed
+	"truncate",
+	// Lines are forwarded as consecutive lines of at most the max event size
+	"split",
+	// Lines are not forwarded
+	"drop",
+}
+
+// oversizeSettings is the max event size and the policy for longer lines, set from the configuration. Held in an
+// atomic.Value since it may change when the configuration is reloaded.
+type oversizeSettings struct {
+	policy   string
+	maxBytes int
+}
+
+var oversize atomic.Value
+
+func init() {
+	SetOversizePolicy("", 0)
+}
+
+// SetOversizePolicy sets how lines longer than maxBytes are handled by batchers, for lines batched from now on. An
+// empty policy selects truncate, and zero the largest line a batch can hold.
+func SetOversizePolicy(policy string, maxBytes int) {
+	if policy == "" {
+		policy = "truncate"
+	}
+
+	if maxBytes <= 0 || maxBytes > maxPayloadSize-1 {
+		maxBytes = maxPayloadSize - 1
+	}
+
+	oversize.Store(oversizeSettings{policy: policy, maxBytes: maxBytes})
+}
+
+// applyOversizePolicy returns the lines to batch in place of line, which is line itself unless it is longer than the
+// max event size. source names where the line was read from in the agent's logs.
+func applyOversizePolicy(line []byte, source string) [][]byte {
+	settings := oversize.Load().(oversizeSettings)
+	if len(line) <= settings.maxBytes {
+		return [][]byte{line}
+	}
+
+	oversizeLinesMetric.Inc(settings.policy)
+
+	switch settings.policy {
+	case "drop":
+		logger.Warnf("Dropped a line of %s longer than the max event size (%d bytes)", source, settings.maxBytes)
+		droppedLinesMetric.Inc("oversize")
+		return nil
+	case "split":
+		logger.Warnf("Split a line of %s longer than the max event size (%d bytes)", source, settings.maxBytes)
+		return splitLine(line, settings.maxBytes)
+	default:
+		logger.Warnf("Truncated a line of %s longer than the max event size (%d bytes)", source, settings.maxBytes)
+		return [][]byte{truncateLine(line, settings.maxBytes)}
+	}
+}
+
+// truncateLine cuts line so that, with a suffix telling how many bytes were removed, it is at most maxBytes long
+func truncateLine(line []byte, maxBytes int) []byte {
+	return truncateLineOfLength(line, int64(len(line)), maxBytes)
+}
+
+// truncateLineOfLength behaves like truncateLine for a line of the given length, of which prefix holds at least the
+// first maxBytes bytes
+func truncateLineOfLength(prefix []byte, length int64, maxBytes int) []byte {
+	// The count in the suffix has at most as many digits as the length of the line
+	keep := runeBoundary(prefix, maxBytes-len(truncatedLineSuffix(length)))
+	suffix := truncatedLineSuffix(length - int64(keep))
+
+	truncated := make([]byte, 0, keep+len(suffix))
+	truncated = append(truncated, prefix[:keep]...)
+
+	return append(truncated, suffix...)
+}
+
+func truncatedLineSuffix(removed int64) string {
+	return fmt.Sprintf("…[truncated %d bytes]", removed)
+}
+
+// splitLine cuts line into consecutive chunks of at most maxBytes
+func splitLine(line []byte, maxBytes int) [][]byte {
+	var chunks [][]byte
+	for len(line) > maxBytes {
+		end := runeBoundary(line, maxBytes)
+		chunks = append(chunks, line[:end])
+		line = line[end:]
+	}
+
+	return append(chunks, line)
+}
+
+// runeBoundary returns the largest offset of at most n in line that does not cut a UTF-8 encoded character. Lines
+// that are not valid UTF-8 are cut at n.
+func runeBoundary(line []byte, n int) int {
+	for i := n; i > 0 && i > n-utf8.UTFMax; i-- {
+		if utf8.RuneStart(line[i]) {
+			return i
+		}
+	}
+
+	return n
+}
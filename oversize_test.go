@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestApplyOversizePolicy(t *testing.T) {
+	defer SetOversizePolicy("", 0)
+
+	line := []byte(strings.Repeat("a", 150))
+	cases := []struct {
+		policy   string
+		expected []string
+	}{
+		{"truncate", []string{strings.Repeat("a", 76) + "…[truncated 74 bytes]"}},
+		{"split", []string{strings.Repeat("a", 100), strings.Repeat("a", 50)}},
+		{"drop", nil},
+	}
+
+	for _, c := range cases {
+		SetOversizePolicy(c.policy, 100)
+
+		var lines []string
+		for _, l := range applyOversizePolicy(line, "test.log") {
+			lines = append(lines, string(l))
+		}
+
+		if strings.Join(lines, "|") != strings.Join(c.expected, "|") || len(lines) != len(c.expected) {
+			t.Fatalf("Expected the %s policy to return %q, got %q", c.policy, c.expected, lines)
+		}
+	}
+
+	// Lines within the max event size are left alone
+	if lines := applyOversizePolicy([]byte("short"), "test.log"); len(lines) != 1 || string(lines[0]) != "short" {
+		t.Fatalf("Expected a short line to be returned unchanged, got %q", lines)
+	}
+}
+
+func TestOversizePolicyKeepsCharactersWhole(t *testing.T) {
+	line := []byte(strings.Repeat("é", 100))
+
+	truncated := truncateLine(line, 64)
+	if len(truncated) > 64 || !utf8.Valid(truncated) {
+		t.Fatalf("Expected a valid line of at most 64 bytes, got %q", truncated)
+	}
+
+	chunks := splitLine(line, 63)
+	if !bytes.Equal(bytes.Join(chunks, nil), line) {
+		t.Fatal("Expected the chunks to hold the whole line")
+	}
+	for _, chunk := range chunks {
+		if len(chunk) > 63 || !utf8.Valid(chunk) {
+			t.Fatalf("Expected valid chunks of at most 63 bytes, got %q", chunk)
+		}
+	}
+}
+
+// Batch()
+// Log lines larger than the max payload size (1 MB) are truncated by default
+func TestBatchTruncatesLogLine(t *testing.T) {
+	lines := make(chan *LogMessage)
+	bufChan := make(chan *LogMessage)
+
+	go Batch(lines, bufChan, 10)
+	lines <- &LogMessage{Lines: bytes.Repeat([]byte("a"), maxPayloadSize+100)}
+	close(lines)
+
+	batch := <-bufChan
+	if batch == nil || len(batch.Lines) > maxPayloadSize || !bytes.HasSuffix(batch.Lines, []byte(" bytes]\n")) {
+		t.Fatal("Expected the line to be truncated to fit in a batch")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// How often the config file is checked for changes when --watch-config is set
+const configWatchInterval = 10 * time.Second
+
+// watchConfigFile requests a reload whenever the modification time or size of the file at path changes, until quit
+// is closed
+func watchConfigFile(path string, reload chan bool, quit chan bool) {
+	last := configFileVersion(path)
+
+	ticker := time.NewTicker(configWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			current := configFileVersion(path)
+			if current != last {
+				logger.Infof("Config file %s changed, reloading configuration...", path)
+				last = current
+				requestReload(reload)
+			}
+
+		case <-quit:
+			return
+		}
+	}
+}
+
+func configFileVersion(path string) string {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("%d:%d", stat.ModTime().UnixNano(), stat.Size())
+}
+
+// fileSupervisor owns the globbing and forwarding goroutines of capture-files, which allows the configuration to be
+// replaced while the agent is running. Globs are started and stopped as [[files]] entries are added and removed, and
+// files whose settings changed are forwarded again with the new settings. A forwarder is always drained before it is
+// replaced, so the offsets recorded in the global state carry over.
+//
+// The supervisor is not safe for concurrent use; Run does all of the bookkeeping on a single goroutine.
+type fileSupervisor struct {
+	spool    *Spool
+	metadata *LogEvent
+	quit     chan bool
+
+	config      *Config
+	sinks       map[string]Sink
+	compression *Compression
+
+	// Files discovered by the globbing goroutines are sent here
+	fileConfigs chan *FileConfig
+	globs       map[string]*supervisedGlob
+	forwarders  map[string]*supervisedForwarder
+	// Closed once the stopped forwarder of a file has handled every line it read
+	draining map[string]chan bool
+}
+
+type supervisedGlob struct {
+	fileConfig FileConfig
+	stop       chan bool
+}
+
+type supervisedForwarder struct {
+	// The settings the file is forwarded with. Path is the path of the file.
+	fileConfig FileConfig
+	stop       chan bool
+	done       chan bool
+}
+
+func newFileSupervisor(config *Config, sinks map[string]Sink, spool *Spool, metadata *LogEvent, quit chan bool) *fileSupervisor {
+	compression, _ := NewCompression(config.Compression, config.CompressionLevel)
+
+	return &fileSupervisor{
+		spool:       spool,
+		metadata:    metadata,
+		quit:        quit,
+		config:      config,
+		sinks:       sinks,
+		compression: compression,
+		fileConfigs: make(chan *FileConfig),
+		globs:       make(map[string]*supervisedGlob),
+		forwarders:  make(map[string]*supervisedForwarder),
+		draining:    make(map[string]chan bool),
+	}
+}
+
+// Run starts discovering the configured files and forwards them until quit is closed. Each value received on reload
+// replaces the configuration with the one returned by loadConfig. If loading fails, the current configuration is kept.
+func (s *fileSupervisor) Run(reload chan bool, loadConfig func() (*Config, error)) {
+	for _, fileConfig := range globFileConfigs(s.config) {
+		s.startGlob(fileConfig)
+	}
+
+	for {
+		select {
+		case fileConfig := <-s.fileConfigs:
+			s.forward(fileConfig)
+
+		case <-reload:
+			config, err := loadConfig()
+			if err != nil {
+				logger.Errorf("Failed to reload configuration, keeping the current configuration: %s", err)
+				continue
+			}
+
+			if err := s.Reload(config); err != nil {
+				logger.Errorf("Failed to reload configuration, keeping the current configuration: %s", err)
+			}
+
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Reload applies a new, validated configuration. Offsets in the global state are kept for every file.
+func (s *fileSupervisor) Reload(config *Config) error {
+	sinks, err := NewSinks(config.Sinks)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(s.config.Spool, config.Spool) {
+		logger.Warn("Spool settings changed, they will be applied the next time the agent starts")
+		config.Spool = s.config.Spool
+	}
+
+	restartAll := forwardingSettingsChanged(s.config, config)
+
+	SetFingerprintMaxBytes(config.FingerprintBytes)
+	SetOversizePolicy(config.OversizePolicy, config.MaxEventBytes)
+	globalState.SetStateTTL(config.StateTTL())
+
+	s.config = config
+	s.sinks = sinks
+	s.compression, _ = NewCompression(config.Compression, config.CompressionLevel)
+
+	fileConfigs := globFileConfigs(config)
+
+	for path, glob := range s.globs {
+		if _, ok := fileConfigs[path]; !ok {
+			logger.Infof("Stopped discovering files for %s", path)
+			close(glob.stop)
+			delete(s.globs, path)
+		}
+	}
+
+	for path, fileConfig := range fileConfigs {
+		if glob, ok := s.globs[path]; ok {
+			glob.fileConfig = fileConfig
+		} else {
+			s.startGlob(fileConfig)
+		}
+	}
+
+	for _, path := range s.forwardedPaths() {
+		forwarder := s.forwarders[path]
+
+		glob := s.globFor(path, forwarder.fileConfig.glob)
+		if glob == nil {
+			logger.Infof("Stopping forward for %s, it is no longer configured", path)
+			s.stopForwarder(path)
+			continue
+		}
+
+		if restartAll || forwarder.fileConfig.glob != glob.fileConfig.Path || !sameFileSettings(forwarder.fileConfig, glob.fileConfig) {
+			logger.Infof("Settings for %s changed, restarting forward", path)
+			s.stopForwarder(path)
+			s.startForwarder(path, glob.fileConfig, false)
+		}
+	}
+
+	logger.Info("Configuration reloaded")
+
+	return nil
+}
+
+func (s *fileSupervisor) startGlob(fileConfig FileConfig) {
+	glob := &supervisedGlob{fileConfig: fileConfig, stop: make(chan bool)}
+	s.globs[fileConfig.Path] = glob
+
+	go func() {
+		err := GlobContinually(fileConfig, s.fileConfigs, glob.stop)
+		if err != nil {
+			logger.Error(err)
+		} else {
+			logger.Infof("Globbing goroutine quit for %s", fileConfig.Path)
+		}
+	}()
+}
+
+// forward starts forwarding a discovered file with the current settings of the glob that discovered it
+func (s *fileSupervisor) forward(fileConfig *FileConfig) {
+	glob, ok := s.globs[fileConfig.glob]
+	if !ok {
+		// Discovered by a glob that has been removed since
+		return
+	}
+
+	logger.Infof("Received file %s, attempting to foward", fileConfig.Path)
+
+	// Check to see if we already tailing file, if so do not duplicate
+	if _, ok := s.forwarders[fileConfig.Path]; ok {
+		logger.Warnf("Already tailing file: %s", fileConfig.Path)
+		return
+	}
+
+	s.startForwarder(fileConfig.Path, glob.fileConfig, fileConfig.discoveredLater)
+}
+
+// startForwarder forwards the file at path with the settings of the given glob. If the file was forwarded before,
+// forwarding starts once the previous forwarder has been drained so that the file is never tailed twice.
+// discoveredLater is set for files created while the agent runs, see Config.readFromStart.
+func (s *fileSupervisor) startForwarder(path string, globConfig FileConfig, discoveredLater bool) {
+	after := s.draining[path]
+	delete(s.draining, path)
+
+	fileConfig := globConfig
+	fileConfig.Path = path
+	fileConfig.glob = globConfig.Path
+	fileConfig.discoveredLater = discoveredLater
+
+	forwarder := &supervisedForwarder{fileConfig: fileConfig, stop: make(chan bool), done: make(chan bool)}
+	s.forwarders[path] = forwarder
+
+	config := s.config
+	sinks := selectSinks(fileConfig.Sinks, s.sinks, config.Endpoint, fileConfig.ApiKey, s.compression)
+
+	go func() {
+		defer close(forwarder.done)
+
+		if after != nil {
+			<-after
+		}
+
+		err := ForwardFile(path, config.readFromStart(&fileConfig), config.Poll, config.BatchPeriodSeconds, false, fileConfig.Multiline, s.spool, sinks, s.metadata, nil, s.quit, forwarder.stop)
+		if err != nil {
+			logger.Error(err)
+		}
+		logger.Infof("Forwarding goroutine quit for %s", path)
+	}()
+}
+
+// stopForwarder stops forwarding the file at path
+func (s *fileSupervisor) stopForwarder(path string) {
+	forwarder := s.forwarders[path]
+	delete(s.forwarders, path)
+	close(forwarder.stop)
+
+	s.draining[path] = forwarder.done
+}
+
+func (s *fileSupervisor) forwardedPaths() []string {
+	paths := make([]string, 0, len(s.forwarders))
+	for path := range s.forwarders {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// globFor returns the glob a file should be forwarded with: the one it was discovered by if it is still configured,
+// otherwise any other configured glob matching the file. Returns nil if there is none.
+func (s *fileSupervisor) globFor(path string, discoveredBy string) *supervisedGlob {
+	if glob, ok := s.globs[discoveredBy]; ok {
+		return glob
+	}
+
+	for globPath, glob := range s.globs {
+		if matched, _ := filepath.Match(globPath, path); matched {
+			return glob
+		}
+	}
+
+	return nil
+}
+
+// globFileConfigs returns the file configurations keyed by their path. Only the first of duplicate paths is used.
+func globFileConfigs(config *Config) map[string]FileConfig {
+	fileConfigs := make(map[string]FileConfig)
+
+	for _, fileConfig := range config.Files {
+		// Check to see if we already looping on glob, if so do not duplicate
+		if _, ok := fileConfigs[fileConfig.Path]; ok {
+			logger.Warnf("Ignoring duplicate glob pattern: %s", fileConfig.Path)
+			continue
+		}
+
+		fileConfigs[fileConfig.Path] = fileConfig
+	}
+
+	return fileConfigs
+}
+
+// forwardingSettingsChanged reports whether settings shared by every forwarded file differ between the configurations
+func forwardingSettingsChanged(previous, current *Config) bool {
+	return previous.Endpoint != current.Endpoint ||
+		previous.BatchPeriodSeconds != current.BatchPeriodSeconds ||
+		previous.Poll != current.Poll ||
+		previous.ReadNewFileFromStart != current.ReadNewFileFromStart ||
+		previous.StartPosition != current.StartPosition ||
+		previous.Compression != current.Compression ||
+		previous.CompressionLevel != current.CompressionLevel ||
+		!reflect.DeepEqual(previous.Sinks, current.Sinks)
+}
+
+// sameFileSettings reports whether two file configurations forward with the same settings, ignoring their paths
+func sameFileSettings(a, b FileConfig) bool {
+	return a.ApiKey == b.ApiKey && reflect.DeepEqual(a.Sinks, b.Sinks) && sameMultiline(a.Multiline, b.Multiline)
+}
+
+func sameMultiline(a, b *MultilineConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.StartPattern == b.StartPattern &&
+		a.ContinuationPattern == b.ContinuationPattern &&
+		a.MaxLines == b.MaxLines &&
+		a.FlushTimeoutMilliseconds == b.FlushTimeoutMilliseconds
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReloadTestConfig(outPath string, files ...string) *Config {
+	configString := fmt.Sprintf(`
+default_sinks = ["out"]
+
+[[sinks]]
+name = "out"
+type = "file"
+path = "%s"
+`, outPath)
+
+	for _, file := range files {
+		configString += fmt.Sprintf("\n[[files]]\npath = \"%s\"\n", file)
+	}
+
+	config := NewConfig()
+	if err := config.UpdateFromReader(strings.NewReader(configString)); err != nil {
+		panic(err)
+	}
+
+	config.BatchPeriodSeconds = 1
+	config.Poll = true
+	config.ReadNewFileFromStart = true
+
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
+
+	return config
+}
+
+func appendToFile(path string, contents string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	file.WriteString(contents)
+}
+
+func waitForFileContents(test *testing.T, path string, expected string) {
+	var contents []byte
+	for i := 0; i < 50; i++ {
+		contents, _ = ioutil.ReadFile(path)
+		if string(contents) == expected {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	test.Fatalf("expected %s to contain %q, got %q", path, expected, contents)
+}
+
+func TestFileSupervisorReload(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-agent-reload-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	globalState = NewGlobalState()
+
+	outPath := filepath.Join(dir, "out")
+	firstPath := filepath.Join(dir, "first.log")
+	secondPath := filepath.Join(dir, "second.log")
+
+	// Files are kept longer than the checksummed prefix so that appending does not look like a new file
+	header := strings.Repeat("x", 300) + "\n"
+	appendToFile(firstPath, header)
+	appendToFile(secondPath, "three\n")
+
+	configs := make(chan *Config, 1)
+	loadConfig := func() (*Config, error) {
+		return <-configs, nil
+	}
+
+	config := newReloadTestConfig(outPath, firstPath)
+	sinks, err := NewSinks(config.Sinks)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	quit := make(chan bool)
+	defer close(quit)
+
+	reload := make(chan bool)
+	go newFileSupervisor(config, sinks, nil, NewLogEvent(), quit).Run(reload, loadConfig)
+
+	waitForFileContents(test, outPath, header)
+
+	// Changing the batch period restarts forwarding, which must resume from the recorded offset
+	changed := newReloadTestConfig(outPath, firstPath)
+	changed.BatchPeriodSeconds = 2
+	configs <- changed
+	reload <- true
+
+	appendToFile(firstPath, "two\n")
+	waitForFileContents(test, outPath, header+"two\n")
+
+	// Replacing the glob stops forwarding the first file and starts forwarding the second
+	configs <- newReloadTestConfig(outPath, secondPath)
+	reload <- true
+
+	waitForFileContents(test, outPath, header+"two\nthree\n")
+
+	appendToFile(firstPath, "four\n")
+	time.Sleep(1500 * time.Millisecond)
+
+	contents, _ := ioutil.ReadFile(outPath)
+	if strings.Contains(string(contents), "four") {
+		test.Fatalf("expected the removed file to no longer be forwarded, got %q", contents)
+	}
+}
+
+func TestSameFileSettings(test *testing.T) {
+	a := FileConfig{Path: "/var/log/*.log", ApiKey: "abc", Multiline: &MultilineConfig{StartPattern: "^\\S"}}
+	b := FileConfig{Path: "/var/log/app.log", ApiKey: "abc", Multiline: &MultilineConfig{StartPattern: "^\\S"}}
+
+	if !sameFileSettings(a, b) {
+		test.Error("expected settings that only differ in path to be the same")
+	}
+
+	b.ApiKey = "def"
+	if sameFileSettings(a, b) {
+		test.Error("expected a changed API key to be detected")
+	}
+
+	b.ApiKey = "abc"
+	b.Multiline = nil
+	if sameFileSettings(a, b) {
+		test.Error("expected a removed multiline configuration to be detected")
+	}
+}
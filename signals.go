@@ -41,3 +41,29 @@ func handleSignals() chan bool {
 
 	return quit
 }
+
+// handleReloadSignal returns a channel that receives a value each time the OS
+// sends SIGHUP, requesting the agent to reload its configuration. Signals
+// received while a reload is still pending are coalesced.
+func handleReloadSignal() chan bool {
+	reload := make(chan bool, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for signal := range signals {
+			logger.Infof("got %s, reloading configuration...", signal)
+			requestReload(reload)
+		}
+	}()
+
+	return reload
+}
+
+// requestReload queues a reload unless one is already pending
+func requestReload(reload chan bool) {
+	select {
+	case reload <- true:
+	default:
+	}
+}
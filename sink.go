@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// The name of the sink built from the top level endpoint and a file's API key when a file does not name any sinks
+const defaultSinkName = "default"
+
+// Sink is a destination that batches of log lines are delivered to. Delivery offsets are tracked per sink name, so
+// names must be unique. A sink may be fed by several sources at once, so Deliver must be safe for concurrent use.
+type Sink interface {
+	Name() string
+	// Compression returns how batches for the sink are compressed, nil if they are not
+	Compression() *Compression
+	// Deliver sends a batch along with its encoded metadata. An error means the batch was not delivered and will not
+	// be retried by the caller.
+	Deliver(message *LogMessage, metadata []byte) error
+}
+
+// SinkConfig declares a named sink in the configuration file. Which fields apply depends on the type.
+type SinkConfig struct {
+	Name             string
+	Type             string
+	Endpoint         string
+	ApiKey           string `toml:"api_key"`
+	Path             string
+	Compression      string
+	CompressionLevel int `toml:"compression_level"`
+}
+
+type sinkConstructor func(config *SinkConfig, compression *Compression) (Sink, error)
+
+var sinkTypes = map[string]sinkConstructor{
+	"timber": newTimberSinkFromConfig,
+	"file":   newFileSinkFromConfig,
+}
+
+func supportedSinkTypes() []string {
+	types := make([]string, 0, len(sinkTypes))
+	for sinkType := range sinkTypes {
+		types = append(types, sinkType)
+	}
+
+	return types
+}
+
+// NewSinks builds every configured sink, keyed by name
+func NewSinks(configs []SinkConfig) (map[string]Sink, error) {
+	sinks := make(map[string]Sink)
+
+	for i := range configs {
+		config := &configs[i]
+
+		constructor, ok := sinkTypes[config.Type]
+		if !ok {
+			return nil, fmt.Errorf("Sink %s has unsupported type %s, expected one of %s", config.Name, config.Type,
+				strings.Join(supportedSinkTypes(), ", "))
+		}
+
+		compression, err := NewCompression(config.Compression, config.CompressionLevel)
+		if err != nil {
+			return nil, fmt.Errorf("Sink %s: %s", config.Name, err)
+		}
+
+		sink, err := constructor(config, compression)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks[config.Name] = sink
+	}
+
+	return sinks, nil
+}
+
+// selectSinks returns the named sinks in order. When no names are given, the default Timber sink is built from the
+// given endpoint, API key and compression.
+func selectSinks(names []string, sinks map[string]Sink, endpoint, apiKey string, compression *Compression) []Sink {
+	if len(names) == 0 {
+		return []Sink{NewTimberSink(defaultSinkName, defaultHTTPClient, endpoint, apiKey, compression)}
+	}
+
+	selected := make([]Sink, 0, len(names))
+	for _, name := range names {
+		if sink, ok := sinks[name]; ok {
+			selected = append(selected, sink)
+		} else {
+			logger.Errorf("Sink %s is not configured and will be skipped", name)
+		}
+	}
+
+	return selected
+}
+
+func sinkNames(sinks []Sink) []string {
+	names := make([]string, len(sinks))
+	for i, sink := range sinks {
+		names[i] = sink.Name()
+	}
+
+	return names
+}
+
+// TimberSink delivers batches to the Timber log collection endpoint over HTTP
+type TimberSink struct {
+	name          string
+	httpClient    *retryablehttp.Client
+	endpoint      string
+	authorization string
+	compression   *Compression
+}
+
+func NewTimberSink(name string, httpClient *retryablehttp.Client, endpoint, apiKey string, compression *Compression) *TimberSink {
+	token := base64.StdEncoding.EncodeToString([]byte(apiKey))
+
+	return &TimberSink{
+		name:          name,
+		httpClient:    httpClient,
+		endpoint:      endpoint,
+		authorization: fmt.Sprintf("Basic %s", token),
+		compression:   compression,
+	}
+}
+
+func newTimberSinkFromConfig(config *SinkConfig, compression *Compression) (Sink, error) {
+	if config.ApiKey == "" {
+		return nil, fmt.Errorf("Sink %s has no API key", config.Name)
+	}
+
+	return NewTimberSink(config.Name, defaultHTTPClient, config.Endpoint, config.ApiKey, compression), nil
+}
+
+func (s *TimberSink) Name() string {
+	return s.name
+}
+
+func (s *TimberSink) Compression() *Compression {
+	return s.compression
+}
+
+func (s *TimberSink) Deliver(message *LogMessage, metadata []byte) error {
+	// Set the logger when the function is called to ensure we pickup any logger changes.
+	s.httpClient.Logger = standardLoggerAlternative
+
+	req, err := retryablehttp.NewRequest("POST", s.endpoint, bytes.NewReader(message.Lines))
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	req.Header.Add("Content-Type", "text/plain")
+	req.Header.Add("Authorization", s.authorization)
+	if message.Encoding != "" {
+		req.Header.Add("Content-Encoding", message.Encoding)
+	}
+	req.Header.Add("User-Agent", UserAgent)
+
+	if len(metadata) > 0 {
+		encodedMetadata := base64.StdEncoding.EncodeToString(metadata)
+		req.Header.Add("Timber-Metadata-Override", encodedMetadata)
+	}
+
+	// We do not need to handle this error since we retry "forever"
+	resp, _ := s.httpClient.Do(req)
+
+	// We should not reach this if, but require it for testing
+	if resp == nil {
+		return errors.New("httpClient did not return a response")
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Warn("unable to read response body")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// We return the error here instead of retrying on any http error. We had
+		// previously returned on any client error, but some should resolve
+		// themselves and are retried by the http client.
+		return fmt.Errorf("unexpected response (status code %d): %s", resp.StatusCode, string(body))
+	}
+
+	logger.Infof("flushed buffer (status code %d)", resp.StatusCode)
+
+	return nil
+}
+
+// FileSink appends batches to a local file, for example to keep an archive next to what is sent to Timber. Metadata
+// is not written.
+type FileSink struct {
+	sync.Mutex
+
+	name        string
+	path        string
+	compression *Compression
+}
+
+func newFileSinkFromConfig(config *SinkConfig, compression *Compression) (Sink, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("Sink %s has no path", config.Name)
+	}
+
+	return &FileSink{name: config.Name, path: config.Path, compression: compression}, nil
+}
+
+func (s *FileSink) Name() string {
+	return s.name
+}
+
+// Compression returns the configured compression. Compressed batches are appended as consecutive gzip members,
+// which gzip tools read as a single stream.
+func (s *FileSink) Compression() *Compression {
+	return s.compression
+}
+
+func (s *FileSink) Deliver(message *LogMessage, metadata []byte) error {
+	// Several files may deliver to the same sink, so writes are serialized to keep batches intact
+	s.Lock()
+	defer s.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(message.Lines)
+	return err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink remembers every batch delivered to it
+type recordingSink struct {
+	sync.Mutex
+
+	name    string
+	batches []string
+}
+
+func (s *recordingSink) Name() string {
+	return s.name
+}
+
+func (s *recordingSink) Compression() *Compression {
+	return nil
+}
+
+func (s *recordingSink) Deliver(message *LogMessage, metadata []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.batches = append(s.batches, string(message.Lines))
+	return nil
+}
+
+// received returns the lines of every batch delivered so far
+func (s *recordingSink) received() string {
+	s.Lock()
+	defer s.Unlock()
+
+	return strings.Join(s.batches, "")
+}
+
+// waitForLines waits until the sink has received lines ending with suffix
+func (s *recordingSink) waitForLines(test *testing.T, suffix string) {
+	timeout := time.After(5 * time.Second)
+	for !strings.HasSuffix(s.received(), suffix) {
+		select {
+		case <-timeout:
+			test.Fatalf("expected sink %s to receive %q, got %q", s.name, suffix, s.received())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestNewSinksUnsupportedType(test *testing.T) {
+	_, err := NewSinks([]SinkConfig{{Name: "mystery", Type: "carrier-pigeon"}})
+
+	if err == nil {
+		test.Fatal("expected unsupported sink type to fail")
+	}
+}
+
+func TestNewSinksTimberRequiresApiKey(test *testing.T) {
+	_, err := NewSinks([]SinkConfig{{Name: "timber", Type: "timber", Endpoint: "http://localhost"}})
+
+	if err == nil {
+		test.Fatal("expected timber sink without an API key to fail")
+	}
+}
+
+func TestSelectSinksDefault(test *testing.T) {
+	sinks := selectSinks(nil, nil, "http://localhost", "api key", nil)
+
+	if len(sinks) != 1 || sinks[0].Name() != defaultSinkName {
+		test.Fatalf("expected the default timber sink, got %+v", sinks)
+	}
+}
+
+func TestSelectSinksByName(test *testing.T) {
+	configured := map[string]Sink{
+		"one": &recordingSink{name: "one"},
+		"two": &recordingSink{name: "two"},
+	}
+
+	sinks := selectSinks([]string{"two", "missing"}, configured, "http://localhost", "api key", nil)
+
+	if len(sinks) != 1 || sinks[0].Name() != "two" {
+		test.Fatalf("expected only sink two to be selected, got %+v", sinks)
+	}
+}
+
+func TestTimberSinkDeliverClientError(test *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+	}))
+	defer ts.Close()
+
+	sink := NewTimberSink("timber", defaultHTTPClient, ts.URL, "api key", nil)
+
+	err := sink.Deliver(&LogMessage{Lines: []byte("test log line\n")}, nil)
+	if err == nil {
+		test.Fatal("expected a client error to be returned")
+	}
+}
+
+func TestTimberSinkDeliverContentEncoding(test *testing.T) {
+	var encoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+	}))
+	defer ts.Close()
+
+	sink := NewTimberSink("timber", defaultHTTPClient, ts.URL, "api key", nil)
+
+	err := sink.Deliver(&LogMessage{Lines: []byte("compressed"), Encoding: "gzip"}, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	if encoding != "gzip" {
+		test.Fatalf("expected Content-Encoding gzip, got \"%s\"", encoding)
+	}
+}
+
+func TestFileSinkDeliver(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-agent-sink-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "archive.log")
+	sinks, err := NewSinks([]SinkConfig{{Name: "archive", Type: "file", Path: path}})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	sinks["archive"].Deliver(&LogMessage{Lines: []byte("one\n")}, nil)
+	sinks["archive"].Deliver(&LogMessage{Lines: []byte("two\n")}, nil)
+
+	contents, _ := ioutil.ReadFile(path)
+	if string(contents) != "one\ntwo\n" {
+		test.Fatalf("expected batches to be appended, got \"%s\"", contents)
+	}
+}
+
+func TestForwardToSinksTracksOffsetsPerSink(test *testing.T) {
+	globalState = NewGlobalState()
+	UpdateState("testfile", 12345, 10)
+
+	// The slow sink delivered up to offset 10, the fast sink up to offset 20 before a restart
+	UpdateSinkOffset("testfile", "slow", 10)
+	UpdateSinkOffset("testfile", "fast", 20)
+
+	slow := &recordingSink{name: "slow"}
+	fast := &recordingSink{name: "fast"}
+	sinks := []Sink{slow, fast}
+	delivered := &deliveredOffsets{generation: globalState.generation("testfile")}
+	delivered.offsets = InitSinkOffsets("testfile", sinkNames(sinks))
+
+	lines := make(chan *LogMessage, 2)
+	lines <- &LogMessage{Filename: "testfile", Lines: []byte("second"), Position: 20}
+	lines <- &LogMessage{Filename: "testfile", Lines: []byte("third"), Position: 30}
+	close(lines)
+
+	forwardToSinks(lines, sinks, delivered, make([]*SpoolQueue, len(sinks)), 10, nil)
+
+	if len(slow.batches) != 1 || slow.batches[0] != "second\nthird\n" {
+		test.Fatalf("expected slow sink to receive both lines, got %q", slow.batches)
+	}
+
+	if len(fast.batches) != 1 || fast.batches[0] != "third\n" {
+		test.Fatalf("expected fast sink to only receive the undelivered line, got %q", fast.batches)
+	}
+
+	state := globalState.getState("testfile")
+	if state.SinkOffsets["slow"] != 30 || state.SinkOffsets["fast"] != 30 || state.Offset != 30 {
+		test.Fatalf("expected every sink to be at offset 30, got %+v", state)
+	}
+}
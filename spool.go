@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SpoolOverflowBlock      = "block"
+	SpoolOverflowDropOldest = "drop_oldest"
+	SpoolOverflowDropNewest = "drop_newest"
+
+	defaultSpoolMaxSizeBytes = 100 * 1024 * 1024
+	spoolRecordExt           = ".batch"
+)
+
+var supportedSpoolOverflowPolicies = []string{SpoolOverflowBlock, SpoolOverflowDropOldest, SpoolOverflowDropNewest}
+
+// How long a queue waits before sending a batch that failed to be delivered again
+var spoolRetryPeriod = 10 * time.Second
+
+// SpoolConfig configures the optional on-disk queue that sits between batching and forwarding. When enabled,
+// batches are written to disk as soon as they are flushed so that an unavailable endpoint does not stall tailing.
+type SpoolConfig struct {
+	Path         string
+	MaxSizeBytes int64  `toml:"max_size_bytes"`
+	Overflow     string `toml:"overflow"`
+}
+
+// DefaultSpoolDirectory returns the directory spooled batches are stored in when no path is configured. It lives
+// next to the default global statefile.
+func DefaultSpoolDirectory() string {
+	if strings.Contains(runtime.GOOS, "bsd") || runtime.GOOS == "darwin" {
+		return "/var/db/timber-agent/spool"
+	} else {
+		return "/var/lib/timber-agent/spool"
+	}
+}
+
+// Validate fills in defaults and ensures the overflow policy is known
+func (sc *SpoolConfig) Validate() error {
+	if sc.Path == "" {
+		sc.Path = DefaultSpoolDirectory()
+	}
+
+	if sc.MaxSizeBytes <= 0 {
+		sc.MaxSizeBytes = defaultSpoolMaxSizeBytes
+	}
+
+	if sc.Overflow == "" {
+		sc.Overflow = SpoolOverflowBlock
+	}
+
+	for _, policy := range supportedSpoolOverflowPolicies {
+		if sc.Overflow == policy {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Spool overflow policy %s is not supported, expected one of %s", sc.Overflow,
+		strings.Join(supportedSpoolOverflowPolicies, ", "))
+}
+
+// Spool is the root of all spool queues and enforces the configured maximum size across all of them.
+type Spool struct {
+	sync.Mutex
+
+	config *SpoolConfig
+	size   int64
+	space  *sync.Cond
+}
+
+// OpenSpool creates the spool directory if needed and accounts for any batches left behind by a previous run
+func OpenSpool(config *SpoolConfig) (*Spool, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(config.Path, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("Unable to create spool directory %s: %s", config.Path, err)
+	}
+
+	spool := &Spool{config: config}
+	spool.space = sync.NewCond(spool)
+
+	err := filepath.Walk(config.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && filepath.Ext(path) == spoolRecordExt {
+			spool.size += info.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read spool directory %s: %s", config.Path, err)
+	}
+
+	logger.Infof("Opened spool at %s (%d of %d bytes used, overflow policy: %s)", config.Path, spool.size,
+		config.MaxSizeBytes, config.Overflow)
+
+	return spool, nil
+}
+
+// Queue returns the queue for the given source. When replay is false, batches left over from a previous run are
+// discarded. This is the case for files, since the tailer resumes from the last delivered offset and will read those
+// lines again; replaying them as well would duplicate data.
+func (s *Spool) Queue(source string, replay bool) (*SpoolQueue, error) {
+	name := fmt.Sprintf("%x", sha1.Sum([]byte(source)))
+	dir := filepath.Join(s.config.Path, name)
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("Unable to create spool queue directory %s: %s", dir, err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read spool queue directory %s: %s", dir, err)
+	}
+
+	q := &SpoolQueue{spool: s, source: source, dir: dir, stopped: make(chan struct{})}
+	q.available = sync.NewCond(q)
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		if filepath.Ext(entry.Name()) != spoolRecordExt {
+			// Leftover temporary file from an interrupted write
+			os.Remove(path)
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spoolRecordExt), 10, 64)
+		if err != nil || !replay {
+			os.Remove(path)
+			s.release(entry.Size())
+			continue
+		}
+
+		q.records = append(q.records, &spoolRecord{seq: seq, size: entry.Size()})
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+
+	sort.Slice(q.records, func(i, j int) bool { return q.records[i].seq < q.records[j].seq })
+
+	if len(q.records) > 0 {
+		logger.Infof("Replaying %d spooled batches for %s", len(q.records), source)
+	}
+
+	return q, nil
+}
+
+// reserve blocks until n bytes fit in the spool when the overflow policy is block, otherwise it returns false if they
+// do not fit. A record larger than the spool itself never fits.
+func (s *Spool) reserve(n int64) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if n > s.config.MaxSizeBytes {
+		return false
+	}
+
+	for s.size+n > s.config.MaxSizeBytes {
+		if s.config.Overflow != SpoolOverflowBlock {
+			return false
+		}
+		s.space.Wait()
+	}
+
+	s.size += n
+	return true
+}
+
+func (s *Spool) release(n int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.size -= n
+	s.space.Broadcast()
+}
+
+type spoolRecord struct {
+	seq  uint64
+	size int64
+}
+
+type spoolRecordHeader struct {
+	Filename   string `json:"filename"`
+	Position   int64  `json:"position"`
+	Encoding   string `json:"encoding,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+}
+
+// SpoolQueue is a single, ordered on-disk queue of batches for one source
+type SpoolQueue struct {
+	sync.Mutex
+
+	spool     *Spool
+	source    string
+	dir       string
+	records   []*spoolRecord
+	nextSeq   uint64
+	inFlight  *spoolRecord
+	closed    bool
+	available *sync.Cond
+	// Closed along with closed being set, to stop waiting to retry a batch
+	stopped chan struct{}
+}
+
+// Run writes every batch received on in to disk and sends them on out in order. A batch is removed from disk only
+// once the receiver acknowledges it was delivered, and is sent again every spoolRetryPeriod until it is. out is closed
+// once in has been closed and every spooled batch has been handed off, or once in has been closed while a batch fails
+// to be delivered. Batches left on disk are replayed when the queue is opened again.
+func (q *SpoolQueue) Run(in chan *LogMessage, out chan *LogMessage) {
+	go q.receive(in)
+
+	for {
+		record, ok := q.next()
+		if !ok {
+			close(out)
+			return
+		}
+
+		message, err := q.read(record)
+		if err != nil {
+			logger.Errorf("Unable to read spooled batch for %s, discarding it: %s", q.source, err)
+			q.remove(record)
+			continue
+		}
+
+		result := make(chan bool, 1)
+		message.ack = func(delivered bool) { result <- delivered }
+
+		out <- message
+		if <-result {
+			q.remove(record)
+			continue
+		}
+
+		logger.Warnf("Batch for %s stays spooled, it will be sent again in %s", q.source, spoolRetryPeriod)
+		select {
+		case <-time.After(spoolRetryPeriod):
+		case <-q.stopped:
+			close(out)
+			return
+		}
+	}
+}
+
+func (q *SpoolQueue) receive(in chan *LogMessage) {
+	for message := range in {
+		if err := q.write(message); err != nil {
+			logger.Errorf("Unable to spool batch for %s, it will not be sent: %s", q.source, err)
+		}
+	}
+
+	q.Lock()
+	q.closed = true
+	q.available.Broadcast()
+	close(q.stopped)
+	q.Unlock()
+}
+
+// next blocks until a record is available, returning false once the queue is closed and drained
+func (q *SpoolQueue) next() (*spoolRecord, bool) {
+	q.Lock()
+	defer q.Unlock()
+
+	for len(q.records) == 0 && !q.closed {
+		q.available.Wait()
+	}
+
+	if len(q.records) == 0 {
+		return nil, false
+	}
+
+	q.inFlight = q.records[0]
+	return q.inFlight, true
+}
+
+func (q *SpoolQueue) write(message *LogMessage) error {
+	header, err := json.Marshal(&spoolRecordHeader{
+		Filename:   message.Filename,
+		Position:   message.Position,
+		Encoding:   message.Encoding,
+		Generation: message.generation,
+	})
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(header)
+	buf.WriteByte('\n')
+	buf.Write(message.Lines)
+	size := int64(buf.Len())
+
+	if !q.spool.reserve(size) {
+		if q.spool.config.Overflow != SpoolOverflowDropOldest || !q.dropOldest(size) {
+			logger.Warnf("Spool is full, dropping newest batch for %s (%d bytes)", q.source, size)
+			return nil
+		}
+	}
+
+	q.Lock()
+	seq := q.nextSeq
+	q.nextSeq++
+	q.Unlock()
+
+	path := q.recordPath(seq)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		q.spool.release(size)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		q.spool.release(size)
+		return err
+	}
+
+	q.Lock()
+	q.records = append(q.records, &spoolRecord{seq: seq, size: size})
+	q.available.Broadcast()
+	q.Unlock()
+
+	return nil
+}
+
+// dropOldest discards the oldest batches of this queue that are not currently being delivered until size bytes could
+// be reserved. It returns false if not enough space could be made.
+func (q *SpoolQueue) dropOldest(size int64) bool {
+	for {
+		// The batch is taken out of the queue while it cannot be handed to the forwarder, so that it is only
+		// discarded once
+		q.Lock()
+		var victim *spoolRecord
+		for _, record := range q.records {
+			if record != q.inFlight {
+				victim = record
+				break
+			}
+		}
+		if victim != nil {
+			q.detach(victim)
+		}
+		q.Unlock()
+
+		if victim == nil {
+			return false
+		}
+
+		logger.Warnf("Spool is full, dropping oldest batch for %s (%d bytes)", q.source, victim.size)
+		q.discard(victim)
+
+		if q.spool.reserve(size) {
+			return true
+		}
+	}
+}
+
+func (q *SpoolQueue) read(record *spoolRecord) (*LogMessage, error) {
+	data, err := ioutil.ReadFile(q.recordPath(record.seq))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+	headerLine, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, errors.New("spooled batch is missing its header")
+	}
+
+	var header spoolRecordHeader
+	if err := json.Unmarshal(headerLine, &header); err != nil {
+		return nil, err
+	}
+
+	return &LogMessage{
+		Filename:   header.Filename,
+		Lines:      data[len(headerLine):],
+		Position:   header.Position,
+		Encoding:   header.Encoding,
+		generation: header.Generation,
+	}, nil
+}
+
+// remove takes the record out of the queue and discards it, unless it was already
+func (q *SpoolQueue) remove(record *spoolRecord) {
+	q.Lock()
+	present := q.detach(record)
+	q.Unlock()
+
+	if present {
+		q.discard(record)
+	}
+}
+
+// detach takes the record out of the queue, returning false if it was not in the queue anymore. The queue must be
+// locked.
+func (q *SpoolQueue) detach(record *spoolRecord) bool {
+	if q.inFlight == record {
+		q.inFlight = nil
+	}
+
+	for i, r := range q.records {
+		if r == record {
+			q.records = append(q.records[:i], q.records[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// discard deletes a detached record and releases its space in the spool
+func (q *SpoolQueue) discard(record *spoolRecord) {
+	if err := os.Remove(q.recordPath(record.seq)); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Unable to remove spooled batch %s: %s", q.recordPath(record.seq), err)
+	}
+
+	q.spool.release(record.size)
+}
+
+func (q *SpoolQueue) recordPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, spoolRecordExt))
+}
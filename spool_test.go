@@ -0,0 +1,250 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestSpool(test *testing.T, config *SpoolConfig) *Spool {
+	dir, err := ioutil.TempDir("", "timber-agent-spool-test")
+	if err != nil {
+		panic(err)
+	}
+	config.Path = dir
+
+	spool, err := OpenSpool(config)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	return spool
+}
+
+func expectSpooledMessage(test *testing.T, out chan *LogMessage, expectedLines string, expectedPosition int64) {
+	select {
+	case message := <-out:
+		if string(message.Lines) != expectedLines {
+			test.Fatalf("expected \"%s\", got \"%s\"", expectedLines, message.Lines)
+		}
+
+		if message.Position != expectedPosition {
+			test.Fatalf("expected position %d, got %d", expectedPosition, message.Position)
+		}
+
+		message.acknowledge(true)
+	case <-time.After(5 * time.Second):
+		test.Fatalf("timed out expecting \"%s\"", expectedLines)
+	}
+}
+
+func TestSpoolConfigValidateSetsDefaults(test *testing.T) {
+	config := &SpoolConfig{}
+
+	if err := config.Validate(); err != nil {
+		test.Fatal(err)
+	}
+
+	if config.Path != DefaultSpoolDirectory() {
+		test.Errorf("expected path to default to %s, got %s", DefaultSpoolDirectory(), config.Path)
+	}
+
+	if config.Overflow != SpoolOverflowBlock {
+		test.Errorf("expected overflow policy to default to %s, got %s", SpoolOverflowBlock, config.Overflow)
+	}
+}
+
+func TestSpoolConfigValidateUnsupportedOverflow(test *testing.T) {
+	config := &SpoolConfig{Overflow: "explode"}
+
+	if err := config.Validate(); err == nil {
+		test.Fatal("expected unsupported overflow policy to fail validation")
+	}
+}
+
+func TestSpoolQueueDeliversInOrder(test *testing.T) {
+	spool := newTestSpool(test, &SpoolConfig{})
+	defer os.RemoveAll(spool.config.Path)
+
+	queue, err := spool.Queue("/var/log/test.log", false)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	in := make(chan *LogMessage)
+	out := make(chan *LogMessage)
+	go queue.Run(in, out)
+
+	in <- &LogMessage{Filename: "/var/log/test.log", Lines: []byte("one\n"), Position: 4}
+	in <- &LogMessage{Filename: "/var/log/test.log", Lines: []byte("two\n"), Position: 8}
+	close(in)
+
+	expectSpooledMessage(test, out, "one\n", 4)
+	expectSpooledMessage(test, out, "two\n", 8)
+
+	if _, ok := <-out; ok {
+		test.Fatal("expected out to be closed once the queue is drained")
+	}
+
+	if spool.size != 0 {
+		test.Fatalf("expected delivered batches to be removed from the spool, %d bytes remain", spool.size)
+	}
+}
+
+func TestSpoolQueueReplay(test *testing.T) {
+	spool := newTestSpool(test, &SpoolConfig{})
+	defer os.RemoveAll(spool.config.Path)
+
+	queue, _ := spool.Queue("stdin", true)
+	queue.write(&LogMessage{Filename: "stdin", Lines: []byte("undelivered\n")})
+
+	// Reopening the spool simulates an agent restart
+	spool, err := OpenSpool(spool.config)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	queue, _ = spool.Queue("stdin", true)
+	in := make(chan *LogMessage)
+	out := make(chan *LogMessage)
+	go queue.Run(in, out)
+	close(in)
+
+	expectSpooledMessage(test, out, "undelivered\n", 0)
+}
+
+func TestSpoolQueueRetriesUndeliveredBatches(test *testing.T) {
+	defaultRetryPeriod := spoolRetryPeriod
+	spoolRetryPeriod = 10 * time.Millisecond
+	defer func() { spoolRetryPeriod = defaultRetryPeriod }()
+
+	spool := newTestSpool(test, &SpoolConfig{})
+	defer os.RemoveAll(spool.config.Path)
+
+	queue, _ := spool.Queue("stdin", true)
+	in := make(chan *LogMessage)
+	out := make(chan *LogMessage)
+	go queue.Run(in, out)
+
+	in <- &LogMessage{Filename: "stdin", Lines: []byte("retried\n")}
+
+	// The sink fails to deliver the batch the first time
+	select {
+	case message := <-out:
+		message.acknowledge(false)
+	case <-time.After(5 * time.Second):
+		test.Fatal("timed out expecting the batch")
+	}
+
+	expectSpooledMessage(test, out, "retried\n", 0)
+	close(in)
+
+	if _, ok := <-out; ok {
+		test.Fatal("expected out to be closed once the batch was delivered")
+	}
+
+	if spool.size != 0 {
+		test.Fatalf("expected the delivered batch to be released, %d bytes remain", spool.size)
+	}
+}
+
+func TestSpoolQueueKeepsUndeliveredBatchesWhenStopped(test *testing.T) {
+	spool := newTestSpool(test, &SpoolConfig{})
+	defer os.RemoveAll(spool.config.Path)
+
+	queue, _ := spool.Queue("stdin", true)
+	in := make(chan *LogMessage)
+	out := make(chan *LogMessage)
+	go queue.Run(in, out)
+
+	in <- &LogMessage{Filename: "stdin", Lines: []byte("undelivered\n")}
+	close(in)
+
+	(<-out).acknowledge(false)
+	if _, ok := <-out; ok {
+		test.Fatal("expected out to be closed once the input is closed")
+	}
+
+	// The batch is replayed once the queue is opened again
+	queue, _ = spool.Queue("stdin", true)
+	if len(queue.records) != 1 {
+		test.Fatalf("expected the undelivered batch to be kept, got %d batches", len(queue.records))
+	}
+}
+
+func TestSpoolQueueWithoutReplayDiscards(test *testing.T) {
+	spool := newTestSpool(test, &SpoolConfig{})
+	defer os.RemoveAll(spool.config.Path)
+
+	queue, _ := spool.Queue("/var/log/test.log", false)
+	queue.write(&LogMessage{Filename: "/var/log/test.log", Lines: []byte("will be read again\n"), Position: 19})
+
+	queue, _ = spool.Queue("/var/log/test.log", false)
+	if len(queue.records) != 0 {
+		test.Fatalf("expected spooled batches to be discarded, got %d", len(queue.records))
+	}
+
+	if spool.size != 0 {
+		test.Fatalf("expected discarded batches to be released, %d bytes remain", spool.size)
+	}
+}
+
+func TestSpoolQueueDropNewest(test *testing.T) {
+	spool := newTestSpool(test, &SpoolConfig{MaxSizeBytes: 100, Overflow: SpoolOverflowDropNewest})
+	defer os.RemoveAll(spool.config.Path)
+
+	queue, _ := spool.Queue("stdin", true)
+	queue.write(&LogMessage{Lines: make([]byte, 60)})
+	queue.write(&LogMessage{Lines: make([]byte, 60)})
+
+	if len(queue.records) != 1 || queue.records[0].seq != 0 {
+		test.Fatal("expected the newest batch to be dropped")
+	}
+}
+
+func TestSpoolQueueDropOldest(test *testing.T) {
+	spool := newTestSpool(test, &SpoolConfig{MaxSizeBytes: 100, Overflow: SpoolOverflowDropOldest})
+	defer os.RemoveAll(spool.config.Path)
+
+	queue, _ := spool.Queue("stdin", true)
+	queue.write(&LogMessage{Lines: make([]byte, 60)})
+	queue.write(&LogMessage{Lines: make([]byte, 60)})
+
+	if len(queue.records) != 1 || queue.records[0].seq != 1 {
+		test.Fatal("expected the oldest batch to be dropped")
+	}
+}
+
+func TestSpoolQueueDropOldestWhileDelivering(test *testing.T) {
+	spool := newTestSpool(test, &SpoolConfig{MaxSizeBytes: 1000, Overflow: SpoolOverflowDropOldest})
+	defer os.RemoveAll(spool.config.Path)
+
+	queue, _ := spool.Queue("stdin", true)
+	in := make(chan *LogMessage)
+	out := make(chan *LogMessage)
+	go queue.Run(in, out)
+
+	// Batches are written faster than they are delivered, so older ones are dropped while others are delivered
+	go func() {
+		for i := 0; i < 500; i++ {
+			in <- &LogMessage{Filename: "stdin", Lines: make([]byte, 100)}
+		}
+		close(in)
+	}()
+
+	for message := range out {
+		message.acknowledge(true)
+
+		spool.Lock()
+		size := spool.size
+		spool.Unlock()
+		if size < 0 || size > spool.config.MaxSizeBytes {
+			test.Fatalf("expected the spool size to stay between 0 and %d bytes, got %d", spool.config.MaxSizeBytes, size)
+		}
+	}
+
+	if spool.size != 0 {
+		test.Fatalf("expected every batch to be released once delivered or dropped, %d bytes remain", spool.size)
+	}
+}
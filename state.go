@@ -30,13 +30,45 @@ type LogMessage struct {
 	Filename string
 	Lines    []byte
 	Position int64
+	// Content encoding of Lines, set when a batch is compressed
+	Encoding string
+	// Stream and time recorded by the container runtime, for lines read from container log files. Sent with each
+	// line rather than with the batch, see encodeEventLine.
+	Container *ContainerContext
+
+	// generation of the file at Filename that Position belongs to, see GlobalState
+	generation int64
+
+	// ack is set by a SpoolQueue and called once the forwarder delivered the message or failed to
+	ack func(delivered bool)
+}
+
+// acknowledge informs the producer of the message, if it cares, whether the message was delivered. Messages that were
+// not are retried by producers able to.
+func (m *LogMessage) acknowledge(delivered bool) {
+	if m.ack != nil {
+		m.ack(delivered)
+	}
 }
 
 type GlobalState struct {
 	sync.Mutex
 
 	Data *GlobalStateData
-	File *os.File
+	// Path of the statefile. It is replaced on every write, so no handle to it is kept.
+	Filename string
+
+	// Set whenever Data changes and cleared once it has been written to the statefile. Guarded by the lock of Data.
+	dirty bool
+
+	// The generation of each path is incremented whenever a different file takes over the path. Offsets of batches
+	// read from the previous file are then no longer recorded. Guarded by the lock of Data.
+	generations map[string]int64
+	// Number of tailers reading each path. Guarded by the lock of Data.
+	tailing map[string]int
+	// States of files that have been gone for longer than this are removed, zero keeps them forever. Guarded by the
+	// lock of Data.
+	stateTTL time.Duration
 
 	flushTimer *time.Ticker
 }
@@ -46,25 +78,56 @@ type GlobalStateData struct {
 
 	Version string            `json:"version"`
 	States  map[string]*State `json:"states"`
+	// States of files that were replaced at their path, keyed by file identity. They are picked up again when the file
+	// is discovered under a new path, for example after log rotation renamed it.
+	Detached map[string]*State `json:"detached,omitempty"`
 }
 
 type State struct {
+	// CRC32 of the first FingerprintLength bytes of the file
 	Checksum uint32
 	Offset   int64
+	// Delivery offsets per sink name. Offset is kept at the lowest of these so that the tailer resumes from the
+	// sink that is furthest behind.
+	SinkOffsets map[string]int64 `json:"SinkOffsets,omitempty"`
+	// Device and inode of the file, zero where the platform does not provide them
+	Device uint64 `json:"Device,omitempty"`
+	Inode  uint64 `json:"Inode,omitempty"`
+	// Number of bytes covered by Checksum. It grows as the file grows, up to the configured maximum. Zero for states
+	// recorded by earlier versions, whose checksum covers the first 256 bytes padded with zeros.
+	FingerprintLength int64 `json:"FingerprintLength,omitempty"`
+	// Unix time at which the file was last known to exist or be tailed. Zero until the state is first collected.
+	LastSeen int64 `json:"last_seen,omitempty"`
 }
 
+// Passed instead of a generation when an offset applies to whichever file is at the path
+const anyGeneration = -1
+
+// How long the state of a file is kept after the file was last seen, unless configured otherwise
+const defaultStateTTL = 24 * time.Hour
+
+// How often states of files that no longer exist are looked for
+const stateCollectionInterval = 1 * time.Minute
+
+// How far the recorded last seen time of a file may fall behind before the statefile is rewritten to update it
+const lastSeenResolution = 1 * time.Hour
+
 // Provides global state to this package
 var globalState = NewGlobalState()
 
 //NewGlobalState return an empty *GlobalState with reference types allocated
 func NewGlobalState() *GlobalState {
 	globalStateData := &GlobalStateData{
-		Version: version,
-		States:  make(map[string]*State),
+		Version:  version,
+		States:   make(map[string]*State),
+		Detached: make(map[string]*State),
 	}
 
 	return &GlobalState{
-		Data: globalStateData,
+		Data:        globalStateData,
+		generations: make(map[string]int64),
+		tailing:     make(map[string]int),
+		stateTTL:    defaultStateTTL,
 	}
 }
 
@@ -83,28 +146,22 @@ func DefaultGlobalStateFilename() string {
 	}
 }
 
-//Load Reads GlobalState Data from stateFilename, or creates stateFilename if not found. Returns an error if we fail
-// to create, read, or write to stateFile, as it is crucial to our execution.
+//Load Reads GlobalState Data from stateFilename, or creates stateFilename if not found. If stateFilename cannot be
+// parsed, the backup of the previous state written next to it is used instead. Returns an error if we fail to create,
+// read, or write to stateFile, as it is crucial to our execution.
 func (gs *GlobalState) Load(stateFilename string) error {
-	var stateFile *os.File
-
-	// If we find a file, read from it
-	if _, err := os.Stat(stateFilename); err == nil {
-		stateFile, err = os.OpenFile(stateFilename, os.O_RDWR, os.ModePerm)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Unable to open global statefile %s: %s", stateFilename, err))
-		}
-
-		bytes, err := ioutil.ReadAll(stateFile)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Unable to read global statefile %s: %s", stateFilename, err))
-		}
+	globalStateData, restored, err := readGlobalStateFileOrBackup(stateFilename)
+	if restored {
+		// The statefile is replaced on the next write. It must not become the backup, so it is removed.
+		os.Remove(stateFilename)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
-		var globalStateData GlobalStateData
-		if err := json.Unmarshal(bytes, &globalStateData); err != nil {
-			return errors.New(fmt.Sprintf("Unable to parse json from global statefile %s: %s", stateFilename, err))
-		}
+	gs.Filename = stateFilename
 
+	if globalStateData != nil {
 		// We could have malformed or empty fields in our statefile while
 		// still being valid json. In this case, we need to ensure our
 		// globalState is valid and does not contain incorrect values.
@@ -119,42 +176,93 @@ func (gs *GlobalState) Load(stateFilename string) error {
 		// When unmarshalling JSON, objects not found will be set to the
 		// default value for that type. For strings it is the empty string,
 		// and for maps that is nil.
+		gs.Data.Lock()
 		if globalStateData.Version != "" {
 			gs.Data.Version = globalStateData.Version
 		}
 
-		if globalStateData.States != nil {
-			gs.Data.States = globalStateData.States
-		}
-	} else {
-		// If we didn't find a file, we create the file and persist its empty state to disk
-		stateFile, err = createGlobalStateFile(stateFilename)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Unable to create global statefile %s: %s", stateFilename, err))
-		}
+		gs.Data.States = globalStateData.States
 
-		err = writeGlobalStateFile(stateFile, gs.Data)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Unable to write global statefile %s: %s", stateFilename, err))
+		if globalStateData.Detached != nil {
+			gs.Data.Detached = globalStateData.Detached
 		}
+		gs.dirty = false
+		gs.Data.Unlock()
+
+		return nil
+	}
+
+	// If we didn't find a file, we create the file and persist its empty state to disk
+	if err := os.MkdirAll(filepath.Dir(stateFilename), os.ModePerm); err != nil {
+		return errors.New(fmt.Sprintf("Unable to create global statefile %s: %s", stateFilename, err))
 	}
 
-	// Save reference to file in globalState
-	gs.File = stateFile
+	gs.Data.Lock()
+	gs.dirty = true
+	gs.Data.Unlock()
+
+	if err := gs.persistState(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// ReadGlobalStateFile reads a global statefile without taking ownership of it, for example to report on it while
+// another agent is running
+func ReadGlobalStateFile(stateFilename string) (*GlobalStateData, error) {
+	bytes, err := ioutil.ReadFile(stateFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	var globalStateData GlobalStateData
+	if err := json.Unmarshal(bytes, &globalStateData); err != nil {
+		return nil, fmt.Errorf("Unable to parse json from global statefile %s: %s", stateFilename, err)
+	}
+
+	if globalStateData.States == nil {
+		globalStateData.States = make(map[string]*State)
+	}
+
+	return &globalStateData, nil
+}
+
+// readGlobalStateFileOrBackup reads a global statefile, or the backup of the previous state written next to it if the
+// statefile cannot be read. Reports whether the backup was read, and returns the error reading the statefile if the
+// backup cannot be read either.
+func readGlobalStateFileOrBackup(stateFilename string) (*GlobalStateData, bool, error) {
+	globalStateData, err := ReadGlobalStateFile(stateFilename)
+	if err == nil {
+		return globalStateData, false, nil
+	}
+
+	backup, backupErr := ReadGlobalStateFile(backupStateFilename(stateFilename))
+	if backupErr != nil {
+		return nil, false, err
+	}
+
+	logger.Warnf("Restoring global state from %s: %s", backupStateFilename(stateFilename), err)
+	return backup, true, nil
+}
+
 //PersistState Write GlobalState to disk
 func (gs *GlobalState) PersistState() error {
 	return gs.persistState()
 }
 
-//Start Create and start ticker for writing GlobalState to disk on a timer
+//Start Create and start ticker for writing GlobalState to disk on a timer. States of files that no longer exist are
+// collected on the same timer.
 func (gs *GlobalState) Start() {
 	gs.flushTimer = time.NewTicker(1 * time.Second)
+	lastCollection := time.Now()
+
+	for now := range gs.flushTimer.C {
+		if now.Sub(lastCollection) >= stateCollectionInterval {
+			gs.collectStates(now)
+			lastCollection = now
+		}
 
-	for _ = range gs.flushTimer.C {
 		err := gs.persistState()
 		if err != nil {
 			logger.Fatal(err)
@@ -172,6 +280,107 @@ func (gs *GlobalState) deleteState(filename string) {
 	defer gs.Data.Unlock()
 
 	delete(gs.Data.States, filename)
+	gs.dirty = true
+}
+
+// SetStateTTL sets how long the state of a file is kept after the file was last seen. Zero keeps states forever.
+func (gs *GlobalState) SetStateTTL(ttl time.Duration) {
+	gs.Data.Lock()
+	defer gs.Data.Unlock()
+
+	gs.stateTTL = ttl
+}
+
+// startTailing records that a tailer reads filename, which keeps its state from being collected even if the file is
+// deleted, since the tailer waits for the file to be created again
+func (gs *GlobalState) startTailing(filename string) {
+	gs.Data.Lock()
+	defer gs.Data.Unlock()
+
+	gs.tailing[filename]++
+}
+
+func (gs *GlobalState) stopTailing(filename string) {
+	gs.Data.Lock()
+	defer gs.Data.Unlock()
+
+	gs.tailing[filename]--
+	if gs.tailing[filename] <= 0 {
+		delete(gs.tailing, filename)
+	}
+}
+
+// collectStates removes the states of files that are not tailed and have not existed for longer than the state TTL,
+// as well as detached states that have not been picked up within the TTL. States seen for the first time are stamped
+// with now. Returns the number of states removed.
+func (gs *GlobalState) collectStates(now time.Time) int {
+	gs.Data.RLock()
+	ttl := gs.stateTTL
+	var paths []string
+	for path := range gs.Data.States {
+		if gs.tailing[path] == 0 {
+			paths = append(paths, path)
+		}
+	}
+	gs.Data.RUnlock()
+
+	if ttl <= 0 {
+		return 0
+	}
+
+	// Stat without holding the lock, the filesystem may be slow
+	exists := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		exists[path] = !os.IsNotExist(err)
+	}
+
+	gs.Data.Lock()
+	defer gs.Data.Unlock()
+
+	expired := now.Add(-ttl).Unix()
+	removed := 0
+
+	for path, state := range gs.Data.States {
+		known, checked := exists[path]
+		if !checked || known || gs.tailing[path] > 0 || state.LastSeen == 0 {
+			gs.see(state, now)
+			continue
+		}
+
+		if state.LastSeen < expired {
+			logger.Infof("Removing state of %s, the file has not been seen for more than %s", path, ttl)
+			delete(gs.Data.States, path)
+			delete(gs.generations, path)
+			gs.dirty = true
+			removed++
+		}
+	}
+
+	for key, state := range gs.Data.Detached {
+		if state.LastSeen == 0 {
+			gs.see(state, now)
+			continue
+		}
+
+		if state.LastSeen < expired {
+			delete(gs.Data.Detached, key)
+			gs.dirty = true
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// see records that the file of state was seen at now. The statefile is only rewritten for it once the recorded time
+// is off by more than lastSeenResolution. Callers must hold the lock of Data.
+func (gs *GlobalState) see(state *State, now time.Time) {
+	if now.Sub(time.Unix(state.LastSeen, 0)) >= lastSeenResolution {
+		gs.dirty = true
+	}
+
+	state.LastSeen = now.Unix()
 }
 
 func (gs *GlobalState) getState(filename string) *State {
@@ -181,13 +390,258 @@ func (gs *GlobalState) getState(filename string) *State {
 	return gs.Data.States[filename]
 }
 
+// offsets returns the recorded offset of every file being tailed
+func (gs *GlobalState) offsets() map[string]int64 {
+	gs.Data.RLock()
+	defer gs.Data.RUnlock()
+
+	offsets := make(map[string]int64, len(gs.tailing))
+	for filename := range gs.tailing {
+		if state, ok := gs.Data.States[filename]; ok {
+			offsets[filename] = state.Offset
+		}
+	}
+
+	return offsets
+}
+
+// detachState moves the state recorded for filename aside, keyed by the identity of the file it was recorded for, so
+// that the file can resume from it when it is discovered under another path. States without an identity, or whose
+// file is still tracked under another path, are dropped.
+func (gs *GlobalState) detachState(filename string) {
+	gs.Data.Lock()
+	defer gs.Data.Unlock()
+
+	state := gs.Data.States[filename]
+	if state == nil {
+		return
+	}
+	delete(gs.Data.States, filename)
+	gs.dirty = true
+
+	if state.Inode == 0 {
+		return
+	}
+
+	for _, other := range gs.Data.States {
+		if other.identity() == state.identity() {
+			return
+		}
+	}
+
+	if gs.Data.Detached == nil {
+		gs.Data.Detached = make(map[string]*State)
+	}
+	state.LastSeen = time.Now().Unix()
+	gs.Data.Detached[state.identity().key()] = state
+	gs.dirty = true
+}
+
+// findMovedState returns the state of the file described by info if it was recorded under a path other than
+// filename, along with that path. The state is carried over to filename. States recorded under another path are
+// preferred over detached states, since they are more recent.
+func (gs *GlobalState) findMovedState(filename string, info os.FileInfo) (*State, string) {
+	identity, ok := fileIdentity(info)
+	if !ok {
+		return nil, ""
+	}
+
+	gs.Data.RLock()
+	candidates := make(map[string]*State)
+	for path, state := range gs.Data.States {
+		if path != filename && state.identity() == identity {
+			candidates[path] = state
+		}
+	}
+	detached := gs.Data.Detached[identity.key()]
+	gs.Data.RUnlock()
+
+	for path, state := range candidates {
+		// The file at the other path must be gone or be a different file
+		if otherInfo, err := os.Stat(path); err == nil {
+			if otherIdentity, _ := fileIdentity(otherInfo); otherIdentity == identity {
+				continue
+			}
+		}
+
+		if !state.identifies(filename, info) {
+			continue
+		}
+
+		gs.Data.Lock()
+		moved := *state
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// The file was renamed, there is nothing left to track at the old path
+			delete(gs.Data.States, path)
+		}
+		gs.Data.States[filename] = &moved
+		gs.dirty = true
+		gs.Data.Unlock()
+
+		return &moved, path
+	}
+
+	if detached != nil && detached.identifies(filename, info) {
+		gs.Data.Lock()
+		delete(gs.Data.Detached, identity.key())
+		gs.Data.States[filename] = detached
+		gs.dirty = true
+		gs.Data.Unlock()
+
+		return detached, "a rotated path"
+	}
+
+	return nil, ""
+}
+
+// resetState starts tracking the file that is now at filename from its beginning, after the file that was tailed
+// there was truncated or replaced. The state of a replaced file is detached. Returns the new generation of the path.
+func (gs *GlobalState) resetState(filename string) int64 {
+	state := &State{}
+	if info, err := os.Stat(filename); err == nil {
+		if err := state.identify(filename, info); err != nil {
+			logger.Errorf("Failed to fingerprint file %s: %s", filename, err)
+		}
+	}
+
+	previous := gs.getState(filename)
+	if previous != nil && previous.identity() != state.identity() {
+		gs.detachState(filename)
+	}
+
+	generation := gs.nextGeneration(filename)
+	gs.saveState(filename, state)
+
+	return generation
+}
+
+// nextGeneration increments the generation of filename, since a different file took over the path
+func (gs *GlobalState) nextGeneration(filename string) int64 {
+	gs.Data.Lock()
+	defer gs.Data.Unlock()
+
+	gs.generations[filename]++
+
+	return gs.generations[filename]
+}
+
+func (gs *GlobalState) generation(filename string) int64 {
+	gs.Data.RLock()
+	defer gs.Data.RUnlock()
+
+	return gs.generations[filename]
+}
+
+// growFingerprint records a longer fingerprint for the file at filename, unless the file was replaced in the meantime
+func (gs *GlobalState) growFingerprint(filename string, generation int64, length int64, checksum uint32) {
+	gs.Data.Lock()
+	defer gs.Data.Unlock()
+
+	state := gs.Data.States[filename]
+	if state == nil || gs.generations[filename] != generation || state.FingerprintLength >= length {
+		return
+	}
+
+	state.Checksum = checksum
+	state.FingerprintLength = length
+	gs.dirty = true
+}
+
+func (gs *GlobalState) initSinkOffsets(filename string, sinks []string) []int64 {
+	gs.Data.Lock()
+	defer gs.Data.Unlock()
+
+	offsets := make([]int64, len(sinks))
+
+	state := gs.Data.States[filename]
+	if state == nil {
+		return offsets
+	}
+
+	sinkOffsets := make(map[string]int64, len(sinks))
+	for i, sink := range sinks {
+		offset, ok := state.SinkOffsets[sink]
+		if !ok {
+			offset = state.Offset
+		}
+
+		sinkOffsets[sink] = offset
+		offsets[i] = offset
+	}
+
+	state.SinkOffsets = sinkOffsets
+	state.Offset = minSinkOffset(state)
+	gs.dirty = true
+
+	return offsets
+}
+
+func (gs *GlobalState) updateSinkOffset(filename string, sink string, offset int64, generation int64) error {
+	gs.Data.Lock()
+	defer gs.Data.Unlock()
+
+	state := gs.Data.States[filename]
+	if state == nil {
+		return errors.New(fmt.Sprintf("Unable to read state for file %s", filename))
+	}
+
+	if generation != anyGeneration && generation != gs.generations[filename] {
+		// The offset belongs to a file that has since been replaced at this path
+		return nil
+	}
+
+	if previous, ok := state.SinkOffsets[sink]; ok && previous == offset {
+		return nil
+	}
+
+	if state.SinkOffsets == nil {
+		state.SinkOffsets = make(map[string]int64)
+	}
+
+	state.SinkOffsets[sink] = offset
+	state.Offset = minSinkOffset(state)
+	gs.dirty = true
+
+	return nil
+}
+
+func minSinkOffset(state *State) int64 {
+	first := true
+	var min int64
+
+	for _, offset := range state.SinkOffsets {
+		if first || offset < min {
+			min = offset
+			first = false
+		}
+	}
+
+	return min
+}
+
+// persistState writes Data to the statefile if it changed since it was last written
 func (gs *GlobalState) persistState() error {
 	gs.Lock()
 	defer gs.Unlock()
 
-	err := writeGlobalStateFile(gs.File, gs.Data)
+	gs.Data.Lock()
+	if !gs.dirty {
+		gs.Data.Unlock()
+		return nil
+	}
+	json, err := json.Marshal(gs.Data)
+	gs.dirty = false
+	gs.Data.Unlock()
 	if err != nil {
-		return errors.New(fmt.Sprintf("Unable to write to global statefile %s: %s", gs.File.Name(), err))
+		return err
+	}
+
+	if err := writeGlobalStateFile(gs.Filename, json); err != nil {
+		gs.Data.Lock()
+		gs.dirty = true
+		gs.Data.Unlock()
+
+		return errors.New(fmt.Sprintf("Unable to write to global statefile %s: %s", gs.Filename, err))
 	}
 
 	return nil
@@ -198,40 +652,54 @@ func (gs *GlobalState) saveState(filename string, state *State) {
 	defer gs.Data.Unlock()
 
 	gs.Data.States[filename] = state
+	gs.dirty = true
 }
 
-func createGlobalStateFile(filename string) (*os.File, error) {
-	err := os.MkdirAll(filepath.Dir(filename), os.ModePerm)
-	if err != nil {
-		return nil, err
-	}
+// backupStateFilename returns the path the previous contents of the statefile at filename are kept at
+func backupStateFilename(filename string) string {
+	return filename + ".bak"
+}
 
-	stateFile, err := os.Create(filename)
+// writeGlobalStateFile replaces the statefile at filename with data. The data is written to a temporary file first, so
+// that the statefile is never left partially written. The previous statefile is kept as a backup.
+func writeGlobalStateFile(filename string, data []byte) error {
+	tempFilename := filename + ".tmp"
+
+	file, err := os.OpenFile(tempFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return stateFile, nil
-}
-
-func writeGlobalStateFile(file *os.File, data *GlobalStateData) error {
-	json, err := json.Marshal(data)
-	if err != nil {
+	if _, err := file.Write(data); err != nil {
+		file.Close()
 		return err
 	}
 
-	if err := file.Truncate(0); err != nil {
+	if err := file.Sync(); err != nil {
+		file.Close()
 		return err
 	}
 
-	if _, err := file.WriteAt(json, 0); err != nil {
+	if err := file.Close(); err != nil {
 		return err
 	}
 
-	if err := file.Sync(); err != nil {
+	if _, err := os.Stat(filename); err == nil {
+		if err := os.Rename(filename, backupStateFilename(filename)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tempFilename, filename); err != nil {
 		return err
 	}
 
+	// Persist the renames as well. Directories cannot be synced on every platform, which is not worth failing over.
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
 	return nil
 }
 
@@ -293,6 +761,23 @@ func UpdateStateOffset(filename string, offset int64) error {
 	return nil
 }
 
+//InitSinkOffsets Ensures the state for filename tracks an offset for exactly the given sinks, starting sinks that
+// are new to the file at its current offset. Returns the offset of each sink in the given order.
+func InitSinkOffsets(filename string, sinks []string) []int64 {
+	return globalState.initSinkOffsets(filename, sinks)
+}
+
+//UpdateSinkOffset Update globalState offset of a sink for filename in memory
+func UpdateSinkOffset(filename string, sink string, offset int64) error {
+	return globalState.updateSinkOffset(filename, sink, offset, anyGeneration)
+}
+
+//UpdateMessageSinkOffset Update globalState offset of a sink for the file a delivered message was read from. The
+// offset is ignored if the file has been replaced at its path since the message was read.
+func UpdateMessageSinkOffset(message *LogMessage, sink string) error {
+	return globalState.updateSinkOffset(message.Filename, sink, message.Position, message.generation)
+}
+
 //LegacyStateFilename returns legacy StateFilename for a given filename.
 func LegacyStateFilename(filename string) string {
 	return fmt.Sprintf("%s-state.json", path.Base(filename))
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -84,6 +85,7 @@ func TestGlobalStateLoadWithoutFile(test *testing.T) {
 	filename := "tmp/global-state-test"
 	defer func() {
 		os.Remove(filename)
+		os.Remove(backupStateFilename(filename))
 		os.Remove(filepath.Dir(filename))
 	}()
 
@@ -123,7 +125,7 @@ func TestDeleteState(test *testing.T) {
 
 	globalState = NewGlobalState()
 	globalState.Data = globalStateData
-	globalState.File = file
+	globalState.Filename = file.Name()
 
 	DeleteState("testfile")
 
@@ -149,6 +151,7 @@ func TestLoadStateWithLegacyStatefile(test *testing.T) {
 	defer func() {
 		os.Remove(stateFilename)
 		os.Remove(globalStateFile)
+		os.Remove(backupStateFilename(globalStateFile))
 		os.Remove(filepath.Dir(stateFilename))
 	}()
 
@@ -217,6 +220,7 @@ func TestPersistState(test *testing.T) {
 	globalStateFile := "tmp/global-statefile"
 	defer func() {
 		os.Remove(globalStateFile)
+		os.Remove(backupStateFilename(globalStateFile))
 		os.Remove(filepath.Dir(globalStateFile))
 	}()
 
@@ -248,3 +252,197 @@ func TestStateFilename(test *testing.T) {
 		test.Fatalf("expected %s, got %s", expected, stateFilename)
 	}
 }
+
+func TestInitSinkOffsets(test *testing.T) {
+	globalState = NewGlobalState()
+	globalState.saveState("testfile", &State{
+		Checksum:    12345,
+		Offset:      100,
+		SinkOffsets: map[string]int64{"removed": 50, "kept": 150},
+	})
+
+	offsets := InitSinkOffsets("testfile", []string{"kept", "added"})
+
+	if !cmp.Equal(offsets, []int64{150, 100}) {
+		test.Fatalf("expected existing sinks to keep their offset and new sinks to start at the file offset, got %v",
+			offsets)
+	}
+
+	state := globalState.getState("testfile")
+	if _, ok := state.SinkOffsets["removed"]; ok {
+		test.Fatal("expected sinks no longer configured to be removed")
+	}
+
+	if state.Offset != 100 {
+		test.Fatalf("expected offset to be the lowest sink offset, got %d", state.Offset)
+	}
+}
+
+func TestUpdateSinkOffset(test *testing.T) {
+	globalState = NewGlobalState()
+	UpdateState("testfile", 12345, 0)
+	InitSinkOffsets("testfile", []string{"one", "two"})
+
+	UpdateSinkOffset("testfile", "one", 200)
+	if offset := globalState.getState("testfile").Offset; offset != 0 {
+		test.Fatalf("expected offset to be held at the slowest sink, got %d", offset)
+	}
+
+	UpdateSinkOffset("testfile", "two", 100)
+	if offset := globalState.getState("testfile").Offset; offset != 100 {
+		test.Fatalf("expected offset to advance with the slowest sink, got %d", offset)
+	}
+}
+
+func TestGlobalStateCollectStates(test *testing.T) {
+	dir, err := ioutil.TempDir("", "global-state-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	existing := filepath.Join(dir, "existing.log")
+	ioutil.WriteFile(existing, []byte("line\n"), 0644)
+	deleted := filepath.Join(dir, "deleted.log")
+	tailed := filepath.Join(dir, "tailed.log")
+
+	gs := NewGlobalState()
+	gs.SetStateTTL(time.Hour)
+	gs.saveState(existing, &State{})
+	gs.saveState(deleted, &State{})
+	gs.saveState(tailed, &State{})
+	gs.Data.Detached["1:2"] = &State{Inode: 2}
+	gs.startTailing(tailed)
+
+	start := time.Now()
+
+	// The first collection only records when the states were seen
+	if removed := gs.collectStates(start); removed != 0 {
+		test.Fatalf("expected no states to be removed on first collection, removed %d", removed)
+	}
+
+	if removed := gs.collectStates(start.Add(30 * time.Minute)); removed != 0 {
+		test.Fatalf("expected no states to be removed within the TTL, removed %d", removed)
+	}
+
+	if removed := gs.collectStates(start.Add(2 * time.Hour)); removed != 2 {
+		test.Fatalf("expected the deleted and detached states to be removed, removed %d", removed)
+	}
+
+	if gs.getState(deleted) != nil || len(gs.Data.Detached) != 0 {
+		test.Fatal("expected the deleted and detached states to be removed")
+	}
+
+	if gs.getState(existing) == nil || gs.getState(tailed) == nil {
+		test.Fatal("expected the states of existing and tailed files to be kept")
+	}
+
+	// Once the tailer stops, the state of a deleted file expires like any other
+	gs.stopTailing(tailed)
+	gs.collectStates(start.Add(3 * time.Hour))
+	if removed := gs.collectStates(start.Add(5 * time.Hour)); removed != 1 || gs.getState(tailed) != nil {
+		test.Fatal("expected the state of the no longer tailed file to be removed")
+	}
+}
+
+func TestGlobalStateCollectStatesDisabled(test *testing.T) {
+	gs := NewGlobalState()
+	gs.SetStateTTL(0)
+	gs.saveState("/does/not/exist.log", &State{LastSeen: 1})
+
+	if removed := gs.collectStates(time.Now()); removed != 0 {
+		test.Fatalf("expected states to be kept when the TTL is zero, removed %d", removed)
+	}
+}
+
+func TestGlobalStateLoadFallsBackToBackup(test *testing.T) {
+	dir, err := ioutil.TempDir("", "global-state-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "statefile.json")
+
+	globalState = NewGlobalState()
+	globalState.Load(filename)
+	UpdateState("testfile", 12345, 100)
+	globalState.PersistState()
+	UpdateState("testfile", 12345, 200)
+	globalState.PersistState()
+
+	// A crash while writing left the statefile partially written
+	ioutil.WriteFile(filename, []byte(`{"states": {"testf`), 0644)
+
+	globalState = NewGlobalState()
+	if err := globalState.Load(filename); err != nil {
+		test.Fatalf("expected load to fall back to the backup, got %s", err)
+	}
+
+	state := globalState.getState("testfile")
+	if state == nil || state.Offset != 100 {
+		test.Fatalf("expected the previous state to be restored from the backup, got %v", state)
+	}
+
+	// The broken statefile must not replace the good backup
+	globalState.PersistState()
+	UpdateState("testfile", 12345, 300)
+	globalState.PersistState()
+
+	backup, err := ReadGlobalStateFile(backupStateFilename(filename))
+	if err != nil {
+		test.Fatalf("expected a readable backup, got %s", err)
+	}
+
+	if offset := backup.States["testfile"].Offset; offset != 100 {
+		test.Fatalf("expected the backup to hold offset 100, got %d", offset)
+	}
+}
+
+func TestGlobalStateLoadWithBadFileAndNoBackup(test *testing.T) {
+	file, err := ioutil.TempFile("", "global-state-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.Write([]byte("Garbage"))
+
+	globalState = NewGlobalState()
+	if err := globalState.Load(file.Name()); err == nil {
+		test.Fatal("expected load to fail without a backup to fall back to")
+	}
+}
+
+func TestPersistStateSkipsUnchangedState(test *testing.T) {
+	dir, err := ioutil.TempDir("", "global-state-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "statefile.json")
+
+	globalState = NewGlobalState()
+	globalState.Load(filename)
+	UpdateState("testfile", 12345, 0)
+	InitSinkOffsets("testfile", []string{"timber"})
+	UpdateSinkOffset("testfile", "timber", 100)
+	globalState.PersistState()
+
+	os.Remove(filename)
+
+	UpdateSinkOffset("testfile", "timber", 100)
+	globalState.PersistState()
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		test.Fatal("expected the statefile not to be written when no offsets changed")
+	}
+
+	UpdateSinkOffset("testfile", "timber", 150)
+	globalState.PersistState()
+
+	if _, err := os.Stat(filename); err != nil {
+		test.Fatalf("expected the statefile to be written after an offset changed, got %s", err)
+	}
+}
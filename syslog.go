@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The largest syslog message accepted, larger messages could not be sent in a single batch
+const maxSyslogMessageSize = maxPayloadSize - 1
+
+// SyslogConfig Configures a listener receiving syslog messages
+type SyslogConfig struct {
+	// Address to listen on, such as ":514"
+	Address string
+	// udp, tcp or tls
+	Protocol string
+	// API key the messages are sent with, the default API key when empty
+	ApiKey string `toml:"api_key"`
+	Sinks  []string
+	// Certificate and private key of the listener, for tls
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// source returns the name the messages of the listener are forwarded under, in metadata, metrics and spool queues
+func (sc *SyslogConfig) source() string {
+	return fmt.Sprintf("syslog-%s-%s", sc.Protocol, sc.Address)
+}
+
+// Validate returns an error if the listener cannot be started
+func (sc *SyslogConfig) Validate() error {
+	if sc.Address == "" {
+		return errors.New("Every syslog listener requires an address")
+	}
+
+	switch sc.Protocol {
+	case "udp", "tcp":
+	case "tls":
+		if sc.CertFile == "" || sc.KeyFile == "" {
+			return fmt.Errorf("Syslog listener %s requires cert_file and key_file", sc.Address)
+		}
+	default:
+		return fmt.Errorf("Syslog listener %s has protocol %q, expected udp, tcp or tls", sc.Address, sc.Protocol)
+	}
+
+	return nil
+}
+
+// Names of the facilities and severities of the syslog priority, by code
+var (
+	syslogFacilities = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron",
+		"authpriv", "ftp", "ntp", "security", "console", "solaris-cron", "local0", "local1", "local2", "local3",
+		"local4", "local5", "local6", "local7"}
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+)
+
+var (
+	syslogPriority = regexp.MustCompile(`^<(\d{1,3})>`)
+	// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID of an RFC 5424 header, following the priority
+	syslogRFC5424Header = regexp.MustCompile(`^1 (\S+) (\S+) (\S+) (\S+) (\S+) `)
+	// TAG[PID]: of an RFC 3164 message
+	syslogRFC3164Tag = regexp.MustCompile(`^([^\s\[\]:]{1,48})(?:\[([^\]\s]*)\])?:`)
+)
+
+// SyslogContext describes the header of a syslog message, see parseSyslogMessage
+type SyslogContext struct {
+	Facility string `json:"facility,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	AppName  string `json:"app_name,omitempty"`
+	ProcID   string `json:"proc_id,omitempty"`
+	MsgID    string `json:"msg_id,omitempty"`
+	// Parameters by SD-ID, only sent in RFC 5424 messages
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+}
+
+// syslogLine is a message forwarded along with its parsed header, so that messages with different headers can be
+// sent in the same batch
+type syslogLine struct {
+	Message string         `json:"message"`
+	Syslog  *SyslogContext `json:"syslog"`
+}
+
+// encodeSyslogLine returns the line forwarded for message, which is the message as JSON with its parsed header. A
+// message without a header is forwarded as is, or as JSON if it contains line breaks, see encodeEventLine.
+func encodeSyslogLine(message []byte) []byte {
+	context := parseSyslogMessage(message)
+	if context == nil {
+		return encodeEventLine(message, nil)
+	}
+
+	// Every message starts with its priority, such as <13>, which is kept as is rather than escaped
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(&syslogLine{Message: string(message), Syslog: context}); err != nil {
+		return message
+	}
+
+	return bytes.TrimSuffix(line.Bytes(), []byte("\n"))
+}
+
+// parseSyslogMessage returns the header of an RFC 5424 or RFC 3164 message, or nil if the message does not start with
+// a priority
+func parseSyslogMessage(message []byte) *SyslogContext {
+	match := syslogPriority.FindSubmatch(message)
+	if match == nil {
+		return nil
+	}
+
+	priority, _ := strconv.Atoi(string(match[1]))
+	if priority > 191 {
+		return nil
+	}
+
+	context := &SyslogContext{
+		Facility: syslogFacilities[priority/8],
+		Severity: syslogSeverities[priority%8],
+	}
+	rest := string(message[len(match[0]):])
+
+	if header := syslogRFC5424Header.FindStringSubmatch(rest); header != nil {
+		context.Hostname = syslogNilValue(header[2])
+		context.AppName = syslogNilValue(header[3])
+		context.ProcID = syslogNilValue(header[4])
+		context.MsgID = syslogNilValue(header[5])
+		context.StructuredData = parseSyslogStructuredData(rest[len(header[0]):])
+
+		return context
+	}
+
+	// An RFC 3164 message has a timestamp, a hostname and a tag, any of which senders may leave out
+	if len(rest) > len(time.Stamp) && rest[len(time.Stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil {
+			rest = rest[len(time.Stamp)+1:]
+		}
+	}
+
+	if !syslogRFC3164Tag.MatchString(rest) {
+		if i := strings.IndexByte(rest, ' '); i > 0 {
+			context.Hostname, rest = rest[:i], rest[i+1:]
+		}
+	}
+
+	if tag := syslogRFC3164Tag.FindStringSubmatch(rest); tag != nil {
+		context.AppName, context.ProcID = tag[1], tag[2]
+	}
+
+	return context
+}
+
+func syslogNilValue(value string) string {
+	if value == "-" {
+		return ""
+	}
+
+	return value
+}
+
+// parseSyslogStructuredData parses the structured data elements at the start of data, such as
+// [exampleSDID@32473 iut="3" eventSource="Application"]. Returns nil for the nil value or malformed elements.
+func parseSyslogStructuredData(data string) map[string]map[string]string {
+	elements := make(map[string]map[string]string)
+
+	i := 0
+	for i < len(data) && data[i] == '[' {
+		i++
+		start := i
+		for i < len(data) && data[i] != ' ' && data[i] != ']' {
+			i++
+		}
+		if i == len(data) {
+			return nil
+		}
+
+		params := make(map[string]string)
+		elements[data[start:i]] = params
+
+		for i < len(data) && data[i] == ' ' {
+			i++
+			start = i
+			for i < len(data) && data[i] != '=' {
+				i++
+			}
+			if i+1 >= len(data) || data[i+1] != '"' {
+				return nil
+			}
+			name := data[start:i]
+			i += 2
+
+			var value []byte
+			for i < len(data) && data[i] != '"' {
+				// ", \ and ] are escaped with a backslash
+				if data[i] == '\\' && i+1 < len(data) && strings.IndexByte(`"\]`, data[i+1]) >= 0 {
+					i++
+				}
+				value = append(value, data[i])
+				i++
+			}
+			if i == len(data) {
+				return nil
+			}
+			params[name] = string(value)
+			i++
+		}
+
+		if i == len(data) || data[i] != ']' {
+			return nil
+		}
+		i++
+	}
+
+	if len(elements) == 0 {
+		return nil
+	}
+
+	return elements
+}
+
+// readSyslogFrame reads a message from a stream, framed by its length as in "LEN MSG" or terminated by a newline
+// (RFC 6587). Messages larger than maxSyslogMessageSize are skipped and reported.
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Messages start with the "<" of their priority, octet counted frames with their length
+	if first[0] >= '1' && first[0] <= '9' {
+		var length int
+		for digits := 0; ; digits++ {
+			c, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if c == ' ' {
+				break
+			}
+			if c < '0' || c > '9' || digits == 9 {
+				return nil, fmt.Errorf("Invalid syslog frame length")
+			}
+			length = length*10 + int(c-'0')
+		}
+
+		if length > maxSyslogMessageSize {
+			if _, err := r.Discard(length); err != nil {
+				return nil, err
+			}
+			return nil, errSyslogMessageTooLarge
+		}
+
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return nil, err
+		}
+
+		return frame, nil
+	}
+
+	var frame []byte
+	tooLarge := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(frame)+len(chunk) > maxSyslogMessageSize+1 {
+			// The rest of the message is read and dropped
+			tooLarge, frame = true, nil
+		} else if !tooLarge {
+			frame = append(frame, chunk...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+
+		// The last message of the stream may not be terminated
+		if err != nil && (err != io.EOF || (len(frame) == 0 && !tooLarge)) {
+			return nil, err
+		}
+
+		if tooLarge {
+			return nil, errSyslogMessageTooLarge
+		}
+
+		return frame, nil
+	}
+}
+
+// Returned for messages larger than maxSyslogMessageSize, which are skipped
+var errSyslogMessageTooLarge = errors.New("Syslog message is larger than the max payload size (1 MB)")
+
+// SyslogListener Receives syslog messages over UDP, TCP or TLS. Each UDP datagram holds a single message.
+type SyslogListener struct {
+	config SyslogConfig
+
+	packetConn net.PacketConn
+	listener   net.Listener
+}
+
+// NewSyslogListener Returns a *SyslogListener listening on the address of config, which receives messages once Run
+// is called
+func NewSyslogListener(config SyslogConfig) (*SyslogListener, error) {
+	s := &SyslogListener{config: config}
+
+	var err error
+	switch config.Protocol {
+	case "udp":
+		s.packetConn, err = net.ListenPacket("udp", config.Address)
+	case "tcp":
+		s.listener, err = net.Listen("tcp", config.Address)
+	case "tls":
+		var certificate tls.Certificate
+		certificate, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err == nil {
+			s.listener, err = tls.Listen("tcp", config.Address, &tls.Config{Certificates: []tls.Certificate{certificate}})
+		}
+	default:
+		err = fmt.Errorf("Protocol %q is not supported", config.Protocol)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen for syslog messages on %s: %s", config.Address, err)
+	}
+
+	return s, nil
+}
+
+// Addr returns the address the listener receives messages on
+func (s *SyslogListener) Addr() net.Addr {
+	if s.packetConn != nil {
+		return s.packetConn.LocalAddr()
+	}
+
+	return s.listener.Addr()
+}
+
+// Run Sends received messages to lines until quit is closed. lines is closed on return.
+func (s *SyslogListener) Run(lines chan *LogMessage, quit chan bool) {
+	var wg sync.WaitGroup
+	connections := make(map[net.Conn]bool)
+	var lock sync.Mutex
+
+	go func() {
+		<-quit
+
+		if s.packetConn != nil {
+			s.packetConn.Close()
+			return
+		}
+
+		s.listener.Close()
+		lock.Lock()
+		for conn := range connections {
+			conn.Close()
+		}
+		lock.Unlock()
+	}()
+
+	if s.packetConn != nil {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := s.packetConn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			message := make([]byte, n)
+			copy(message, buf[:n])
+			s.receive(message, lines, quit)
+		}
+	} else {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				if isClosed(quit) {
+					break
+				}
+				logger.Warnf("Failed to accept syslog connection on %s: %s", s.config.Address, err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			lock.Lock()
+			connections[conn] = true
+			lock.Unlock()
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.readConnection(conn, lines, quit)
+
+				lock.Lock()
+				delete(connections, conn)
+				lock.Unlock()
+				conn.Close()
+			}()
+		}
+	}
+
+	wg.Wait()
+	close(lines)
+}
+
+// readConnection receives the messages of a stream until it is closed
+func (s *SyslogListener) readConnection(conn net.Conn, lines chan *LogMessage, quit chan bool) {
+	r := bufio.NewReader(conn)
+
+	for {
+		frame, err := readSyslogFrame(r)
+		if err == errSyslogMessageTooLarge {
+			logger.Warnf("Ignoring syslog message from %s: %s", conn.RemoteAddr(), err)
+			droppedLinesMetric.Inc("oversize")
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && !isClosed(quit) {
+				logger.Warnf("Closing syslog connection from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		s.receive(frame, lines, quit)
+	}
+}
+
+// receive sends a message to lines with its parsed header, see encodeSyslogLine
+func (s *SyslogListener) receive(message []byte, lines chan *LogMessage, quit chan bool) {
+	message = bytes.TrimRight(message, "\r\n\x00")
+	if len(message) == 0 {
+		return
+	}
+
+	linesReadMetric.Inc(s.config.source())
+
+	select {
+	case lines <- &LogMessage{Filename: s.config.source(), Lines: encodeSyslogLine(message)}:
+	case <-quit:
+	}
+}
+
+// ForwardSyslog forwards the messages received by the listener to the sinks until quit is closed
+func ForwardSyslog(listener *SyslogListener, sinks []Sink, batchPeriodSeconds int64, spool *Spool, metadata *LogEvent, quit chan bool) error {
+	source := listener.config.source()
+	logger.Infof("Starting forward for syslog messages on %s", listener.Addr())
+
+	encodedMetadata, err := encodeFileMetadata(metadata, source)
+	if err != nil {
+		logger.Errorf("Failed to encode additional metadata as JSON while preparing to forward %s", source)
+		return err
+	}
+
+	// Received messages cannot be read again, so spooled batches are replayed
+	queues, err := openSpoolQueues(spool, source, sinks, true)
+	if err != nil {
+		return err
+	}
+
+	lines := make(chan *LogMessage)
+	go listener.Run(lines, quit)
+
+	// Forward will block until lines is closed
+	forwardToSinks(lines, sinks, nil, queues, batchPeriodSeconds, newSharedMetadata(encodedMetadata))
+
+	return nil
+}
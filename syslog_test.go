@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslogMessage(test *testing.T) {
+	cases := []struct {
+		message  string
+		expected *SyslogContext
+	}{
+		{
+			`<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed for lonvick on /dev/pts/8`,
+			&SyslogContext{Facility: "auth", Severity: "crit", Hostname: "mymachine.example.com", AppName: "su", MsgID: "ID47"},
+		},
+		{
+			`<165>1 2003-10-11T22:14:15.003Z host evntslog 1234 - [exampleSDID@32473 iut="3" eventSource="App\]lication"][meta seq="1"] An event`,
+			&SyslogContext{Facility: "local4", Severity: "notice", Hostname: "host", AppName: "evntslog", ProcID: "1234",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "eventSource": "App]lication"},
+					"meta":              {"seq": "1"},
+				}},
+		},
+		{
+			`<13>Oct 11 22:14:15 router-1 sshd[4123]: Accepted publickey for admin`,
+			&SyslogContext{Facility: "user", Severity: "notice", Hostname: "router-1", AppName: "sshd", ProcID: "4123"},
+		},
+		{
+			`<190>Oct  1 02:01:00 cron: job started`,
+			&SyslogContext{Facility: "local7", Severity: "info", AppName: "cron"},
+		},
+		{`not syslog`, nil},
+		{`<192>1 - - - - - -`, nil},
+	}
+
+	for _, c := range cases {
+		context := parseSyslogMessage([]byte(c.message))
+		if !reflect.DeepEqual(context, c.expected) {
+			test.Fatalf("Expected %q to be parsed as %+v, got %+v", c.message, c.expected, context)
+		}
+	}
+}
+
+func TestReadSyslogFrame(test *testing.T) {
+	oversize := strings.Repeat("a", maxSyslogMessageSize+1)
+	stream := "<13>newline framed\n" +
+		"17 <13>octet\ncounted" +
+		fmt.Sprintf("%d %s", len(oversize), oversize) +
+		oversize + "\n" +
+		"<13>unterminated"
+
+	r := bufio.NewReader(strings.NewReader(stream))
+	expected := []struct {
+		frame string
+		err   error
+	}{
+		{"<13>newline framed\n", nil},
+		{"<13>octet\ncounted", nil},
+		{"", errSyslogMessageTooLarge},
+		{"", errSyslogMessageTooLarge},
+		{"<13>unterminated", nil},
+	}
+
+	for _, e := range expected {
+		frame, err := readSyslogFrame(r)
+		if string(frame) != e.frame || err != e.err {
+			test.Fatalf("Expected frame %q (error %v), got %.40q (error %v)", e.frame, e.err, frame, err)
+		}
+	}
+}
+
+func TestSyslogListener(test *testing.T) {
+	for _, protocol := range []string{"udp", "tcp"} {
+		listener, err := NewSyslogListener(SyslogConfig{Address: "127.0.0.1:0", Protocol: protocol})
+		if err != nil {
+			test.Fatal(err)
+		}
+
+		lines := make(chan *LogMessage)
+		quit := make(chan bool)
+		go listener.Run(lines, quit)
+
+		conn, err := net.Dial(protocol, listener.Addr().String())
+		if err != nil {
+			test.Fatal(err)
+		}
+		fmt.Fprint(conn, "<13>Oct 11 22:14:15 router-1 sshd[4123]: Accepted publickey for admin\n")
+
+		select {
+		case message := <-lines:
+			var line syslogLine
+			if err := json.Unmarshal(message.Lines, &line); err != nil {
+				test.Fatalf("Expected the %s message to be forwarded as JSON, got %q", protocol, message.Lines)
+			}
+			if line.Message != "<13>Oct 11 22:14:15 router-1 sshd[4123]: Accepted publickey for admin" {
+				test.Fatalf("Unexpected %s message %q", protocol, line.Message)
+			}
+			if line.Syslog == nil || line.Syslog.Hostname != "router-1" {
+				test.Fatalf("Expected the %s message header to be parsed, got %+v", protocol, line.Syslog)
+			}
+			if message.Filename != "syslog-"+protocol+"-127.0.0.1:0" {
+				test.Fatalf("Unexpected %s message source %s", protocol, message.Filename)
+			}
+		case <-time.After(5 * time.Second):
+			test.Fatalf("Expected a message to be received over %s", protocol)
+		}
+
+		// Open connections are closed when the listener stops
+		close(quit)
+		for range lines {
+		}
+		conn.Close()
+	}
+}
+
+func TestSyslogListenerSendsMessagesWithoutPriorityAsOneLine(test *testing.T) {
+	listener, err := NewSyslogListener(SyslogConfig{Address: "127.0.0.1:0", Protocol: "udp"})
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	lines := make(chan *LogMessage)
+	quit := make(chan bool)
+	defer close(quit)
+	go listener.Run(lines, quit)
+
+	sink := &recordingSink{name: "timber"}
+	go forwardToSinks(lines, []Sink{sink}, nil, make([]*SpoolQueue, 1), 1, nil)
+
+	conn, err := net.Dial("udp", listener.Addr().String())
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "no priority\r\ninjected line\n")
+
+	// The receiver splits batches on newlines, which must not turn the message into two events
+	sink.waitForLines(test, `{"message":"no priority\r\ninjected line"}`+"\n")
+}
+
+func TestEncodeSyslogLine(test *testing.T) {
+	cases := []struct {
+		message  string
+		expected string
+	}{
+		{"<86>sshd[42]: Accepted publickey",
+			`{"message":"<86>sshd[42]: Accepted publickey","syslog":{"facility":"authpriv","severity":"info","app_name":"sshd","proc_id":"42"}}`},
+		{"<78>cron: (root) CMD (run-parts)",
+			`{"message":"<78>cron: (root) CMD (run-parts)","syslog":{"facility":"cron","severity":"info","app_name":"cron"}}`},
+		// Without a priority, the message is forwarded as received unless it would be split into several lines
+		{"not a syslog message", "not a syslog message"},
+		{"not a syslog\r\nmessage", `{"message":"not a syslog\r\nmessage"}`},
+	}
+
+	for _, c := range cases {
+		if line := string(encodeSyslogLine([]byte(c.message))); line != c.expected {
+			test.Fatalf("Expected %q to be forwarded as %s, got %s", c.message, c.expected, line)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"bufio"
 	"hash/crc32"
 	"io"
 	"os"
+	"sync/atomic"
 
 	"github.com/timberio/tail"
 )
@@ -17,6 +17,8 @@ type FileTailer struct {
 	filename string
 	inner    *tail.Tail
 	lines    chan *LogMessage
+	// The offset reading started at
+	start int64
 }
 
 func NewFileTailer(filename string, readNewFileFromStart bool, poll bool, quit chan bool, stop chan bool) *FileTailer {
@@ -25,60 +27,76 @@ func NewFileTailer(filename string, readNewFileFromStart bool, poll bool, quit c
 	ch := make(chan *LogMessage)
 
 	var seekInfo *tail.SeekInfo
-	start := &tail.SeekInfo{0, io.SeekStart}
-	end := &tail.SeekInfo{0, io.SeekEnd}
-
 	var newState *State
 
+	info, err := os.Stat(filename)
+	if err != nil {
+		logger.Errorf("Failed to stat file %s: %s", filename, err)
+	}
+
 	state := LoadState(filename)
-	if state != nil {
-		// We treat a failed checksum the same as a non-matching checksum which results in reading the file from the
+	replaced := false
+
+	if state != nil && info != nil && !state.identifies(filename, info) {
+		// We treat a file we cannot identify the same as a different file which results in reading the file from the
 		// beginning. While we may send duplicate data, we prefer that over not sending new data.
-		checksum, err := calculateChecksum(filename)
-		if err != nil {
-			logger.Errorf("Failed to checksum file %s: %s", filename, err)
+		logger.Infof("%s is not the file recorded in state. Reading from beginning of file.", filename)
+		globalState.detachState(filename)
+		replaced = true
+	} else if state != nil {
+		// Work on a copy, the recorded state may be persisted concurrently
+		copied := *state
+		newState = &copied
+	}
+
+	if newState == nil && info != nil {
+		if moved, from := globalState.findMovedState(filename, info); moved != nil {
+			logger.Infof("%s was moved from %s, carrying over its state", filename, from)
+			copied := *moved
+			newState = &copied
 		}
+	}
 
-		if checksum == state.Checksum {
-			logger.Infof("Checksum for %s matched recorded state, resuming - offset: %d, seekstart: %d", filename, state.Offset, io.SeekStart)
-			seekInfo = &tail.SeekInfo{state.Offset, io.SeekStart}
+	if newState != nil {
+		if info != nil && newState.Offset > info.Size() {
+			logger.Infof("%s was truncated since its state was recorded. Reading from beginning of file.", filename)
+			newState.Offset = 0
+			// Offsets recorded for sinks belong to the previous contents
+			newState.SinkOffsets = nil
 		} else {
-			logger.Infof("Checksum for %s does not match recorded state. Reading from beginning of file.", filename)
-			seekInfo = start
-			state.Offset = 0
+			logger.Infof("%s matched recorded state, resuming - offset: %d", filename, newState.Offset)
 		}
 
-		newState = state
+		seekInfo = &tail.SeekInfo{Offset: newState.Offset, Whence: io.SeekStart}
+	} else if replaced {
+		newState = &State{}
+		seekInfo = &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}
+		globalState.nextGeneration(filename)
 	} else {
 		var msg string
 		newState = &State{}
 
-		if readNewFileFromStart {
+		if readNewFileFromStart || info == nil {
 			msg = "read from start of file"
-			seekInfo = start
+			seekInfo = &tail.SeekInfo{Offset: 0, Whence: io.SeekStart}
 		} else {
 			msg = "recognize new data only"
-			seekInfo = end
-
-			stat, err := os.Stat(filename)
-			if err != nil {
-				logger.Errorf("Failed to stat file %s: %s", filename, err)
-			} else {
-				newState.Offset = stat.Size()
-			}
-		}
-
-		checksum, err := calculateChecksum(filename)
-		if err != nil {
-			logger.Errorf("Failed to checksum file %s: %s", filename, err)
+			// Seek to an absolute offset so that the positions reported for lines are absolute as well
+			newState.Offset = info.Size()
+			seekInfo = &tail.SeekInfo{Offset: newState.Offset, Whence: io.SeekStart}
 		}
-		newState.Checksum = checksum
 
 		logger.Infof("New file detected %s, agent will %s", filename, msg)
 	}
 
+	if info != nil {
+		if err := newState.identify(filename, info); err != nil {
+			logger.Errorf("Failed to fingerprint file %s: %s", filename, err)
+		}
+	}
+
 	// Write state of file to globalState, which may be redundant but handles all cases
-	UpdateState(filename, newState.Checksum, newState.Offset)
+	globalState.saveState(filename, newState)
 
 	inner, err := tail.TailFile(filename, tail.Config{
 		Follow:    true,
@@ -92,7 +110,15 @@ func NewFileTailer(filename string, readNewFileFromStart bool, poll bool, quit c
 		logger.Fatal(err)
 	}
 
+	generation := globalState.generation(filename)
+	fingerprinted := newState.FingerprintLength
+	lastPosition := newState.Offset
+
+	globalState.startTailing(filename)
+
 	go func() {
+		defer globalState.stopTailing(filename)
+
 		for {
 			select {
 			case line, ok := <-inner.Lines:
@@ -101,42 +127,67 @@ func NewFileTailer(filename string, readNewFileFromStart bool, poll bool, quit c
 						logger.Errorf("Error reading from %s: %s", filename, err)
 					} else {
 						position := inner.Offset
+						linesReadMetric.Inc(filename)
+
+						if position < lastPosition {
+							// The tail reopened the file after it was truncated or replaced, so a different file is
+							// read from here on
+							logger.Infof("%s was truncated or replaced, tracking it from the beginning", filename)
+							generation = globalState.resetState(filename)
+							fingerprinted = 0
+						}
+						lastPosition = position
+
+						if position > fingerprinted && fingerprinted < atomic.LoadInt64(&fingerprintMaxBytes) {
+							fingerprinted = fingerprintLength(position)
+							if checksum, err := fingerprintFile(filename, fingerprinted); err == nil {
+								globalState.growFingerprint(filename, generation, fingerprinted, checksum)
+							}
+						}
 
 						ch <- &LogMessage{
-							Filename: filename,
-							Lines:    []byte(line.Text),
-							Position: position,
+							Filename:   filename,
+							Lines:      []byte(line.Text),
+							Position:   position,
+							generation: generation,
 						}
 					}
 				} else {
 					close(ch)
-					checksum, err := calculateChecksum(filename)
-					if err == nil {
-						UpdateStateChecksum(filename, checksum)
-					} else {
-						logger.Errorf("Error calculating checksum: %s", err)
-					}
 					return
 				}
 
 			case <-quit:
-				// looks like we're getting into here multiple times for some files?
-				inner.Stop()
+				stopTail(inner)
+				quit, stop = nil, nil
 
 			case <-stop:
-				inner.Stop()
+				stopTail(inner)
+				quit, stop = nil, nil
 			}
 
 		}
 	}()
 
-	return &FileTailer{inner: inner, lines: ch, filename: filename}
+	return &FileTailer{inner: inner, lines: ch, filename: filename, start: newState.Offset}
+}
+
+// stopTail stops the tail in the background. The tail may be blocked sending a line, so lines keep being drained
+// until inner.Lines is closed. Callers should stop selecting on their quit and stop channels afterwards, since these
+// remain closed.
+func stopTail(inner *tail.Tail) {
+	go inner.Stop()
 }
 
 func (f *FileTailer) Lines() chan *LogMessage {
 	return f.lines
 }
 
+// StartOffset Returns the offset in the file the tailer started reading at
+func (f *FileTailer) StartOffset() int64 {
+	return f.start
+}
+
 func (f *FileTailer) Wait() {
 	f.inner.Wait()
 }
@@ -165,19 +216,30 @@ type ReaderTailer struct {
 	lines chan *LogMessage
 }
 
-func NewReaderTailer(r io.Reader, quit chan bool) *ReaderTailer {
-	logger.Info("Creating reader tailer")
+// NewReaderTailer Returns a *ReaderTailer sending the records read from r under the name source, until r ends or
+// quit is closed. Records are framed as configured by framing, or by newlines when it is nil. Records containing line
+// breaks are batched as JSON, see encodeEventLine.
+func NewReaderTailer(r io.Reader, source string, framing *FramingConfig, quit chan bool) *ReaderTailer {
+	logger.Infof("Creating reader tailer for %s", source)
 
 	ch := make(chan *LogMessage)
-	innerCh := make(chan string)
-	scanner := bufio.NewScanner(r)
+	innerCh := make(chan []byte)
+	records := newRecordReader(r, framing)
 
 	go func() {
-		for scanner.Scan() {
-			innerCh <- scanner.Text()
-		}
-		if err := scanner.Err(); err != nil {
-			logger.Errorf("Error reading stdin: ", err)
+		for {
+			record, truncated, err := records.ReadRecord()
+			if err != nil {
+				if err != io.EOF {
+					logger.Errorf("Error reading %s: %s", source, err)
+				}
+				break
+			}
+
+			if truncated {
+				logger.Warnf("Truncated a record of %s longer than %d bytes", source, records.maxBytes)
+			}
+			innerCh <- record
 		}
 		close(innerCh)
 	}()
@@ -190,9 +252,10 @@ func NewReaderTailer(r io.Reader, quit chan bool) *ReaderTailer {
 					close(ch)
 					return
 				}
+				linesReadMetric.Inc(source)
 				ch <- &LogMessage{
-					Filename: "stdin",
-					Lines:    []byte(line),
+					Filename: source,
+					Lines:    line,
 					Position: 0,
 				}
 			case <-quit:
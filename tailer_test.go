@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -30,7 +31,7 @@ func TestReaderTailer(test *testing.T) {
 		buf.WriteString(line + "\n")
 	}
 
-	tailer := NewReaderTailer(&buf, nil)
+	tailer := NewReaderTailer(&buf, "stdin", nil, nil)
 
 	expected := generateLogLines("test", 10)
 	for line := range tailer.Lines() {
@@ -40,6 +41,21 @@ func TestReaderTailer(test *testing.T) {
 	}
 }
 
+// Lines longer than the 64KB a bufio.Scanner accepts used to end the capture
+func TestReaderTailerLongLine(test *testing.T) {
+	long := strings.Repeat("a", 100000)
+	tailer := NewReaderTailer(strings.NewReader(long+"\nafter\n"), "stdin", nil, nil)
+
+	var lines []string
+	for line := range tailer.Lines() {
+		lines = append(lines, string(line.Lines))
+	}
+
+	if len(lines) != 2 || lines[0] != long || lines[1] != "after" {
+		test.Fatalf("Expected the long line and the line after it, got %d lines", len(lines))
+	}
+}
+
 func TestFileTailerListensOnStopChannel(test *testing.T) {
 	file, err := ioutil.TempFile("", "timber-agent-test")
 	if err != nil {
@@ -52,7 +68,7 @@ func TestFileTailerListensOnStopChannel(test *testing.T) {
 		panic(err)
 	}
 	defer os.Remove(file.Name())
-	globalState.File = globalStateFile
+	globalState.Filename = globalStateFile.Name()
 
 	stop := make(chan bool, 1)
 
@@ -82,7 +98,7 @@ func TestFileTailerPersistsState(test *testing.T) {
 		panic(err)
 	}
 	defer os.Remove(file.Name())
-	globalState.File = globalStateFile
+	globalState.Filename = globalStateFile.Name()
 
 	// Writes 256 bytes to the file as initial data; this ensures that
 	// the file hash can be computed properly
@@ -154,7 +170,7 @@ func TestFileTailerIgnoresStateAfterRotation(test *testing.T) {
 		panic(err)
 	}
 	defer os.Remove(file.Name())
-	globalState.File = globalStateFile
+	globalState.Filename = globalStateFile.Name()
 
 	// Writes 256 bytes to the file as initial data; this ensures that
 	// the file hash can be computed properly
@@ -201,6 +217,51 @@ func TestFileTailerIgnoresStateAfterRotation(test *testing.T) {
 	os.Remove(secondTailer.filename)
 }
 
+func TestFileTailerReadsTruncatedFileFromStart(test *testing.T) {
+	file, err := ioutil.TempFile("", "timber-agent-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(file.Name())
+
+	globalStateFile, err := ioutil.TempFile("", "timber-agent-test-statefile.json")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(globalStateFile.Name())
+	globalState.Filename = globalStateFile.Name()
+
+	fmt.Fprintln(file, "header")
+	quit := make(chan bool)
+
+	firstTailer := NewFileTailer(file.Name(), false, true, quit, nil)
+	time.Sleep(5 * time.Millisecond)
+
+	sendLines(file, generateLogLines("one", 10))
+	expectLines(test, firstTailer, generateLogLines("one", 10))
+
+	quit <- true
+	firstTailer.Wait()
+	UpdateStateOffset(file.Name(), firstTailer.inner.Offset)
+
+	// copytruncate: the file keeps its inode and its first line, but is shorter than the recorded offset
+	file.Truncate(0)
+	file.Seek(0, io.SeekStart)
+	fmt.Fprintln(file, "header")
+	sendLines(file, generateLogLines("two", 1))
+
+	secondTailer := NewFileTailer(file.Name(), false, true, quit, nil)
+	time.Sleep(5 * time.Millisecond)
+
+	if message := <-secondTailer.Lines(); string(message.Lines) != "header" {
+		test.Fatalf("got '%s', expected 'header'", message.Lines)
+	}
+	expectLines(test, secondTailer, generateLogLines("two", 1))
+
+	quit <- true
+	secondTailer.Wait()
+}
+
 func TestFileTailerReadFromStart(test *testing.T) {
 	file, err := ioutil.TempFile("", "timber-agent-test")
 	if err != nil {
@@ -213,7 +274,7 @@ func TestFileTailerReadFromStart(test *testing.T) {
 		panic(err)
 	}
 	defer os.Remove(file.Name())
-	globalState.File = globalStateFile
+	globalState.Filename = globalStateFile.Name()
 
 	quit := make(chan bool)
 
@@ -304,7 +365,7 @@ func BenchmarkTail(b *testing.B) {
 		panic(err)
 	}
 	defer os.Remove(file.Name())
-	globalState.File = globalStateFile
+	globalState.Filename = globalStateFile.Name()
 
 	tailer := NewFileTailer(file.Name(), false, true, nil, nil)
 
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Timeout for each request made when probing endpoints. Unlike forwarding, probes are not retried.
+const probeTimeout = 10 * time.Second
+
+// validationReport writes a human readable report of configuration checks and counts the problems found
+type validationReport struct {
+	out      io.Writer
+	problems int
+	warnings int
+}
+
+func (r *validationReport) section(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "\n"+format+"\n", args...)
+}
+
+func (r *validationReport) ok(format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "  ok    "+format+"\n", args...)
+}
+
+func (r *validationReport) warn(format string, args ...interface{}) {
+	r.warnings++
+	fmt.Fprintf(r.out, "  warn  "+format+"\n", args...)
+}
+
+func (r *validationReport) fail(format string, args ...interface{}) {
+	r.problems++
+	fmt.Fprintf(r.out, "  FAIL  "+format+"\n", args...)
+}
+
+// ValidateConfigFile checks the configuration file at configFilePath the same way the capture-files command reads it,
+// expands every glob and reports the offset each file would be read from according to the statefile. When probe is
+// set, an empty batch is sent to every Timber endpoint to verify its API key. The report is written to out and the
+// number of problems found is returned. Warnings are not counted as problems.
+func ValidateConfigFile(configFilePath string, stateFilePath string, probe bool, out io.Writer) int {
+	report := &validationReport{out: out}
+
+	config := NewConfig()
+
+	report.section("Configuration %s", configFilePath)
+	if err := config.UpdateFromFile(configFilePath); err != nil {
+		report.fail("Unable to read configuration: %s", err)
+		return report.summarize()
+	}
+
+	if err := config.Validate(); err != nil {
+		report.fail("%s", err)
+	} else {
+		report.ok("%d [[files]] and %d [[sinks]] entries", len(config.Files), len(config.Sinks))
+	}
+
+	if _, err := NewSinks(config.Sinks); err != nil {
+		report.fail("%s", err)
+	}
+
+	if config.KubernetesConfig != nil {
+		report.section("Kubernetes")
+		kinds := config.KubernetesConfig.unsupportedExcludeKinds()
+		for _, kind := range kinds {
+			report.fail("Exclusion kind %s is not supported, expected one of %s", kind, strings.Join(supportedFilterKinds, ", "))
+		}
+		if len(kinds) == 0 {
+			report.ok("Exclusion kinds are supported")
+		}
+
+		if config.KubernetesConfig.Include != nil {
+			kinds := config.KubernetesConfig.unsupportedIncludeKinds()
+			for _, kind := range kinds {
+				report.fail("Inclusion kind %s is not supported, expected one of %s", kind, strings.Join(supportedFilterKinds, ", "))
+			}
+			if len(kinds) == 0 {
+				report.ok("Inclusion kinds are supported")
+			}
+		}
+
+		for _, field := range config.KubernetesConfig.unsupportedMetadataFields() {
+			report.fail("Metadata field %s is not supported, expected one of %s", field, strings.Join(supportedMetadataFields, ", "))
+		}
+
+		if routes := config.KubernetesConfig.Routes; len(routes) > 0 {
+			report.ok("%d [[kubernetes.routes]] entries", len(routes))
+		}
+
+		if kubeconfig := config.KubernetesConfig.Kubeconfig; kubeconfig != "" {
+			if _, err := GetKubernetesClientFromKubeconfig(kubeconfig); err != nil {
+				report.fail("%s", err)
+			} else {
+				report.ok("Kubeconfig %s", kubeconfig)
+			}
+		}
+	}
+
+	if len(config.Syslog) > 0 {
+		report.section("Syslog")
+		for _, listener := range config.Syslog {
+			if listener.Protocol != "tls" {
+				report.ok("Listening on %s %s", listener.Protocol, listener.Address)
+			} else if _, err := tls.LoadX509KeyPair(listener.CertFile, listener.KeyFile); err != nil {
+				report.fail("Listener %s cannot load its certificate: %s", listener.Address, err)
+			} else {
+				report.ok("Listening on tls %s", listener.Address)
+			}
+		}
+	}
+
+	if config.HTTPIngest != nil {
+		report.section("HTTP ingest")
+		listener := config.HTTPIngest
+		if listener.CertFile != "" {
+			if _, err := tls.LoadX509KeyPair(listener.CertFile, listener.KeyFile); err != nil {
+				report.fail("Listener %s cannot load its certificate: %s", listener.Address, err)
+			} else {
+				report.ok("Listening on https %s", listener.Address)
+			}
+		} else {
+			report.ok("Listening on http %s", listener.Address)
+		}
+
+		if listener.ApiKey == "" && len(listener.Sinks) == 0 {
+			report.warn("Requests without an Authorization header will be rejected, there is no default API key")
+		}
+
+		if len(listener.ApiKeys) == 0 {
+			report.warn("Requests with any API key are accepted, set api_keys to restrict them")
+		} else {
+			report.ok("Requests with %d API keys are accepted", len(listener.ApiKeys))
+		}
+	}
+
+	report.section("Statefile %s", stateFilePath)
+	states := make(map[string]*State)
+	if data, restored, err := readGlobalStateFileOrBackup(stateFilePath); err == nil {
+		states = data.States
+		if restored {
+			report.warn("The statefile cannot be read, the agent will resume from its backup %s", backupStateFilename(stateFilePath))
+		}
+		report.ok("%d files recorded", len(states))
+	} else if os.IsNotExist(err) {
+		report.warn("No statefile yet, every file is treated as new")
+	} else {
+		report.fail("%s", err)
+	}
+
+	report.section("Files")
+	for _, fileConfig := range globFileConfigs(config) {
+		report.validateGlob(config, fileConfig, states)
+	}
+
+	if probe {
+		report.section("Endpoints")
+		for _, target := range probeTargets(config) {
+			report.probe(target.endpoint, target.apiKey)
+		}
+	}
+
+	return report.summarize()
+}
+
+func (r *validationReport) validateGlob(config *Config, fileConfig FileConfig, states map[string]*State) {
+	paths, err := filepath.Glob(fileConfig.Path)
+	if err != nil {
+		r.fail("%s is not a valid pattern: %s", fileConfig.Path, err)
+		return
+	}
+
+	// Files created later are discovered while the agent runs, which may change where they are read from
+	discovered := fileConfig
+	discovered.discoveredLater = true
+	if config.readFromStart(&discovered) != config.readFromStart(&fileConfig) {
+		r.ok("%s: files created while the agent runs are read from the start", fileConfig.Path)
+	}
+
+	if len(paths) == 0 {
+		r.warn("%s matches no files yet, the agent will keep checking", fileConfig.Path)
+		return
+	}
+
+	// Files matching now are present when the agent starts
+	readNewFileFromStart := config.readFromStart(&fileConfig)
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			r.fail("%s is not readable: %s", path, err)
+			continue
+		}
+
+		stat, err := file.Stat()
+		file.Close()
+		if err != nil {
+			r.fail("%s is not readable: %s", path, err)
+			continue
+		}
+
+		if stat.IsDir() {
+			r.warn("%s is a directory and will not be tailed", path)
+			continue
+		}
+
+		offset, reason := plannedStartOffset(path, stat, states[path], readNewFileFromStart)
+		r.ok("%s is readable, reading from offset %d of %d (%s)", path, offset, stat.Size(), reason)
+	}
+}
+
+// plannedStartOffset returns the offset a file tailer would start reading the file at, following the same rules as
+// NewFileTailer, readNewFileFromStart being the start position of the file as given by Config.readFromStart. Files
+// that were moved are reported as new, since their state is only carried over once they are tailed.
+func plannedStartOffset(path string, info os.FileInfo, state *State, readNewFileFromStart bool) (int64, string) {
+	size := info.Size()
+
+	if state != nil {
+		if !state.identifies(path, info) {
+			return 0, "file was replaced since it was recorded, reading from the start"
+		}
+
+		if state.Offset > size {
+			return 0, "file was truncated since it was recorded, reading from the start"
+		}
+
+		return state.Offset, "resuming from the statefile"
+	}
+
+	if readNewFileFromStart {
+		return 0, "new file, reading from the start"
+	}
+
+	return size, "new file, only new lines are read"
+}
+
+type probeTarget struct {
+	endpoint string
+	apiKey   string
+}
+
+// probeTargets returns every distinct Timber endpoint and API key combination the configuration delivers to
+func probeTargets(config *Config) []probeTarget {
+	var targets []probeTarget
+	seen := make(map[probeTarget]bool)
+
+	add := func(target probeTarget) {
+		if target.apiKey != "" && !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	if len(config.Files) == 0 && len(config.DefaultSinks) == 0 {
+		add(probeTarget{config.Endpoint, config.DefaultApiKey})
+	}
+
+	for _, fileConfig := range config.Files {
+		if len(fileConfig.Sinks) == 0 {
+			add(probeTarget{config.Endpoint, fileConfig.ApiKey})
+		}
+	}
+
+	for _, listener := range config.Syslog {
+		if len(listener.Sinks) == 0 {
+			add(probeTarget{config.Endpoint, listener.ApiKey})
+		}
+	}
+
+	if config.HTTPIngest != nil && len(config.HTTPIngest.Sinks) == 0 {
+		add(probeTarget{config.Endpoint, config.HTTPIngest.ApiKey})
+	}
+
+	if config.KubernetesConfig != nil {
+		for _, route := range config.KubernetesConfig.Routes {
+			endpoint, apiKey := route.Endpoint, route.ApiKey
+			if endpoint == "" {
+				endpoint = config.Endpoint
+			}
+			if apiKey == "" {
+				apiKey = config.DefaultApiKey
+			}
+			add(probeTarget{endpoint, apiKey})
+		}
+	}
+
+	for _, sink := range config.Sinks {
+		if sink.Type == "timber" {
+			add(probeTarget{sink.Endpoint, sink.ApiKey})
+		}
+	}
+
+	return targets
+}
+
+// probe sends an empty batch to the endpoint, which verifies that it can be reached and that it accepts the API key
+func (r *validationReport) probe(endpoint string, apiKey string) {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(nil))
+	if err != nil {
+		r.fail("%s is not a valid endpoint: %s", endpoint, err)
+		return
+	}
+
+	token := base64.StdEncoding.EncodeToString([]byte(apiKey))
+	req.Header.Add("Content-Type", "text/plain")
+	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", token))
+	req.Header.Add("User-Agent", UserAgent)
+
+	client := &http.Client{Timeout: probeTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		r.fail("%s could not be reached: %s", endpoint, err)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		r.ok("%s accepted API key ...%s (status code %d)", endpoint, apiKeySample(apiKey), resp.StatusCode)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		r.fail("%s rejected API key ...%s (status code %d)", endpoint, apiKeySample(apiKey), resp.StatusCode)
+	default:
+		r.fail("%s returned an unexpected response for API key ...%s (status code %d): %s", endpoint,
+			apiKeySample(apiKey), resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+}
+
+func (r *validationReport) summarize() int {
+	switch r.problems {
+	case 0:
+		fmt.Fprintf(r.out, "\nConfiguration is valid (%d warnings)\n", r.warnings)
+	case 1:
+		fmt.Fprintf(r.out, "\n1 problem found (%d warnings)\n", r.warnings)
+	default:
+		fmt.Fprintf(r.out, "\n%d problems found (%d warnings)\n", r.problems, r.warnings)
+	}
+
+	return r.problems
+}
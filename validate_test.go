@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeValidateTestConfig(dir string, configString string) string {
+	configPath := filepath.Join(dir, "timber.toml")
+	if err := ioutil.WriteFile(configPath, []byte(configString), 0644); err != nil {
+		panic(err)
+	}
+
+	return configPath
+}
+
+func TestValidateConfigFile(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-agent-validate-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(logPath, []byte("first line\nsecond line\n"), 0644)
+	checksum, _ := calculateChecksum(logPath)
+
+	statePath := filepath.Join(dir, "state.json")
+	ioutil.WriteFile(statePath, []byte(fmt.Sprintf(`{"states": {"%s": {"Checksum": %d, "Offset": 11}}}`, logPath, checksum)), 0644)
+
+	configPath := writeValidateTestConfig(dir, fmt.Sprintf(`
+default_api_key = "abc:1234"
+
+[[files]]
+path = "%s/*.log"
+
+[[files]]
+path = "%s/missing/*.log"
+
+[kubernetes.exclude]
+replicasets = "web"
+`, dir, dir))
+
+	var out bytes.Buffer
+	problems := ValidateConfigFile(configPath, statePath, false, &out)
+
+	if problems != 1 {
+		test.Errorf("expected the unsupported exclusion kind to be the only problem, got %d:\n%s", problems, out.String())
+	}
+
+	expected := []string{
+		"FAIL  Exclusion kind replicasets is not supported",
+		fmt.Sprintf("ok    %s is readable, reading from offset 11 of 23 (resuming from the statefile)", logPath),
+		fmt.Sprintf("warn  %s/missing/*.log matches no files yet", dir),
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line) {
+			test.Errorf("expected report to contain %q, got:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestValidateConfigFileInvalid(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-agent-validate-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := writeValidateTestConfig(dir, `
+[[files]]
+path = "/var/log/app.log"
+`)
+
+	var out bytes.Buffer
+	problems := ValidateConfigFile(configPath, filepath.Join(dir, "state.json"), false, &out)
+
+	if problems == 0 || !strings.Contains(out.String(), "FAIL  File /var/log/app.log has no API key") {
+		test.Errorf("expected the missing API key to be reported, got:\n%s", out.String())
+	}
+}
+
+func TestValidateConfigFileProbe(test *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "timber-agent-validate-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := writeValidateTestConfig(dir, fmt.Sprintf(`
+default_api_key = "abc:1234"
+endpoint = "%s"
+`, ts.URL))
+
+	var out bytes.Buffer
+	problems := ValidateConfigFile(configPath, filepath.Join(dir, "state.json"), true, &out)
+
+	if problems != 1 || !strings.Contains(out.String(), "rejected API key ...1234 (status code 401)") {
+		test.Errorf("expected the rejected API key to be reported, got:\n%s", out.String())
+	}
+}
+
+func TestValidateConfigFileStateBackupAndStartPosition(test *testing.T) {
+	dir, err := ioutil.TempDir("", "timber-agent-validate-test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(logPath, []byte("first line\nsecond line\n"), 0644)
+	checksum, _ := calculateChecksum(logPath)
+
+	// The agent resumes from the backup when the statefile cannot be parsed
+	statePath := filepath.Join(dir, "state.json")
+	ioutil.WriteFile(statePath, []byte(`{"states": {`), 0644)
+	ioutil.WriteFile(backupStateFilename(statePath), []byte(fmt.Sprintf(`{"states": {"%s": {"Checksum": %d, "Offset": 11}}}`, logPath, checksum)), 0644)
+
+	configPath := writeValidateTestConfig(dir, fmt.Sprintf(`
+default_api_key = "abc:1234"
+start_position = "discovered_from_start"
+
+[[files]]
+path = "%s/*.log"
+`, dir))
+
+	var out bytes.Buffer
+	problems := ValidateConfigFile(configPath, statePath, false, &out)
+
+	if problems != 0 {
+		test.Errorf("expected no problems, got %d:\n%s", problems, out.String())
+	}
+
+	expected := []string{
+		"warn  The statefile cannot be read, the agent will resume from its backup",
+		fmt.Sprintf("ok    %s is readable, reading from offset 11 of 23 (resuming from the statefile)", logPath),
+		fmt.Sprintf("ok    %s/*.log: files created while the agent runs are read from the start", dir),
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line) {
+			test.Errorf("expected report to contain %q, got:\n%s", line, out.String())
+		}
+	}
+}